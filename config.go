@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ferpart/hlseverify/verifier"
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// config is a --config file. Defaults holds flags by name, sent as if they
+// were on the command line, and Manifests the overrides of the manifests
+// verified when neither --manifest nor --manifest-list are sent, also
+// applied to the manifests they send with the same uri. Flags sent on the
+// command line take precedence over both.
+//
+//	defaults:
+//	  concurrency: 8
+//	  header: ["X-Env: staging"]
+//	manifests:
+//	  - uri: https://example.com/master.m3u8
+//	    token: abc
+//	    resolution: 1280x720
+type config struct {
+	Defaults  map[string]interface{} `yaml:"defaults"`
+	Manifests []manifestConfig       `yaml:"manifests"`
+}
+
+// manifestConfig overrides the type, credentials and variant filters of
+// the manifest on URI, with the same names as their flags. It's also the
+// body of a serve POST /verify, which can't set TokenCommand.
+type manifestConfig struct {
+	URI              string   `yaml:"uri" json:"uri"`
+	Type             string   `yaml:"type" json:"type"`
+	Token            string   `yaml:"token" json:"token"`
+	TokenCommand     string   `yaml:"token-command" json:"token-command"`
+	Headers          []string `yaml:"header" json:"header"`
+	KeyHeaders       []string `yaml:"key-header" json:"key-header"`
+	Cookies          []string `yaml:"cookie" json:"cookie"`
+	UserAgent        string   `yaml:"user-agent" json:"user-agent"`
+	ManifestQuery    []string `yaml:"manifest-query" json:"manifest-query"`
+	SegmentQuery     []string `yaml:"segment-query" json:"segment-query"`
+	KeyQuery         []string `yaml:"key-query" json:"key-query"`
+	VariantBandwidth int64    `yaml:"variant-bandwidth" json:"variant-bandwidth"`
+	MinBandwidth     int64    `yaml:"min-bandwidth" json:"min-bandwidth"`
+	MaxBandwidth     int64    `yaml:"max-bandwidth" json:"max-bandwidth"`
+	Resolution       string   `yaml:"resolution" json:"resolution"`
+	AudioGroup       string   `yaml:"audio-group" json:"audio-group"`
+}
+
+// parseConfig loads --config when sent, exiting if it's invalid.
+func parseConfig() *config {
+	if configPath == "" {
+		return nil
+	}
+
+	recordCommandLine()
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatal(err.Error())
+	}
+	return cfg
+}
+
+// loadConfig reads the --config file on path, sending its defaults to every
+// flag that isn't on the command line.
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, errors.New("error: unable to parse --config " + path + ": " + err.Error())
+	}
+
+	for name, value := range cfg.Defaults {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" {
+			return nil, errors.New("error: unknown flag \"" + name + "\" on --config " + path)
+		}
+		if commandLineChanged(f) {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, value := range values {
+			if err = f.Value.Set(fmt.Sprint(value)); err != nil {
+				return nil, fmt.Errorf("error: invalid %s on --config %s: %w", name, path, err)
+			}
+			f.Changed = true
+		}
+	}
+
+	for i, manifest := range cfg.Manifests {
+		if manifest.URI == "" {
+			return nil, fmt.Errorf("error: manifest %d on --config %s has no uri", i, path)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// manifests returns the uris of every manifest of c.
+func (c *config) manifests() []string {
+	var uris []string
+	for _, manifest := range c.Manifests {
+		uris = append(uris, manifest.URI)
+	}
+	return uris
+}
+
+// options returns opts with the overrides of the manifest on uri, skipping
+// the ones whose flags are on the command line.
+func (c *config) options(uri string, opts verifier.Options) verifier.Options {
+	if c == nil {
+		return opts
+	}
+
+	for _, m := range c.Manifests {
+		if m.URI == uri {
+			m.apply(&opts, func(name string) bool { return commandLineChanged(flag.Lookup(name)) })
+		}
+	}
+	return opts
+}
+
+// apply sets every override of m on opts, but the ones keep returns true
+// for, by flag name.
+func (m *manifestConfig) apply(opts *verifier.Options, keep func(name string) bool) {
+	overrideString(&opts.ManifestType, m.Type, "type", keep)
+	overrideString(&opts.Token, m.Token, "token", keep)
+	overrideString(&opts.TokenCommand, m.TokenCommand, "token-command", keep)
+	overrideStrings(&opts.Headers, m.Headers, "header", keep)
+	overrideStrings(&opts.KeyHeaders, m.KeyHeaders, "key-header", keep)
+	overrideStrings(&opts.Cookies, m.Cookies, "cookie", keep)
+	overrideString(&opts.UserAgent, m.UserAgent, "user-agent", keep)
+	overrideStrings(&opts.ManifestQuery, m.ManifestQuery, "manifest-query", keep)
+	overrideStrings(&opts.SegmentQuery, m.SegmentQuery, "segment-query", keep)
+	overrideStrings(&opts.KeyQuery, m.KeyQuery, "key-query", keep)
+	overrideInt(&opts.VariantBandwidth, m.VariantBandwidth, "variant-bandwidth", keep)
+	overrideInt(&opts.MinBandwidth, m.MinBandwidth, "min-bandwidth", keep)
+	overrideInt(&opts.MaxBandwidth, m.MaxBandwidth, "max-bandwidth", keep)
+	overrideString(&opts.Resolution, m.Resolution, "resolution", keep)
+	overrideString(&opts.AudioGroup, m.AudioGroup, "audio-group", keep)
+}
+
+func overrideString(field *string, value, name string, keep func(string) bool) {
+	if value != "" && !keep(name) {
+		*field = value
+	}
+}
+
+func overrideStrings(field *[]string, value []string, name string, keep func(string) bool) {
+	if len(value) > 0 && !keep(name) {
+		*field = value
+	}
+}
+
+func overrideInt(field *int64, value int64, name string, keep func(string) bool) {
+	if value != 0 && !keep(name) {
+		*field = value
+	}
+}
+
+// commandLine holds the flags sent on the command line, by the name of the
+// flag they're an alias of if they are one. It's filled by
+// recordCommandLine before --config sends any.
+var commandLine = make(map[string]bool)
+
+// recordCommandLine records every flag sent on the command line.
+func recordCommandLine() {
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[canonicalFlag(f)] = true
+	})
+}
+
+// commandLineChanged returns whether f, or the flag it's an alias of, was
+// sent on the command line.
+func commandLineChanged(f *flag.Flag) bool {
+	return f != nil && commandLine[canonicalFlag(f)]
+}
+
+// canonicalFlag returns the name of the flag f is an alias of, or its own
+// name if it isn't one.
+func canonicalFlag(f *flag.Flag) string {
+	if name, ok := strings.CutPrefix(f.Usage, "alias of --"); ok {
+		return name
+	}
+	return f.Name
+}
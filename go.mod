@@ -1,10 +1,24 @@
 module github.com/ferpart/hlseverify
 
-go 1.20
+go 1.21
 
 replace github.com/grafov/m3u8 v0.11.1 => github.com/zencoder/m3u8 v0.0.0-20220215110504-18d14540b385
 
 require (
 	github.com/grafov/m3u8 v0.11.1
 	github.com/spf13/pflag v1.0.5
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.34.5
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
 )
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// levelFatal is the level of the errors hlseverify exits on, the only
+// records still logged under --quiet.
+const levelFatal = slog.LevelError + 4
+
+// logger logs what the CLI prints besides summaries and reports. Until
+// setupLogging runs it logs text to stderr, for errors on the flags.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{ReplaceAttr: replaceLevel}))
+
+// setupLogging builds logger from --verbose, --quiet, --log-format and
+// --log-file, tagging its records with runID when not empty, and sends it
+// to every Verifier through opts.
+func setupLogging(runID string) {
+	level := slog.LevelInfo
+	switch {
+	case quiet && opts.Verbose:
+		fatal("error: --quiet and --verbose can't be combined")
+	case quiet:
+		level = levelFatal
+	case opts.Verbose:
+		level = slog.LevelDebug
+	}
+
+	console = &progressView{out: os.Stdout}
+	var w io.Writer = console
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fatal("error: unable to open --log-file: " + err.Error())
+		}
+		w = io.MultiWriter(console, f)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevel}
+	var handler slog.Handler
+	switch logFormat {
+	case "text":
+		handler = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		fatal("error: --log-format \"" + logFormat + "\" isn't supported")
+	}
+
+	logger = slog.New(handler)
+	if runID != "" {
+		logger = logger.With("run_id", runID)
+	}
+	opts.Logger = logger
+}
+
+// replaceLevel names levelFatal on the records logged with it.
+func replaceLevel(_ []string, attr slog.Attr) slog.Attr {
+	if attr.Key == slog.LevelKey && attr.Value.Any() == levelFatal {
+		attr.Value = slog.StringValue("FATAL")
+	}
+	return attr
+}
+
+// fatal logs msg and exits with exitError.
+func fatal(msg string) {
+	exit(exitError, msg)
+}
+
+// exit logs msg, without the "error: " prefix of CLI errors, and exits with
+// code.
+func exit(code int, msg string) {
+	logger.Log(context.Background(), levelFatal, strings.TrimPrefix(msg, "error: "))
+	os.Exit(code)
+}
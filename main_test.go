@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ferpart/hlseverify/verifier"
+)
+
+func TestFailureCodeOfUnfetchedPlaylist(t *testing.T) {
+	// The only rendition of the master manifest isn't there, which is never
+	// tolerated by --fail-threshold.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/master.m3u8" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000\nvideo.m3u8\n")
+	}))
+	defer server.Close()
+
+	defer func(threshold int) { failThreshold = threshold }(failThreshold)
+	failThreshold = 10
+
+	opts := verifier.DefaultOptions()
+	opts.ManifestType = "master"
+	opts.OutputDir = t.TempDir()
+	opts.RetryBackoff = time.Millisecond
+	opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	v, err := verifier.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := v.Verify(context.Background(), server.URL+"/master.m3u8")
+	var failures *verifier.MultiError
+	if !errors.As(err, &failures) {
+		t.Fatalf("Verify() error = %v, want the playlist failure", err)
+	}
+	if report.Totals.Unverified != 1 {
+		t.Errorf("Verify() totals %+v, want 1 unverified playlist", report.Totals)
+	}
+	if code, msg := failureCode(failures, report.Totals); code != exitError {
+		t.Errorf("failureCode() = %d %q, want %d for failures: %v", code, msg, exitError, failures)
+	}
+}
+
+func TestFailureCodeOfStalledStream(t *testing.T) {
+	// A live playlist that never grows, with a target duration short enough
+	// for the default --stall-target-durations to be reached well before
+	// --poll-timeout.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/live.m3u8":
+			_, _ = io.WriteString(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:0.2\n#EXT-X-MEDIA-SEQUENCE:7\n#EXTINF:0.2,\nseg7.ts\n")
+		case "/seg7.ts":
+			_, _ = io.WriteString(w, "clear media")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	opts := verifier.DefaultOptions()
+	opts.ManifestType = "media"
+	opts.OutputDir = t.TempDir()
+	opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	opts.Follow = true
+	opts.PollTimeout = 5 * 200 * time.Millisecond
+	if opts.StallTargetDurations != 3 {
+		t.Fatalf("default StallTargetDurations = %d, want 3", opts.StallTargetDurations)
+	}
+	v, err := verifier.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := v.Verify(context.Background(), server.URL+"/live.m3u8")
+	var failures *verifier.MultiError
+	if !errors.As(err, &failures) {
+		t.Fatalf("Verify() error = %v, want the stall", err)
+	}
+	if code, msg := failureCode(failures, report.Totals); code != exitStalled {
+		t.Errorf("failureCode() = %d %q, want %d for failures: %v", code, msg, exitStalled, failures)
+	}
+	if stall := report.Variants[0].Stall; stall == nil || stall.MediaSequence != 7 {
+		t.Errorf("Verify() recorded stall %+v, want one at media sequence 7", stall)
+	}
+}
+
+// failingReport is a report whose writes fail after writing part of it.
+type failingReport struct{}
+
+func (failingReport) WriteJSON(w io.Writer) error {
+	_, _ = io.WriteString(w, `{"uri":`)
+	return errors.New("interrupted")
+}
+
+func (r failingReport) WriteJUnit(w io.Writer) error { return r.WriteJSON(w) }
+func (r failingReport) WriteHTML(w io.Writer) error  { return r.WriteJSON(w) }
+
+func TestWriteReportLeavesPreviousReportOnFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := os.WriteFile(path, []byte("previous"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeReport(failingReport{}, path, io.Discard); err == nil {
+		t.Fatal("writeReport() error = nil, want the failed write")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "previous" {
+		t.Errorf("writeReport() left %q on %s, want the previous report", data, path)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("writeReport() left %d files behind, want only the report", len(entries))
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ferpart/hlseverify/verifier"
+)
+
+// progressInterval is how often --progress prints the totals of the run
+// when stdout isn't a terminal.
+const progressInterval = 5 * time.Second
+
+// progressRedraw is how often the progress bars of a terminal are redrawn.
+const progressRedraw = 250 * time.Millisecond
+
+// progressBarWidth is the amount of characters of a progress bar.
+const progressBarWidth = 20
+
+// console is stdout as the logs are written to it, set up by setupLogging.
+var console *progressView
+
+// startProgress prints the Progress of v until the returned function is
+// called: as progress bars of every rendition redrawn below the logs when
+// stdout is a terminal, or as the totals every progressInterval otherwise.
+func startProgress(v *verifier.Verifier) (stop func()) {
+	if isTerminal(os.Stdout) {
+		console.start(v)
+		return console.stop
+	}
+
+	done := make(chan struct{})
+	go printProgress(v, done)
+	return func() { close(done) }
+}
+
+// printProgress prints the Progress of v every progressInterval until done
+// is closed.
+func printProgress(v *verifier.Verifier, done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		p := v.Progress()
+		fmt.Printf(
+			"Progress: %d/%d segments done, %d verified, %d failed, %d skipped, %d bytes in %s, ETA %s\n",
+			p.Done(),
+			p.Queued,
+			p.Verified,
+			p.Failed,
+			p.Skipped,
+			p.Bytes,
+			p.Elapsed.Round(time.Second),
+			formatETA(p),
+		)
+	}
+}
+
+// progressView writes to out, drawing the progress bars of a Verifier below
+// everything else while started. Writes erase the bars and draw them again
+// after what's written, so logs scroll above them instead of across them.
+type progressView struct {
+	out io.Writer
+
+	mu    sync.Mutex
+	bars  string
+	lines int
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func (p *progressView) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.erase()
+	n, err := p.out.Write(b)
+	p.draw()
+	return n, err
+}
+
+// start draws the bars of v every progressRedraw until stop.
+func (p *progressView) start(v *verifier.Verifier) {
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressRedraw)
+		defer ticker.Stop()
+
+		for {
+			p.redraw(v)
+			select {
+			case <-p.done:
+				p.redraw(v)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stop draws the bars one last time and leaves them above what's written
+// next.
+func (p *progressView) stop() {
+	close(p.done)
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bars, p.lines = "", 0
+}
+
+// redraw replaces the bars on screen with the current Progress of v.
+func (p *progressView) redraw(v *verifier.Verifier) {
+	bars := renderProgress(v.Progress(), terminalWidth())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.erase()
+	p.bars = bars
+	p.draw()
+}
+
+// erase moves the cursor back to the first line of the bars, clearing them.
+// It's called with mu held.
+func (p *progressView) erase() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.out, "\033[%dA\r\033[J", p.lines)
+		p.lines = 0
+	}
+}
+
+// draw writes the bars below the cursor. It's called with mu held.
+func (p *progressView) draw() {
+	if p.bars != "" {
+		_, _ = io.WriteString(p.out, p.bars)
+		p.lines = strings.Count(p.bars, "\n")
+	}
+}
+
+// renderProgress returns a line with the bar of every rendition of p, by
+// folder, and one with the totals, each cut to width.
+func renderProgress(p verifier.Progress, width int) string {
+	if len(p.Renditions) == 0 {
+		return ""
+	}
+	sort.Slice(p.Renditions, func(i, k int) bool { return p.Renditions[i].Variant < p.Renditions[k].Variant })
+
+	nameWidth := len("total")
+	for _, r := range p.Renditions {
+		if len(r.Variant) > nameWidth {
+			nameWidth = len(r.Variant)
+		}
+	}
+
+	var b strings.Builder
+	for _, r := range p.Renditions {
+		b.WriteString(progressLine(r.Variant, nameWidth, r.Progress, width))
+	}
+	b.WriteString(progressLine("total", nameWidth, p, width))
+	return b.String()
+}
+
+// progressLine renders the bar of p, named name, cut to width.
+func progressLine(name string, nameWidth int, p verifier.Progress, width int) string {
+	fraction := 0.0
+	if p.Queued > 0 {
+		fraction = float64(p.Done()) / float64(p.Queued)
+	}
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+
+	line := fmt.Sprintf(
+		"%-*s [%s] %3d%% %d/%d, %d failed, %.2f Mbps, ETA %s",
+		nameWidth,
+		name,
+		bar,
+		int(fraction*100),
+		p.Done(),
+		p.Queued,
+		p.Failed,
+		p.Throughput()*8/1e6,
+		formatETA(p),
+	)
+	if len(line) > width-1 {
+		line = line[:width-1]
+	}
+	return line + "\n"
+}
+
+// formatETA describes the ETA of p, which is unknown until a segment is
+// finished.
+func formatETA(p verifier.Progress) string {
+	switch {
+	case p.Queued > 0 && p.Done() >= p.Queued:
+		return "done"
+	case p.Done() == 0:
+		return "unknown"
+	}
+	return p.ETA().Round(time.Second).String()
+}
+
+// terminalWidth returns the columns of the terminal from COLUMNS, or 80 when
+// it isn't set.
+func terminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 80
+}
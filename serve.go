@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ferpart/hlseverify/verifier"
+	flag "github.com/spf13/pflag"
+)
+
+// jobHistory is the amount of finished jobs serve keeps reports of, older
+// ones are dropped as new jobs finish.
+const jobHistory = 100
+
+// maxJobBody bounds the size of a POST /verify body.
+const maxJobBody = 1 << 20
+
+// Statuses of a serve job.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobPassed  = "passed"
+	jobFailed  = "failed"
+	jobError   = "error"
+)
+
+// job is a verification requested through POST /verify, returned by GET
+// /jobs/{id} with its report once finished.
+type job struct {
+	ID       string           `json:"id"`
+	URI      string           `json:"uri"`
+	Status   string           `json:"status"`
+	Error    string           `json:"error,omitempty"`
+	Created  time.Time        `json:"created"`
+	Started  *time.Time       `json:"started,omitempty"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	Report   *verifier.Report `json:"report,omitempty"`
+
+	opts verifier.Options
+}
+
+// server runs the jobs of serve, at most --jobs of them at once, each with
+// the Options sent on the command line and the overrides of its request.
+type server struct {
+	ctx   context.Context
+	cfg   *config
+	slots chan struct{}
+
+	mu       sync.Mutex
+	jobs     map[string]*job
+	finished []string
+}
+
+// serve runs hlseverify serve, verifying the manifests sent to its REST API
+// until SIGINT or SIGTERM. Every flag of a single run sets the defaults of
+// its jobs.
+func serve(args []string) {
+	var listen string
+	var jobs int
+	flag.StringVar(
+		&listen,
+		"listen",
+		":8080",
+		"OPTIONAL, address hlseverify serve accepts POST /verify, GET /jobs/{id} and GET /metrics requests on",
+	)
+	flag.IntVar(
+		&jobs,
+		"jobs",
+		1,
+		"OPTIONAL, amount of hlseverify serve jobs verified at once, the rest wait queued",
+	)
+	_ = flag.CommandLine.Parse(args)
+	cfg := parseConfig()
+	setupLogging("")
+
+	if jobs < 1 {
+		fatal("error: --jobs must be at least 1")
+	}
+	if _, err := verifier.New(opts); err != nil {
+		fatal(err.Error())
+	}
+
+	ctx, stop := notifyContext(context.Background())
+	defer stop()
+
+	// Every job feeds the same metrics, so /metrics covers the whole
+	// lifetime of the server.
+	opts.Metrics = verifier.NewMetrics()
+	s := &server{ctx: ctx, cfg: cfg, slots: make(chan struct{}, jobs), jobs: make(map[string]*job)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/verify", s.handleVerify)
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	mux.Handle("/metrics", opts.Metrics)
+	httpServer := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpServer.Shutdown(shutdown)
+	}()
+
+	logger.Info("Serving POST /verify, GET /jobs/{id} and GET /metrics on: " + listen)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(err.Error())
+	}
+}
+
+// handleVerify queues a job for the manifest of a manifestConfig body,
+// answering 202 with the job and its uri on Location.
+func (s *server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "only POST is supported on /verify")
+		return
+	}
+
+	var request manifestConfig
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJobBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if request.URI == "" {
+		writeJSONError(w, http.StatusBadRequest, "no manifest uri provided")
+		return
+	}
+	if !strings.HasPrefix(request.URI, "http://") && !strings.HasPrefix(request.URI, "https://") {
+		writeJSONError(w, http.StatusBadRequest, "manifest uri must be http or https, got: "+request.URI)
+		return
+	}
+	// Jobs can't run commands on the host serving them.
+	if request.TokenCommand != "" {
+		writeJSONError(w, http.StatusBadRequest, "token-command can only be set on the command line or --config")
+		return
+	}
+
+	id := verifier.NewRunID()
+	jobOpts := s.cfg.options(request.URI, opts)
+	request.apply(&jobOpts, func(string) bool { return false })
+	jobOpts.RunID = id
+	jobOpts.Logger = logger.With("run_id", id)
+	if jobOpts.Output == nil {
+		jobOpts.OutputDir = filepath.Join(jobOpts.OutputDir, id)
+	}
+	if _, err := verifier.New(jobOpts); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	j := &job{ID: id, URI: request.URI, Status: jobQueued, Created: time.Now().UTC(), opts: jobOpts}
+	s.mu.Lock()
+	s.jobs[id] = j
+	s.mu.Unlock()
+	go s.run(j)
+
+	jobOpts.Logger.Info("Queued job: " + request.URI)
+	w.Header().Set("Location", "/jobs/"+id)
+	s.writeJob(w, http.StatusAccepted, j)
+}
+
+// handleJobs lists every job kept, oldest first, without their reports.
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "only GET is supported on /jobs")
+		return
+	}
+
+	s.mu.Lock()
+	jobs := make([]job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		summary := *j
+		summary.Report = nil
+		jobs = append(jobs, summary)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Created.Before(jobs[k].Created) })
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleJob returns the job on /jobs/{id}, with its report once finished.
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "only GET is supported on /jobs/{id}")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no job found with id: "+id)
+		return
+	}
+	s.writeJob(w, http.StatusOK, j)
+}
+
+// run verifies j once a --jobs slot is free, unless serve stops first.
+func (s *server) run(j *job) {
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-s.ctx.Done():
+		s.finish(j, nil, errors.New("serve stopped before the job was started"))
+		return
+	}
+
+	started := time.Now().UTC()
+	s.mu.Lock()
+	j.Status = jobRunning
+	j.Started = &started
+	s.mu.Unlock()
+
+	j.opts.Logger.Info("Running job: " + j.URI)
+	report, err := verifier.Run(s.ctx, j.URI, j.opts)
+	s.finish(j, report, err)
+}
+
+// finish records the report and error of j, dropping the oldest finished
+// jobs beyond jobHistory.
+func (s *server) finish(j *job, report *verifier.Report, err error) {
+	finished := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j.Report = report
+	j.Finished = &finished
+	var failures *verifier.MultiError
+	switch {
+	case err == nil:
+		j.Status = jobPassed
+	case errors.As(err, &failures):
+		j.Status = jobFailed
+	default:
+		j.Status = jobError
+		j.Error = err.Error()
+	}
+	j.opts.Logger.Info(fmt.Sprintf("Finished job, %s: %s", j.Status, j.URI))
+
+	s.finished = append(s.finished, j.ID)
+	for len(s.finished) > jobHistory {
+		delete(s.jobs, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+// writeJob writes j as JSON with status, copying it while locked as its run
+// may finish meanwhile.
+func (s *server) writeJob(w http.ResponseWriter, status int, j *job) {
+	s.mu.Lock()
+	snapshot := *j
+	s.mu.Unlock()
+	writeJSON(w, status, snapshot)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: unable to write response: %s\n", err.Error())
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
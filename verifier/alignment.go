@@ -0,0 +1,119 @@
+package verifier
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// timeline is the segment layout of a media playlist, which the video
+// renditions of a master manifest must share for players to switch between
+// them under --check-alignment.
+type timeline struct {
+	mediaSeq uint64
+	live     bool
+
+	// discontinuities are the discontinuity sequence numbers of every
+	// segment, and durations their EXTINF.
+	discontinuities []uint64
+	durations       []time.Duration
+}
+
+func newTimeline(mp *m3u8.MediaPlaylist) *timeline {
+	t := &timeline{mediaSeq: mp.SeqNo, live: !mp.Closed}
+	discontinuity := mp.DiscontinuitySeq
+	for _, segment := range mp.Segments {
+		if segment == nil {
+			continue
+		}
+		if segment.Discontinuity {
+			discontinuity++
+		}
+		t.discontinuities = append(t.discontinuities, discontinuity)
+		t.durations = append(t.durations, time.Duration(segment.Duration*float64(time.Second)))
+	}
+	return t
+}
+
+// checkAlignment compares every video rendition of report to the first
+// one, recording a cross check for each and failing the misaligned ones.
+func (v *Verifier) checkAlignment(report *Report) {
+	var videos []*MediaResult
+	for _, media := range report.Renditions() {
+		if media.Type == "video" && media.timeline != nil {
+			videos = append(videos, media)
+		}
+	}
+	if len(videos) < 2 {
+		return
+	}
+
+	reference := videos[0]
+	for _, media := range videos[1:] {
+		check := &CheckResult{Name: "rendition-alignment", URI: media.URI}
+		if err := alignTimelines(reference.timeline, media.timeline, v.opts.AlignmentTolerance); err != nil {
+			v.errorf("Rendition %s isn't aligned with %s: %s", media.URI, reference.URI, err.Error())
+			check.Error = err.Error()
+			v.failures.Add(ClassLadder, media.Variant, media.URI, err)
+		} else {
+			v.infof("Rendition aligned with %s: %s", reference.URI, media.URI)
+		}
+		report.addCrossCheck(check)
+	}
+}
+
+// alignTimelines errors unless t has the media sequence numbers, segment
+// count and discontinuity sequence numbers of reference, with every segment
+// starting within tolerance of its reference one. Live playlists, which may
+// have been loaded a segment apart, are only compared where their media
+// sequence numbers overlap.
+func alignTimelines(reference, t *timeline, tolerance time.Duration) error {
+	if !reference.live && !t.live {
+		if t.mediaSeq != reference.mediaSeq {
+			return newError(fmt.Sprintf("starts at media sequence %d, expected %d", t.mediaSeq, reference.mediaSeq))
+		}
+		if len(t.durations) != len(reference.durations) {
+			return newError(fmt.Sprintf("has %d segments, expected %d", len(t.durations), len(reference.durations)))
+		}
+	}
+
+	start, end := reference.mediaSeq, reference.mediaSeq+uint64(len(reference.durations))
+	if t.mediaSeq > start {
+		start = t.mediaSeq
+	}
+	if tEnd := t.mediaSeq + uint64(len(t.durations)); tEnd < end {
+		end = tEnd
+	}
+	if start >= end {
+		return newError(fmt.Sprintf("shares no media sequence numbers, starting at %d, expected %d", t.mediaSeq, reference.mediaSeq))
+	}
+
+	var offset, referenceOffset time.Duration
+	for seq := start; seq < end; seq++ {
+		i, r := int(seq-t.mediaSeq), int(seq-reference.mediaSeq)
+		if t.discontinuities[i] != reference.discontinuities[r] {
+			return newError(fmt.Sprintf(
+				"segment at media sequence %d has discontinuity sequence %d, expected %d",
+				seq,
+				t.discontinuities[i],
+				reference.discontinuities[r],
+			))
+		}
+
+		drift := offset - referenceOffset
+		if drift < 0 {
+			drift = -drift
+		}
+		if drift > tolerance {
+			return newError(fmt.Sprintf("segment at media sequence %d starts at %s, expected %s", seq, offset, referenceOffset))
+		}
+		offset += t.durations[i]
+		referenceOffset += reference.durations[r]
+	}
+
+	if drift := offset - referenceOffset; drift > tolerance || -drift > tolerance {
+		return newError(fmt.Sprintf("segments up to media sequence %d add up to %s, expected %s", end-1, offset, referenceOffset))
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package verifier
+
+import (
+	"context"
+	"crypto/cipher"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// Audio codecs that can be identified from a decrypted segment.
+const (
+	codecAAC  = "aac"
+	codecAC3  = "ac-3"
+	codecEAC3 = "ec-3"
+)
+
+// audioInfo describes the first audio frame found on a segment.
+type audioInfo struct {
+	Codec    string
+	Channels int
+}
+
+// acmodChannels maps an AC-3/E-AC-3 audio coding mode to its full bandwidth
+// channel count.
+var acmodChannels = [8]int{2, 1, 2, 3, 3, 4, 4, 5}
+
+// VerifyAudioDeclaration decrypts the first segment of an audio rendition
+// and checks its codec and channel count against the CODECS of the variant
+// referencing it and the rendition's CHANNELS attribute.
+func (v *Verifier) VerifyAudioDeclaration(ctx context.Context, alt *m3u8.Alternative, codecs string) error {
+	p, pType, base, err := v.getPlaylist(ctx, alt.URI)
+	if err != nil {
+		return err
+	}
+
+	mp, ok := p.(*m3u8.MediaPlaylist)
+	if pType != m3u8.MEDIA || !ok {
+		return newError("unable to parse media manifest")
+	}
+
+	var segment *m3u8.MediaSegment
+	for _, s := range mp.Segments {
+		if s != nil {
+			segment = s
+			break
+		}
+	}
+	if segment == nil {
+		return newError("audio rendition has no segments")
+	}
+
+	key := segment.Key
+	if key == nil {
+		key = mp.Key
+	}
+	if key == nil {
+		return newError("audio rendition has no EXT-X-KEY")
+	}
+
+	segmentURI, err := v.resolveSegmentURI(base, segment.URI)
+	if err != nil {
+		return err
+	}
+
+	// The frame headers read below stay in the clear under sample
+	// encryption, so those segments aren't decrypted.
+	var body []byte
+	if isSampleEncryption(normalizeMethod(key.Method)) {
+		body, err = v.GetByteRange(ctx, segmentURI, segment.Offset, segment.Limit)
+	} else {
+		var mode cipher.BlockMode
+		if mode, err = v.GetCBCDecrypter(ctx, v.resolveURI(base, key.URI), key.IV, segment.SeqId); err != nil {
+			return err
+		}
+		body, err = v.GetDecryptedSegment(ctx, segmentURI, segment.Offset, segment.Limit, mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	actual, err := findAudioInfo(body)
+	if err != nil {
+		return err
+	}
+
+	declaredCodec := declaredAudioCodec(codecs)
+	declaredChannels, _ := strconv.Atoi(strings.SplitN(alt.Channels, "/", 2)[0])
+
+	v.infof(
+		"Audio rendition %s: declared codec %q with %q channels, found %s with %d channels",
+		alt.Name,
+		declaredCodec,
+		alt.Channels,
+		actual.Codec,
+		actual.Channels,
+	)
+
+	if declaredCodec != "" && declaredCodec != actual.Codec {
+		return newError(fmt.Sprintf("declared codec %s but found %s", declaredCodec, actual.Codec))
+	}
+
+	if declaredChannels != 0 && actual.Channels != 0 && declaredChannels != actual.Channels {
+		return newError(fmt.Sprintf("declared %d channels but found %d", declaredChannels, actual.Channels))
+	}
+
+	return nil
+}
+
+// declaredAudioCodec returns the audio codec family listed on a variant
+// CODECS attribute, or an empty string if none is recognized.
+func declaredAudioCodec(codecs string) string {
+	for _, codec := range strings.Split(codecs, ",") {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		switch {
+		case strings.HasPrefix(codec, "mp4a.40"):
+			return codecAAC
+		case codec == codecAC3:
+			return codecAC3
+		case codec == codecEAC3:
+			return codecEAC3
+		}
+	}
+	return ""
+}
+
+// findAudioInfo locates the first audio frame on a decrypted segment, either
+// inside an MPEG-TS audio stream or on a packed audio segment.
+func findAudioInfo(body []byte) (audioInfo, error) {
+	if isTransportStream(body) {
+		payload, err := firstAudioPayload(body)
+		if err != nil {
+			return audioInfo{}, err
+		}
+		body = payload
+	}
+
+	return parseAudioFrame(skipID3(body))
+}
+
+// parseAudioFrame reads the codec and channel count from the ADTS or
+// AC-3/E-AC-3 frame header at the start of frame.
+func parseAudioFrame(frame []byte) (audioInfo, error) {
+	switch {
+	case len(frame) >= 7 && frame[0] == 0xFF && frame[1]&0xF0 == 0xF0:
+		channels := int(frame[2]&0x01)<<2 | int(frame[3]>>6)
+		if channels == 7 {
+			channels = 8
+		}
+		return audioInfo{Codec: codecAAC, Channels: channels}, nil
+	case len(frame) >= 8 && frame[0] == 0x0B && frame[1] == 0x77:
+		return parseDolbyFrame(frame), nil
+	}
+
+	return audioInfo{}, newError("no ADTS or AC-3 audio frame found on segment")
+}
+
+func parseDolbyFrame(frame []byte) audioInfo {
+	bsid := frame[5] >> 3
+	r := bitReader{data: frame}
+
+	if bsid > 10 {
+		// strmtyp, substreamid, frmsiz, fscod and numblkscod
+		r.skip(16 + 20)
+		acmod := r.read(3)
+		lfe := r.read(1)
+		return audioInfo{Codec: codecEAC3, Channels: acmodChannels[acmod] + int(lfe)}
+	}
+
+	// syncword, crc1, fscod, frmsizecod, bsid and bsmod
+	r.skip(48)
+	acmod := r.read(3)
+	if acmod&1 != 0 && acmod != 1 {
+		r.skip(2)
+	}
+	if acmod&4 != 0 {
+		r.skip(2)
+	}
+	if acmod == 2 {
+		r.skip(2)
+	}
+	lfe := r.read(1)
+
+	return audioInfo{Codec: codecAC3, Channels: acmodChannels[acmod] + int(lfe)}
+}
+
+// skipID3 drops the ID3 tag packed audio segments start with.
+func skipID3(data []byte) []byte {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return data
+	}
+
+	size := int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9])
+	if 10+size > len(data) {
+		return nil
+	}
+	return data[10+size:]
+}
+
+// bitReader reads big-endian bit fields off a byte slice, returning zeros
+// past its end.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) skip(bits int) {
+	r.pos += bits
+}
+
+func (r *bitReader) read(bits int) uint32 {
+	var v uint32
+	for i := 0; i < bits; i++ {
+		v <<= 1
+		if r.pos/8 < len(r.data) {
+			v |= uint32(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+		}
+		r.pos++
+	}
+	return v
+}
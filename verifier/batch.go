@@ -0,0 +1,188 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BatchReport combines the Report of every manifest of a batch run, keyed
+// by manifest uri. Errors holds the manifests that couldn't be verified at
+// all, with Totals summing up every Report.
+type BatchReport struct {
+	Passed    bool               `json:"passed"`
+	Totals    Totals             `json:"totals"`
+	Manifests map[string]*Report `json:"manifests"`
+	Errors    map[string]string  `json:"errors,omitempty"`
+
+	// uris holds the manifests in the order they were sent.
+	uris []string
+	mu   sync.Mutex
+}
+
+// BatchManifest is a manifest of a batch run, verified with its own
+// Options.
+type BatchManifest struct {
+	URI     string
+	Options Options
+}
+
+// RunBatch verifies every manifest of manifests, at most concurrency of them
+// at once, each with a new Verifier writing under its own manifest_N folder
+// of its OutputDir. It only errors when the Options of a manifest are
+// invalid, before any is verified, holding the failures and errors of every
+// manifest on the BatchReport.
+func RunBatch(ctx context.Context, manifests []BatchManifest, concurrency int) (*BatchReport, error) {
+	if len(manifests) == 0 {
+		return nil, newError("no manifest uris to verify")
+	}
+	if concurrency < 1 {
+		return nil, newError("--manifest-concurrency must be at least 1")
+	}
+	for _, manifest := range manifests {
+		if _, err := New(manifest.Options); err != nil {
+			return nil, fmt.Errorf("%w, on options of manifest: %s", err, manifest.URI)
+		}
+	}
+
+	batch := &BatchReport{Manifests: make(map[string]*Report), Errors: make(map[string]string)}
+	start := time.Now()
+	pool := newWorkerPool(concurrency)
+	var wg sync.WaitGroup
+	for i, manifest := range manifests {
+		uri := manifest.URI
+		opts := manifest.Options
+		logger := optionsLogger(opts)
+		if _, seen := batch.Manifests[uri]; seen {
+			logf(logger, slog.LevelInfo, "Skipping manifest listed more than once: %s", uri)
+			continue
+		}
+		batch.add(uri, &Report{URI: uri}, nil)
+
+		// Records of concurrent manifests are told apart by their folder.
+		name := fmt.Sprintf("manifest_%d", i)
+		opts.Logger = logger.With("manifest", name)
+		if opts.Output == nil {
+			opts.OutputDir = filepath.Join(opts.OutputDir, name)
+		}
+		if opts.VerifyChecksums != "" {
+			opts.VerifyChecksums = filepath.Join(opts.VerifyChecksums, name)
+		}
+
+		position := fmt.Sprintf("%s (%d of %d)", name, i+1, len(manifests))
+		started := pool.Go(ctx, &wg, func() {
+			logf(opts.Logger, slog.LevelInfo, "Verifying %s: %s", position, uri)
+			report, err := Run(ctx, uri, opts)
+			if report == nil {
+				report = &Report{URI: uri}
+			}
+			batch.add(uri, report, err)
+		})
+		if !started {
+			batch.add(uri, &Report{URI: uri}, errors.New("the run stopped before it was started"))
+		}
+	}
+	wg.Wait()
+
+	batch.sumTotals(time.Since(start))
+	return batch, nil
+}
+
+// add records the report of the manifest on uri, along with err when it
+// couldn't be verified at all.
+func (b *BatchReport) add(uri string, report *Report, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, seen := b.Manifests[uri]; !seen {
+		b.uris = append(b.uris, uri)
+	}
+	b.Manifests[uri] = report
+
+	var failures *MultiError
+	if err != nil && !errors.As(err, &failures) {
+		b.Errors[uri] = err.Error()
+	}
+}
+
+// sumTotals fills the Totals of b from the Totals of every manifest, with
+// elapsed as the wall-clock duration of the batch.
+func (b *BatchReport) sumTotals(elapsed time.Duration) {
+	totals := Totals{Elapsed: elapsed}
+	b.Passed = len(b.Errors) == 0
+	for _, uri := range b.uris {
+		report := b.Manifests[uri]
+		b.Passed = b.Passed && report.Passed
+		totals.Renditions += report.Totals.Renditions
+		totals.Segments += report.Totals.Segments
+		totals.Verified += report.Totals.Verified
+		totals.Failed += report.Totals.Failed
+		totals.Skipped += report.Totals.Skipped
+		totals.Unsampled += report.Totals.Unsampled
+		totals.Failures += report.Totals.Failures
+		totals.Unverified += report.Totals.Unverified
+		totals.Keys += report.Totals.Keys
+		totals.Bytes += report.Totals.Bytes
+	}
+	b.Totals = totals
+}
+
+// Reports returns the Report of every manifest, in the order they were
+// sent.
+func (b *BatchReport) Reports() []*Report {
+	reports := make([]*Report, 0, len(b.uris))
+	for _, uri := range b.uris {
+		reports = append(reports, b.Manifests[uri])
+	}
+	return reports
+}
+
+// PrintSummary prints the summary of every manifest, or its brief lines when
+// brief is set, followed by the Totals of b.
+func (b *BatchReport) PrintSummary(brief bool) {
+	passed := 0
+	for _, report := range b.Reports() {
+		fmt.Printf("\nManifest %s:\n", report.URI)
+		if err, ok := b.Errors[report.URI]; ok {
+			fmt.Printf("  not verified: %s\n", err)
+			continue
+		}
+		if report.Passed {
+			passed++
+		}
+		if brief {
+			report.PrintBrief()
+		} else {
+			report.PrintSummary()
+		}
+	}
+
+	totals := b.Totals
+	fmt.Printf(
+		"\nBatch summary: %d manifests, %d passed, %d failed, %d not verified, %d renditions, %d segments, %d verified, %d failed, %d skipped, %d bytes in %s\n",
+		len(b.uris),
+		passed,
+		len(b.uris)-passed-len(b.Errors),
+		len(b.Errors),
+		totals.Renditions,
+		totals.Segments,
+		totals.Verified,
+		totals.Failed,
+		totals.Skipped,
+		totals.Bytes,
+		totals.Elapsed.Round(time.Millisecond),
+	)
+}
+
+// WriteJSON writes b to w as an indented JSON document.
+func (b *BatchReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(b)
+}
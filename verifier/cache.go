@@ -0,0 +1,232 @@
+package verifier
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cacheMaxAge is how long a segment stays on the cache without being
+// verified again before it's dropped from it.
+const cacheMaxAge = 30 * 24 * time.Hour
+
+// cacheFileMu serializes the Verifiers of a process saving the same cache,
+// as every save merges what's already on the file.
+var cacheFileMu sync.Mutex
+
+// DefaultCachePath returns where the segment cache is kept by default, under
+// the user cache directory, or "" when there's none.
+func DefaultCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hlseverify", "segments.json")
+}
+
+// cacheEntry is a segment verified on a previous run, along with the
+// validators it was served with and the results that are restored when the
+// origin answers it's unchanged.
+type cacheEntry struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// Checks are the options the segment was verified under, and KeySum
+	// the SHA-256 of the key it was decrypted with, so it's verified again
+	// when either changes.
+	Checks string `json:"checks"`
+	KeySum string `json:"key_sum,omitempty"`
+
+	Length          int           `json:"length"`
+	DecryptedLength int           `json:"decrypted_length"`
+	PadValue        int           `json:"pad_value"`
+	MediaDuration   time.Duration `json:"media_duration,omitempty"`
+	VerifiedAt      time.Time     `json:"verified_at"`
+}
+
+// restore sets the results of the segment verified as e on result.
+func (e *cacheEntry) restore(result *SegmentResult) {
+	result.Cached = true
+	result.Length = e.Length
+	result.DecryptedLength = e.DecryptedLength
+	result.PadValue = e.PadValue
+	result.MediaDuration = e.MediaDuration
+}
+
+// segmentCache is the JSON index of the segments verified by previous runs,
+// keyed by segment uri, byte range and key, loaded when a run starts and
+// saved once it ends.
+type segmentCache struct {
+	path   string
+	checks string
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	updated map[string]*cacheEntry
+}
+
+// openSegmentCache loads the cache on path, starting an empty one when it's
+// absent. checks are the options segments are verified under.
+func openSegmentCache(path, checks string) (*segmentCache, error) {
+	entries, err := readCacheFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentCache{
+		path:    path,
+		checks:  checks,
+		entries: entries,
+		updated: make(map[string]*cacheEntry),
+	}, nil
+}
+
+func readCacheFile(path string) (map[string]*cacheEntry, error) {
+	entries := make(map[string]*cacheEntry)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, newError(fmt.Sprintf("segment cache %s is corrupted, remove it or run with --no-cache: %s", path, err.Error()))
+	}
+	return entries, nil
+}
+
+// cacheKey identifies a segment on the cache by its uri, byte range and the
+// key and IV it's decrypted with.
+func cacheKey(result *SegmentResult) string {
+	return fmt.Sprintf("%s@%d+%d|%s|%s|%s", result.URI, result.Offset, result.Limit, result.Method, result.KeyURI, result.IV)
+}
+
+// lookup returns the entry of the segment of result verified under the same
+// checks and key, or nil when it has to be verified again.
+func (c *segmentCache) lookup(result *SegmentResult, keySum string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cacheKey(result)]
+	if !ok || entry.Checks != c.checks || entry.KeySum != keySum {
+		return nil
+	}
+	return entry
+}
+
+// store records the segment of result, verified with the key summed as
+// keySum, when the origin served it with a validator to request it again
+// with.
+func (c *segmentCache) store(result *SegmentResult, keySum string) {
+	if result.etag == "" && result.lastModified == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updated[cacheKey(result)] = &cacheEntry{
+		ETag:            result.etag,
+		LastModified:    result.lastModified,
+		Checks:          c.checks,
+		KeySum:          keySum,
+		Length:          result.Length,
+		DecryptedLength: result.DecryptedLength,
+		PadValue:        result.PadValue,
+		MediaDuration:   result.MediaDuration,
+		VerifiedAt:      time.Now().UTC(),
+	}
+}
+
+// save merges the segments stored during the run into the cache file,
+// dropping the ones older than cacheMaxAge. The file is read again first,
+// so runs sharing it concurrently don't drop each other's segments.
+func (c *segmentCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.updated) == 0 {
+		return nil
+	}
+
+	cacheFileMu.Lock()
+	defer cacheFileMu.Unlock()
+
+	entries, err := readCacheFile(c.path)
+	if err != nil {
+		return err
+	}
+	for key, entry := range c.updated {
+		entries[key] = entry
+	}
+	for key, entry := range entries {
+		if time.Since(entry.VerifiedAt) > cacheMaxAge {
+			delete(entries, key)
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	return WriteFileAtomic(c.path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(entries)
+	})
+}
+
+// cacheChecks sums up the options that change how a segment is verified,
+// which invalidate the cached segments when they change.
+func (v *Verifier) cacheChecks() string {
+	return fmt.Sprintf(
+		"deep=%t padding=%t durations=%t dominant=%g gunzip=%t init=%t methods=%t",
+		v.opts.DeepCheck,
+		!v.opts.NoPaddingCheck,
+		v.opts.CheckMediaDurations,
+		v.opts.DominantByteRatio,
+		v.opts.GunzipSegments,
+		v.opts.RequireInitSegment,
+		v.opts.CompareMethods,
+	)
+}
+
+// useCache reports whether the segment cache applies to the run. Segments
+// are always downloaded when their bodies are saved, concatenated, compared,
+// dumped or decoded by --ffprobe, and under --verify-checksums.
+func (v *Verifier) useCache() bool {
+	return v.opts.CachePath != "" &&
+		!v.opts.NoCache &&
+		!v.opts.SaveSegments &&
+		!v.opts.Concat &&
+		!v.opts.DumpTails &&
+		!v.opts.FFprobe &&
+		v.opts.CompareOrigin == "" &&
+		v.opts.VerifyChecksums == ""
+}
+
+// keySum returns the SHA-256 of the key the segment of result is decrypted
+// with, "" when it's clear or its samples are verified without a FairPlay
+// key. ok is false when the key can't be had, in which case the segment
+// isn't cached.
+func (v *Verifier) keySum(ctx context.Context, result *SegmentResult) (string, bool) {
+	if result.Method == "" || result.Method == methodNone {
+		return "", true
+	}
+	if isSampleEncryption(result.Method) && !isKeyFetchable(result.KeyURI) {
+		return "", true
+	}
+	if result.KeyURI == "" {
+		return "", false
+	}
+	key, err := v.GetKey(ctx, result.KeyURI)
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:]), true
+}
@@ -0,0 +1,167 @@
+package verifier
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyRevalidatesCachedSegments(t *testing.T) {
+	tests := []struct {
+		name string
+		// change alters the stream or options between the first run and
+		// the second.
+		change     func(stream *testStream, opts *Options)
+		wantCached int
+		wantErr    bool
+	}{
+		{name: "unchanged", change: func(*testStream, *Options) {}, wantCached: 3},
+		{
+			name: "segment changed",
+			change: func(stream *testStream, _ *Options) {
+				stream.add("/media/seg1.ts", encryptSegment(testKey, sequenceIV(1), testPlain(7, 500)))
+			},
+			wantCached: 2,
+		},
+		{
+			name:   "checks changed",
+			change: func(_ *testStream, opts *Options) { opts.DominantByteRatio = 0.5 },
+		},
+		{
+			name:   "key methods compared",
+			change: func(_ *testStream, opts *Options) { opts.CompareMethods = true },
+		},
+		{
+			name:    "key changed",
+			change:  func(stream *testStream, _ *Options) { stream.add("/media/key.bin", []byte("fedcba9876543210")) },
+			wantErr: true,
+		},
+		{
+			name:   "saved",
+			change: func(_ *testStream, opts *Options) { opts.SaveSegments = true },
+		},
+		{
+			name:   "concatenated",
+			change: func(_ *testStream, opts *Options) { opts.Concat = true },
+		},
+		{
+			name:   "no cache",
+			change: func(_ *testStream, opts *Options) { opts.NoCache = true },
+		},
+		{
+			name:   "no cache path",
+			change: func(_ *testStream, opts *Options) { opts.CachePath = "" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.addMedia("/media/index.m3u8", 3)
+			cachePath := filepath.Join(t.TempDir(), "segments.json")
+
+			first := newTestVerifier(t, func(opts *Options) { opts.CachePath = cachePath })
+			report, err := first.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+			if err != nil {
+				t.Fatalf("first Verify() error = %v", err)
+			}
+			if report.Totals.Cached != 0 {
+				t.Fatalf("first Verify() cached %d segments, want 0", report.Totals.Cached)
+			}
+
+			second := newTestVerifier(t, func(opts *Options) {
+				opts.CachePath = cachePath
+				opts.NoRecheck = true
+				tt.change(stream, opts)
+			})
+			report, err = second.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("second Verify() error = %v, want error %t", err, tt.wantErr)
+			}
+			if report.Totals.Cached != tt.wantCached {
+				t.Errorf("second Verify() cached %d segments, want %d", report.Totals.Cached, tt.wantCached)
+			}
+
+			revalidated := 0
+			for _, r := range stream.requestsTo("/media/seg0.ts") {
+				if r.Header.Get("If-None-Match") != "" {
+					revalidated++
+				}
+			}
+			if want := min(tt.wantCached, 1); revalidated != want {
+				t.Errorf("seg0.ts was revalidated %d times, want %d", revalidated, want)
+			}
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	base := SegmentResult{URI: "https://cdn.example.com/seg0.ts", Method: methodAES128, KeyURI: "https://cdn.example.com/key.bin"}
+	tests := []struct {
+		name   string
+		change func(*SegmentResult)
+	}{
+		{"uri", func(r *SegmentResult) { r.URI = "https://cdn.example.com/seg1.ts" }},
+		{"offset", func(r *SegmentResult) { r.Offset = 1024 }},
+		{"limit", func(r *SegmentResult) { r.Limit = 1024 }},
+		{"method", func(r *SegmentResult) { r.Method = methodSampleAES }},
+		{"key uri", func(r *SegmentResult) { r.KeyURI = "https://cdn.example.com/key2.bin" }},
+		{"iv", func(r *SegmentResult) { r.IV = "0x01" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := base
+			tt.change(&changed)
+			if cacheKey(&changed) == cacheKey(&base) {
+				t.Errorf("cacheKey() = %q for both segments, want the %s to tell them apart", cacheKey(&base), tt.name)
+			}
+		})
+	}
+}
+
+func TestSegmentCacheLookup(t *testing.T) {
+	cache, err := openSegmentCache(filepath.Join(t.TempDir(), "segments.json"), "checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &SegmentResult{URI: "https://cdn.example.com/seg0.ts", Length: 1024, etag: `"abc"`}
+	cache.store(result, "sum")
+	if err := cache.save(); err != nil {
+		t.Fatal(err)
+	}
+	unvalidated := &SegmentResult{URI: "https://cdn.example.com/seg1.ts"}
+	cache.store(unvalidated, "sum")
+
+	tests := []struct {
+		name   string
+		checks string
+		result *SegmentResult
+		keySum string
+		want   bool
+	}{
+		{name: "same", checks: "checks", result: result, keySum: "sum", want: true},
+		{name: "other checks", checks: "other", result: result, keySum: "sum"},
+		{name: "other key", checks: "checks", result: result, keySum: "other"},
+		{name: "no validator", checks: "checks", result: unvalidated, keySum: "sum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reopened, err := openSegmentCache(cache.path, tt.checks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := reopened.lookup(tt.result, tt.keySum)
+			if got := entry != nil; got != tt.want {
+				t.Fatalf("lookup() found = %t, want %t", got, tt.want)
+			}
+			if entry == nil {
+				return
+			}
+
+			restored := &SegmentResult{}
+			entry.restore(restored)
+			if !restored.Cached || restored.Length != 1024 || entry.ETag != `"abc"` {
+				t.Errorf("restore() = %+v of entry %+v, want the cached results", restored, entry)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package verifier
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	sessionDataTag    = "#EXT-X-SESSION-DATA:"
+	targetDurationTag = "#EXT-X-TARGETDURATION:"
+)
+
+// findTags returns the attribute lists of every line in raw starting with
+// tag, in the order they appear.
+func findTags(raw []byte, tag string) []map[string]string {
+	var found []map[string]string
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, tag) {
+			continue
+		}
+		found = append(found, m3u8.DecodeAttributeList(strings.TrimPrefix(line, tag)))
+	}
+
+	return found
+}
+
+// checkSessionData reports every EXT-X-SESSION-DATA entry of a master
+// manifest, warning on malformed ones, and errors if any of the
+// RequiredSessionData ids is missing or only present in a malformed entry.
+func (v *Verifier) checkSessionData(raw []byte) error {
+	present := make(map[string]bool)
+
+	for _, attrs := range findTags(raw, sessionDataTag) {
+		id := attrs["DATA-ID"]
+		value, hasValue := attrs["VALUE"]
+		uri, hasURI := attrs["URI"]
+
+		switch {
+		case id == "":
+			v.warnf("Session data without DATA-ID")
+			continue
+		case hasValue == hasURI:
+			v.warnf("Session data %s must have exactly one of VALUE or URI", id)
+			continue
+		case hasValue:
+			v.infof("Session data %s: %s", id, value)
+		default:
+			v.infof("Session data %s: %s", id, uri)
+		}
+		present[id] = true
+	}
+
+	var missing []string
+	for _, id := range v.opts.RequiredSessionData {
+		if !present[id] {
+			missing = append(missing, id)
+		}
+	}
+
+	if len(missing) > 0 {
+		return newError("missing required session data: " + strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// checkSegmentCount errors if a media manifest doesn't have the amount of
+// segments sent through --assert-segment-count.
+func (v *Verifier) checkSegmentCount(uri string, mp *m3u8.MediaPlaylist) error {
+	if v.opts.AssertSegmentCount < 0 {
+		return nil
+	}
+
+	count := 0
+	for _, segment := range mp.Segments {
+		if segment != nil {
+			count++
+		}
+	}
+
+	v.infof("Segment count for %s: expected %d, found %d", uri, v.opts.AssertSegmentCount, count)
+	if count != v.opts.AssertSegmentCount {
+		return newError(fmt.Sprintf("expected %d segments, found %d", v.opts.AssertSegmentCount, count))
+	}
+
+	return nil
+}
+
+// checkEndList warns when a media manifest has no EXT-X-ENDLIST, as it may
+// still be growing and its verification would be incomplete.
+func (v *Verifier) checkEndList(uri string, mp *m3u8.MediaPlaylist) {
+	if !mp.Closed {
+		v.warnf("No EXT-X-ENDLIST on %s, it may still be growing and results could be incomplete", uri)
+		return
+	}
+
+	v.debugf("EXT-X-ENDLIST present on: %s", uri)
+}
+
+// checkTotalDuration reports the added duration of a media manifest's
+// segments, erroring if it deviates from --expected-duration by more than
+// --duration-tolerance.
+func (v *Verifier) checkTotalDuration(uri string, mp *m3u8.MediaPlaylist) error {
+	var total time.Duration
+	for _, segment := range mp.Segments {
+		if segment != nil {
+			total += time.Duration(segment.Duration * float64(time.Second))
+		}
+	}
+
+	v.infof("Total segment duration for %s: %s", uri, total)
+	if v.opts.ExpectedDuration <= 0 {
+		return nil
+	}
+
+	deviation := total - v.opts.ExpectedDuration
+	if deviation < 0 {
+		deviation = -deviation
+	}
+
+	if deviation > v.opts.DurationTolerance {
+		return newError(fmt.Sprintf("segments add up to %s, expected %s", total, v.opts.ExpectedDuration))
+	}
+
+	return nil
+}
+
+// fmp4Extensions are the segment extensions of fragmented MP4 renditions.
+var fmp4Extensions = map[string]bool{
+	".m4s":  true,
+	".m4f":  true,
+	".mp4":  true,
+	".cmfv": true,
+	".cmfa": true,
+}
+
+// checkInitSegment warns when a media manifest of fMP4 segments has a segment
+// without an EXT-X-MAP, as players can't decode it without the init segment.
+// If --require-init-segment is set it errors instead.
+func (v *Verifier) checkInitSegment(uri string, mp *m3u8.MediaPlaylist) error {
+	missing := 0
+	fmp4 := false
+	for _, segment := range mp.Segments {
+		if segment == nil || !isFMP4Segment(segment.URI) {
+			continue
+		}
+		fmp4 = true
+		if segment.Map == nil && mp.Map == nil {
+			missing++
+		}
+	}
+
+	if !fmp4 || missing == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%d fMP4 segments without an EXT-X-MAP init segment on %s", missing, uri)
+	if v.opts.RequireInitSegment {
+		return newError(msg)
+	}
+
+	v.warnf("%s", msg)
+	return nil
+}
+
+// isFMP4Segment reports whether the segment uri has a fragmented MP4
+// extension.
+func isFMP4Segment(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return fmp4Extensions[strings.ToLower(path.Ext(u.Path))]
+}
+
+// checkTargetDuration errors if the EXT-X-TARGETDURATION of a media manifest
+// is below its longest segment, once rounded to the nearest integer as the
+// spec allows, or at least a whole second above it. The declared value is
+// read from raw, as the m3u8 package raises it to fit appended segments.
+func (v *Verifier) checkTargetDuration(uri string, raw []byte, mp *m3u8.MediaPlaylist) error {
+	target, ok := declaredTargetDuration(raw)
+	if !ok {
+		return newError("missing or malformed EXT-X-TARGETDURATION")
+	}
+
+	longest := 0.0
+	for _, segment := range mp.Segments {
+		if segment != nil && segment.Duration > longest {
+			longest = segment.Duration
+		}
+	}
+
+	v.debugf("Target duration for %s: declared %g, longest segment %g", uri, target, longest)
+
+	switch {
+	case math.Round(longest) > target:
+		return newError(fmt.Sprintf("EXT-X-TARGETDURATION %g is below the longest segment duration %g", target, longest))
+	case longest > 0 && target >= longest+1:
+		return newError(fmt.Sprintf("EXT-X-TARGETDURATION %g is above the ceiling of the longest segment duration %g", target, longest))
+	}
+
+	return nil
+}
+
+// declaredTargetDuration returns the EXT-X-TARGETDURATION of raw.
+func declaredTargetDuration(raw []byte) (float64, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, targetDurationTag) {
+			continue
+		}
+		target, err := strconv.ParseFloat(strings.TrimPrefix(line, targetDurationTag), 64)
+		return target, err == nil
+	}
+	return 0, false
+}
+
+// checkBandwidthOrdering prints the BANDWIDTH of every variant of a master
+// manifest, warning if they aren't in ascending order and erroring on values
+// shared by more than one variant.
+func (v *Verifier) checkBandwidthOrdering(uri string, mp *m3u8.MasterPlaylist) error {
+	var bandwidths []string
+	var duplicates []string
+	seen := make(map[uint32]bool)
+	ascending := true
+	var previous uint32
+	for _, variant := range mp.Variants {
+		if variant.Iframe {
+			continue
+		}
+
+		bandwidth := variant.Bandwidth
+		bandwidths = append(bandwidths, strconv.FormatUint(uint64(bandwidth), 10))
+		if seen[bandwidth] {
+			duplicates = append(duplicates, strconv.FormatUint(uint64(bandwidth), 10))
+		}
+		seen[bandwidth] = true
+
+		if bandwidth < previous {
+			ascending = false
+		}
+		previous = bandwidth
+	}
+
+	v.infof("Variant bandwidths for %s: %s", uri, strings.Join(bandwidths, ", "))
+	if !ascending {
+		v.warnf("Variants of %s aren't in ascending BANDWIDTH order", uri)
+	}
+
+	if len(duplicates) > 0 {
+		return newError("duplicate variant BANDWIDTH values: " + strings.Join(duplicates, ", "))
+	}
+	return nil
+}
+
+// checkMediaGroups errors if an EXT-X-MEDIA group of a master manifest has
+// more than one DEFAULT=YES member, or a DEFAULT=YES member with
+// AUTOSELECT=NO, as both break player track selection.
+func checkMediaGroups(mp *m3u8.MasterPlaylist) error {
+	var groups []string
+	defaults := make(map[string][]string)
+	seen := make(map[*m3u8.Alternative]bool)
+	var violations []string
+	for _, variant := range mp.Variants {
+		for _, alt := range variant.Alternatives {
+			if alt == nil || seen[alt] {
+				continue
+			}
+			seen[alt] = true
+
+			group := alt.Type + " group \"" + alt.GroupId + "\""
+			if _, ok := defaults[group]; !ok {
+				groups = append(groups, group)
+				defaults[group] = nil
+			}
+			if !alt.Default {
+				continue
+			}
+
+			defaults[group] = append(defaults[group], alt.Name)
+			if strings.EqualFold(alt.Autoselect, "NO") {
+				violations = append(violations, fmt.Sprintf("%s member %q is DEFAULT=YES with AUTOSELECT=NO", group, alt.Name))
+			}
+		}
+	}
+
+	for _, group := range groups {
+		if members := defaults[group]; len(members) > 1 {
+			violations = append(violations, fmt.Sprintf("%s has %d DEFAULT=YES members: %q", group, len(members), members))
+		}
+	}
+
+	if len(violations) > 0 {
+		return newError("EXT-X-MEDIA constraints violated:\n    " + strings.Join(violations, "\n    "))
+	}
+	return nil
+}
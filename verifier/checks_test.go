@@ -0,0 +1,74 @@
+package verifier
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestCheckMediaGroups(t *testing.T) {
+	const variant = "#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO=\"aac\"\nvideo.m3u8\n"
+	tests := []struct {
+		name   string
+		media  []string
+		errors []string
+	}{
+		{
+			name: "single default",
+			media: []string{
+				`TYPE=AUDIO,GROUP-ID="aac",NAME="en",DEFAULT=YES,AUTOSELECT=YES,URI="en.m3u8"`,
+				`TYPE=AUDIO,GROUP-ID="aac",NAME="es",DEFAULT=NO,AUTOSELECT=YES,URI="es.m3u8"`,
+			},
+		},
+		{
+			name: "no default",
+			media: []string{
+				`TYPE=AUDIO,GROUP-ID="aac",NAME="en",AUTOSELECT=NO,URI="en.m3u8"`,
+			},
+		},
+		{
+			name: "two defaults",
+			media: []string{
+				`TYPE=AUDIO,GROUP-ID="aac",NAME="en",DEFAULT=YES,AUTOSELECT=YES,URI="en.m3u8"`,
+				`TYPE=AUDIO,GROUP-ID="aac",NAME="es",DEFAULT=YES,AUTOSELECT=YES,URI="es.m3u8"`,
+			},
+			errors: []string{`AUDIO group "aac" has 2 DEFAULT=YES members: ["en" "es"]`},
+		},
+		{
+			name: "default without autoselect",
+			media: []string{
+				`TYPE=AUDIO,GROUP-ID="aac",NAME="en",DEFAULT=YES,AUTOSELECT=NO,URI="en.m3u8"`,
+			},
+			errors: []string{`AUDIO group "aac" member "en" is DEFAULT=YES with AUTOSELECT=NO`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "#EXTM3U\n"
+			for _, media := range tt.media {
+				raw += "#EXT-X-MEDIA:" + media + "\n"
+			}
+			p, _, err := decodePlaylist("master.m3u8", []byte(raw+variant))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = checkMediaGroups(p.(*m3u8.MasterPlaylist))
+			if len(tt.errors) == 0 {
+				if err != nil {
+					t.Errorf("checkMediaGroups() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("checkMediaGroups() error = nil, want %q", tt.errors)
+			}
+			for _, want := range tt.errors {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("checkMediaGroups() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package verifier
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/grafov/m3u8"
+)
+
+// checksumFile is the name of the checksum manifest written to every
+// rendition folder under --save, in the format of sha256sum.
+const checksumFile = "checksums.sha256"
+
+// errChecksumMismatch is returned by DecodeSegment when a segment differs
+// from the checksum recorded for it by a previous --save run.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumManifest holds the checksums a rendition was saved with by a
+// previous run, loaded under --verify-checksums.
+type checksumManifest struct {
+	path string
+
+	mu   sync.Mutex
+	sums map[string]string
+	seen map[string]bool
+}
+
+// checksumName identifies the segment of result on a checksum manifest, by
+// its uri without the query, which signed URLs change on every run, and its
+// byte range when it has one.
+func checksumName(result *SegmentResult) string {
+	name := result.URI
+	if u, err := url.Parse(result.URI); err == nil {
+		u.RawQuery, u.Fragment = "", ""
+		name = u.String()
+	}
+	if result.Limit > 0 {
+		name += fmt.Sprintf("#%d@%d", result.Limit, result.Offset)
+	}
+	return name
+}
+
+// readChecksums reads the checksum manifest on path.
+func readChecksums(path string) (*checksumManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checksumManifest{path: path, sums: make(map[string]string), seen: make(map[string]bool)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if _, err := hex.DecodeString(sum); !ok || err != nil || len(sum) != sha256.Size*2 {
+			return nil, newError(fmt.Sprintf("line %d of %s isn't a SHA-256 and a segment", n, path))
+		}
+		c.sums[name] = strings.ToLower(sum)
+	}
+	return c, nil
+}
+
+// compare errors unless the segment of result, whose body sums to sum, has
+// the checksum recorded for it.
+func (c *checksumManifest) compare(result *SegmentResult, sum string) error {
+	name := checksumName(result)
+	c.mu.Lock()
+	expected, ok := c.sums[name]
+	c.seen[name] = true
+	c.mu.Unlock()
+
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: segment not on %s", errChecksumMismatch, c.path)
+	case sum != expected:
+		return fmt.Errorf("%w: segment SHA-256 %s, %s expected by %s", errChecksumMismatch, sum, expected, c.path)
+	}
+	return nil
+}
+
+// missing returns the segments recorded on c that weren't compared, sorted.
+func (c *checksumManifest) missing() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var names []string
+	for name := range c.sums {
+		if !c.seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openChecksums loads the checksum manifest of the rendition saved to
+// folder from the matching folder under --verify-checksums.
+func (v *Verifier) openChecksums(folder string) error {
+	// The run ID folder of --output-dir-per-run is new on every run, so
+	// renditions are matched by their own folder.
+	name := folder
+	if v.opts.OutputDirPerRun {
+		if rel, err := filepath.Rel(v.opts.RunID, folder); err == nil {
+			name = rel
+		}
+	}
+
+	c, err := readChecksums(filepath.Join(v.opts.VerifyChecksums, name, checksumFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: no %s for the rendition under %s", errChecksumMismatch, checksumFile, v.opts.VerifyChecksums)
+	}
+	if err != nil {
+		return err
+	}
+
+	v.checksumsMu.Lock()
+	v.checksums[folder] = c
+	v.checksumsMu.Unlock()
+	return nil
+}
+
+// checksumsOf returns the checksum manifest of the rendition saved to
+// folder, or nil without --verify-checksums.
+func (v *Verifier) checksumsOf(folder string) *checksumManifest {
+	v.checksumsMu.Lock()
+	defer v.checksumsMu.Unlock()
+	return v.checksums[folder]
+}
+
+// checksumSegment sums the body of the segment of result as served, before
+// it's decompressed or decrypted, when it's saved, compared or could be
+// rechecked, erroring if it differs from the checksum manifest of its
+// rendition.
+func (v *Verifier) checksumSegment(result *SegmentResult, body []byte) error {
+	if !v.sumsSegments() {
+		return nil
+	}
+	return v.checksumSum(result, sha256.Sum256(body))
+}
+
+// sumsSegments reports whether the SHA256 of segments is recorded, as
+// --save, --verify-checksums and rechecks need it.
+func (v *Verifier) sumsSegments() bool {
+	return v.opts.SaveSegments || v.opts.VerifyChecksums != "" || !v.opts.NoRecheck
+}
+
+// checksumSum is checksumSegment with sum, the SHA256 of the still
+// encrypted body of the segment of result.
+func (v *Verifier) checksumSum(result *SegmentResult, sum [sha256.Size]byte) error {
+	result.SHA256 = hex.EncodeToString(sum[:])
+
+	c := v.checksumsOf(result.Variant)
+	if c == nil {
+		return nil
+	}
+	if err := c.compare(result, result.SHA256); err != nil {
+		v.errorf("Segment differs from --verify-checksums on segment: %s", result.URI)
+		return err
+	}
+	return nil
+}
+
+// checkMissingChecksums errors when segments recorded on the checksum
+// manifest of media are no longer on its playlist mp. It's only checked
+// when every segment of a complete playlist was compared.
+func (v *Verifier) checkMissingChecksums(media *MediaResult, mp *m3u8.MediaPlaylist) error {
+	c := v.checksumsOf(media.Variant)
+	if c == nil || !mp.Closed || v.sampler != nil || v.opts.MaxDuration > 0 || media.Skipped > 0 {
+		return nil
+	}
+	missing := c.missing()
+	if len(missing) == 0 {
+		return nil
+	}
+	v.errorf("%d segments of --verify-checksums no longer on: %s", len(missing), media.URI)
+	return fmt.Errorf("%w: %d segments on %s missing from the playlist, first %s", errChecksumMismatch, len(missing), c.path, missing[0])
+}
+
+// writeChecksums writes the checksum manifest of the segments of media
+// fetched during the run to its folder on the Output, in index order.
+func (v *Verifier) writeChecksums(media *MediaResult) error {
+	indexes := make([]int, 0, len(media.checksums))
+	for index := range media.checksums {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	lines := make([]string, len(indexes))
+	for i, index := range indexes {
+		lines[i] = media.checksums[index]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	output, ok := v.output.(OutputFileWriter)
+	if !ok {
+		v.warnf("Checksums of %s not written, the output only stores segments", media.URI)
+		return nil
+	}
+	if err := output.WriteFile(media.Variant, checksumFile, []byte(strings.Join(lines, ""))); err != nil {
+		return err
+	}
+	written := filepath.Join(media.Variant, checksumFile)
+	if local, ok := v.output.(FSWriter); ok {
+		written = filepath.Join(local.Root, written)
+	}
+	v.infof("Checksums of %d segments of %s written to: %s", len(lines), media.URI, written)
+	return nil
+}
@@ -0,0 +1,94 @@
+package verifier
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteChecksumsKeepsDroppedSegments(t *testing.T) {
+	v := newTestVerifier(t, nil)
+	media := &MediaResult{URI: "live.m3u8", Variant: "video_0", keepSegments: 2}
+	const n = 6
+	for i := n - 1; i >= 0; i-- {
+		media.addSegment(&SegmentResult{
+			Index:  i,
+			URI:    fmt.Sprintf("seg%d.ts?token=%d", i, i),
+			Passed: true,
+			SHA256: fmt.Sprintf("%064x", i),
+		})
+	}
+	if len(media.Segments) >= n {
+		t.Fatalf("addSegment() kept %d results, want some dropped", len(media.Segments))
+	}
+
+	if err := v.writeChecksums(media); err != nil {
+		t.Fatalf("writeChecksums() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(v.opts.OutputDir, media.Variant, checksumFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&want, "%064x  seg%d.ts\n", i, i)
+	}
+	if string(data) != want.String() {
+		t.Errorf("writeChecksums() wrote:\n%s\nwant:\n%s", data, want.String())
+	}
+}
+
+// memoryOutput is an OutputWriter keeping every file written to it in
+// memory, by variant and name.
+type memoryOutput struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (o *memoryOutput) Write(variant string, index int, status Status, data []byte) error {
+	return o.WriteFile(variant, fmt.Sprintf("%s%d.m4f", filePrefixes[status], index), data)
+}
+
+func (o *memoryOutput) WriteFile(variant, name string, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.files == nil {
+		o.files = make(map[string][]byte)
+	}
+	o.files[variant+"/"+name] = append([]byte(nil), data...)
+	return nil
+}
+
+func TestSaveWritesChecksumsToOutput(t *testing.T) {
+	stream := newTestStream(t)
+	stream.addMedia("/index.m3u8", 2)
+
+	output := &memoryOutput{}
+	v := newTestVerifier(t, func(opts *Options) {
+		opts.SaveSegments = true
+		opts.Output = output
+	})
+	if _, err := v.Verify(context.Background(), stream.uri("/index.m3u8")); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	manifest, ok := output.files["media/"+checksumFile]
+	if !ok {
+		t.Fatalf("Verify() wrote %d files to the output, none of them media/%s", len(output.files), checksumFile)
+	}
+	if lines := strings.Count(string(manifest), "\n"); lines != 2 {
+		t.Errorf("Verify() wrote %d checksums, want 2:\n%s", lines, manifest)
+	}
+	entries, err := os.ReadDir(v.opts.OutputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Verify() wrote %d entries to OutputDir, want none with a custom output", len(entries))
+	}
+}
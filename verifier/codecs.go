@@ -0,0 +1,404 @@
+package verifier
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// tsStreamCodecs maps the MPEG-TS stream types of audio and video to the
+// RFC 6381 codec they're declared with on CODECS. H.264 is refined by its
+// SPS when one is found.
+var tsStreamCodecs = map[byte]string{
+	0x1B: "avc1",
+	0xDB: "avc1",
+	0x24: "hvc1",
+	0x03: "mp4a.40.34",
+	0x04: "mp4a.40.34",
+	0x0F: "mp4a",
+	0xCF: "mp4a",
+	0x81: "ac-3",
+	0xC1: "ac-3",
+	0x87: "ec-3",
+	0xC2: "ec-3",
+}
+
+// tsH264StreamTypes are the MPEG-TS stream types of H.264, in the clear or
+// under SAMPLE-AES.
+var tsH264StreamTypes = map[byte]bool{0x1B: true, 0xDB: true}
+
+// codecFamilies groups the sample entries a codec may be declared with, so
+// hev1 content declared as hvc1 isn't a mismatch. Families not listed are
+// their own sample entry.
+var codecFamilies = map[string]string{
+	"avc1": "avc",
+	"avc3": "avc",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"dvh1": "dvh",
+	"dvhe": "dvh",
+}
+
+// videoFamilies are the codec families carrying video.
+var videoFamilies = map[string]bool{"avc": true, "hevc": true, "dvh": true, "av01": true, "vp09": true}
+
+// textCodecs are declared on CODECS by subtitle renditions, whose segments
+// are never multiplexed with the variant.
+var textCodecs = map[string]bool{"wvtt": true, "stpp": true}
+
+// mediaContent is the codecs and resolution the segments of a rendition
+// carry, read from its first decrypted TS segment or from its init
+// segments.
+type mediaContent struct {
+	Codecs []string
+	Width  int
+	Height int
+}
+
+func (c *mediaContent) String() string {
+	s := strings.Join(c.Codecs, ",")
+	if c.Width > 0 && c.Height > 0 {
+		s += fmt.Sprintf(" at %dx%d", c.Width, c.Height)
+	}
+	return s
+}
+
+// codecFamily returns the family of an RFC 6381 codec, its sample entry
+// before the first dot grouped by codecFamilies.
+func codecFamily(codec string) string {
+	entry := strings.SplitN(strings.TrimSpace(codec), ".", 2)[0]
+	if family, ok := codecFamilies[entry]; ok {
+		return family
+	}
+	return strings.ToLower(entry)
+}
+
+// tsContent reads the codecs of the elementary streams declared on the PMT
+// of the decrypted TS segment body, and the profile, level and resolution of
+// its H.264 stream from its SPS. It returns nil when body isn't a TS
+// segment or declares no PMT.
+func tsContent(body []byte) *mediaContent {
+	if !isTransportStream(body) {
+		return nil
+	}
+	streams := segmentStreams(tsPackets(body))
+	if streams == nil {
+		return nil
+	}
+
+	content := &mediaContent{}
+	h264 := false
+	for _, streamType := range streams {
+		if codec, ok := tsStreamCodecs[streamType]; ok {
+			content.Codecs = append(content.Codecs, codec)
+		}
+		h264 = h264 || tsH264StreamTypes[streamType]
+	}
+	if h264 {
+		payload, err := firstStreamPayload(body, "video", func(streamType byte) bool {
+			return tsH264StreamTypes[streamType]
+		})
+		if err == nil {
+			if sps, ok := h264SPS(payload); ok {
+				codec, width, height := parseH264SPS(sps)
+				for i, c := range content.Codecs {
+					if c == "avc1" {
+						content.Codecs[i] = codec
+					}
+				}
+				content.Width, content.Height = width, height
+			}
+		}
+	}
+	sort.Strings(content.Codecs)
+	return content
+}
+
+// initContent returns the codecs and resolution of the tracks declared by
+// the init segments of a rendition, or nil when there are none.
+func initContent(tracks map[uint32]initTrack) *mediaContent {
+	content := &mediaContent{}
+	for _, track := range tracks {
+		if track.Codec == "" {
+			continue
+		}
+		content.Codecs = append(content.Codecs, track.Codec)
+		if track.Width > 0 && track.Height > 0 {
+			content.Width, content.Height = track.Width, track.Height
+		}
+	}
+	if len(content.Codecs) == 0 {
+		return nil
+	}
+	sort.Strings(content.Codecs)
+	return content
+}
+
+// h264SPS returns the first sequence parameter set NAL unit of the Annex B
+// H.264 stream es, without its emulation prevention bytes.
+func h264SPS(es []byte) ([]byte, bool) {
+	for len(es) > 0 {
+		start := bytes.Index(es, []byte{0, 0, 1})
+		if start < 0 {
+			return nil, false
+		}
+		es = es[start+3:]
+		end := bytes.Index(es, []byte{0, 0, 1})
+		nal := es
+		if end >= 0 {
+			nal = es[:end]
+		}
+		if len(nal) > 0 && nal[0]&0x1F == 7 {
+			return bytes.ReplaceAll(nal[1:], []byte{0, 0, 3}, []byte{0, 0}), true
+		}
+	}
+	return nil, false
+}
+
+// parseH264SPS returns the avc1 codec of a sequence parameter set payload,
+// with its profile, constraint flags and level, along with the cropped
+// width and height of the pictures it describes.
+func parseH264SPS(sps []byte) (string, int, int) {
+	if len(sps) < 3 {
+		return "avc1", 0, 0
+	}
+	codec := fmt.Sprintf("avc1.%02X%02X%02X", sps[0], sps[1], sps[2])
+
+	r := bitReader{data: sps}
+	r.skip(24)
+	r.readUE() // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	switch sps[0] {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat = r.readUE(); chromaFormat == 3 {
+			r.skip(1) // separate_colour_plane_flag
+		}
+		r.readUE() // bit_depth_luma_minus8
+		r.readUE() // bit_depth_chroma_minus8
+		r.skip(1)  // qpprime_y_zero_transform_bypass_flag
+		if r.read(1) == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.read(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.readSE() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.readUE() // log2_max_frame_num_minus4
+	switch r.readUE() {
+	case 0:
+		r.readUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1)  // delta_pic_order_always_zero_flag
+		r.readSE() // offset_for_non_ref_pic
+		r.readSE() // offset_for_top_to_bottom_field
+		for n := r.readUE(); n > 0; n-- {
+			r.readSE()
+		}
+	}
+	r.readUE() // max_num_ref_frames
+	r.skip(1)  // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := int(r.readUE()) + 1
+	heightUnits := int(r.readUE()) + 1
+	frameMbsOnly := int(r.read(1))
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+
+	width := widthMbs * 16
+	height := (2 - frameMbsOnly) * heightUnits * 16
+	if r.read(1) == 1 {
+		left, right, top, bottom := int(r.readUE()), int(r.readUE()), int(r.readUE()), int(r.readUE())
+		cropX, cropY := 1, 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+	if width <= 0 || height <= 0 {
+		return codec, 0, 0
+	}
+	return codec, width, height
+}
+
+// readUE reads an unsigned Exp-Golomb code.
+func (r *bitReader) readUE() uint32 {
+	zeros := 0
+	for r.pos < len(r.data)*8 && r.read(1) == 0 && zeros < 32 {
+		zeros++
+	}
+	if zeros == 0 {
+		return 0
+	}
+	return 1<<zeros - 1 + r.read(zeros)
+}
+
+// readSE reads a signed Exp-Golomb code.
+func (r *bitReader) readSE() int32 {
+	v := r.readUE()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+// checkCodecDeclaration errors when the segments of the variant rendition
+// media carry codecs missing from its CODECS, or a video codec or
+// resolution other than declared. Its audio codecs only have to be found
+// when it has no AUDIO group carrying them instead. An H.264 stream must
+// also have the declared profile, at a level no higher than declared.
+func checkCodecDeclaration(variant *m3u8.Variant, content *mediaContent) error {
+	declared := make(map[string]string)
+	for _, codec := range strings.Split(variant.Codecs, ",") {
+		if codec = strings.TrimSpace(codec); codec != "" && !textCodecs[codecFamily(codec)] {
+			declared[codecFamily(codec)] = codec
+		}
+	}
+
+	found := make(map[string]string)
+	var errs []string
+	for _, codec := range content.Codecs {
+		family := codecFamily(codec)
+		found[family] = codec
+		want, ok := declared[family]
+		switch {
+		case len(declared) == 0:
+		case !ok:
+			errs = append(errs, fmt.Sprintf("segments carry %s, not declared on CODECS %q", codec, variant.Codecs))
+		case family == "avc":
+			if err := compareAVC(want, codec); err != "" {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for family, codec := range declared {
+		_, ok := found[family]
+		if !ok && (videoFamilies[family] || variant.Audio == "") {
+			errs = append(errs, fmt.Sprintf("CODECS declares %s, not found on the segments", codec))
+		}
+	}
+
+	if variant.Resolution != "" && content.Width > 0 && content.Height > 0 {
+		if actual := fmt.Sprintf("%dx%d", content.Width, content.Height); !strings.EqualFold(variant.Resolution, actual) {
+			errs = append(errs, fmt.Sprintf("RESOLUTION declares %s, segments are %s", variant.Resolution, actual))
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return newError(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// compareAVC compares the profile and level of the H.264 codec declared
+// with the one found, returning why they mismatch or "". Codecs without a
+// profile and level, such as a bare avc1, aren't compared.
+func compareAVC(declared, found string) string {
+	parse := func(codec string) (profile, level uint64, ok bool) {
+		_, hex, ok := strings.Cut(codec, ".")
+		if !ok || len(hex) != 6 {
+			return 0, 0, false
+		}
+		p, err := strconv.ParseUint(hex[:2], 16, 8)
+		if err != nil {
+			return 0, 0, false
+		}
+		l, err := strconv.ParseUint(hex[4:], 16, 8)
+		if err != nil {
+			return 0, 0, false
+		}
+		return p, l, true
+	}
+
+	declaredProfile, declaredLevel, ok := parse(declared)
+	if !ok {
+		return ""
+	}
+	profile, level, ok := parse(found)
+	switch {
+	case !ok:
+	case profile != declaredProfile:
+		return fmt.Sprintf("CODECS declares H.264 profile %d as %s, segments are profile %d as %s", declaredProfile, declared, profile, found)
+	case level > declaredLevel:
+		return fmt.Sprintf("CODECS declares H.264 level %.1f as %s, segments need level %.1f as %s", float64(declaredLevel)/10, declared, float64(level)/10, found)
+	}
+	return ""
+}
+
+// readContent sets the codecs and resolution of the decrypted TS segment
+// body on result under --deep-check.
+func (v *Verifier) readContent(result *SegmentResult, body []byte) {
+	if v.opts.DeepCheck {
+		result.content = tsContent(body)
+	}
+}
+
+// VerifyCodecDeclaration errors when the codecs and resolution found on the
+// segments of media, or declared by its init segments, don't match the
+// CODECS and RESOLUTION of variant. checked is false when nothing was found
+// to compare them with.
+func (v *Verifier) VerifyCodecDeclaration(variant *m3u8.Variant, media *MediaResult) (checked bool, err error) {
+	if variant.Codecs == "" && variant.Resolution == "" {
+		return false, nil
+	}
+	content := media.mediaContent()
+	if content == nil {
+		v.initTracksMu.Lock()
+		content = initContent(v.initTracks[media.Variant])
+		v.initTracksMu.Unlock()
+	}
+	if content == nil {
+		return false, nil
+	}
+
+	v.infof("Variant declares CODECS %q RESOLUTION %q, segments carry %s: %s", variant.Codecs, variant.Resolution, content, media.URI)
+	if err = checkCodecDeclaration(variant, content); err != nil {
+		v.errorf("Variant declarations don't match its segments: %s", media.URI)
+	}
+	return true, err
+}
+
+// recordCodecDeclaration records the comparison of the declarations of
+// variant with its rendition media as a cross check of report.
+func (v *Verifier) recordCodecDeclaration(report *Report, variant *m3u8.Variant, media *MediaResult) {
+	checked, err := v.VerifyCodecDeclaration(variant, media)
+	if !checked {
+		return
+	}
+	check := &CheckResult{Name: "codec-declaration", URI: media.URI}
+	if err != nil {
+		check.Error = err.Error()
+		v.failures.Add(ClassDeclaration, media.Variant, media.URI, err)
+	}
+	report.addCrossCheck(check)
+}
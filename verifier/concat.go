@@ -0,0 +1,145 @@
+package verifier
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// concatFile gathers the decrypted init and media segments of a rendition
+// for --concat. Segments are verified concurrently, so they're spooled to a
+// temporary file as they complete and only copied into the output file, in
+// media sequence order, once the rendition is done. A nil concatFile
+// ignores every segment, so callers don't have to check for --concat.
+type concatFile struct {
+	mu      sync.Mutex
+	spool   *os.File
+	size    int64
+	entries []concatEntry
+}
+
+// concatEntry locates an init or media segment on the spool of a
+// concatFile.
+type concatEntry struct {
+	init   bool
+	index  int
+	offset int64
+	length int64
+}
+
+// add spools data, the init segment or media segment at index.
+func (c *concatFile) add(index int, init bool, data []byte) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.spool.WriteAt(data, c.size); err != nil {
+		return err
+	}
+	c.entries = append(c.entries, concatEntry{init: init, index: index, offset: c.size, length: int64(len(data))})
+	c.size += int64(len(data))
+	return nil
+}
+
+// writeTo writes every spooled init segment, followed by every media
+// segment, each group in index order, to path. It returns the amount of
+// media segments written.
+func (c *concatFile) writeTo(path string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sort.Slice(c.entries, func(i, j int) bool {
+		if c.entries[i].init != c.entries[j].init {
+			return c.entries[i].init
+		}
+		return c.entries[i].index < c.entries[j].index
+	})
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, err
+	}
+	segments := 0
+	err := WriteFileAtomic(path, func(w io.Writer) error {
+		for _, entry := range c.entries {
+			if _, err := io.Copy(w, io.NewSectionReader(c.spool, entry.offset, entry.length)); err != nil {
+				return err
+			}
+			if !entry.init {
+				segments++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return segments, nil
+}
+
+// close removes the spool of c.
+func (c *concatFile) close() {
+	_ = c.spool.Close()
+	_ = os.Remove(c.spool.Name())
+}
+
+// openConcat starts gathering the segments of the rendition saved to
+// folder, spooling them under OutputDir.
+func (v *Verifier) openConcat(folder string) (*concatFile, error) {
+	if err := os.MkdirAll(v.opts.OutputDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	spool, err := os.CreateTemp(v.opts.OutputDir, ".concat-*")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &concatFile{spool: spool}
+	v.concatMu.Lock()
+	v.concats[folder] = c
+	v.concatMu.Unlock()
+	return c, nil
+}
+
+// concat returns the concatFile of the rendition saved to folder, or nil
+// without --concat.
+func (v *Verifier) concat(folder string) *concatFile {
+	v.concatMu.Lock()
+	defer v.concatMu.Unlock()
+	return v.concats[folder]
+}
+
+// finishConcat writes the segments gathered for folder next to it under
+// OutputDir, as an .mp4 when the rendition has init segments or a .ts
+// otherwise, and discards its spool.
+func (v *Verifier) finishConcat(uri, folder string, c *concatFile) error {
+	v.concatMu.Lock()
+	delete(v.concats, folder)
+	v.concatMu.Unlock()
+	defer c.close()
+
+	if len(c.entries) == 0 {
+		v.infof("No verified segments to concatenate for: %s", uri)
+		return nil
+	}
+
+	ext := ".ts"
+	for _, entry := range c.entries {
+		if entry.init {
+			ext = ".mp4"
+			break
+		}
+	}
+
+	path := filepath.Join(v.opts.OutputDir, folder+ext)
+	segments, err := c.writeTo(path)
+	if err != nil {
+		return err
+	}
+	v.infof("Concatenated %d segments of %s into: %s", segments, uri, path)
+	return nil
+}
@@ -0,0 +1,114 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConcatFileOrder(t *testing.T) {
+	spool, err := os.CreateTemp(t.TempDir(), ".concat-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &concatFile{spool: spool}
+	defer c.close()
+
+	// Added in completion order, written init first then by index.
+	for _, entry := range []struct {
+		index int
+		init  bool
+		data  string
+	}{
+		{2, false, "c"},
+		{0, false, "a"},
+		{1, true, "I1"},
+		{3, false, "d"},
+		{0, true, "I0"},
+		{1, false, "b"},
+	} {
+		if err := c.add(entry.index, entry.init, []byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "video_0.mp4")
+	segments, err := c.writeTo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segments != 4 {
+		t.Errorf("writeTo() wrote %d segments, want 4", segments)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "I0I1abcd" {
+		t.Errorf("writeTo() wrote %q, want %q", got, "I0I1abcd")
+	}
+}
+
+func TestVerifyConcatPreservesOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		save bool
+	}{
+		{name: "concat", save: false},
+		{name: "concat and save", save: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const n = 6
+			stream := newTestStream(t)
+			plains := stream.addMedia("/media/index.m3u8", n)
+			// Earlier segments are served later, so they complete out of order.
+			for i := 0; i < n; i++ {
+				path := fmt.Sprintf("/media/seg%d.ts", i)
+				body := stream.files[path]
+				delay := time.Duration(n-i) * 5 * time.Millisecond
+				stream.handle(path, func(w http.ResponseWriter, r *http.Request) {
+					time.Sleep(delay)
+					_, _ = w.Write(body)
+				})
+			}
+
+			v := newTestVerifier(t, func(opts *Options) {
+				opts.Concat = true
+				opts.SaveSegments = tt.save
+				opts.Concurrency = n
+			})
+			if _, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8")); err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+
+			concatenated, err := filepath.Glob(filepath.Join(v.opts.OutputDir, "*.ts"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(concatenated) != 1 {
+				t.Fatalf("concatenated files %v, want one", concatenated)
+			}
+			got, err := os.ReadFile(concatenated[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, bytes.Join(plains, nil)) {
+				t.Errorf("concatenated %d bytes, want every decrypted segment in order", len(got))
+			}
+
+			saved, err := filepath.Glob(filepath.Join(v.opts.OutputDir, "*", "segment*.m4f"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if tt.save {
+				want = n
+			}
+			if len(saved) != want {
+				t.Errorf("saved %d segments, want %d", len(saved), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package verifier
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// errContainer is returned by DecodeSegment when a decrypted segment isn't a
+// well formed media container.
+var errContainer = errors.New("segment container invalid")
+
+// validateContainer checks that a decrypted segment is a structurally valid
+// MPEG-TS, fragmented MP4, packed audio or WebVTT segment. Up to a block of
+// trailing bytes is tolerated, as it may be padding.
+func validateContainer(body []byte) error {
+	switch {
+	case len(body) > 0 && body[0] == tsSyncByte:
+		return validateTransportStream(body)
+	case len(body) >= 8 && isBoxType(body[4:8]):
+		return validateFragment(body)
+	case bytes.HasPrefix(body, []byte("WEBVTT")) || bytes.HasPrefix(body, []byte("\xef\xbb\xbfWEBVTT")):
+		return nil
+	}
+
+	if _, err := parseAudioFrame(skipID3(body)); err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%w: unrecognized container", errContainer)
+}
+
+// validateTransportStream checks that every packet of a TS segment is sync
+// aligned, that the continuity counter of every PID is unbroken and that the
+// segment carries a PAT and the PMT it lists, so it can be decoded on its
+// own.
+func validateTransportStream(body []byte) error {
+	for offset := 0; offset+tsPacketSize <= len(body); offset += tsPacketSize {
+		if body[offset] != tsSyncByte {
+			return fmt.Errorf("%w: missing sync byte on packet at offset %d", errContainer, offset)
+		}
+	}
+
+	if remainder := len(body) % tsPacketSize; remainder > 16 {
+		return fmt.Errorf("%w: %d trailing bytes after last packet", errContainer, remainder)
+	}
+
+	packets := tsPackets(body)
+	if i, ok := checkContinuity(packets); !ok {
+		return fmt.Errorf("%w: continuity counter of PID %d broken on packet at offset %d", errContainer, packets[i].PID, i*tsPacketSize)
+	}
+
+	var pmt uint16
+	var hasPAT, hasPMT bool
+	for _, p := range packets {
+		switch {
+		case p.PID == 0 && p.Start && !hasPAT:
+			pmt, hasPAT = pmtPID(psiSection(p.Payload))
+		case hasPAT && p.PID == pmt && p.Start:
+			hasPMT = true
+		}
+	}
+	switch {
+	case !hasPAT:
+		return fmt.Errorf("%w: no PAT on segment", errContainer)
+	case !hasPMT:
+		return fmt.Errorf("%w: no PMT on PID %d listed by the PAT", errContainer, pmt)
+	}
+	return nil
+}
+
+func validateBoxes(body []byte) error {
+	offset := 0
+	for len(body)-offset >= 8 {
+		size := int(binary.BigEndian.Uint32(body[offset:]))
+		boxType := body[offset+4 : offset+8]
+
+		if !isBoxType(boxType) {
+			return fmt.Errorf("%w: invalid box type at offset %d", errContainer, offset)
+		}
+
+		switch size {
+		case 0:
+			// box extends to the end of the segment
+			return nil
+		case 1:
+			if len(body)-offset < 16 {
+				return fmt.Errorf("%w: truncated %s box at offset %d", errContainer, boxType, offset)
+			}
+			size = int(binary.BigEndian.Uint64(body[offset+8:]))
+		}
+
+		if size < 8 || size > len(body)-offset {
+			return fmt.Errorf("%w: %s box at offset %d overruns segment", errContainer, boxType, offset)
+		}
+		offset += size
+	}
+
+	if remainder := len(body) - offset; remainder > 16 {
+		return fmt.Errorf("%w: %d trailing bytes after last box", errContainer, remainder)
+	}
+	return nil
+}
+
+// validateInitBoxes checks that a decrypted initialization section is a
+// well formed MP4 holding the ftyp and moov boxes players need to set up
+// decoding, and no media fragments.
+func validateInitBoxes(body []byte) error {
+	if err := validateBoxes(body); err != nil {
+		return err
+	}
+
+	found := make(map[string]bool)
+	for _, box := range readBoxes(body) {
+		found[box.Type] = true
+	}
+	for _, required := range []string{"ftyp", "moov"} {
+		if !found[required] {
+			return fmt.Errorf("%w: init segment has no %s box", errContainer, required)
+		}
+	}
+	if found["moof"] {
+		return fmt.Errorf("%w: init segment holds a moof media fragment", errContainer)
+	}
+	return nil
+}
+
+// validateFragment checks that a decrypted fMP4 segment is made of well
+// formed boxes where every moof is followed by the mdat holding its samples,
+// large enough for the sample sizes its track runs declare.
+func validateFragment(body []byte) error {
+	if err := validateBoxes(body); err != nil {
+		return err
+	}
+
+	var moof *mp4Box
+	fragments := 0
+	for _, box := range readBoxes(body) {
+		switch box.Type {
+		case "moof":
+			if moof != nil {
+				return fmt.Errorf("%w: moof %d isn't followed by an mdat", errContainer, fragments)
+			}
+			box := box
+			moof = &box
+			fragments++
+		case "mdat":
+			if moof == nil {
+				if fragments == 0 {
+					return fmt.Errorf("%w: mdat before any moof", errContainer)
+				}
+				continue
+			}
+			var samples int64
+			for _, track := range fragmentTracks(moof.Data) {
+				if track.Sized {
+					samples += track.SampleBytes
+				}
+			}
+			if samples > int64(len(box.Data)) {
+				return fmt.Errorf("%w: moof %d declares %d bytes of samples but its mdat holds %d", errContainer, fragments, samples, len(box.Data))
+			}
+			moof = nil
+		}
+	}
+
+	switch {
+	case fragments == 0:
+		return fmt.Errorf("%w: no moof box on segment", errContainer)
+	case moof != nil:
+		return fmt.Errorf("%w: moof %d isn't followed by an mdat", errContainer, fragments)
+	}
+	return nil
+}
+
+// isBoxType reports whether b is a printable four character box type.
+func isBoxType(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return len(b) == 4
+}
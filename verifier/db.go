@@ -0,0 +1,104 @@
+package verifier
+
+import (
+	"database/sql"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// resultsSchema creates the table --db writes segment results to, indexed by
+// run ID and status for queries across runs.
+const resultsSchema = `
+CREATE TABLE IF NOT EXISTS segment_results (
+	run_id            TEXT    NOT NULL,
+	variant           TEXT    NOT NULL,
+	segment_index     INTEGER NOT NULL,
+	media_sequence    INTEGER NOT NULL,
+	uri               TEXT    NOT NULL,
+	key_uri           TEXT,
+	iv                TEXT,
+	method            TEXT,
+	http_status       INTEGER,
+	content_type      TEXT,
+	length            INTEGER NOT NULL,
+	decrypted_length  INTEGER NOT NULL,
+	pad_value         INTEGER NOT NULL,
+	status            TEXT    NOT NULL,
+	error             TEXT,
+	fetch_duration_ms INTEGER NOT NULL,
+	retries           INTEGER NOT NULL,
+	verified_at       TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS segment_results_run_id ON segment_results (run_id);
+CREATE INDEX IF NOT EXISTS segment_results_status ON segment_results (status);
+`
+
+const insertResult = `
+INSERT INTO segment_results (
+	run_id, variant, segment_index, media_sequence, uri, key_uri, iv, method,
+	http_status, content_type, length, decrypted_length, pad_value, status,
+	error, fetch_duration_ms, retries, verified_at
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// resultsDB stores every SegmentResult of a run on a SQLite database as it
+// completes.
+type resultsDB struct {
+	db    *sql.DB
+	runID string
+}
+
+// openResultsDB opens the SQLite database on path, creating it along with
+// its schema if absent. Results are inserted under runID.
+func openResultsDB(path, runID string) (*resultsDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, so concurrent segments share one
+	// connection instead of failing with "database is locked".
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(resultsSchema); err != nil {
+		_ = db.Close()
+		return nil, newError("unable to create --db schema: " + err.Error())
+	}
+
+	return &resultsDB{db: db, runID: runID}, nil
+}
+
+// Insert writes result under the run ID of r.
+func (r *resultsDB) Insert(result *SegmentResult) error {
+	status := "ok"
+	if !result.OK() {
+		status = string(result.Class)
+	}
+
+	_, err := r.db.Exec(
+		insertResult,
+		r.runID,
+		result.Variant,
+		result.Index,
+		int64(result.MediaSequence),
+		result.URI,
+		result.KeyURI,
+		result.IV,
+		result.Method,
+		result.HTTPStatus,
+		result.ContentType,
+		result.Length,
+		result.DecryptedLength,
+		result.PadValue,
+		status,
+		result.Error,
+		result.FetchDuration.Milliseconds(),
+		result.Retries,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+func (r *resultsDB) Close() error {
+	return r.db.Close()
+}
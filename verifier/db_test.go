@@ -0,0 +1,56 @@
+package verifier
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestResultsDB(t *testing.T) {
+	stream := newTestStream(t)
+	stream.addMedia("/media/index.m3u8", 3)
+	// Decrypts to a last byte of 0, an invalid padding.
+	stream.add("/media/seg1.ts", encryptBlocks(testKey, sequenceIV(1), make([]byte, 64)))
+
+	path := filepath.Join(t.TempDir(), "results.sqlite")
+	for _, runID := range []string{"first", "second"} {
+		v := newTestVerifier(t, func(opts *Options) {
+			opts.ResultsPath = path
+			opts.RunID = runID
+			opts.NoRecheck = true
+		})
+		if _, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8")); err == nil {
+			t.Fatalf("Verify() of run %s error = nil, want the padding failure", runID)
+		}
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"every result of every run", "SELECT COUNT(*) FROM segment_results", 6},
+		{"results of a run", "SELECT COUNT(*) FROM segment_results WHERE run_id = 'second'", 3},
+		{"failures by status", "SELECT COUNT(*) FROM segment_results WHERE status = 'padding' AND segment_index = 1", 2},
+		{"passing results", "SELECT COUNT(*) FROM segment_results WHERE status = 'ok'", 4},
+		{"indexes", "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = 'segment_results'", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int
+			if err := db.QueryRow(tt.query).Scan(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("%s = %d, want %d", tt.query, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package verifier
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+const gapTag = "#EXT-X-GAP"
+
+// gapSegments reports which segments of a media playlist, by their position
+// on raw, are marked with EXT-X-GAP, which the m3u8 package doesn't parse.
+func gapSegments(raw []byte) map[int]bool {
+	gaps := make(map[int]bool)
+	position := 0
+	gap := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == gapTag:
+			gap = true
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			if gap {
+				gaps[position] = true
+			}
+			position++
+			gap = false
+		}
+	}
+
+	return gaps
+}
+
+// skipGaps returns queue without its EXT-X-GAP segments, which are
+// intentionally absent and aren't fetched, counting them and the
+// discontinuities of queue on media.
+func (v *Verifier) skipGaps(media *MediaResult, queue []queuedSegment) []queuedSegment {
+	kept := queue[:0]
+	for _, queued := range queue {
+		if queued.segment.Discontinuity {
+			media.addDiscontinuity()
+		}
+		if queued.gap {
+			v.infof("Segment marked EXT-X-GAP, skipped: %s", queued.segment.URI)
+			media.addGap()
+			continue
+		}
+		kept = append(kept, queued)
+	}
+	return kept
+}
@@ -0,0 +1,163 @@
+package verifier
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// tsClockRate is the rate of the 90kHz clock of MPEG-TS timestamps.
+const tsClockRate = 90000
+
+// tsPTSWrap is the period at which the 33 bit PTS wraps around.
+const tsPTSWrap = 1 << 33
+
+// errDurationDrift is returned when the media of a segment lasts longer or
+// shorter than its EXTINF by more than --media-duration-tolerance, or longer
+// than the EXT-X-TARGETDURATION of its playlist.
+var errDurationDrift = errors.New("segment media duration drifts from playlist")
+
+// measureMediaDuration sets the MediaDuration of result from the decrypted
+// body of its segment under --check-media-durations, when its timestamps
+// can be read.
+func (v *Verifier) measureMediaDuration(result *SegmentResult, body []byte) {
+	if !v.opts.CheckMediaDurations {
+		return
+	}
+
+	var duration time.Duration
+	var ok bool
+	if isTransportStream(body) {
+		duration, ok = tsDuration(tsPackets(body))
+	} else {
+		v.initTracksMu.Lock()
+		duration, ok = fragmentDuration(body, v.initTracks[result.Variant])
+		v.initTracksMu.Unlock()
+	}
+
+	if !ok {
+		v.debugf("Media duration not measured, no timestamps found on segment: %s", result.URI)
+		return
+	}
+	result.MediaDuration = duration
+}
+
+// checkMediaDuration errors if the measured media duration of result drifts
+// from the EXTINF of segment by more than --media-duration-tolerance, or
+// exceeds the EXT-X-TARGETDURATION of media once rounded as the spec allows.
+func (v *Verifier) checkMediaDuration(media *MediaResult, segment *m3u8.MediaSegment, result *SegmentResult) error {
+	extinf := time.Duration(segment.Duration * float64(time.Second))
+	drift := result.MediaDuration - extinf
+	if drift < 0 {
+		drift = -drift
+	}
+
+	if drift > v.opts.MediaDurationTolerance {
+		v.errorf("Segment media lasts %s but EXTINF is %g on segment: %s", result.MediaDuration, segment.Duration, result.URI)
+		return fmt.Errorf("%w: media lasts %s, EXTINF is %g", errDurationDrift, result.MediaDuration, segment.Duration)
+	}
+
+	if target := media.TargetDuration; target > 0 && math.Round(result.MediaDuration.Seconds()) > target {
+		v.errorf("Segment media lasts %s, above EXT-X-TARGETDURATION %g on segment: %s", result.MediaDuration, target, result.URI)
+		return fmt.Errorf("%w: media lasts %s, above EXT-X-TARGETDURATION %g", errDurationDrift, result.MediaDuration, target)
+	}
+
+	v.debugf("Segment media lasts %s, EXTINF is %g on segment: %s", result.MediaDuration, segment.Duration, result.URI)
+	return nil
+}
+
+// tsDuration returns how long the longest elementary stream of packets
+// lasts, from the first PTS of its PES packets to the last one, plus the
+// typical gap between them for the duration of the last PES.
+func tsDuration(packets []tsPacket) (time.Duration, bool) {
+	streams := segmentStreams(packets)
+	timestamps := make(map[uint16][]int64)
+	for _, p := range packets {
+		if _, ok := streams[p.PID]; !ok || !p.Start {
+			continue
+		}
+		if pts, ok := pesPTS(p.Payload); ok {
+			timestamps[p.PID] = append(timestamps[p.PID], pts)
+		}
+	}
+
+	var longest int64
+	for _, pts := range timestamps {
+		if ticks, ok := ptsSpan(pts); ok && ticks > longest {
+			longest = ticks
+		}
+	}
+	if longest == 0 {
+		return 0, false
+	}
+	return time.Duration(longest) * time.Second / tsClockRate, true
+}
+
+// ptsSpan returns the 90kHz ticks covered by the PES timestamps pts of a
+// stream, which needs at least two of them. Timestamps are unwrapped
+// against the first one and sorted, as B-frames are sent out of
+// presentation order.
+func ptsSpan(pts []int64) (int64, bool) {
+	if len(pts) < 2 {
+		return 0, false
+	}
+
+	unwrapped := make([]int64, len(pts))
+	for i, value := range pts {
+		if value < pts[0]-tsPTSWrap/2 {
+			value += tsPTSWrap
+		}
+		unwrapped[i] = value
+	}
+	sort.Slice(unwrapped, func(i, k int) bool { return unwrapped[i] < unwrapped[k] })
+
+	gaps := make([]int64, 0, len(unwrapped)-1)
+	for i := 1; i < len(unwrapped); i++ {
+		gaps = append(gaps, unwrapped[i]-unwrapped[i-1])
+	}
+	sort.Slice(gaps, func(i, k int) bool { return gaps[i] < gaps[k] })
+
+	return unwrapped[len(unwrapped)-1] - unwrapped[0] + gaps[len(gaps)/2], true
+}
+
+// pesPTS returns the PTS of the PES packet starting data, when it has one.
+func pesPTS(data []byte) (int64, bool) {
+	if len(data) < 14 || data[0] != 0 || data[1] != 0 || data[2] != 1 || data[7]&0x80 == 0 {
+		return 0, false
+	}
+
+	return int64(data[9]>>1&0x07)<<30 |
+		int64(data[10])<<22 |
+		int64(data[11]>>1)<<15 |
+		int64(data[12])<<7 |
+		int64(data[13]>>1), true
+}
+
+// fragmentDuration returns how long the longest track of the fMP4 segment
+// body lasts, from the sample durations of its track fragments in the
+// timescale of tracks, the ones declared by the init segment.
+func fragmentDuration(body []byte, tracks map[uint32]initTrack) (time.Duration, bool) {
+	ticks := make(map[uint32]uint64)
+	for _, moof := range childBoxes(body, "moof") {
+		for _, fragment := range fragmentTracks(moof.Data) {
+			track, ok := tracks[fragment.ID]
+			if !ok || track.Timescale == 0 {
+				continue
+			}
+			ticks[fragment.ID] += fragment.Ticks + uint64(fragment.Untimed)*uint64(track.DefaultDuration)
+		}
+	}
+
+	var longest time.Duration
+	for id, total := range ticks {
+		duration := time.Duration(float64(total) / float64(tracks[id].Timescale) * float64(time.Second))
+		if duration > longest {
+			longest = duration
+		}
+	}
+	return longest, longest > 0
+}
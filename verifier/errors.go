@@ -0,0 +1,265 @@
+package verifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrorClass categorizes the failures recorded on a MultiError.
+type ErrorClass string
+
+// Failure classes recorded while verifying a manifest.
+const (
+	ClassMedia     ErrorClass = "media"
+	ClassPlaylist  ErrorClass = "playlist"
+	ClassSegment   ErrorClass = "segment"
+	ClassPadding   ErrorClass = "padding"
+	ClassContainer ErrorClass = "container"
+	ClassDominant  ErrorClass = "dominant-byte"
+	ClassGzip      ErrorClass = "gzip"
+	ClassAlignment ErrorClass = "alignment"
+	ClassMethod    ErrorClass = "method"
+	ClassDuration  ErrorClass = "duration"
+	ClassDecode    ErrorClass = "decode"
+	ClassHTTP      ErrorClass = "http"
+	ClassTransient ErrorClass = "transient"
+
+	ClassInit        ErrorClass = "init"
+	ClassDeclaration ErrorClass = "declaration"
+	ClassCompliance  ErrorClass = "compliance"
+	ClassLive        ErrorClass = "live"
+	ClassOrigin      ErrorClass = "origin"
+	ClassLadder      ErrorClass = "ladder"
+	ClassChecksum    ErrorClass = "checksum"
+	ClassSubtitle    ErrorClass = "subtitle"
+	ClassPanic       ErrorClass = "panic"
+	ClassStopped     ErrorClass = "stopped"
+	ClassStalled     ErrorClass = "stalled"
+)
+
+// errPadding is returned by DecodeSegment when a segment decrypts with an
+// incorrect PKCS7 padding.
+var errPadding = errors.New("segment padding incorrect")
+
+// errDominantByte is returned by DecodeSegment when a segment with a valid
+// padding is mostly made of a single repeated byte.
+var errDominantByte = errors.New("segment dominated by a single byte")
+
+// errOriginMismatch is returned by DecodeSegment when a segment differs from
+// its copy on the --compare-origin host.
+var errOriginMismatch = errors.New("segment differs between origins")
+
+// errGzipEncoded is returned by DecodeSegment when a segment was served
+// gzip-encoded instead of as raw encrypted media.
+var errGzipEncoded = errors.New("segment is gzip-encoded, not raw media")
+
+// errBlockAlignment is returned by DecodeSegment when a segment's length
+// isn't a multiple of the AES block size, as with truncated downloads or
+// error pages served with a 200.
+var errBlockAlignment = errors.New("segment length isn't a multiple of the AES block size")
+
+// errStreamStalled is recorded when a followed playlist goes --poll-timeout
+// without new segments.
+var errStreamStalled = errors.New("stream stalled")
+
+// errHTTPStatus is returned when a request is answered with a 4xx status
+// other than 429, which retrying wouldn't fix.
+var errHTTPStatus = errors.New("request failed with status")
+
+// errTransient is returned when a request keeps failing with a network
+// error, 429 or 5xx status after every retry.
+var errTransient = errors.New("transient failure")
+
+// errUnsupportedMethod is returned by DecodeSegment when a segment is
+// encrypted with a METHOD other than AES-128 or NONE.
+var errUnsupportedMethod = errors.New("unsupported encryption method")
+
+// Failure is a single categorized error, tied to the variant folder and uri
+// it happened on.
+type Failure struct {
+	Class   ErrorClass
+	Variant string
+	URI     string
+	Err     error
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("%s failure on %s (%s): %s", f.Class, f.URI, f.Variant, f.Err.Error())
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+// MultiError accumulates the failures of concurrent verifications. It's safe
+// for use by multiple goroutines.
+type MultiError struct {
+	mu       sync.Mutex
+	Failures []*Failure
+
+	// log logs recovered panics, with their stack trace at debug level.
+	log *slog.Logger
+}
+
+// Add records err under class for the given variant and uri.
+func (m *MultiError) Add(class ErrorClass, variant, uri string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Failures = append(m.Failures, &Failure{
+		Class:   class,
+		Variant: variant,
+		URI:     uri,
+		Err:     err,
+	})
+}
+
+// Len returns the amount of failures recorded.
+func (m *MultiError) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.Failures)
+}
+
+// ByVariant returns the amount of failures recorded for every variant.
+func (m *MultiError) ByVariant() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, f := range m.Failures {
+		counts[f.Variant]++
+	}
+	return counts
+}
+
+// ByClass returns the amount of failures recorded for every class.
+func (m *MultiError) ByClass() map[ErrorClass]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[ErrorClass]int)
+	for _, f := range m.Failures {
+		counts[f.Class]++
+	}
+	return counts
+}
+
+// ErrorOrNil returns m if any failure was recorded, or nil otherwise.
+func (m *MultiError) ErrorOrNil() error {
+	if m.Len() == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *MultiError) Error() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Failures are listed grouped by class, in the order each class was
+	// first seen, after a count of every class and variant.
+	var classes []ErrorClass
+	var variants []string
+	byClass := make(map[ErrorClass][]*Failure)
+	byVariant := make(map[string]int)
+	for _, f := range m.Failures {
+		if _, ok := byClass[f.Class]; !ok {
+			classes = append(classes, f.Class)
+		}
+		byClass[f.Class] = append(byClass[f.Class], f)
+		if byVariant[f.Variant] == 0 {
+			variants = append(variants, f.Variant)
+		}
+		byVariant[f.Variant]++
+	}
+
+	counts := make([]string, 0, len(classes))
+	for _, class := range classes {
+		counts = append(counts, fmt.Sprintf("%s: %d", class, len(byClass[class])))
+	}
+	sort.Strings(variants)
+	variantCounts := make([]string, 0, len(variants))
+	for _, variant := range variants {
+		variantCounts = append(variantCounts, fmt.Sprintf("%s: %d", variant, byVariant[variant]))
+	}
+
+	lines := make([]string, 0, len(m.Failures)+1)
+	lines = append(lines, fmt.Sprintf(
+		"error: %d failures found (%s) on %d variants (%s)",
+		len(m.Failures),
+		strings.Join(counts, ", "),
+		len(variants),
+		strings.Join(variantCounts, ", "),
+	))
+	for _, class := range classes {
+		for _, f := range byClass[class] {
+			lines = append(lines, "  "+f.Error())
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Recover records a panic of the calling goroutine under ClassPanic for the
+// given variant and uri, logging its stack trace in verbose mode. It must be
+// deferred directly.
+func (m *MultiError) Recover(variant, uri string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	logf(m.log, slog.LevelError, "Panic while verifying %s: %v", uri, r)
+	logf(m.log, slog.LevelDebug, "%s", debug.Stack())
+	m.Add(ClassPanic, variant, uri, fmt.Errorf("panic: %v", r))
+}
+
+// stoppedOr returns ClassStopped if ctx is done, as failures found after the
+// run was stopped are caused by it, or class otherwise.
+func stoppedOr(ctx context.Context, class ErrorClass) ErrorClass {
+	if ctx.Err() != nil {
+		return ClassStopped
+	}
+	return class
+}
+
+// classOf returns the ErrorClass a segment error belongs to.
+func classOf(err error) ErrorClass {
+	switch {
+	case errors.Is(err, errPadding):
+		return ClassPadding
+	case errors.Is(err, errContainer):
+		return ClassContainer
+	case errors.Is(err, errDominantByte):
+		return ClassDominant
+	case errors.Is(err, errOriginMismatch):
+		return ClassOrigin
+	case errors.Is(err, errChecksumMismatch):
+		return ClassChecksum
+	case errors.Is(err, errWebVTT):
+		return ClassSubtitle
+	case errors.Is(err, errGzipEncoded):
+		return ClassGzip
+	case errors.Is(err, errBlockAlignment):
+		return ClassAlignment
+	case errors.Is(err, errUnsupportedMethod):
+		return ClassMethod
+	case errors.Is(err, errDurationDrift):
+		return ClassDuration
+	case errors.Is(err, errDecode):
+		return ClassDecode
+	case errors.Is(err, errHTTPStatus):
+		return ClassHTTP
+	case errors.Is(err, errTransient):
+		return ClassTransient
+	}
+	return ClassSegment
+}
@@ -0,0 +1,342 @@
+package verifier
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fetcher sends the requests of a Verifier for the uris of a scheme,
+// answering them as an origin would. *http.Client is the one used for http
+// and https uris.
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// fileFetcher serves file uris from disk, honouring Range headers like an
+// origin would, so captured streams can be verified without a server.
+type fileFetcher struct {
+	transport http.RoundTripper
+}
+
+func newFileFetcher() fileFetcher {
+	return fileFetcher{transport: http.NewFileTransport(http.Dir("/"))}
+}
+
+func (f fileFetcher) Do(req *http.Request) (*http.Response, error) {
+	return f.transport.RoundTrip(req)
+}
+
+// newFetchers returns the fetchers of the uri schemes read from somewhere
+// other than an http origin, file uris from disk and s3 and gs ones from
+// their bucket, along with the Fetchers of the options, which take
+// precedence.
+func (v *Verifier) newFetchers() map[string]Fetcher {
+	fetchers := map[string]Fetcher{
+		"file": newFileFetcher(),
+		"s3":   newS3Fetcher(v.client),
+		"gs":   newGCSFetcher(v.client),
+	}
+	for scheme, f := range v.opts.Fetchers {
+		fetchers[strings.ToLower(scheme)] = f
+	}
+	return fetchers
+}
+
+// fetcherFor returns the Fetcher req is sent with, by the scheme of its
+// uri.
+func (v *Verifier) fetcherFor(req *http.Request) Fetcher {
+	if f, ok := v.fetchers[strings.ToLower(req.URL.Scheme)]; ok {
+		return f
+	}
+	return v.client
+}
+
+// objectRequest returns a copy of req, for an object on a bucket, sent to
+// target instead with its Authorization replaced by authorization when not
+// empty.
+func objectRequest(req *http.Request, target *url.URL, authorization string) *http.Request {
+	out := req.Clone(req.Context())
+	out.URL = target
+	out.Host = target.Host
+	out.Header.Del("Authorization")
+	if authorization != "" {
+		out.Header.Set("Authorization", authorization)
+	}
+	return out
+}
+
+// doObject sends out, the objectRequest of req, with client. The response
+// is returned as answering req, so the uris of a playlist on a bucket are
+// resolved against its own uri rather than the endpoint it was read from.
+func doObject(client *http.Client, req, out *http.Request) (*http.Response, error) {
+	res, err := client.Do(out)
+	if res != nil {
+		res.Request = req
+	}
+	return res, err
+}
+
+// fileURI returns the absolute file uri of a uri without a scheme or with a
+// file scheme, which keys and segments resolved against a local manifest
+// have.
+func fileURI(uri string) (string, bool) {
+	path, ok := localPath(uri)
+	if !ok {
+		return "", false
+	}
+
+	if u, err := url.Parse(uri); err == nil {
+		path = u.Path
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), true
+}
+
+// parseHeaders parses the "Key: Value" headers sent through --header, along
+// with userAgent, into the headers set on every request. Repeated keys are
+// all sent.
+func parseHeaders(headers, cookies []string, userAgent string) (http.Header, error) {
+	parsed, err := parseHeaderPairs("header", headers)
+	if err != nil {
+		return nil, err
+	}
+	if len(cookies) > 0 {
+		cookie, err := joinCookies(parsed.Values("Cookie"), cookies)
+		if err != nil {
+			return nil, err
+		}
+		parsed.Set("Cookie", cookie)
+	}
+	if userAgent != "" {
+		parsed.Set("User-Agent", userAgent)
+	}
+	return parsed, nil
+}
+
+// parseHeaderPairs parses the "Key: Value" pairs sent through the flag
+// named name.
+func parseHeaderPairs(name string, headers []string) (http.Header, error) {
+	parsed := make(http.Header)
+	for _, header := range headers {
+		key, value, ok := strings.Cut(header, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, newError(fmt.Sprintf("--%s must be a \"Key: Value\" pair, got: %s", name, header))
+		}
+		parsed.Add(key, strings.TrimSpace(value))
+	}
+	return parsed, nil
+}
+
+// joinCookies joins the "name=value" pairs sent through --cookie, each of
+// them holding one or more separated by semicolons, into a single Cookie
+// header after the ones already sent through --header.
+func joinCookies(sent, cookies []string) (string, error) {
+	pairs := append([]string(nil), sent...)
+	for _, cookie := range cookies {
+		for _, pair := range strings.Split(cookie, ";") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			name, _, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(name) == "" {
+				return "", newError(fmt.Sprintf("--cookie must be a \"name=value\" pair, got: %s", cookie))
+			}
+			pairs = append(pairs, pair)
+		}
+	}
+	return strings.Join(pairs, "; "), nil
+}
+
+// decodeContent decodes a body of uri served with a gzip or deflate
+// Content-Encoding. The transport only does so itself when it asked for
+// gzip, not when the origin compresses unasked or --header sets
+// Accept-Encoding.
+func (v *Verifier) decodeContent(uri, encoding string, body []byte) ([]byte, error) {
+	var zr io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		zr, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// Deflate is meant to be zlib-wrapped, but some origins send the
+		// raw stream.
+		if zr, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+			zr, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return body, nil
+	}
+	if err != nil {
+		return nil, newError(fmt.Sprintf("unable to decode %s Content-Encoding of %s: %s", encoding, uri, err.Error()))
+	}
+	defer func() { _ = zr.Close() }()
+
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, newError(fmt.Sprintf("unable to decode %s Content-Encoding of %s: %s", encoding, uri, err.Error()))
+	}
+	v.infof("Decoded %s Content-Encoding of: %s", encoding, uri)
+	return decoded, nil
+}
+
+// retryMaxDelay bounds the exponential backoff between retries of a request.
+const retryMaxDelay = 10 * time.Second
+
+// do sends req with fetcherFor, retrying network errors, 429 and 5xx
+// responses up to Retries times. Retries wait for the Retry-After of the
+// response when present, or an exponential backoff from RetryBackoff with
+// jitter otherwise. Network errors that outlast the retries are returned as
+// errTransient. A 401 or 403 is sent again once with a fresh token, under
+// TokenCommand.
+func (v *Verifier) do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	reauthorized := false
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		res, err := v.fetcherFor(req).Do(req)
+		v.logRequest(req, res, err, time.Since(start))
+		if err == nil && !reauthorized && v.reauthorize(req, res) {
+			// Sending the fresh token doesn't count as a retry.
+			reauthorized = true
+			if err = rewind(req, res); err != nil {
+				return nil, err
+			}
+			attempt--
+			continue
+		}
+		reason := retryReason(res, err)
+		if reason == "" || ctx.Err() != nil {
+			return res, err
+		}
+		if attempt >= v.opts.Retries {
+			if err != nil {
+				err = fmt.Errorf("%w after %d retries: %w", errTransient, attempt, err)
+			}
+			return res, err
+		}
+
+		wait := retryDelay(v.opts.RetryBackoff, attempt, res)
+		if err = rewind(req, res); err != nil {
+			return nil, err
+		}
+
+		v.infof("Retrying %s in %s after %s", req.URL, wait.Round(time.Millisecond), reason)
+		countRetry(ctx)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// rewind discards res, if any, and restores the body of req so it can be
+// sent again.
+func rewind(req *http.Request, res *http.Response) error {
+	if res != nil {
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+	}
+	if req.GetBody == nil {
+		return nil
+	}
+	var err error
+	req.Body, err = req.GetBody()
+	return err
+}
+
+// logRequest logs at debug level how req was answered after elapsed.
+func (v *Verifier) logRequest(req *http.Request, res *http.Response, err error, elapsed time.Duration) {
+	if err != nil {
+		v.debugf("Request %s %s failed after %s: %s", req.Method, req.URL, elapsed.Round(time.Millisecond), err.Error())
+		return
+	}
+	v.debugf("Request %s %s: %s in %s", req.Method, req.URL, res.Status, elapsed.Round(time.Millisecond))
+}
+
+// retryReason describes why a request answered with res and err should be
+// retried, or returns "" if it shouldn't.
+func retryReason(res *http.Response, err error) string {
+	var certErr *tls.CertificateVerificationError
+	switch {
+	case errors.As(err, &certErr):
+		// Certificates don't fix themselves between attempts.
+		return ""
+	case err != nil:
+		return err.Error()
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return res.Status
+	}
+	return ""
+}
+
+// checkStatus returns errHTTPStatus when res, answering uri, has a 4xx
+// status retrying wouldn't fix, or errTransient when it's still a 429 or 5xx
+// after every retry.
+func (v *Verifier) checkStatus(uri string, res *http.Response) error {
+	if res.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+
+	v.opts.Metrics.addHTTPError(res.StatusCode)
+	switch {
+	case retryReason(res, nil) != "":
+		return fmt.Errorf("%w after %d retries: %s on %s", errTransient, v.opts.Retries, res.Status, uri)
+	default:
+		return fmt.Errorf("%w %s on %s", errHTTPStatus, res.Status, uri)
+	}
+}
+
+// retryDelay returns how long to wait before retrying a request for the
+// attempt-th time, doubling base on every attempt or honouring the
+// Retry-After header of res.
+func retryDelay(base time.Duration, attempt int, res *http.Response) time.Duration {
+	if res != nil {
+		if after := res.Header.Get("Retry-After"); after != "" {
+			if seconds, err := strconv.Atoi(after); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+			if at, err := http.ParseTime(after); err == nil {
+				if wait := time.Until(at); wait > 0 {
+					return wait
+				}
+				return 0
+			}
+		}
+	}
+
+	delay := retryMaxDelay
+	if attempt < 16 {
+		if backoff := base << attempt; backoff < delay {
+			delay = backoff
+		}
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Jitter on the upper half, so concurrent segments don't retry in
+	// lockstep.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,233 @@
+package verifier
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestVerifyLocalManifests(t *testing.T) {
+	// A master manifest packaged under local/, whose rendition, key and
+	// segments are all resolved relative to it on disk.
+	dir := t.TempDir()
+	key := []byte("0123456789abcdef")
+	files := map[string][]byte{
+		"local/master.m3u8": []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000\nvideo/index.m3u8\n"),
+		"local/key.bin":     key,
+		"local/video/index.m3u8": []byte("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"../key.bin\"\n" +
+			"#EXTINF:4.0,\nseg0.ts\n#EXTINF:4.0,\nseg1.ts\n#EXT-X-ENDLIST\n"),
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// Pseudo-random media, padded with PKCS7 and encrypted with the IV
+		// of its media sequence number.
+		var plain []byte
+		for sum := sha256.Sum256([]byte(fmt.Sprint(i))); len(plain) < 1000+i; sum = sha256.Sum256(sum[:]) {
+			plain = append(plain, sum[:]...)
+		}
+		plain = plain[:1000+i]
+		padding := aes.BlockSize - len(plain)%aes.BlockSize
+		plain = append(plain, bytes.Repeat([]byte{byte(padding)}, padding)...)
+		cipher.NewCBCEncrypter(block, sequenceIV(uint64(i))).CryptBlocks(plain, plain)
+		files[fmt.Sprintf("local/video/seg%d.ts", i)] = plain
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, body, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(cwd) })
+
+	master := filepath.Join(dir, "local", "master.m3u8")
+	tests := []struct {
+		name string
+		uri  string
+	}{
+		{name: "relative path", uri: "./local/master.m3u8"},
+		{name: "absolute path", uri: master},
+		{name: "file url", uri: (&url.URL{Scheme: "file", Path: filepath.ToSlash(master)}).String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.OutputDir = t.TempDir()
+			v, err := New(opts)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			report, err := v.Verify(context.Background(), tt.uri)
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if report.Totals.Verified != 2 || report.Totals.Failed != 0 {
+				t.Errorf("Verify() verified %d and failed %d segments, want 2 and 0", report.Totals.Verified, report.Totals.Failed)
+			}
+		})
+	}
+}
+
+// flakyTransport is an http.RoundTripper failing the first requests of a
+// path, either with a network error or with a response of status.
+type flakyTransport struct {
+	path     string
+	failures int
+	status   int
+
+	mu   sync.Mutex
+	sent int
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != f.path {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	f.mu.Lock()
+	f.sent++
+	fail := f.sent <= f.failures
+	f.mu.Unlock()
+
+	switch {
+	case !fail:
+		return http.DefaultTransport.RoundTrip(req)
+	case f.status == 0:
+		return nil, errors.New("connection reset by peer")
+	}
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = res.Body.Close()
+	res.StatusCode, res.Status = f.status, fmt.Sprintf("%d %s", f.status, http.StatusText(f.status))
+	res.Body = http.NoBody
+	return res, nil
+}
+
+func TestDoRetriesTransientFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		failures int
+		status   int
+		wantSent int
+		wantErr  ErrorClass
+	}{
+		{name: "segment network error", path: "/media/seg1.ts", failures: 2, wantSent: 3},
+		{name: "segment 503", path: "/media/seg1.ts", failures: 2, status: http.StatusServiceUnavailable, wantSent: 3},
+		{name: "segment 429", path: "/media/seg1.ts", failures: 2, status: http.StatusTooManyRequests, wantSent: 3},
+		{name: "key 502", path: "/media/key.bin", failures: 2, status: http.StatusBadGateway, wantSent: 3},
+		{name: "playlist network error", path: "/media/index.m3u8", failures: 2, wantSent: 3},
+		{name: "segment 503 past the retries", path: "/media/seg1.ts", failures: 4, status: http.StatusServiceUnavailable, wantSent: 4, wantErr: ClassTransient},
+		{name: "segment 404 isn't retried", path: "/media/seg1.ts", failures: 1, status: http.StatusNotFound, wantSent: 1, wantErr: ClassHTTP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.addMedia("/media/index.m3u8", 3)
+
+			transport := &flakyTransport{path: tt.path, failures: tt.failures, status: tt.status}
+			v := newTestVerifier(t, func(opts *Options) {
+				opts.Client = &http.Client{Transport: transport}
+				opts.Retries = 3
+				opts.NoRecheck = true
+			})
+			report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+			if transport.sent != tt.wantSent {
+				t.Errorf("%s was sent %d times, want %d", tt.path, transport.sent, tt.wantSent)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Verify() error = %v", err)
+				}
+				if report.Totals.Verified != 3 {
+					t.Errorf("Verify() verified %d segments, want 3", report.Totals.Verified)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("Verify() error = nil, want a %s failure", tt.wantErr)
+			}
+			if segment := report.Variants[0].Segments[1]; segment.Class != tt.wantErr {
+				t.Errorf("segment 1 failed as %q, want %q", segment.Class, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyDecodesContentEncoding(t *testing.T) {
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"raw deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+	}
+	tests := []struct {
+		name     string
+		encoder  string
+		encoding string
+	}{
+		{name: "gzip", encoder: "gzip", encoding: "gzip"},
+		{name: "x-gzip", encoder: "gzip", encoding: "x-gzip"},
+		{name: "deflate", encoder: "deflate", encoding: "deflate"},
+		{name: "raw deflate", encoder: "raw deflate", encoding: "deflate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.addMedia("/media/index.m3u8", 2)
+			for _, path := range []string{"/media/index.m3u8", "/media/key.bin"} {
+				var encoded bytes.Buffer
+				zw := encoders[tt.encoder](&encoded)
+				_, _ = zw.Write(stream.files[path])
+				_ = zw.Close()
+				stream.handle(path, func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Encoding", tt.encoding)
+					_, _ = w.Write(encoded.Bytes())
+				})
+			}
+
+			v := newTestVerifier(t, nil)
+			report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if report.Totals.Verified != 2 {
+				t.Errorf("Verify() verified %d segments, want 2", report.Totals.Verified)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// errDecode is returned by DecodeSegment when ffprobe can't decode a
+// segment under --ffprobe, as with corruption introduced by the encoder that
+// neither its padding nor its container reveal.
+var errDecode = errors.New("segment failed to decode")
+
+// maxProbeErrors bounds the decode errors of a segment kept on its
+// ProbeResult, as a corrupted segment can log one per frame.
+const maxProbeErrors = 10
+
+// ProbeResult is what ffprobe found decoding a segment under --ffprobe:
+// its streams and the errors logged while decoding them.
+type ProbeResult struct {
+	Streams []ProbeStream `json:"streams"`
+	Errors  []string      `json:"errors,omitempty"`
+}
+
+// ProbeStream is a stream of a segment as read by ffprobe, with the amount
+// of frames it decoded.
+type ProbeStream struct {
+	Index  int    `json:"index"`
+	Type   string `json:"type"`
+	Codec  string `json:"codec"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Frames int    `json:"frames"`
+}
+
+func (p *ProbeResult) String() string {
+	streams := make([]string, 0, len(p.Streams))
+	for _, s := range p.Streams {
+		stream := s.Codec
+		if s.Width > 0 && s.Height > 0 {
+			stream += fmt.Sprintf(" %dx%d", s.Width, s.Height)
+		}
+		streams = append(streams, fmt.Sprintf("%s %d frames", stream, s.Frames))
+	}
+	return strings.Join(streams, ", ")
+}
+
+// frames returns the amount of frames decoded across every stream of p.
+func (p *ProbeResult) frames() int {
+	frames := 0
+	for _, s := range p.Streams {
+		frames += s.Frames
+	}
+	return frames
+}
+
+// probeSegment decodes the decrypted body of the segment of result with
+// ffprobe under --ffprobe, recording what it found on result. fMP4 segments
+// are probed with their init segment prepended. It errors with errDecode
+// when ffprobe logged errors or decoded no frames at all.
+func (v *Verifier) probeSegment(ctx context.Context, result *SegmentResult, body []byte) error {
+	if !v.opts.FFprobe || len(body) == 0 {
+		return nil
+	}
+
+	input := body
+	if !isTransportStream(body) {
+		if init := v.initBody(result.Variant, result.initMap); init != nil {
+			input = append(append(make([]byte, 0, len(init)+len(body)), init...), body...)
+		}
+	}
+
+	probe, err := v.runFFprobe(ctx, input)
+	if err != nil {
+		return err
+	}
+	result.Probe = probe
+
+	var decodeErr error
+	switch {
+	case len(probe.Errors) > 0:
+		decodeErr = fmt.Errorf("%w: %s", errDecode, strings.Join(probe.Errors, "; "))
+	case probe.frames() == 0:
+		decodeErr = fmt.Errorf("%w: no frames decoded", errDecode)
+	}
+	if decodeErr == nil {
+		v.debugf("Segment decoded by ffprobe, %s: %s", probe, result.URI)
+		return nil
+	}
+
+	v.errorf("Segment failed to decode with ffprobe on segment: %s", result.URI)
+	if err = v.output.Write(result.Variant, result.Index, SegmentInvalid, body); err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+// runFFprobe pipes input into the FFprobePath of v, decoding every frame to
+// count them. Whatever ffprobe logs at error level is a decode error.
+func (v *Verifier) runFFprobe(ctx context.Context, input []byte) (*ProbeResult, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(
+		ctx,
+		v.opts.FFprobePath,
+		"-v", "error",
+		"-count_frames",
+		"-show_entries", "stream=index,codec_type,codec_name,width,height,nb_read_frames",
+		"-of", "json",
+		"-i", "pipe:0",
+	)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	runErr := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	probe := &ProbeResult{}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" && len(probe.Errors) < maxProbeErrors {
+			probe.Errors = append(probe.Errors, line)
+		}
+	}
+	if runErr != nil && len(probe.Errors) == 0 {
+		return nil, newError(fmt.Sprintf("unable to run --ffprobe-path %s: %s", v.opts.FFprobePath, runErr.Error()))
+	}
+
+	var output struct {
+		Streams []struct {
+			Index  int    `json:"index"`
+			Type   string `json:"codec_type"`
+			Codec  string `json:"codec_name"`
+			Width  int    `json:"width"`
+			Height int    `json:"height"`
+			Frames string `json:"nb_read_frames"`
+		} `json:"streams"`
+	}
+	if stdout.Len() > 0 {
+		if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+			return nil, newError("unable to parse the output of ffprobe: " + err.Error())
+		}
+	}
+	for _, s := range output.Streams {
+		frames, _ := strconv.Atoi(s.Frames)
+		probe.Streams = append(probe.Streams, ProbeStream{
+			Index:  s.Index,
+			Type:   s.Type,
+			Codec:  s.Codec,
+			Width:  s.Width,
+			Height: s.Height,
+			Frames: frames,
+		})
+	}
+	return probe, nil
+}
+
+// addInitBody records the decrypted body of the init segment m of folder
+// under --ffprobe, prepended to the fMP4 segments it initializes.
+func (v *Verifier) addInitBody(folder string, m *m3u8.Map, body []byte) {
+	if !v.opts.FFprobe || m == nil {
+		return
+	}
+	v.initTracksMu.Lock()
+	defer v.initTracksMu.Unlock()
+
+	bodies := v.initBodies[folder]
+	if bodies == nil {
+		bodies = make(map[m3u8.Map][]byte)
+		v.initBodies[folder] = bodies
+	}
+	bodies[*m] = append([]byte(nil), body...)
+}
+
+// initBody returns the body of the init segment m of folder, or of its only
+// init segment when m is nil or unknown, as for partial segments.
+func (v *Verifier) initBody(folder string, m *m3u8.Map) []byte {
+	v.initTracksMu.Lock()
+	defer v.initTracksMu.Unlock()
+
+	bodies := v.initBodies[folder]
+	if m != nil {
+		if body, ok := bodies[*m]; ok {
+			return body
+		}
+	}
+	if len(bodies) == 1 {
+		for _, body := range bodies {
+			return body
+		}
+	}
+	return nil
+}
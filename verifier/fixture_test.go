@@ -0,0 +1,252 @@
+package verifier
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKey is the AES-128 key the segments of a testStream are encrypted
+// with.
+var testKey = []byte("0123456789abcdef")
+
+// testStream is an HLS origin serving the files added to it with an ETag,
+// recording every request it's sent.
+type testStream struct {
+	*httptest.Server
+
+	// delay holds every response back, so requests overlap.
+	delay time.Duration
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	handlers map[string]http.HandlerFunc
+	requests []*http.Request
+}
+
+func newTestStream(t *testing.T) *testStream {
+	t.Helper()
+	return startTestStream(t, false)
+}
+
+// newTLSTestStream returns a testStream served over https with a self-signed
+// certificate.
+func newTLSTestStream(t *testing.T) *testStream {
+	t.Helper()
+	return startTestStream(t, true)
+}
+
+func startTestStream(t *testing.T, tls bool) *testStream {
+	s := &testStream{files: make(map[string][]byte), handlers: make(map[string]http.HandlerFunc)}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	// Rejected handshakes are expected, not worth logging.
+	s.Config.ErrorLog = log.New(io.Discard, "", 0)
+	if tls {
+		s.StartTLS()
+	} else {
+		s.Start()
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testStream) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Clone(r.Context()))
+	handler, handled := s.handlers[r.URL.Path]
+	body, ok := s.files[r.URL.Path]
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+	switch {
+	case handled:
+		handler(w, r)
+	case ok:
+		// The ETag lets conditional requests be answered as unchanged.
+		sum := sha256.Sum256(body)
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum[:8]))
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(body))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// add serves body on path.
+func (s *testStream) add(path string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = body
+}
+
+// handle serves path with handler instead of a file.
+func (s *testStream) handle(path string, handler http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[path] = handler
+}
+
+// uri returns the absolute uri of path on s.
+func (s *testStream) uri(path string) string {
+	return s.URL + path
+}
+
+// requestsTo returns the requests sent for path, in the order they were
+// received.
+func (s *testStream) requestsTo(path string) []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var requests []*http.Request
+	for _, r := range s.requests {
+		if r.URL.Path == path {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// addMedia serves an AES-128 media playlist on path with n segments next to
+// it, seg0.ts onwards, encrypted with testKey served on key.bin, returning
+// the plain bodies of the segments.
+func (s *testStream) addMedia(path string, n int) [][]byte {
+	dir := path[:strings.LastIndex(path, "/")+1]
+	s.add(dir+"key.bin", testKey)
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n")
+	playlist.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n")
+	plains := make([][]byte, n)
+	for i := range plains {
+		plains[i] = testPlain(i, 1000+i)
+		s.add(fmt.Sprintf("%sseg%d.ts", dir, i), encryptSegment(testKey, sequenceIV(uint64(i)), plains[i]))
+		fmt.Fprintf(&playlist, "#EXTINF:4.0,\nseg%d.ts\n", i)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	s.add(path, []byte(playlist.String()))
+	return plains
+}
+
+// testPlain returns n pseudo-random bytes seeded by seed, standing in for
+// the media of a segment without any dominant byte.
+func testPlain(seed, n int) []byte {
+	plain := make([]byte, 0, n+sha256.Size)
+	block := sha256.Sum256([]byte(fmt.Sprint(seed)))
+	for len(plain) < n {
+		plain = append(plain, block[:]...)
+		block = sha256.Sum256(block[:])
+	}
+	return plain[:n]
+}
+
+// encryptSegment pads plain with PKCS7 and encrypts it with AES-128 CBC.
+func encryptSegment(key, iv, plain []byte) []byte {
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	return encryptBlocks(key, iv, append(append([]byte(nil), plain...), bytes.Repeat([]byte{byte(padding)}, padding)...))
+}
+
+// encryptBlocks encrypts body, made of whole blocks, with AES-128 CBC and no
+// padding.
+func encryptBlocks(key, iv, body []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	encrypted := make([]byte, len(body))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, body)
+	return encrypted
+}
+
+// newTestVerifier returns a Verifier of media playlists with the default
+// options changed by set, saving under a temporary folder and logging
+// nowhere.
+func newTestVerifier(t *testing.T, set func(*Options)) *Verifier {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.ManifestType = "media"
+	opts.OutputDir = t.TempDir()
+	opts.RetryBackoff = time.Millisecond
+	opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if set != nil {
+		set(&opts)
+	}
+
+	v, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return v
+}
+
+// countingTransport is an http.RoundTripper counting the requests sent
+// through it by path, along with the most segment requests ever in flight at
+// once, from being sent until their body is closed. Playlists are loaded
+// outside the worker pool, so they aren't part of the latter.
+type countingTransport struct {
+	next http.RoundTripper
+
+	mu          sync.Mutex
+	byPath      map[string]int
+	inFlight    int
+	maxInFlight int
+}
+
+func newCountingTransport() *countingTransport {
+	return &countingTransport{next: http.DefaultTransport, byPath: make(map[string]int)}
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	segment := strings.HasSuffix(req.URL.Path, ".ts")
+	c.mu.Lock()
+	c.byPath[req.URL.Path]++
+	if segment {
+		c.inFlight++
+		c.maxInFlight = max(c.maxInFlight, c.inFlight)
+	}
+	c.mu.Unlock()
+
+	res, err := c.next.RoundTrip(req)
+	if !segment {
+		return res, err
+	}
+	if err != nil {
+		c.done()
+		return nil, err
+	}
+	res.Body = &countedBody{ReadCloser: res.Body, done: c.done}
+	return res, nil
+}
+
+func (c *countingTransport) count(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.byPath[path]
+}
+
+// done records the end of a segment request, once its body is closed.
+func (c *countingTransport) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+}
+
+type countedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *countedBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
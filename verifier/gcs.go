@@ -0,0 +1,235 @@
+package verifier
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsEndpoint      = "https://storage.googleapis.com"
+	gcsReadOnlyScope = "https://www.googleapis.com/auth/devstorage.read_only"
+	googleTokenURI   = "https://oauth2.googleapis.com/token"
+	gceTokenURI      = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// googleToken is an OAuth access token GCS requests are authorized with,
+// valid until Expires when it's set.
+type googleToken struct {
+	AccessToken string
+	Expires     time.Time
+}
+
+// gcsFetcher reads gs://bucket/object uris from their bucket through the
+// XML API, which answers Range and conditional requests like an origin.
+// Requests are authorized the way Google client libraries do: with the
+// GOOGLE_OAUTH_ACCESS_TOKEN environment, the service account or user of
+// the application default credentials, or the service account of the GCE
+// instance. STORAGE_EMULATOR_HOST points it to an unauthenticated emulator.
+type gcsFetcher struct {
+	client   *http.Client
+	endpoint string
+	emulated bool
+
+	mu    sync.Mutex
+	token *googleToken
+}
+
+func newGCSFetcher(client *http.Client) *gcsFetcher {
+	f := &gcsFetcher{client: client, endpoint: gcsEndpoint}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		f.endpoint, f.emulated = strings.TrimSuffix(host, "/"), true
+	}
+	return f
+}
+
+func (f *gcsFetcher) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "" {
+		return nil, newError("gs uri without a bucket: " + req.URL.String())
+	}
+	target, err := url.Parse(f.endpoint + "/" + req.URL.Host + escapeObjectPath(req.URL.Path))
+	if err != nil {
+		return nil, err
+	}
+	target.RawQuery = req.URL.RawQuery
+
+	authorization := ""
+	if !f.emulated {
+		token, err := f.accessToken(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		authorization = "Bearer " + token
+	}
+	return doObject(f.client, req, objectRequest(req, target, authorization))
+}
+
+// accessToken returns the token requests are authorized with, requesting a
+// new one once it expires.
+func (f *gcsFetcher) accessToken(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.token != nil && (f.token.Expires.IsZero() || time.Until(f.token.Expires) > time.Minute) {
+		return f.token.AccessToken, nil
+	}
+	token, err := f.lookupToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	f.token = token
+	return token.AccessToken, nil
+}
+
+func (f *gcsFetcher) lookupToken(ctx context.Context) (*googleToken, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return &googleToken{AccessToken: token}, nil
+	}
+
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			path = filepath.Join(dir, "gcloud", "application_default_credentials.json")
+		}
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		return f.credentialsToken(ctx, path, data)
+	} else if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gceTokenURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	body, err := readMetadata(&http.Client{Timeout: metadataTimeout}, req)
+	if err != nil {
+		return nil, newError("no Google credentials for gs uris, set GOOGLE_APPLICATION_CREDENTIALS, GOOGLE_OAUTH_ACCESS_TOKEN or run on GCE: " + err.Error())
+	}
+	return parseGoogleToken(gceTokenURI, []byte(body))
+}
+
+// credentialsToken exchanges the service account or authorized user
+// credentials file on path, holding data, for an access token.
+func (f *gcsFetcher) credentialsToken(ctx context.Context, path string, data []byte) (*googleToken, error) {
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, newError("invalid Google credentials file " + path + ": " + err.Error())
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = googleTokenURI
+	}
+
+	form := url.Values{}
+	switch creds.Type {
+	case "service_account":
+		assertion, err := serviceAccountAssertion(creds.ClientEmail, creds.PrivateKey, creds.TokenURI, time.Now())
+		if err != nil {
+			return nil, newError("invalid service account key on " + path + ": " + err.Error())
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientID)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	default:
+		return nil, newError("unsupported Google credentials type " + creds.Type + " on " + path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, creds.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := readMetadata(f.client, req)
+	if err != nil {
+		return nil, newError("unable to get a Google access token with " + path + ": " + err.Error())
+	}
+	return parseGoogleToken(creds.TokenURI, []byte(body))
+}
+
+// serviceAccountAssertion returns the signed JWT a service account requests
+// a read-only storage token with, at now.
+func serviceAccountAssertion(email, privateKey, audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return "", newError("no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return "", err
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", newError("service account key isn't RSA")
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": gcsReadOnlyScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
+
+// parseGoogleToken parses the OAuth token response of uri.
+func parseGoogleToken(uri string, body []byte) (*googleToken, error) {
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.AccessToken == "" {
+		return nil, newError("invalid Google access token from " + uri)
+	}
+	token := &googleToken{AccessToken: res.AccessToken}
+	if res.ExpiresIn > 0 {
+		token.Expires = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
@@ -0,0 +1,370 @@
+package verifier
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// htmlPage is the document written by WriteHTML, with a section per
+// manifest.
+type htmlPage struct {
+	Title     string
+	Generated string
+	Passed    bool
+	Reports   []*htmlReport
+}
+
+type htmlReport struct {
+	URI         string
+	Passed      bool
+	Error       string
+	Sampling    string
+	Totals      Totals
+	Bytes       int64
+	Renditions  []*htmlRendition
+	CrossChecks []*CheckResult
+	Keys        []*KeyResult
+}
+
+type htmlRendition struct {
+	Variant    string
+	URI        string
+	Type       string
+	Bandwidth  uint32
+	Resolution string
+	Codecs     string
+	Verified   int
+	Failed     int
+	Skipped    int
+	Cached     int
+	Passed     bool
+	Error      string
+	Throughput string
+	Rechecks   string
+	LiveErrors []*LiveError
+	Stall      *Stall
+	Segments   []*htmlSegment
+	Failures   []*htmlSegment
+	Chart      *htmlChart
+}
+
+type htmlSegment struct {
+	Index         int
+	MediaSequence uint64
+	URI           string
+	Status        string
+	Title         string
+	Class         ErrorClass
+	Error         string
+	Recheck       string
+	Tail          string
+	Link          string
+}
+
+// htmlChart is an SVG bar chart of the download bitrate of every segment of
+// a rendition, stretched to the width of the page, with the BANDWIDTH the
+// variant declares as a line when it's within the chart.
+type htmlChart struct {
+	Width      int
+	Bars       []htmlBar
+	Max        string
+	BandwidthY float64
+	Bandwidth  string
+}
+
+type htmlBar struct {
+	X, Y, Height float64
+	Status       string
+	Title        string
+}
+
+// Statuses of a segment on the timeline of the HTML report, which are also
+// the CSS classes coloring it.
+const (
+	htmlPassed      = "passed"
+	htmlCached      = "cached"
+	htmlRebuffer    = "rebuffer"
+	htmlFailed      = "failed"
+	htmlUnreachable = "unreachable"
+)
+
+// chartHeight is the height of the viewBox of a throughput chart, whose bars
+// are chartHeight at the fastest segment.
+const chartHeight = 100
+
+// WriteHTML writes r to w as a self-contained HTML document, with the
+// variant ladder, a color-coded timeline and a throughput chart of the
+// segments of every rendition, and links to its failed segments saved by
+// an FSWriter.
+func (r *Report) WriteHTML(w io.Writer) error {
+	page := &htmlPage{Title: r.URI, Passed: r.Passed}
+	page.Reports = append(page.Reports, r.htmlReport())
+	return page.write(w)
+}
+
+// WriteHTML writes b to w as a single HTML document, with the sections
+// Report.WriteHTML writes for every manifest. A manifest that couldn't be
+// verified only has its error.
+func (b *BatchReport) WriteHTML(w io.Writer) error {
+	page := &htmlPage{Title: fmt.Sprintf("%d manifests", len(b.uris)), Passed: b.Passed}
+	for _, report := range b.Reports() {
+		if err, ok := b.Errors[report.URI]; ok {
+			page.Reports = append(page.Reports, &htmlReport{URI: report.URI, Error: err})
+			continue
+		}
+		page.Reports = append(page.Reports, report.htmlReport())
+	}
+	return page.write(w)
+}
+
+func (p *htmlPage) write(w io.Writer) error {
+	p.Generated = time.Now().Format(time.RFC1123)
+	return htmlTemplate.Execute(w, p)
+}
+
+func (r *Report) htmlReport() *htmlReport {
+	report := &htmlReport{
+		URI:         r.URI,
+		Passed:      r.Passed,
+		Sampling:    r.Sampling,
+		Totals:      r.Totals,
+		Bytes:       r.Bytes,
+		CrossChecks: r.CrossChecks,
+		Keys:        r.Keys,
+	}
+	report.Totals.Elapsed = report.Totals.Elapsed.Round(time.Millisecond)
+	for _, media := range r.Renditions() {
+		report.Renditions = append(report.Renditions, media.htmlRendition(r.output))
+	}
+	return report
+}
+
+func (m *MediaResult) htmlRendition(output *FSWriter) *htmlRendition {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rendition := &htmlRendition{
+		Variant:    m.Variant,
+		URI:        m.URI,
+		Type:       m.Type,
+		Bandwidth:  m.Bandwidth,
+		Resolution: m.Resolution,
+		Codecs:     m.Codecs,
+		Verified:   m.Verified,
+		Failed:     m.Failed,
+		Skipped:    m.Skipped,
+		Cached:     m.Cached,
+		Passed:     m.Failed == 0 && m.Error == "" && len(m.LiveErrors) == 0 && m.Stall == nil,
+		Error:      m.Error,
+		Rechecks:   formatRechecks(m.Rechecks),
+		LiveErrors: m.LiveErrors,
+		Stall:      m.Stall,
+	}
+	if t := m.Throughput; t != nil {
+		rendition.Throughput = fmt.Sprintf(
+			"p50/p95/p99 of %d segments: first byte %s, download %s, bitrate %s",
+			t.Segments,
+			t.FirstByte,
+			t.Download,
+			t.Bitrate,
+		)
+	}
+
+	for _, result := range m.Segments {
+		segment := htmlSegmentOf(result)
+		if !result.OK() && output != nil {
+			// Only segments whose body failed verification are saved.
+			if file := output.path(m.Variant, result.Index, SegmentInvalid); fileExists(file) {
+				segment.Link = filepath.ToSlash(file)
+			}
+		}
+		rendition.Segments = append(rendition.Segments, segment)
+		if !result.OK() {
+			rendition.Failures = append(rendition.Failures, segment)
+		}
+	}
+	rendition.Chart = throughputChart(m.Segments, m.Bandwidth)
+	return rendition
+}
+
+func htmlSegmentOf(result *SegmentResult) *htmlSegment {
+	segment := &htmlSegment{
+		Index:         result.Index,
+		MediaSequence: result.MediaSequence,
+		URI:           result.URI,
+		Class:         result.Class,
+		Error:         result.Error,
+	}
+	if result.Recheck != nil {
+		segment.Recheck = result.Recheck.Verdict
+	}
+	if result.Tail != "" {
+		segment.Tail = fmt.Sprintf("tail %s, claimed padding %d", result.Tail, result.PadValue)
+	}
+
+	detail := fmt.Sprintf("fetched in %s, %d bytes", roundFetch(result.FetchDuration), result.Length)
+	switch {
+	case !result.OK() && (result.Class == ClassHTTP || result.Class == ClassTransient || result.Class == ClassSegment):
+		segment.Status, detail = htmlUnreachable, result.Error
+	case !result.OK():
+		segment.Status, detail = htmlFailed, result.Error
+	case result.Cached:
+		segment.Status, detail = htmlCached, "unchanged since a previous run"
+	case result.RebufferRisk:
+		segment.Status = htmlRebuffer
+		detail += fmt.Sprintf(", longer than its %s of media", result.MediaDuration)
+	default:
+		segment.Status = htmlPassed
+	}
+	if segment.Tail != "" {
+		detail += ", " + segment.Tail
+	}
+	segment.Title = fmt.Sprintf("#%d (seq %d) %s: %s", result.Index, result.MediaSequence, result.URI, detail)
+	return segment
+}
+
+// throughputChart returns the chart of the download bitrate of segments, or
+// nil when none was downloaded. bandwidth is the BANDWIDTH of the variant of
+// the segments, or 0 for other renditions.
+func throughputChart(segments []*SegmentResult, bandwidth uint32) *htmlChart {
+	var fastest int64
+	for _, segment := range segments {
+		if segment.Bitrate > fastest {
+			fastest = segment.Bitrate
+		}
+	}
+	if fastest == 0 {
+		return nil
+	}
+
+	chart := &htmlChart{Width: len(segments) * 4, Max: formatMbps(fastest)}
+	for i, segment := range segments {
+		height := chartScale(segment.Bitrate, fastest)
+		chart.Bars = append(chart.Bars, htmlBar{
+			X:      float64(i * 4),
+			Y:      chartHeight - height,
+			Height: height,
+			Status: htmlSegmentOf(segment).Status,
+			Title:  fmt.Sprintf("#%d: %s in %s", segment.Index, formatMbps(segment.Bitrate), roundFetch(segment.FetchDuration)),
+		})
+	}
+	if bandwidth > 0 && int64(bandwidth) <= fastest {
+		chart.BandwidthY = chartHeight - chartScale(int64(bandwidth), fastest)
+		chart.Bandwidth = formatMbps(int64(bandwidth))
+	}
+	return chart
+}
+
+// chartScale returns the height of bitrate on a chart topping at fastest.
+func chartScale(bitrate, fastest int64) float64 {
+	return float64(bitrate) / float64(fastest) * chartHeight
+}
+
+func formatMbps(bitrate int64) string {
+	return fmt.Sprintf("%.2f Mbps", float64(bitrate)/1e6)
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>hlseverify: {{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; word-break: break-all; }
+h2 { font-size: 1.2em; margin-top: 2em; word-break: break-all; }
+h3 { font-size: 1em; margin: 1.5em 0 0.5em; word-break: break-all; }
+table { border-collapse: collapse; margin: 0.5em 0; font-size: 0.9em; }
+th, td { border: 1px solid #ddd; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+td.error { word-break: break-word; max-width: 50em; }
+.status { font-weight: bold; padding: 0.1em 0.5em; border-radius: 3px; color: #fff; }
+.status.pass { background: #2e7d32; }
+.status.fail { background: #c62828; }
+.muted { color: #777; font-size: 0.9em; }
+.timeline { display: flex; flex-wrap: wrap; gap: 1px; margin: 0.5em 0; }
+.timeline > * { display: block; width: 8px; height: 24px; }
+.passed { background: #43a047; fill: #43a047; }
+.cached { background: #80cbc4; fill: #80cbc4; }
+.rebuffer { background: #fbc02d; fill: #fbc02d; }
+.failed { background: #e53935; fill: #e53935; }
+.unreachable { background: #6a1b9a; fill: #6a1b9a; }
+.legend span { display: inline-block; width: 10px; height: 10px; margin: 0 0.3em 0 1em; }
+svg.chart { width: 100%; height: 120px; background: #fafafa; border: 1px solid #eee; }
+svg.chart line { stroke: #1565c0; stroke-width: 1; stroke-dasharray: 4 2; }
+</style>
+</head>
+<body>
+<h1>hlseverify {{if .Passed}}<span class="status pass">PASS</span>{{else}}<span class="status fail">FAIL</span>{{end}} {{.Title}}</h1>
+<p class="muted">Generated {{.Generated}}</p>
+<p class="legend muted">
+<span class="passed"></span>passed
+<span class="cached"></span>unchanged since a previous run
+<span class="rebuffer"></span>rebuffer risk
+<span class="failed"></span>failed verification
+<span class="unreachable"></span>failed to download
+</p>
+{{range .Reports}}
+<h2>Manifest {{.URI}} {{if .Passed}}<span class="status pass">PASS</span>{{else}}<span class="status fail">FAIL</span>{{end}}</h2>
+{{if .Error}}<p>Not verified: {{.Error}}</p>{{else}}
+<p>
+{{.Totals.Renditions}} renditions, {{.Totals.Segments}} segments, {{.Totals.Verified}} verified, {{.Totals.Failed}} failed, {{.Totals.Skipped}} skipped, {{.Totals.Failures}} failures, {{.Bytes}} bytes in {{.Totals.Elapsed}}
+{{if .Sampling}}<br>Sampled with --sample {{.Sampling}}, {{.Totals.Unsampled}} segments not sampled{{end}}
+</p>
+<h3>Variant ladder</h3>
+<table>
+<tr><th>Rendition</th><th>Type</th><th>Bandwidth</th><th>Resolution</th><th>Codecs</th><th>Verified</th><th>Failed</th><th>Skipped</th><th>Status</th></tr>
+{{range .Renditions}}<tr>
+<td><a href="#{{.Variant}}">{{.Variant}}</a></td><td>{{.Type}}</td><td>{{if .Bandwidth}}{{.Bandwidth}} bps{{end}}</td><td>{{.Resolution}}</td><td>{{.Codecs}}</td>
+<td>{{.Verified}}</td><td>{{.Failed}}</td><td>{{.Skipped}}</td>
+<td>{{if .Passed}}<span class="status pass">PASS</span>{{else}}<span class="status fail">FAIL</span>{{end}}</td>
+</tr>
+{{end}}</table>
+{{range .Renditions}}
+<h3 id="{{.Variant}}">{{.Variant}} <span class="muted">{{.URI}}</span></h3>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+{{if .Segments}}<div class="timeline">{{range .Segments}}{{if .Link}}<a class="{{.Status}}" href="{{.Link}}" title="{{.Title}}"></a>{{else}}<span class="{{.Status}}" title="{{.Title}}"></span>{{end}}{{end}}</div>{{end}}
+{{with .Chart}}
+<p class="muted">Download bitrate per segment, up to {{.Max}}{{if .Bandwidth}}, dashed at the declared BANDWIDTH of {{.Bandwidth}}{{end}}</p>
+<svg class="chart" viewBox="0 0 {{.Width}} 100" preserveAspectRatio="none">
+{{range .Bars}}<rect class="{{.Status}}" x="{{.X}}" y="{{printf "%.2f" .Y}}" width="3" height="{{printf "%.2f" .Height}}"><title>{{.Title}}</title></rect>{{end}}
+{{if .Bandwidth}}<line x1="0" x2="{{.Width}}" y1="{{printf "%.2f" .BandwidthY}}" y2="{{printf "%.2f" .BandwidthY}}" vector-effect="non-scaling-stroke"></line>{{end}}
+</svg>
+{{end}}
+{{if .Throughput}}<p class="muted">{{.Throughput}}</p>{{end}}
+{{if .Cached}}<p class="muted">{{.Cached}} verified segments unchanged since a previous run, not downloaded again</p>{{end}}
+{{if .Rechecks}}<p>Rechecked failures: {{.Rechecks}}</p>{{end}}
+{{with .Stall}}<p class="error">Stream stalled at media sequence {{.MediaSequence}}, no new segments since {{.LastSeen.Format "15:04:05"}}</p>{{end}}
+{{if .LiveErrors}}<table>
+<tr><th>Live playlist error</th><th>Media sequence</th><th>At</th><th>Error</th></tr>
+{{range .LiveErrors}}<tr><td>{{.Kind}}</td><td>{{.MediaSequence}}</td><td>{{.At.Format "15:04:05"}}</td><td class="error">{{.Error}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Failures}}<table>
+<tr><th>Segment</th><th>Media sequence</th><th>Class</th><th>Error</th><th>Recheck</th><th>Saved</th></tr>
+{{range .Failures}}<tr><td>#{{.Index}} {{.URI}}</td><td>{{.MediaSequence}}</td><td>{{.Class}}</td><td class="error">{{.Error}}{{if .Tail}}<br><code>{{.Tail}}</code>{{end}}</td><td>{{.Recheck}}</td><td>{{if .Link}}<a href="{{.Link}}">{{.Link}}</a>{{end}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+{{if .CrossChecks}}<h3>Cross checks</h3>
+<table>
+<tr><th>Check</th><th>URI</th><th>Error</th></tr>
+{{range .CrossChecks}}<tr><td>{{.Name}}</td><td>{{.URI}}</td><td class="error">{{.Error}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Keys}}<h3>Keys</h3>
+<table>
+<tr><th>Key</th></tr>
+{{range .Keys}}<tr><td>{{.}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+{{end}}
+</body>
+</html>
+`))
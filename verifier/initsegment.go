@@ -0,0 +1,184 @@
+package verifier
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// encryptedInitURIs reports for every EXT-X-MAP uri of a media playlist
+// whether an AES-128 EXT-X-KEY precedes it, which per spec makes the key
+// apply to the initialization section too.
+func encryptedInitURIs(raw []byte) map[string]bool {
+	encrypted := make(map[string]bool)
+	method := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			method = normalizeMethod(m3u8.DecodeAttributeList(strings.TrimPrefix(line, "#EXT-X-KEY:"))["METHOD"])
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attrs := m3u8.DecodeAttributeList(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+			encrypted[attrs["URI"]] = method == "AES-128"
+		}
+	}
+
+	return encrypted
+}
+
+// VerifyInitSegments fetches every distinct initialization section of a
+// media playlist once, recording failures under ClassInit. Encrypted ones
+// are decrypted with the key in effect, as found by segmentKeys, on the
+// first segment referencing them and have their padding checked. Under
+// --save every one is written next to the segments of folder, so the
+// rendition can be played back.
+func (v *Verifier) VerifyInitSegments(ctx context.Context, uri string, raw []byte, mp *m3u8.MediaPlaylist, keys []*m3u8.Key, folder string) {
+	encrypted := encryptedInitURIs(raw)
+	seen := make(map[m3u8.Map]bool)
+
+	index := 0
+	for i, segment := range mp.Segments {
+		if segment == nil || segment.Map == nil || seen[*segment.Map] {
+			continue
+		}
+		seen[*segment.Map] = true
+
+		var err error
+		var mode cipher.BlockMode
+		switch key := keys[i]; {
+		case !encrypted[segment.Map.URI]:
+		case key == nil:
+			err = newError("no EXT-X-KEY applies to init segment")
+		default:
+			mode, err = v.GetCBCDecrypter(ctx, key.URI, key.IV, segment.SeqId)
+		}
+		if err == nil {
+			err = v.verifyInitSegment(ctx, uri, segment.Map, mode, folder, index)
+		}
+		if err != nil {
+			v.failures.Add(ClassInit, folder, segment.Map.URI, err)
+		}
+		index++
+	}
+}
+
+// verifyInitSegment fetches the initialization section m of the playlist
+// served from uri, decrypting it with mode unless it's nil.
+func (v *Verifier) verifyInitSegment(ctx context.Context, uri string, m *m3u8.Map, mode cipher.BlockMode, folder string, index int) error {
+	initURI, err := v.resolveSegmentURI(uri, m.URI)
+	if err != nil {
+		return err
+	}
+
+	if err = v.checkSchemeDowngrade(uri, initURI); err != nil {
+		return err
+	}
+
+	body, err := v.GetByteRange(ctx, initURI, m.Offset, m.Limit)
+	if err != nil {
+		return err
+	}
+
+	if mode == nil {
+		return v.checkInitContainer(initURI, m, folder, index, body)
+	}
+
+	if len(body) == 0 || len(body)%aes.BlockSize != 0 {
+		return newError(fmt.Sprintf("init segment length %d isn't a multiple of the block size", len(body)))
+	}
+
+	mode.CryptBlocks(body, body)
+
+	if !hasValidPadding(body) {
+		v.errorf("Init segment padding incorrect on: %s", initURI)
+		if err = v.output.Write(folder, index, InitInvalid, body); err != nil {
+			return err
+		}
+		return errPadding
+	}
+
+	return v.checkInitContainer(initURI, m, folder, index, body[:len(body)-int(body[len(body)-1])])
+}
+
+// checkInitContainer validates the boxes of the decrypted body of the init
+// segment m under --deep-check, requiring its ftyp and moov and recording
+// its tracks, and saves it under --save and --concat.
+func (v *Verifier) checkInitContainer(initURI string, m *m3u8.Map, folder string, index int, body []byte) error {
+	if v.opts.DeepCheck {
+		if err := validateInitBoxes(body); err != nil {
+			v.errorf("Init segment container invalid on: %s", initURI)
+			if writeErr := v.output.Write(folder, index, InitInvalid, body); writeErr != nil {
+				return writeErr
+			}
+			return err
+		}
+	}
+
+	if v.opts.DeepCheck || v.opts.CheckMediaDurations {
+		v.addInitTracks(folder, readInitTracks(body))
+	}
+	v.addInitBody(folder, m, body)
+
+	v.infof("Init segment verified: %s", initURI)
+	if err := v.concat(folder).add(index, true, body); err != nil {
+		return err
+	}
+	if v.opts.SaveSegments {
+		return v.output.Write(folder, index, InitValid, body)
+	}
+
+	return nil
+}
+
+// addInitTracks records the tracks declared by an init segment of folder,
+// which its fMP4 segments are checked against and timed by.
+func (v *Verifier) addInitTracks(folder string, declared map[uint32]initTrack) {
+	v.initTracksMu.Lock()
+	defer v.initTracksMu.Unlock()
+
+	tracks := v.initTracks[folder]
+	if tracks == nil {
+		tracks = make(map[uint32]initTrack)
+		v.initTracks[folder] = tracks
+	}
+	for id, track := range declared {
+		tracks[id] = track
+	}
+}
+
+// validateSegmentContainer validates the container of a decrypted segment
+// of folder, also requiring the track fragments of an fMP4 segment to
+// reference tracks declared by the init segments of folder, when known.
+func (v *Verifier) validateSegmentContainer(folder string, body []byte) error {
+	if err := validateContainer(body); err != nil {
+		return err
+	}
+	if len(body) < 8 || !isBoxType(body[4:8]) {
+		return nil
+	}
+
+	v.initTracksMu.Lock()
+	defer v.initTracksMu.Unlock()
+
+	tracks := v.initTracks[folder]
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	for _, moof := range childBoxes(body, "moof") {
+		for _, track := range fragmentTracks(moof.Data) {
+			if _, ok := tracks[track.ID]; !ok {
+				return fmt.Errorf("%w: track %d isn't declared by the init segment", errContainer, track.ID)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyInitSegments(t *testing.T) {
+	const key = "#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n"
+	const initMap = "#EXT-X-MAP:URI=\"init.mp4\"\n"
+	tests := []struct {
+		name      string
+		encrypted bool
+	}{
+		{name: "clear", encrypted: false},
+		{name: "encrypted", encrypted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTestStream(t)
+			init := testPlain(99, 700)
+			master := "#EXTM3U\n"
+			for _, name := range []string{"low", "high"} {
+				path := "/" + name + "/index.m3u8"
+				stream.addMedia(path, 4)
+				lines := initMap + key
+				body := init
+				if tt.encrypted {
+					// An EXT-X-MAP after the EXT-X-KEY is encrypted by it.
+					lines = key + initMap
+					body = encryptSegment(testKey, sequenceIV(0), init)
+				}
+				stream.add("/"+name+"/init.mp4", body)
+				stream.add(path, bytes.Replace(stream.files[path], []byte(key), []byte(lines), 1))
+				master += fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=1000000\n%s\n", strings.TrimPrefix(path, "/"))
+			}
+			stream.add("/master.m3u8", []byte(master))
+
+			v := newTestVerifier(t, func(opts *Options) {
+				opts.ManifestType = "master"
+				opts.SaveSegments = true
+			})
+			if _, err := v.Verify(context.Background(), stream.uri("/master.m3u8")); err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+
+			for _, name := range []string{"low", "high"} {
+				if got := len(stream.requestsTo("/" + name + "/init.mp4")); got != 1 {
+					t.Errorf("init segment of %s was requested %d times, want 1", name, got)
+				}
+			}
+			saved, err := filepath.Glob(filepath.Join(v.opts.OutputDir, "*", "init0.*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(saved) != 2 {
+				t.Fatalf("saved init segments %v, want one per rendition", saved)
+			}
+			for _, path := range saved {
+				if body, err := os.ReadFile(path); err != nil || !bytes.Equal(body, init) {
+					t.Errorf("saved %s doesn't hold the decrypted init segment (%v)", path, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package verifier
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// ivStrategy is an IV a segment can be decrypted with by
+// --compare-decrypt-methods.
+type ivStrategy struct {
+	Name string
+	IV   []byte
+}
+
+// ivStrategies returns the IVs a segment with sequence number seqID may
+// have been encrypted with: the one declared on the playlist, if any, the
+// one derived from its media sequence number and a zero IV.
+func ivStrategies(key *m3u8.Key, seqID uint64) []ivStrategy {
+	var strategies []ivStrategy
+
+	if key != nil && key.IV != "" {
+		if iv, err := segmentIV(key.IV, seqID); err == nil {
+			strategies = append(strategies, ivStrategy{Name: "playlist IV", IV: iv})
+		}
+	}
+
+	strategies = append(strategies, ivStrategy{Name: "sequence IV", IV: sequenceIV(seqID)})
+
+	return append(strategies, ivStrategy{Name: "zero IV", IV: make([]byte, aes.BlockSize)})
+}
+
+// CompareDecryptMethods downloads segment again and decrypts it with every
+// IV strategy, printing which ones yield a valid padding and container. It's
+// only run for failing segments, to pinpoint a wrong IV as the cause of the
+// failure.
+func (v *Verifier) CompareDecryptMethods(ctx context.Context, segment *m3u8.MediaSegment, key *m3u8.Key) {
+	uri, seqID := segment.URI, segment.SeqId
+	if key == nil || key.URI == "" {
+		v.infof("Decrypt methods not compared, no key on segment: %s", uri)
+		return
+	}
+
+	keyBytes, err := v.GetKey(ctx, key.URI)
+	if err != nil {
+		v.infof("Decrypt methods not compared, unable to fetch key for segment %s: %s", uri, err.Error())
+		return
+	}
+
+	block, err := aes.NewCipher(keyBytes)
+	if err != nil {
+		v.infof("Decrypt methods not compared, invalid key for segment %s: %s", uri, err.Error())
+		return
+	}
+
+	encrypted, err := v.GetByteRange(ctx, uri, segment.Offset, segment.Limit)
+	if err != nil {
+		v.infof("Decrypt methods not compared, unable to fetch segment %s: %s", uri, err.Error())
+		return
+	}
+
+	if len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		v.infof("Decrypt methods not compared, %d bytes aren't a multiple of the block size on segment: %s", len(encrypted), uri)
+		return
+	}
+
+	var winners []string
+	var report strings.Builder
+	for _, strategy := range ivStrategies(key, seqID) {
+		body := make([]byte, len(encrypted))
+		cipher.NewCBCDecrypter(block, strategy.IV).CryptBlocks(body, encrypted)
+
+		padding := hasValidPadding(body)
+		container := validateContainer(stripPadding(body)) == nil
+		if padding && container {
+			winners = append(winners, strategy.Name)
+		}
+		fmt.Fprintf(&report, "\n    %s %x: padding %t, container %t", strategy.Name, strategy.IV, padding, container)
+	}
+
+	winner := "none"
+	if len(winners) > 0 {
+		winner = strings.Join(winners, ", ")
+	}
+	v.infof("Decrypt methods compared on segment %s, valid with: %s%s", uri, winner, report.String())
+}
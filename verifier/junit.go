@@ -0,0 +1,159 @@
+package verifier
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// junitSuites is the root of a JUnit XML report, as read by Jenkins and
+// GitLab.
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     float64      `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteJUnit writes r to w as a JUnit XML report, with a test suite per
+// rendition and a test case per segment. A rendition whose manifest failed
+// has a failing "manifest" case, and its skipped segments a skipped one.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	suites := junitSuites{Name: r.URI, Time: r.Totals.Elapsed.Seconds()}
+	suites.add(r, "")
+	return suites.write(w)
+}
+
+// WriteJUnit writes b to w as a single JUnit XML report, with a test suite
+// per rendition of every manifest, named after its manifest too. A manifest
+// that couldn't be verified has a suite with a failing "manifest" case.
+func (b *BatchReport) WriteJUnit(w io.Writer) error {
+	suites := junitSuites{Name: "hlseverify", Time: b.Totals.Elapsed.Seconds()}
+	for _, report := range b.Reports() {
+		if err, ok := b.Errors[report.URI]; ok {
+			suites.addSuite(junitSuite{
+				Name:     report.URI,
+				Tests:    1,
+				Failures: 1,
+				Cases: []junitCase{{
+					Name:      "manifest",
+					ClassName: report.URI,
+					Failure:   &junitFailure{Type: string(ClassMedia), Message: err, Text: report.URI},
+				}},
+			})
+			continue
+		}
+		suites.add(report, report.URI+" ")
+	}
+	return suites.write(w)
+}
+
+// add appends a suite for every rendition of r, prefixing its name with
+// prefix unless the rendition is the manifest of r itself.
+func (s *junitSuites) add(r *Report, prefix string) {
+	for _, media := range r.Renditions() {
+		suite := media.junitSuite()
+		if media.URI != r.URI {
+			suite.Name = prefix + suite.Name
+		}
+		s.addSuite(suite)
+	}
+}
+
+func (s *junitSuites) addSuite(suite junitSuite) {
+	s.Tests += suite.Tests
+	s.Failures += suite.Failures
+	s.Skipped += suite.Skipped
+	s.Suites = append(s.Suites, suite)
+}
+
+// write encodes s to w as an XML document.
+func (s *junitSuites) write(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(s); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (m *MediaResult) junitSuite() junitSuite {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	suite := junitSuite{Name: m.Variant + " " + m.URI, Time: m.Elapsed.Seconds()}
+	add := func(c junitCase) {
+		suite.Tests++
+		if c.Failure != nil {
+			suite.Failures++
+		}
+		if c.Skipped != nil {
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if m.Error != "" {
+		add(junitCase{
+			Name:      "manifest",
+			ClassName: m.Variant,
+			Failure:   &junitFailure{Type: string(ClassPlaylist), Message: m.Error, Text: m.URI},
+		})
+	}
+
+	for _, segment := range m.Segments {
+		c := junitCase{
+			Name:      fmt.Sprintf("segment %d %s", segment.Index, segment.URI),
+			ClassName: m.Variant,
+			Time:      segment.FetchDuration.Round(time.Millisecond).Seconds(),
+		}
+		if !segment.OK() {
+			c.Failure = &junitFailure{Type: string(segment.Class), Message: segment.Error, Text: segment.String()}
+		}
+		add(c)
+	}
+
+	if m.Skipped > 0 {
+		add(junitCase{
+			Name:      "skipped segments",
+			ClassName: m.Variant,
+			Skipped:   &junitSkipped{Message: fmt.Sprintf("%d segments not verified", m.Skipped)},
+		})
+	}
+	return suite
+}
@@ -0,0 +1,654 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// Sources of a KeyResult.
+const (
+	KeySourceServer   = "server"
+	KeySourceDataURI  = "data-uri"
+	KeySourceSupplied = "supplied"
+)
+
+// KeyResult is how the key on URI was delivered: by its key server, with
+// the HTTP status and latency of the request, inline on a data uri or
+// supplied through --key-hex or --key-file.
+type KeyResult struct {
+	URI        string        `json:"uri"`
+	Source     string        `json:"source"`
+	HTTPStatus int           `json:"http_status,omitempty"`
+	Latency    time.Duration `json:"latency,omitempty"`
+	Length     int           `json:"length"`
+	Error      string        `json:"error,omitempty"`
+}
+
+func (k *KeyResult) String() string {
+	var s string
+	switch k.Source {
+	case KeySourceServer:
+		s = fmt.Sprintf("%s: http %d in %s, %d bytes", k.URI, k.HTTPStatus, roundFetch(k.Latency), k.Length)
+	case KeySourceDataURI:
+		s = fmt.Sprintf("%s: inline, %d bytes", preview([]byte(k.URI), 40), k.Length)
+	default:
+		s = fmt.Sprintf("%s: supplied, %d bytes", k.URI, k.Length)
+	}
+	if k.Error != "" {
+		s += ", " + k.Error
+	}
+	return s
+}
+
+// keyCache holds the keys fetched during a run, so each distinct key uri is
+// only requested once, even by concurrent callers and across renditions.
+// Failed requests aren't cached, so a timeout or 5xx on a key server is
+// retried by the next segment using the key.
+type keyCache struct {
+	mu   sync.Mutex
+	keys map[string]*cachedKey
+}
+
+type cachedKey struct {
+	mu      sync.Mutex
+	fetched bool
+	key     []byte
+	err     error
+	result  *KeyResult
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{keys: make(map[string]*cachedKey)}
+}
+
+// Len returns the amount of distinct key uris requested so far.
+func (c *keyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.keys)
+}
+
+// results returns the KeyResult of every key delivered so far, by uri.
+func (c *keyCache) results() []*KeyResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	results := make([]*KeyResult, 0, len(c.keys))
+	for _, entry := range c.keys {
+		if entry.result != nil {
+			results = append(results, entry.result)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].URI < results[j].URI })
+	return results
+}
+
+// keyOverrides are the keys supplied through --key-hex and --key-file,
+// used instead of fetching the key uris they match. Keys matching a
+// rendition are mapped to the key uris of its playlist once it's loaded.
+type keyOverrides struct {
+	mu      sync.Mutex
+	all     []byte
+	byMatch map[string][]byte
+	byURI   map[string][]byte
+}
+
+// parseKeyOverrides parses the [MATCH=]VALUE pairs of --key-hex and
+// --key-file, where MATCH is a key uri, a media playlist uri or a rendition
+// folder, and the key applies to every key uri without it. Hex keys are split
+// on the last "=", so matches may hold one, as key uris with a query do.
+// Key files are split where the rest names a file, see splitKeyFile.
+func parseKeyOverrides(hexKeys, files []string) (*keyOverrides, error) {
+	o := &keyOverrides{byMatch: make(map[string][]byte), byURI: make(map[string][]byte)}
+	add := func(flag, match, value string, decode func(string) ([]byte, error)) error {
+		key, err := decode(value)
+		if err != nil {
+			return err
+		}
+
+		_, duplicate := o.byMatch[match]
+		if match == "" {
+			duplicate, o.all = o.all != nil, key
+		} else {
+			o.byMatch[match] = key
+		}
+		switch {
+		case duplicate && match == "":
+			return newError(fmt.Sprintf("--%s supplies a second key for every key uri", flag))
+		case duplicate:
+			return newError(fmt.Sprintf("--%s supplies a second key for %s", flag, match))
+		}
+		return nil
+	}
+
+	for _, value := range hexKeys {
+		match := ""
+		if i := strings.LastIndex(value, "="); i >= 0 {
+			match, value = value[:i], value[i+1:]
+		}
+		if err := add("key-hex", match, value, func(digits string) ([]byte, error) {
+			key, ok := decodeKeyHex(digits)
+			if !ok {
+				return nil, newError(fmt.Sprintf("--key-hex must be a 16 byte key as 32 hex digits, got %d characters", len(digits)))
+			}
+			return key, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range files {
+		match, path, err := splitKeyFile(value)
+		if err != nil {
+			return nil, err
+		}
+		if err := add("key-file", match, path, readKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// splitKeyFile splits the [MATCH=]PATH value of --key-file where PATH names
+// an existing file, as either of them may hold an "=". It errors when more
+// than one split does, and splits on the first "=" when none does, leaving
+// the missing file to be reported.
+func splitKeyFile(value string) (string, string, error) {
+	var match, path string
+	found := 0
+	for i := -1; i < len(value); i++ {
+		if i >= 0 && value[i] != '=' {
+			continue
+		}
+		candidate := value[i+1:]
+		if info, err := os.Stat(candidate); err != nil || info.IsDir() {
+			continue
+		}
+		if found++; found > 1 {
+			return "", "", newError(fmt.Sprintf("--key-file %s is ambiguous, both %s and %s are files", value, path, candidate))
+		}
+		match, path = value[:max(i, 0)], candidate
+	}
+	if found == 0 {
+		if before, after, ok := strings.Cut(value, "="); ok {
+			return before, after, nil
+		}
+		return "", value, nil
+	}
+	return match, path, nil
+}
+
+// decodeKeyHex decodes a 16 byte key written as 32 hex digits, optionally
+// prefixed with 0x.
+func decodeKeyHex(digits string) ([]byte, bool) {
+	digits = strings.TrimSpace(digits)
+	digits = strings.TrimPrefix(strings.TrimPrefix(digits, "0x"), "0X")
+	key, err := hex.DecodeString(digits)
+	return key, err == nil && len(key) == aes128KeySize
+}
+
+// readKeyFile reads the key on path, holding either the raw 16 bytes or
+// their 32 hex digits.
+func readKeyFile(path string) ([]byte, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, newError(fmt.Sprintf("unable to read --key-file %s: %s", path, err.Error()))
+	}
+	if len(body) == aes128KeySize {
+		return body, nil
+	}
+	if key, ok := decodeKeyHex(string(body)); ok {
+		return key, nil
+	}
+	return nil, newError(fmt.Sprintf("--key-file %s must hold a 16 byte key, raw or as 32 hex digits, got %d bytes", path, len(body)))
+}
+
+// forURI returns the supplied key for the key on uri, if any.
+func (o *keyOverrides) forURI(uri string) ([]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if key, ok := o.byURI[uri]; ok {
+		return key, true
+	}
+	if key, ok := o.byMatch[uri]; ok {
+		return key, true
+	}
+	return o.all, o.all != nil
+}
+
+// mapRendition maps the key supplied for the rendition of media, by folder
+// or playlist uri, to every key uri of its playlist mp.
+func (o *keyOverrides) mapRendition(media *MediaResult, mp *m3u8.MediaPlaylist) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key, ok := o.byMatch[media.Variant]
+	if !ok {
+		key, ok = o.byMatch[media.URI]
+	}
+	if !ok {
+		return
+	}
+
+	if mp.Key != nil && mp.Key.URI != "" {
+		o.byURI[mp.Key.URI] = key
+	}
+	for _, segment := range mp.Segments {
+		if segment != nil && segment.Key != nil && segment.Key.URI != "" {
+			o.byURI[segment.Key.URI] = key
+		}
+	}
+}
+
+// GetKey returns the key on uri, fetching it only if it isn't cached yet.
+// Concurrent callers wait on the same request, and a request that fails is
+// retried by the next caller instead of failing every later one.
+func (v *Verifier) GetKey(ctx context.Context, uri string) ([]byte, error) {
+	v.keys.mu.Lock()
+	entry, ok := v.keys.keys[uri]
+	if !ok {
+		entry = &cachedKey{}
+		v.keys.keys[uri] = entry
+	}
+	v.keys.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.fetched {
+		return entry.key, entry.err
+	}
+
+	result := &KeyResult{URI: uri, Source: KeySourceSupplied}
+	key, delivered, err := v.loadKey(ctx, uri, result)
+	result.Length = len(key)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	v.keys.mu.Lock()
+	entry.result = result
+	v.keys.mu.Unlock()
+
+	if delivered {
+		entry.fetched, entry.key, entry.err = true, key, err
+	}
+	return key, err
+}
+
+// loadKey returns the key on uri, either supplied through --key-hex or
+// --key-file or fetched from its key server, recording how it was
+// delivered on result. It reports whether the key was delivered at all,
+// even if with the wrong size, as opposed to its request failing.
+func (v *Verifier) loadKey(ctx context.Context, uri string, result *KeyResult) ([]byte, bool, error) {
+	if key, ok := v.keyOverrides.forURI(uri); ok {
+		v.infof("Using key supplied through --key-hex or --key-file for: %s", uri)
+		return key, true, nil
+	}
+
+	key, err := v.fetchKey(ctx, uri, result)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkKeySize(uri, key); err != nil {
+		return key, true, err
+	}
+	v.infof("Detected AES-128 key on: %s", uri)
+	return key, true, nil
+}
+
+// fetchKey requests the key on uri from its key server, with the KeyHeaders
+// of v on top of the headers of every request, recording the status and
+// latency of the request on result.
+func (v *Verifier) fetchKey(ctx context.Context, uri string, result *KeyResult) ([]byte, error) {
+	if strings.HasPrefix(strings.ToLower(uri), "data:") {
+		result.Source = KeySourceDataURI
+		return decodeDataURI(uri)
+	}
+	result.Source = KeySourceServer
+
+	uri, err := withQuery(uri, v.opts.KeyQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	if v.keyRequestBody != nil {
+		body = bytes.NewReader(v.keyRequestBody)
+	}
+
+	req, err := v.newRequest(ctx, v.opts.KeyMethod, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(req, v.keyHeaders)
+
+	start := time.Now()
+	res, err := v.do(req)
+	if err != nil {
+		result.Latency = time.Since(start)
+		return nil, err
+	}
+
+	defer func() { _ = res.Body.Close() }()
+	result.HTTPStatus = res.StatusCode
+	if err := v.checkStatus(uri, res); err != nil {
+		result.Latency = time.Since(start)
+		return nil, err
+	}
+
+	key, err := io.ReadAll(res.Body)
+	result.Latency = time.Since(start)
+	v.downloaded.Add(len(key))
+	if err != nil {
+		return nil, err
+	}
+	return v.decodeContent(uri, res.Header.Get("Content-Encoding"), key)
+}
+
+// PrefetchKeys concurrently fetches every distinct key referenced by a media
+// playlist into the cache, reporting how many were fetched. Failures are
+// only printed, as they're reported again once the key is used.
+func (v *Verifier) PrefetchKeys(ctx context.Context, uri string, mp *m3u8.MediaPlaylist) {
+	uris := make(map[string]bool)
+	add := func(key *m3u8.Key) {
+		if key != nil && key.URI != "" && isKeyFetchable(key.URI) {
+			uris[v.resolveURI(uri, key.URI)] = true
+		}
+	}
+	add(mp.Key)
+	for _, segment := range mp.Segments {
+		if segment != nil {
+			add(segment.Key)
+		}
+	}
+
+	start := time.Now()
+
+	var failed int32
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for keyURI := range uris {
+		wg.Add(1)
+		go func(keyURI string) {
+			defer wg.Done()
+			if _, err := v.GetKey(ctx, keyURI); err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				v.infof("Key prefetch failed for %s: %s", keyURI, err.Error())
+			}
+		}(keyURI)
+	}
+	wg.Wait()
+
+	v.infof("Prefetched %d keys (%d failed) in %s for: %s", len(uris), failed, time.Since(start), uri)
+}
+
+// keyMethods are the HTTP methods keys can be requested with.
+var keyMethods = map[string]bool{
+	http.MethodGet:  true,
+	http.MethodPost: true,
+	http.MethodPut:  true,
+}
+
+// loadKeyRequest validates --key-method and loads --key-body, which is sent
+// as is or, when prefixed with "@", read from the file it names.
+func (v *Verifier) loadKeyRequest() error {
+	v.opts.KeyMethod = strings.ToUpper(v.opts.KeyMethod)
+	if !keyMethods[v.opts.KeyMethod] {
+		return newError("--key-method must be GET, POST or PUT, got: " + v.opts.KeyMethod)
+	}
+
+	if v.opts.KeyBody == "" {
+		return nil
+	}
+	if v.opts.KeyMethod == http.MethodGet {
+		return newError("--key-body requires a --key-method other than GET")
+	}
+
+	if !strings.HasPrefix(v.opts.KeyBody, "@") {
+		v.keyRequestBody = []byte(v.opts.KeyBody)
+		return nil
+	}
+
+	body, err := os.ReadFile(v.opts.KeyBody[1:])
+	if err != nil {
+		return newError("unable to read --key-body file: " + err.Error())
+	}
+	v.keyRequestBody = body
+	return nil
+}
+
+// decodeDataURI returns the inline key of a data: uri, either base64 or
+// percent-encoded raw bytes.
+func decodeDataURI(uri string) ([]byte, error) {
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return nil, newError("malformed data uri key, missing \",\"")
+	}
+
+	meta, data := uri[len("data:"):comma], uri[comma+1:]
+	if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		key, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, newError("malformed base64 data uri key: " + err.Error())
+		}
+		return key, nil
+	}
+
+	key, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, newError("malformed data uri key: " + err.Error())
+	}
+	return []byte(key), nil
+}
+
+// aes128KeySize is the length every key of an AES-128 EXT-X-KEY must have,
+// and aes256KeySize the one of the AES-256 keys some packagers serve
+// instead.
+const (
+	aes128KeySize = 16
+	aes256KeySize = 32
+)
+
+// checkKeySize errors unless the key fetched from uri is exactly 16 bytes
+// long, as required by AES-128. aes.NewCipher would otherwise accept 24 and
+// 32 byte bodies and decrypt to garbage, so the error hints at what the
+// body seems to be instead, such as an AES-256 key.
+func checkKeySize(uri string, key []byte) error {
+	if len(key) == aes128KeySize {
+		return nil
+	}
+
+	var hint string
+	trimmed := bytes.TrimSpace(key)
+	switch {
+	case len(key) == 0:
+		hint = ", the key response is empty"
+	case len(trimmed) == aes128KeySize:
+		hint = ", the key has leading or trailing whitespace"
+	case len(trimmed) == 2*aes128KeySize && allHex(trimmed):
+		hint = ", the key seems hex-encoded instead of raw bytes"
+	case len(key) == aes256KeySize:
+		hint = ", the key seems to be an AES-256 one, which HLS doesn't support"
+	case isText(trimmed):
+		hint = fmt.Sprintf(", the response seems to be text, starting with: %q", preview(trimmed, 40))
+	}
+
+	return newError(fmt.Sprintf(
+		"unexpected key length of %d bytes on %s, AES-128 requires %d%s",
+		len(key),
+		uri,
+		aes128KeySize,
+		hint,
+	))
+}
+
+// allHex returns whether data is made only of hexadecimal digits.
+func allHex(data []byte) bool {
+	for _, c := range data {
+		if !isHex(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// isText returns whether data is printable ASCII, like HTML or JSON error
+// bodies served in place of a key.
+func isText(data []byte) bool {
+	for _, c := range data {
+		if (c < 0x20 || c > 0x7e) && c != '\n' && c != '\r' && c != '\t' {
+			return false
+		}
+	}
+	return len(data) > 0
+}
+
+// preview returns the first n bytes of data, or all of it if shorter.
+func preview(data []byte, n int) string {
+	if len(data) > n {
+		return string(data[:n]) + "..."
+	}
+	return string(data)
+}
+
+// segmentKeys returns the EXT-X-KEY in effect for every segment of mp, by
+// segment index: the most recent one preceding it, or the playlist key.
+func segmentKeys(mp *m3u8.MediaPlaylist) []*m3u8.Key {
+	keys := make([]*m3u8.Key, len(mp.Segments))
+	current := mp.Key
+	for i, segment := range mp.Segments {
+		if segment == nil {
+			continue
+		}
+		if segment.Key != nil {
+			current = segment.Key
+		}
+		keys[i] = current
+	}
+	return keys
+}
+
+// keySummary returns the distinct methods, comma separated, and key uris of
+// keys, the keys in effect on the segments of mp. Segments without a key
+// count as NONE.
+func keySummary(mp *m3u8.MediaPlaylist, keys []*m3u8.Key) (string, []string) {
+	var methods, uris []string
+	seenMethods := make(map[string]bool)
+	seenURIs := make(map[string]bool)
+	for i, key := range keys {
+		if mp.Segments[i] == nil {
+			continue
+		}
+		if key == nil {
+			key = &m3u8.Key{Method: methodNone}
+		}
+		if !seenMethods[key.Method] {
+			seenMethods[key.Method] = true
+			methods = append(methods, key.Method)
+		}
+		if key.URI != "" && !seenURIs[key.URI] {
+			seenURIs[key.URI] = true
+			uris = append(uris, key.URI)
+		}
+	}
+	return strings.Join(methods, ","), uris
+}
+
+// EXT-X-KEY methods given special treatment by DecodeSegment.
+const (
+	methodNone         = "NONE"
+	methodAES128       = "AES-128"
+	methodSampleAES    = "SAMPLE-AES"
+	methodSampleAESCTR = "SAMPLE-AES-CTR"
+)
+
+// checkKeyMethod returns nil if segments encrypted with method can be
+// verified, or a descriptive errUnsupportedMethod otherwise.
+func checkKeyMethod(method string) error {
+	switch method {
+	case methodNone, methodAES128, methodSampleAES, methodSampleAESCTR:
+		return nil
+	}
+	return fmt.Errorf("%w %q, expected AES-128, SAMPLE-AES, SAMPLE-AES-CTR or NONE", errUnsupportedMethod, method)
+}
+
+// isSampleEncryption reports whether method encrypts media samples inside
+// a clear container rather than the whole segment.
+func isSampleEncryption(method string) bool {
+	return method == methodSampleAES || method == methodSampleAESCTR
+}
+
+// isKeyFetchable reports whether the key on uri can be fetched, unlike the
+// skd:// keys FairPlay delivers to players through its own license
+// exchange.
+func isKeyFetchable(uri string) bool {
+	return !strings.HasPrefix(strings.ToLower(uri), "skd:")
+}
+
+// keyRotations returns how many times the key in effect, or its IV,
+// changes between consecutive segments of mp, along with how many of the
+// changes happen at an EXT-X-DISCONTINUITY instead. Those start a new
+// period, such as an inserted ad, which may legitimately be encrypted on its
+// own, so they aren't counted as rotations.
+func keyRotations(mp *m3u8.MediaPlaylist, keys []*m3u8.Key) (int, int) {
+	rotations, periods := 0, 0
+	var previous *m3u8.Key
+	for i, key := range keys {
+		if mp.Segments[i] == nil {
+			continue
+		}
+		if previous != nil && key != nil && (key.URI != previous.URI || key.IV != previous.IV || key.Method != previous.Method) {
+			if mp.Segments[i].Discontinuity {
+				periods++
+			} else {
+				rotations++
+			}
+		}
+		previous = key
+	}
+	return rotations, periods
+}
+
+// normalizeMethod trims and uppercases an EXT-X-KEY METHOD, as some
+// packagers emit values like " aes-128".
+func normalizeMethod(method string) string {
+	return strings.ToUpper(strings.TrimSpace(method))
+}
+
+// normalizeKeyMethods normalizes the METHOD of every key of a media
+// playlist, printing the raw and normalized value of those that changed.
+func (v *Verifier) normalizeKeyMethods(uri string, mp *m3u8.MediaPlaylist) {
+	reported := make(map[string]bool)
+	normalize := func(key *m3u8.Key) {
+		if key == nil {
+			return
+		}
+		method := normalizeMethod(key.Method)
+		if method != key.Method && !reported[key.Method] {
+			reported[key.Method] = true
+			v.infof("Normalized key method on %s: %q -> %q", uri, key.Method, method)
+		}
+		key.Method = method
+	}
+
+	normalize(mp.Key)
+	for _, segment := range mp.Segments {
+		if segment != nil {
+			normalize(segment.Key)
+		}
+	}
+}
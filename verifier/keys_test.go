@@ -0,0 +1,306 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGetKeyFetchesOnce(t *testing.T) {
+	tests := []struct {
+		renditions int
+		segments   int
+	}{
+		{renditions: 1, segments: 1},
+		{renditions: 1, segments: 20},
+		{renditions: 3, segments: 8},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%dx%d", tt.renditions, tt.segments), func(t *testing.T) {
+			stream := newTestStream(t)
+			master := "#EXTM3U\n"
+			for i := 0; i < tt.renditions; i++ {
+				// Every rendition shares /media/key.bin.
+				stream.addMedia(fmt.Sprintf("/media/%d.m3u8", i), tt.segments)
+				master += fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d\n%d.m3u8\n", 1000000*(i+1), i)
+			}
+			stream.add("/media/master.m3u8", []byte(master))
+
+			transport := newCountingTransport()
+			v := newTestVerifier(t, func(opts *Options) {
+				opts.ManifestType = "master"
+				opts.Client = &http.Client{Transport: transport}
+			})
+			report, err := v.Verify(context.Background(), stream.uri("/media/master.m3u8"))
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if want := tt.renditions * tt.segments; report.Totals.Verified != want {
+				t.Errorf("Verify() verified %d segments, want %d", report.Totals.Verified, want)
+			}
+			if got := transport.count("/media/key.bin"); got != 1 {
+				t.Errorf("key was requested %d times, want 1", got)
+			}
+			if report.Totals.Keys != 1 {
+				t.Errorf("Verify() reported %d keys, want 1", report.Totals.Keys)
+			}
+		})
+	}
+}
+
+func TestGetKeyRetriesFailedRequests(t *testing.T) {
+	stream := newTestStream(t)
+	stream.addMedia("/media/index.m3u8", 4)
+	var requests atomic.Int32
+	stream.handle("/media/key.bin", func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(testKey)
+	})
+
+	v := newTestVerifier(t, func(opts *Options) {
+		opts.Concurrency = 1
+		opts.NoRecheck = true
+	})
+	report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+	if err == nil {
+		t.Fatal("Verify() error = nil, want the failed key request")
+	}
+	if report.Totals.Verified != 3 || report.Totals.Failed != 1 {
+		t.Errorf("Verify() verified %d and failed %d segments, want 3 and 1", report.Totals.Verified, report.Totals.Failed)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("key was requested %d times, want 2", got)
+	}
+}
+
+func TestCheckKeyMethod(t *testing.T) {
+	tests := []struct {
+		method  string
+		wantErr bool
+	}{
+		{method: "NONE"},
+		{method: "AES-128"},
+		{method: "SAMPLE-AES"},
+		{method: "SAMPLE-AES-CTR"},
+		{method: "AES-256", wantErr: true},
+		{method: "SAMPLE-AES-CENC", wantErr: true},
+		{method: "aes-128", wantErr: true},
+		{method: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			err := checkKeyMethod(tt.method)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("checkKeyMethod(%q) error = %v, want error %t", tt.method, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errUnsupportedMethod) {
+				t.Errorf("checkKeyMethod(%q) error = %v, want errUnsupportedMethod", tt.method, err)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyMethods(t *testing.T) {
+	tests := []struct {
+		method    string
+		encrypted bool
+		wantKey   bool
+		wantClass ErrorClass
+	}{
+		{method: "NONE", wantKey: false},
+		{method: "AES-128", encrypted: true, wantKey: true},
+		{method: " aes-128", encrypted: true, wantKey: true},
+		{method: "SAMPLE-AES", encrypted: true, wantKey: true, wantClass: ClassContainer},
+		{method: "SAMPLE-AES-CTR", encrypted: true, wantKey: true, wantClass: ClassContainer},
+		{method: "AES-256", encrypted: true, wantKey: false, wantClass: ClassMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.add("/media/key.bin", testKey)
+			var playlist strings.Builder
+			playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:5\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n")
+			if tt.method == "NONE" {
+				playlist.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+			} else {
+				fmt.Fprintf(&playlist, "#EXT-X-KEY:METHOD=%s,URI=\"key.bin\"\n", tt.method)
+			}
+			for i := 0; i < 2; i++ {
+				body := testPlain(i, 1000)
+				if tt.encrypted {
+					body = encryptSegment(testKey, sequenceIV(uint64(i)), body)
+				}
+				stream.add(fmt.Sprintf("/media/seg%d.ts", i), body)
+				fmt.Fprintf(&playlist, "#EXTINF:4.0,\nseg%d.ts\n", i)
+			}
+			playlist.WriteString("#EXT-X-ENDLIST\n")
+			stream.add("/media/index.m3u8", []byte(playlist.String()))
+
+			v := newTestVerifier(t, func(opts *Options) { opts.NoRecheck = true })
+			report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+			if requested := len(stream.requestsTo("/media/key.bin")) > 0; requested != tt.wantKey {
+				t.Errorf("key requested = %t, want %t", requested, tt.wantKey)
+			}
+			if tt.wantClass == "" {
+				if err != nil {
+					t.Fatalf("Verify() error = %v", err)
+				}
+				if report.Totals.Verified != 2 {
+					t.Errorf("Verify() verified %d segments, want 2", report.Totals.Verified)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("Verify() error = nil, want a %s failure", tt.wantClass)
+			}
+			for _, segment := range report.Variants[0].Segments {
+				if segment.Class != tt.wantClass {
+					t.Errorf("segment %d failed as %q, want %q", segment.Index, segment.Class, tt.wantClass)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckKeySize(t *testing.T) {
+	binary := func(n int) []byte {
+		key := make([]byte, n)
+		for i := range key {
+			key[i] = byte(0x80 + i)
+		}
+		return key
+	}
+	tests := []struct {
+		name string
+		key  []byte
+		want string
+	}{
+		{name: "16 bytes", key: binary(16)},
+		{name: "empty", key: nil, want: "key length of 0 bytes on key.bin, AES-128 requires 16, the key response is empty"},
+		{name: "short", key: binary(8), want: "key length of 8 bytes on key.bin, AES-128 requires 16"},
+		{name: "one over", key: binary(17), want: "key length of 17 bytes on key.bin, AES-128 requires 16"},
+		{name: "trailing newline", key: append(binary(16), '\n'), want: "the key has leading or trailing whitespace"},
+		{name: "hex encoded", key: []byte("000102030405060708090a0b0c0d0e0f"), want: "the key seems hex-encoded instead of raw bytes"},
+		{name: "AES-256", key: binary(32), want: "the key seems to be an AES-256 one"},
+		{name: "HTML error body", key: []byte("<html><body>403 Forbidden</body></html>\n"), want: `the response seems to be text, starting with: "<html><body>403 Forbidden</body></html>"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkKeySize("key.bin", tt.key)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("checkKeySize() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("checkKeySize() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsHTMLKey(t *testing.T) {
+	stream := newTestStream(t)
+	stream.addMedia("/media/index.m3u8", 3)
+	stream.add("/media/key.bin", []byte("<!DOCTYPE html><html><body>Sign in</body></html>"))
+
+	v := newTestVerifier(t, func(opts *Options) { opts.NoRecheck = true })
+	report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+	if err == nil || !strings.Contains(err.Error(), "unexpected key length of 48 bytes") {
+		t.Fatalf("Verify() error = %v, want the key length failure", err)
+	}
+	if report.Totals.Failed != 3 {
+		t.Errorf("Verify() failed %d segments, want 3", report.Totals.Failed)
+	}
+	// The key was delivered, if wrong, so it isn't requested again.
+	if got := len(stream.requestsTo("/media/key.bin")); got != 1 {
+		t.Errorf("key was requested %d times, want 1", got)
+	}
+}
+
+func TestParseKeyOverrides(t *testing.T) {
+	const digits = "000102030405060708090a0b0c0d0e0f"
+	key, _ := hex.DecodeString(digits)
+
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw=1.key")
+	hexFile := filepath.Join(dir, "hex.key")
+	short := filepath.Join(dir, "short.key")
+	// Named like the end of raw, so it's ambiguous relative to dir.
+	tail := filepath.Join(dir, "1.key")
+	for path, body := range map[string][]byte{raw: key, hexFile: []byte(digits + "\n"), short: key[:8], tail: key} {
+		if err := os.WriteFile(path, body, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		hexKeys []string
+		files   []string
+		all     bool
+		byMatch []string
+		dir     string
+		wantErr string
+	}{
+		{name: "every key", hexKeys: []string{digits}, all: true},
+		{name: "prefixed", hexKeys: []string{"0x" + digits}, all: true},
+		{name: "by match", hexKeys: []string{"video_0=" + digits, "https://keys.example.com/k1=0X" + digits}, byMatch: []string{"video_0", "https://keys.example.com/k1"}},
+		{name: "match with a query", hexKeys: []string{"https://k/key?id=5=" + digits}, byMatch: []string{"https://k/key?id=5"}},
+		{name: "raw file with = in its path", files: []string{"audio_0_1=" + raw}, byMatch: []string{"audio_0_1"}},
+		{name: "file with a query match", files: []string{"https://k/key?id=5=" + hexFile}, byMatch: []string{"https://k/key?id=5"}},
+		{name: "ambiguous file", files: []string{"raw=1.key"}, dir: dir, wantErr: "--key-file raw=1.key is ambiguous, both raw=1.key and 1.key are files"},
+		{name: "hex file", files: []string{hexFile}, all: true},
+		{name: "hex and file", hexKeys: []string{"video_0=" + digits}, files: []string{hexFile}, all: true, byMatch: []string{"video_0"}},
+		{name: "short hex", hexKeys: []string{digits[:30]}, wantErr: "--key-hex must be a 16 byte key as 32 hex digits, got 30 characters"},
+		{name: "not hex", hexKeys: []string{"video_0=" + strings.Repeat("zz", 16)}, wantErr: "--key-hex must be a 16 byte key"},
+		{name: "second key for every uri", hexKeys: []string{digits}, files: []string{hexFile}, wantErr: "--key-file supplies a second key for every key uri"},
+		{name: "second key for a match", hexKeys: []string{"video_0=" + digits, "video_0=" + digits}, wantErr: "--key-hex supplies a second key for video_0"},
+		{name: "short file", files: []string{short}, wantErr: "must hold a 16 byte key, raw or as 32 hex digits, got 8 bytes"},
+		{name: "missing file", files: []string{filepath.Join(dir, "missing.key")}, wantErr: "unable to read --key-file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.dir != "" {
+				chdir(t, tt.dir)
+			}
+			o, err := parseKeyOverrides(tt.hexKeys, tt.files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseKeyOverrides() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseKeyOverrides() error = %v", err)
+			}
+
+			if got := o.all != nil; got != tt.all {
+				t.Errorf("key for every uri = %t, want %t", got, tt.all)
+			} else if tt.all && !bytes.Equal(o.all, key) {
+				t.Errorf("key for every uri = %x, want %x", o.all, key)
+			}
+			if len(o.byMatch) != len(tt.byMatch) {
+				t.Errorf("keys by match = %d, want %d", len(o.byMatch), len(tt.byMatch))
+			}
+			for _, match := range tt.byMatch {
+				if got, ok := o.forURI(match); !ok || !bytes.Equal(got, key) {
+					t.Errorf("key for %s = %x, want %x", match, got, key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package verifier
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// optionsLogger returns the Logger of opts, or when nil one logging text to
+// stdout, with debug records only when Verbose.
+func optionsLogger(opts Options) *slog.Logger {
+	if opts.Logger != nil {
+		return opts.Logger
+	}
+	level := slog.LevelInfo
+	if opts.Verbose {
+		level = slog.LevelDebug
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+}
+
+// logf logs the message of format and args at level, skipping formatting
+// when level is disabled or logger is nil.
+func logf(logger *slog.Logger, level slog.Level, format string, args ...interface{}) {
+	if logger == nil || !logger.Enabled(context.Background(), level) {
+		return
+	}
+	logger.Log(context.Background(), level, fmt.Sprintf(format, args...))
+}
+
+// debugf logs details only wanted under --verbose, like every request and
+// segment result.
+func (v *Verifier) debugf(format string, args ...interface{}) {
+	logf(v.log, slog.LevelDebug, format, args...)
+}
+
+// infof logs the progress of the run.
+func (v *Verifier) infof(format string, args ...interface{}) {
+	logf(v.log, slog.LevelInfo, format, args...)
+}
+
+// warnf logs issues that aren't failures of the stream.
+func (v *Verifier) warnf(format string, args ...interface{}) {
+	logf(v.log, slog.LevelWarn, format, args...)
+}
+
+// errorf logs a failure as it's found, besides recording it.
+func (v *Verifier) errorf(format string, args ...interface{}) {
+	logf(v.log, slog.LevelError, format, args...)
+}
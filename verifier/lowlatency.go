@@ -0,0 +1,381 @@
+package verifier
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// Low-Latency HLS tags, which the m3u8 package doesn't decode.
+const (
+	partTag          = "#EXT-X-PART:"
+	partInfTag       = "#EXT-X-PART-INF:"
+	preloadHintTag   = "#EXT-X-PRELOAD-HINT:"
+	serverControlTag = "#EXT-X-SERVER-CONTROL:"
+)
+
+// partsFolder is the folder under the one of its rendition the partial
+// segments of a Low-Latency HLS playlist are saved to, as they'd collide
+// with the segments they're part of otherwise.
+const partsFolder = "parts"
+
+// partialSegment is an EXT-X-PART of a media playlist, the Part-th of its
+// parent segment with media sequence number MediaSequence.
+type partialSegment struct {
+	MediaSequence uint64
+	Part          int
+	URI           string
+	Offset        int64
+	Limit         int64
+	Duration      float64
+	Independent   bool
+	Gap           bool
+}
+
+// preloadHint is an EXT-X-PRELOAD-HINT of a media playlist, the resource a
+// client may request before it's listed.
+type preloadHint struct {
+	Type   string
+	URI    string
+	Offset int64
+	Limit  int64
+}
+
+// lowLatency is what a media playlist declares for Low-Latency HLS, read
+// from its raw tags. PartHoldBack and PartTarget are 0 when not declared.
+type lowLatency struct {
+	CanBlockReload bool
+	PartHoldBack   float64
+	PartTarget     float64
+	Parts          []partialSegment
+	Hints          []preloadHint
+}
+
+// PartResult is the verification of a partial segment of a Low-Latency HLS
+// playlist, reported with the media sequence number of its parent segment
+// and its position within it as Part.
+type PartResult struct {
+	Part int `json:"part"`
+	*SegmentResult
+}
+
+// readLowLatency returns the Low-Latency HLS declarations of raw, the media
+// playlist mp was decoded from, resolving the uris of its parts and hints
+// against base, with an error for every tag that's malformed. It returns
+// nil when raw declares none.
+func (v *Verifier) readLowLatency(raw []byte, base string, mp *m3u8.MediaPlaylist) (*lowLatency, []error) {
+	var ll *lowLatency
+	var errs []error
+	declare := func() {
+		if ll == nil {
+			ll = &lowLatency{}
+		}
+	}
+
+	seq := mp.SeqNo
+	part := 0
+	var previous *partialSegment
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, serverControlTag):
+			attrs := m3u8.DecodeAttributeList(strings.TrimPrefix(line, serverControlTag))
+			declare()
+			ll.CanBlockReload = attrs["CAN-BLOCK-RELOAD"] == "YES"
+			if value, ok := attrs["PART-HOLD-BACK"]; ok {
+				holdBack, err := strconv.ParseFloat(value, 64)
+				if err != nil || holdBack <= 0 {
+					errs = append(errs, fmt.Errorf("EXT-X-SERVER-CONTROL has an invalid PART-HOLD-BACK %q", value))
+				}
+				ll.PartHoldBack = holdBack
+			}
+		case strings.HasPrefix(line, partInfTag):
+			value := m3u8.DecodeAttributeList(strings.TrimPrefix(line, partInfTag))["PART-TARGET"]
+			target, err := strconv.ParseFloat(value, 64)
+			if err != nil || target <= 0 {
+				errs = append(errs, fmt.Errorf("EXT-X-PART-INF has an invalid PART-TARGET %q", value))
+			}
+			declare()
+			ll.PartTarget = target
+		case strings.HasPrefix(line, partTag):
+			attrs := m3u8.DecodeAttributeList(strings.TrimPrefix(line, partTag))
+			p := partialSegment{
+				MediaSequence: seq,
+				Part:          part,
+				Independent:   attrs["INDEPENDENT"] == "YES",
+				Gap:           attrs["GAP"] == "YES",
+			}
+			part++
+			name := fmt.Sprintf("EXT-X-PART %d of media sequence %d", p.Part, p.MediaSequence)
+
+			duration, err := strconv.ParseFloat(attrs["DURATION"], 64)
+			if err != nil || duration <= 0 {
+				errs = append(errs, fmt.Errorf("%s has an invalid DURATION %q", name, attrs["DURATION"]))
+			}
+			p.Duration = duration
+			if attrs["URI"] == "" {
+				errs = append(errs, fmt.Errorf("%s has no URI", name))
+				continue
+			}
+			if p.URI, err = v.resolveSegmentURI(base, attrs["URI"]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+
+			if value, ok := attrs["BYTERANGE"]; ok {
+				if p.Limit, p.Offset, err = parseByteRange(value); err != nil {
+					errs = append(errs, fmt.Errorf("%s has an invalid BYTERANGE %q", name, value))
+					continue
+				}
+				// A range without an offset follows the one of the part
+				// before it on the same resource.
+				if !strings.Contains(value, "@") && previous != nil && previous.URI == p.URI && previous.Limit > 0 {
+					p.Offset = previous.Offset + previous.Limit
+				}
+			}
+			declare()
+			ll.Parts = append(ll.Parts, p)
+			previous = &ll.Parts[len(ll.Parts)-1]
+		case strings.HasPrefix(line, preloadHintTag):
+			attrs := m3u8.DecodeAttributeList(strings.TrimPrefix(line, preloadHintTag))
+			hint := preloadHint{Type: attrs["TYPE"]}
+			if hint.Type != "PART" && hint.Type != "MAP" {
+				errs = append(errs, fmt.Errorf("EXT-X-PRELOAD-HINT has an invalid TYPE %q, PART or MAP expected", hint.Type))
+			}
+			if attrs["URI"] == "" {
+				errs = append(errs, errors.New("EXT-X-PRELOAD-HINT has no URI"))
+				continue
+			}
+			var err error
+			if hint.URI, err = v.resolveSegmentURI(base, attrs["URI"]); err != nil {
+				errs = append(errs, fmt.Errorf("EXT-X-PRELOAD-HINT: %w", err))
+				continue
+			}
+			hint.Offset, _ = strconv.ParseInt(attrs["BYTERANGE-START"], 10, 64)
+			hint.Limit, _ = strconv.ParseInt(attrs["BYTERANGE-LENGTH"], 10, 64)
+			declare()
+			ll.Hints = append(ll.Hints, hint)
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			seq++
+			part = 0
+		}
+	}
+	return ll, errs
+}
+
+// parseByteRange parses the n[@o] value of a BYTERANGE attribute.
+func parseByteRange(value string) (int64, int64, error) {
+	length, offset, hasOffset := strings.Cut(value, "@")
+	limit, err := strconv.ParseInt(length, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, 0, newError("invalid byte range length")
+	}
+	if !hasOffset {
+		return limit, 0, nil
+	}
+	start, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, newError("invalid byte range offset")
+	}
+	return limit, start, nil
+}
+
+// checkLowLatency errors when the partial segments of ll don't follow the
+// Low-Latency HLS rules: a playlist with parts needs an EXT-X-PART-INF no
+// part lasts longer than, and an EXT-X-SERVER-CONTROL supporting blocking
+// reloads with a PART-HOLD-BACK of at least twice its PART-TARGET.
+func checkLowLatency(ll *lowLatency, errs []error) error {
+	if len(ll.Parts) > 0 {
+		switch {
+		case ll.PartTarget <= 0:
+			errs = append(errs, errors.New("EXT-X-PART without an EXT-X-PART-INF"))
+		default:
+			for _, p := range ll.Parts {
+				// Durations are rounded on the playlist, so a part may
+				// exceed the target by a millisecond.
+				if p.Duration > ll.PartTarget+0.001 {
+					errs = append(errs, fmt.Errorf("EXT-X-PART %d of media sequence %d lasts %gs, longer than PART-TARGET %gs", p.Part, p.MediaSequence, p.Duration, ll.PartTarget))
+				}
+			}
+		}
+		if !ll.CanBlockReload {
+			errs = append(errs, errors.New("EXT-X-PART without an EXT-X-SERVER-CONTROL of CAN-BLOCK-RELOAD=YES"))
+		}
+		switch {
+		case ll.PartHoldBack <= 0:
+			errs = append(errs, errors.New("EXT-X-PART without a PART-HOLD-BACK on EXT-X-SERVER-CONTROL"))
+		case ll.PartTarget > 0 && ll.PartHoldBack < 2*ll.PartTarget:
+			errs = append(errs, fmt.Errorf("PART-HOLD-BACK %gs is less than twice PART-TARGET %gs", ll.PartHoldBack, ll.PartTarget))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return newError(fmt.Sprintf("invalid Low-Latency HLS playlist: %s", strings.ReplaceAll(err.Error(), "\n", "; ")))
+	}
+	return nil
+}
+
+// blockingReloadURI returns uri with the _HLS_msn and, when part isn't
+// negative, _HLS_part delivery directives, asking the server to hold the
+// reload back until the playlist has the segment or part they name.
+func blockingReloadURI(uri string, msn uint64, part int) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	query := u.Query()
+	query.Set("_HLS_msn", strconv.FormatUint(msn, 10))
+	if part >= 0 {
+		query.Set("_HLS_part", strconv.Itoa(part))
+	} else {
+		query.Del("_HLS_part")
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// nextReload returns the media sequence number and part a blocking reload
+// of the playlist of ll waits for, the part after its last one, or the
+// segment nextSeq when it lists none, with a part of -1.
+func (ll *lowLatency) nextReload(nextSeq uint64) (uint64, int) {
+	if len(ll.Parts) == 0 {
+		return nextSeq, -1
+	}
+	last := ll.Parts[len(ll.Parts)-1]
+	if last.MediaSequence < nextSeq {
+		return nextSeq, 0
+	}
+	return last.MediaSequence, last.Part + 1
+}
+
+// reloadWait returns how long to wait before the next reload of mp, whose
+// Low-Latency HLS declarations are ll. Blocking reloads are sent at once,
+// unless the last one didn't grow the playlist, and playlists with parts
+// are otherwise reloaded every part target. grew is whether the last
+// reload added segments or parts.
+func reloadWait(mp *m3u8.MediaPlaylist, ll *lowLatency, grew bool) time.Duration {
+	target := reloadInterval(mp)
+	if ll != nil && ll.PartTarget > 0 {
+		target = time.Duration(ll.PartTarget * float64(time.Second))
+	}
+	switch {
+	case ll != nil && ll.CanBlockReload && grew:
+		return 0
+	case grew:
+		return target
+	}
+	// Per spec, an unchanged playlist is reloaded after half its target
+	// duration.
+	return target / 2
+}
+
+// verifyParts verifies the partial segments of the playlist of media not
+// verified yet, decrypted with the key in effect for their parent segment,
+// keys being the ones in effect for the segments of mp. It returns how many
+// were verified. Parts are saved to partsFolder under the folder of media,
+// without being concatenated.
+func (v *Verifier) verifyParts(ctx context.Context, media *MediaResult, ll *lowLatency, mp *m3u8.MediaPlaylist, keys []*m3u8.Key) int {
+	if ll == nil || len(ll.Parts) == 0 {
+		return 0
+	}
+	folder := media.Variant
+	parts := filepath.Join(folder, partsFolder)
+	v.shareInitTracks(folder, parts)
+
+	var wg sync.WaitGroup
+	verified := 0
+	for _, p := range ll.Parts {
+		p := p
+		index, ok := media.queuePart(p)
+		if !ok {
+			continue
+		}
+		if p.Gap {
+			v.infof("Partial segment %d of media sequence %d marked GAP, skipped: %s", p.Part, p.MediaSequence, p.URI)
+			continue
+		}
+		verified++
+
+		key := mp.Key
+		if position := int(p.MediaSequence - mp.SeqNo); p.MediaSequence >= mp.SeqNo && position < len(keys) && keys[position] != nil {
+			key = keys[position]
+		} else {
+			for _, k := range keys {
+				if k != nil {
+					key = k
+				}
+			}
+		}
+
+		started := v.pool.Go(ctx, &wg, func() {
+			defer v.failures.Recover(folder, p.URI)
+
+			segment := &m3u8.MediaSegment{SeqId: p.MediaSequence, URI: p.URI, Offset: p.Offset, Limit: p.Limit, Duration: p.Duration}
+			result, err := v.DecodeSegment(ctx, segment, key, parts, index)
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			media.addPart(&PartResult{Part: p.Part, SegmentResult: result})
+			if err != nil {
+				v.errorf("Partial segment %d of media sequence %d failed: %s", p.Part, p.MediaSequence, p.URI)
+				v.failures.Add(classOf(err), folder, p.URI, fmt.Errorf("part %d of media sequence %d: %w", p.Part, p.MediaSequence, err))
+			}
+		})
+		if !started {
+			break
+		}
+	}
+	wg.Wait()
+	return verified
+}
+
+// shareInitTracks records the tracks and bodies of the init segments of
+// folder for parts too, the folder its partial segments are verified under.
+func (v *Verifier) shareInitTracks(folder, parts string) {
+	v.initTracksMu.Lock()
+	tracks := v.initTracks[folder]
+	bodies := v.initBodies[folder]
+	v.initTracksMu.Unlock()
+	if len(tracks) > 0 {
+		v.addInitTracks(parts, tracks)
+	}
+	for m, body := range bodies {
+		m := m
+		v.addInitBody(parts, &m, body)
+	}
+}
+
+// followLowLatency reads the Low-Latency HLS declarations of raw, the
+// media playlist mp of media was loaded from base, verifying its new parts.
+// Malformed tags are only reported on the first load, when report is set.
+func (v *Verifier) followLowLatency(ctx context.Context, media *MediaResult, raw []byte, base string, mp *m3u8.MediaPlaylist, report bool) (*lowLatency, int) {
+	ll, errs := v.readLowLatency(raw, base, mp)
+	if ll == nil {
+		return nil, 0
+	}
+	if report {
+		if err := checkLowLatency(ll, errs); err != nil {
+			v.errorf("Low-Latency HLS declarations invalid on: %s", media.URI)
+			v.failures.Add(ClassCompliance, media.Variant, media.URI, err)
+		}
+		if len(ll.Parts) > 0 {
+			v.infof("Low-Latency HLS playlist %s: %d partial segments, PART-TARGET %gs, blocking reload %t", media.URI, len(ll.Parts), ll.PartTarget, ll.CanBlockReload)
+		}
+	}
+	for _, hint := range ll.Hints {
+		v.debugf("Preload hint of %s for %s: %s", hint.Type, media.URI, hint.URI)
+	}
+	return ll, v.verifyParts(ctx, media, ll, mp, segmentKeys(mp))
+}
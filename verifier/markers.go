@@ -0,0 +1,246 @@
+package verifier
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+const dateRangeTag = "#EXT-X-DATERANGE:"
+
+// markerTolerance is how far the break of an ad marker can last from its
+// advertised DURATION, END-DATE, PLANNED-DURATION or SCTE-35 break duration.
+const markerTolerance = 500 * time.Millisecond
+
+// Marker is an SCTE-35 ad marker carried by an EXT-X-DATERANGE of a media
+// playlist, with Type "out", "in" or "cmd" after its SCTE35-OUT, SCTE35-IN
+// or SCTE35-CMD attribute. MediaSequence and Offset place it before the
+// segment it precedes.
+type Marker struct {
+	ID              string        `json:"id"`
+	Class           string        `json:"class,omitempty"`
+	Type            string        `json:"type"`
+	StartDate       time.Time     `json:"start_date"`
+	EndDate         *time.Time    `json:"end_date,omitempty"`
+	Duration        float64       `json:"duration,omitempty"`
+	PlannedDuration float64       `json:"planned_duration,omitempty"`
+	MediaSequence   uint64        `json:"media_sequence"`
+	Offset          time.Duration `json:"offset"`
+	Command         string        `json:"command,omitempty"`
+	EventID         uint32        `json:"event_id,omitempty"`
+	BreakDuration   time.Duration `json:"break_duration,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
+func (m *Marker) String() string {
+	s := fmt.Sprintf("%s %s at media sequence %d (%s), START-DATE %s", m.Type, m.ID, m.MediaSequence, m.Offset, m.StartDate.Format(time.RFC3339Nano))
+	if m.Command != "" {
+		s += fmt.Sprintf(", %s event %d", m.Command, m.EventID)
+	}
+	if m.BreakDuration > 0 {
+		s += fmt.Sprintf(" breaking for %s", m.BreakDuration)
+	}
+	return s
+}
+
+// advertised returns how long the break m starts is advertised to last, by
+// its DURATION, END-DATE, PLANNED-DURATION or SCTE-35 break duration in that
+// order.
+func (m *Marker) advertised() (time.Duration, bool) {
+	switch {
+	case m.Duration > 0:
+		return time.Duration(m.Duration * float64(time.Second)), true
+	case m.EndDate != nil:
+		return m.EndDate.Sub(m.StartDate), true
+	case m.PlannedDuration > 0:
+		return time.Duration(m.PlannedDuration * float64(time.Second)), true
+	case m.BreakDuration > 0:
+		return m.BreakDuration, true
+	}
+	return 0, false
+}
+
+// readMarkers returns a Marker for every SCTE-35 attribute of the
+// EXT-X-DATERANGE tags of raw, the media playlist mp was decoded from, with
+// an error for every tag or payload that's malformed.
+func readMarkers(raw []byte, mp *m3u8.MediaPlaylist) ([]*Marker, []error) {
+	var markers []*Marker
+	var errs []error
+	seq := mp.SeqNo
+	var offset, pending time.Duration
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			extinf := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0]
+			if duration, err := strconv.ParseFloat(extinf, 64); err == nil {
+				pending = time.Duration(duration * float64(time.Second))
+			}
+		case strings.HasPrefix(line, dateRangeTag):
+			attrs := m3u8.DecodeAttributeList(strings.TrimPrefix(line, dateRangeTag))
+			found, err := dateRangeMarkers(attrs, seq, offset)
+			markers = append(markers, found...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			seq++
+			offset += pending
+			pending = 0
+		}
+	}
+	return markers, errs
+}
+
+// dateRangeMarkers returns the markers of the EXT-X-DATERANGE attributes
+// attrs, none when it has no SCTE-35 attribute.
+func dateRangeMarkers(attrs map[string]string, seq uint64, offset time.Duration) ([]*Marker, error) {
+	base := Marker{ID: attrs["ID"], Class: attrs["CLASS"], MediaSequence: seq, Offset: offset}
+	var errs []error
+	if base.ID == "" {
+		errs = append(errs, errors.New("EXT-X-DATERANGE without an ID"))
+	}
+	start, err := time.Parse(time.RFC3339Nano, attrs["START-DATE"])
+	if err != nil {
+		errs = append(errs, fmt.Errorf("EXT-X-DATERANGE %s without a valid START-DATE", base.ID))
+	}
+	base.StartDate = start
+	if value, ok := attrs["END-DATE"]; ok {
+		if end, err := time.Parse(time.RFC3339Nano, value); err != nil {
+			errs = append(errs, fmt.Errorf("EXT-X-DATERANGE %s has an invalid END-DATE %q", base.ID, value))
+		} else {
+			base.EndDate = &end
+		}
+	}
+	for name, target := range map[string]*float64{"DURATION": &base.Duration, "PLANNED-DURATION": &base.PlannedDuration} {
+		if value, ok := attrs[name]; ok {
+			if *target, err = strconv.ParseFloat(value, 64); err != nil || *target < 0 {
+				errs = append(errs, fmt.Errorf("EXT-X-DATERANGE %s has an invalid %s %q", base.ID, name, value))
+			}
+		}
+	}
+
+	var markers []*Marker
+	for _, kind := range []string{"out", "in", "cmd"} {
+		value, ok := attrs["SCTE35-"+strings.ToUpper(kind)]
+		if !ok {
+			continue
+		}
+		marker := base
+		marker.Type = kind
+		info, err := decodeSCTE35(value)
+		if err != nil {
+			err = fmt.Errorf("EXT-X-DATERANGE %s SCTE35-%s: %w", base.ID, strings.ToUpper(kind), err)
+			marker.Error = err.Error()
+			errs = append(errs, err)
+		} else {
+			marker.Command, marker.EventID = info.Command, info.EventID
+			if info.HasDuration {
+				marker.BreakDuration = info.Duration
+			}
+		}
+		markers = append(markers, &marker)
+	}
+	if len(markers) == 0 {
+		return nil, nil
+	}
+	return markers, errors.Join(errs...)
+}
+
+// checkMarkers prints the SCTE-35 marker timeline of the media playlist mp
+// decoded from raw under --check-markers, erroring on malformed markers, on
+// SCTE35-IN markers without an SCTE35-OUT before them and on breaks lasting
+// longer or shorter than advertised. An SCTE35-OUT left open only errors
+// once the playlist has an EXT-X-ENDLIST, as a live break may still end.
+func (v *Verifier) checkMarkers(media *MediaResult, raw []byte, mp *m3u8.MediaPlaylist) error {
+	markers, errs := readMarkers(raw, mp)
+	media.Markers = markers
+	if len(markers) == 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, marker := range markers {
+		v.infof("Marker of %s: %s", media.URI, marker)
+	}
+
+	// Breaks are paired by their EXT-X-DATERANGE ID, or by their SCTE-35
+	// event when the packager gives the SCTE35-IN its own ID.
+	var open []*Marker
+	for _, marker := range markers {
+		switch marker.Type {
+		case "out":
+			open = append(open, marker)
+		case "in":
+			paired := -1
+			for i, out := range open {
+				if out.ID == marker.ID || (paired < 0 && out.EventID != 0 && out.EventID == marker.EventID) {
+					paired = i
+				}
+			}
+			if paired < 0 {
+				errs = append(errs, fmt.Errorf("SCTE35-IN %s at media sequence %d has no SCTE35-OUT before it", marker.ID, marker.MediaSequence))
+				continue
+			}
+			out := open[paired]
+			open = append(open[:paired], open[paired+1:]...)
+			if err := checkBreakDuration(out, marker); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, out := range open {
+		if mp.Closed {
+			errs = append(errs, fmt.Errorf("SCTE35-OUT %s at media sequence %d is never followed by an SCTE35-IN", out.ID, out.MediaSequence))
+		} else {
+			v.infof("Ad break %s still open on live playlist: %s", out.ID, media.URI)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return newError(fmt.Sprintf("invalid SCTE-35 markers: %s", strings.ReplaceAll(err.Error(), "\n", "; ")))
+	}
+	return nil
+}
+
+// checkBreakDuration errors if the break from out to in lasts longer or
+// shorter than out advertises by more than markerTolerance, or when the
+// SCTE-35 break duration of out disagrees with its DURATION. The break ends
+// on the END-DATE of in, as set when it repeats the EXT-X-DATERANGE of out,
+// or else on its START-DATE.
+func checkBreakDuration(out, in *Marker) error {
+	end := in.StartDate
+	if in.EndDate != nil {
+		end = *in.EndDate
+	}
+	lasted := end.Sub(out.StartDate)
+	if lasted < 0 {
+		return fmt.Errorf("SCTE35-IN %s starts %s before its SCTE35-OUT", in.ID, -lasted)
+	}
+
+	advertised, ok := out.advertised()
+	if ok && absDuration(lasted-advertised) > markerTolerance {
+		return fmt.Errorf("break %s lasts %s but is advertised for %s", out.ID, lasted, advertised)
+	}
+	if out.Duration > 0 && out.BreakDuration > 0 {
+		if declared := time.Duration(out.Duration * float64(time.Second)); absDuration(declared-out.BreakDuration) > markerTolerance {
+			return fmt.Errorf("break %s has DURATION %g but an SCTE-35 break duration of %s", out.ID, out.Duration, out.BreakDuration)
+		}
+	}
+	return nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,224 @@
+package verifier
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchBuckets are the upper bounds, in seconds, of the segment fetch
+// duration histogram.
+var fetchBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics aggregates the segments verified by every Verifier it's set on
+// through Options, served in the Prometheus text format by ServeHTTP. It's
+// safe for use by multiple goroutines.
+type Metrics struct {
+	mu         sync.Mutex
+	renditions map[renditionKey]*renditionMetrics
+	httpErrors map[int]uint64
+}
+
+// renditionKey labels the metrics of a rendition, by its folder and the
+// uri of its media playlist.
+type renditionKey struct {
+	rendition string
+	uri       string
+}
+
+type renditionMetrics struct {
+	verified uint64
+	failed   uint64
+	failures map[ErrorClass]uint64
+
+	// fetches counts the segments fetched within every bucket of
+	// fetchBuckets, with one more for the ones above them all.
+	fetches    []uint64
+	fetchSum   float64
+	fetchCount uint64
+
+	reloadLag    time.Duration
+	hasReloadLag bool
+}
+
+// NewMetrics returns empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{renditions: make(map[renditionKey]*renditionMetrics), httpErrors: make(map[int]uint64)}
+}
+
+// rendition returns the metrics of media, creating them if absent. It must
+// be called with mu held.
+func (m *Metrics) rendition(media *MediaResult) *renditionMetrics {
+	key := renditionKey{rendition: media.Variant, uri: media.URI}
+	r, ok := m.renditions[key]
+	if !ok {
+		r = &renditionMetrics{failures: make(map[ErrorClass]uint64), fetches: make([]uint64, len(fetchBuckets)+1)}
+		m.renditions[key] = r
+	}
+	return r
+}
+
+// addSegment records the result of a segment of media. It does nothing on
+// nil Metrics, as every method of Metrics.
+func (m *Metrics) addSegment(media *MediaResult, segment *SegmentResult) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.rendition(media)
+	if segment.OK() {
+		r.verified++
+	} else {
+		r.failed++
+		r.failures[segment.Class]++
+	}
+
+	if segment.FetchDuration > 0 {
+		seconds := segment.FetchDuration.Seconds()
+		bucket := sort.SearchFloat64s(fetchBuckets, seconds)
+		r.fetches[bucket]++
+		r.fetchSum += seconds
+		r.fetchCount++
+	}
+}
+
+// addHTTPError records a response with an unexpected status code.
+func (m *Metrics) addHTTPError(status int) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.httpErrors[status]++
+}
+
+// setReloadLag records how long the live playlist of media went without
+// new segments as of its last reload.
+func (m *Metrics) setReloadLag(media *MediaResult, lag time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.rendition(media)
+	r.reloadLag = lag
+	r.hasReloadLag = true
+}
+
+// ServeHTTP writes m in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = m.Write(w)
+}
+
+// Write writes m to w in the Prometheus text format, sorted by label so
+// scrapes are stable.
+func (m *Metrics) Write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]renditionKey, 0, len(m.renditions))
+	for key := range m.renditions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, k int) bool {
+		if keys[i].uri != keys[k].uri {
+			return keys[i].uri < keys[k].uri
+		}
+		return keys[i].rendition < keys[k].rendition
+	})
+
+	var b strings.Builder
+	family := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	family("hlseverify_segments_verified_total", "counter", "Segments verified successfully.")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "hlseverify_segments_verified_total%s %d\n", key.labels(), m.renditions[key].verified)
+	}
+
+	family("hlseverify_segments_failed_total", "counter", "Segments that failed verification.")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "hlseverify_segments_failed_total%s %d\n", key.labels(), m.renditions[key].failed)
+	}
+
+	family("hlseverify_segment_failures_total", "counter", "Failed segments by failure class, such as padding or http.")
+	for _, key := range keys {
+		r := m.renditions[key]
+		classes := make([]string, 0, len(r.failures))
+		for class := range r.failures {
+			classes = append(classes, string(class))
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(&b, "hlseverify_segment_failures_total%s %d\n", key.labels("class", class), r.failures[ErrorClass(class)])
+		}
+	}
+
+	family("hlseverify_http_errors_total", "counter", "Manifest, key and segment responses with an unexpected status code.")
+	codes := make([]int, 0, len(m.httpErrors))
+	for code := range m.httpErrors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&b, "hlseverify_http_errors_total{code=\"%d\"} %d\n", code, m.httpErrors[code])
+	}
+
+	family("hlseverify_segment_fetch_duration_seconds", "histogram", "Time taken to download a segment.")
+	for _, key := range keys {
+		r := m.renditions[key]
+		var cumulative uint64
+		for i, bound := range fetchBuckets {
+			cumulative += r.fetches[i]
+			le := strconv.FormatFloat(bound, 'f', -1, 64)
+			fmt.Fprintf(&b, "hlseverify_segment_fetch_duration_seconds_bucket%s %d\n", key.labels("le", le), cumulative)
+		}
+		fmt.Fprintf(&b, "hlseverify_segment_fetch_duration_seconds_bucket%s %d\n", key.labels("le", "+Inf"), r.fetchCount)
+		fmt.Fprintf(&b, "hlseverify_segment_fetch_duration_seconds_sum%s %g\n", key.labels(), r.fetchSum)
+		fmt.Fprintf(&b, "hlseverify_segment_fetch_duration_seconds_count%s %d\n", key.labels(), r.fetchCount)
+	}
+
+	family("hlseverify_playlist_reload_lag_seconds", "gauge", "Time a live playlist went without new segments as of its last reload under --follow.")
+	for _, key := range keys {
+		if r := m.renditions[key]; r.hasReloadLag {
+			fmt.Fprintf(&b, "hlseverify_playlist_reload_lag_seconds%s %g\n", key.labels(), r.reloadLag.Seconds())
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labels formats the labels of k, followed by the extra name and value
+// pairs of extra.
+func (k renditionKey) labels(extra ...string) string {
+	pairs := append([]string{"rendition", k.rendition, "uri", k.uri}, extra...)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", pairs[i], escapeLabel(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// escapeLabel escapes a label value of the Prometheus text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
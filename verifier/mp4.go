@@ -0,0 +1,343 @@
+package verifier
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// mp4Box is a single ISO BMFF box, with Data holding its payload after the
+// size and type header.
+type mp4Box struct {
+	Type string
+	Data []byte
+}
+
+// readBoxes splits data into its boxes, stopping at the first one that
+// doesn't fit in data.
+func readBoxes(data []byte) []mp4Box {
+	var boxes []mp4Box
+	offset := 0
+	for len(data)-offset >= 8 {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		header := 8
+		switch size {
+		case 0:
+			size = len(data) - offset
+		case 1:
+			if len(data)-offset < 16 {
+				return boxes
+			}
+			size = int(binary.BigEndian.Uint64(data[offset+8:]))
+			header = 16
+		}
+		if size < header || size > len(data)-offset {
+			return boxes
+		}
+
+		boxes = append(boxes, mp4Box{
+			Type: string(data[offset+4 : offset+8]),
+			Data: data[offset+header : offset+size],
+		})
+		offset += size
+	}
+	return boxes
+}
+
+// childBoxes returns the boxes of type boxType directly inside data.
+func childBoxes(data []byte, boxType string) []mp4Box {
+	var children []mp4Box
+	for _, box := range readBoxes(data) {
+		if box.Type == boxType {
+			children = append(children, box)
+		}
+	}
+	return children
+}
+
+// tkhdTrackID returns the track ID of a tkhd box payload, whose creation
+// and modification times before it are 64 bits long on version 1.
+func tkhdTrackID(data []byte) (uint32, bool) {
+	offset := 12
+	if len(data) > 0 && data[0] == 1 {
+		offset = 20
+	}
+	if len(data) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data[offset:]), true
+}
+
+// initTrack is a track declared by the moov of an init segment, with the
+// timescale of its mdhd and the default sample duration of its trex, which
+// its fragments are timed by. Codec, Width and Height are read from its
+// sample description, for the CODECS and RESOLUTION of its variant.
+type initTrack struct {
+	Timescale       uint32
+	DefaultDuration uint32
+	Codec           string
+	Width           int
+	Height          int
+}
+
+// readInitTracks returns the tracks declared by the moov of an init segment,
+// by track ID.
+func readInitTracks(body []byte) map[uint32]initTrack {
+	tracks := make(map[uint32]initTrack)
+	for _, moov := range childBoxes(body, "moov") {
+		for _, trak := range childBoxes(moov.Data, "trak") {
+			for _, tkhd := range childBoxes(trak.Data, "tkhd") {
+				id, ok := tkhdTrackID(tkhd.Data)
+				if !ok {
+					continue
+				}
+				track := tracks[id]
+				for _, mdia := range childBoxes(trak.Data, "mdia") {
+					for _, mdhd := range childBoxes(mdia.Data, "mdhd") {
+						track.Timescale = mdhdTimescale(mdhd.Data)
+					}
+					for _, minf := range childBoxes(mdia.Data, "minf") {
+						for _, stbl := range childBoxes(minf.Data, "stbl") {
+							for _, stsd := range childBoxes(stbl.Data, "stsd") {
+								track.Codec, track.Width, track.Height = readSampleEntry(stsd.Data)
+							}
+						}
+					}
+				}
+				tracks[id] = track
+			}
+		}
+
+		for _, mvex := range childBoxes(moov.Data, "mvex") {
+			for _, trex := range childBoxes(mvex.Data, "trex") {
+				if len(trex.Data) < 16 {
+					continue
+				}
+				id := binary.BigEndian.Uint32(trex.Data[4:])
+				if track, ok := tracks[id]; ok {
+					track.DefaultDuration = binary.BigEndian.Uint32(trex.Data[12:])
+					tracks[id] = track
+				}
+			}
+		}
+	}
+	return tracks
+}
+
+// Sizes of the fields of a sample entry before its child boxes, after the
+// 8 bytes every sample entry starts with.
+const (
+	visualSampleEntrySize = 70
+	audioSampleEntrySize  = 20
+)
+
+// readSampleEntry returns the RFC 6381 codec of the first sample entry of an
+// stsd box payload, along with its width and height when it's video. The
+// codec of an encrypted encv or enca entry is its original format.
+func readSampleEntry(data []byte) (string, int, int) {
+	if len(data) < 8 {
+		return "", 0, 0
+	}
+	entries := readBoxes(data[8:])
+	if len(entries) == 0 {
+		return "", 0, 0
+	}
+	entry := entries[0]
+	format := entry.Type
+
+	var width, height int
+	var children []byte
+	switch format {
+	case "avc1", "avc3", "hvc1", "hev1", "dvh1", "dvhe", "av01", "vp09", "encv":
+		if len(entry.Data) >= 8+visualSampleEntrySize {
+			width = int(binary.BigEndian.Uint16(entry.Data[24:]))
+			height = int(binary.BigEndian.Uint16(entry.Data[26:]))
+			children = entry.Data[8+visualSampleEntrySize:]
+		}
+	case "mp4a", "ac-3", "ec-3", "Opus", "fLaC", "enca":
+		if len(entry.Data) >= 8+audioSampleEntrySize {
+			children = entry.Data[8+audioSampleEntrySize:]
+		}
+	}
+
+	if format == "encv" || format == "enca" {
+		for _, sinf := range childBoxes(children, "sinf") {
+			for _, frma := range childBoxes(sinf.Data, "frma") {
+				if len(frma.Data) >= 4 {
+					format = string(frma.Data[:4])
+				}
+			}
+		}
+	}
+
+	codec := format
+	if format == "avc1" || format == "avc3" {
+		for _, avcC := range childBoxes(children, "avcC") {
+			if len(avcC.Data) >= 4 {
+				codec = fmt.Sprintf("%s.%02X%02X%02X", format, avcC.Data[1], avcC.Data[2], avcC.Data[3])
+			}
+		}
+	}
+	return codec, width, height
+}
+
+// mdhdTimescale returns the timescale of an mdhd box payload, or 0 when
+// it's truncated. As with tkhd its times before it are 64 bits long on
+// version 1.
+func mdhdTimescale(data []byte) uint32 {
+	offset := 12
+	if len(data) > 0 && data[0] == 1 {
+		offset = 20
+	}
+	if len(data) < offset+4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data[offset:])
+}
+
+// fragmentTrack is a track fragment of a moof, with the total size of its
+// samples when every one of them could be sized. Ticks adds up the durations
+// of its samples in the timescale of the track, but for the Untimed ones
+// lasting the default duration of the init segment.
+type fragmentTrack struct {
+	ID          uint32
+	SampleBytes int64
+	Sized       bool
+	Ticks       uint64
+	Untimed     int64
+}
+
+// fragmentTracks reads the track ID, sample sizes and durations of every
+// traf of a moof payload, from their trun entries or the defaults of their
+// tfhd.
+func fragmentTracks(moof []byte) []fragmentTrack {
+	var tracks []fragmentTrack
+	for _, traf := range childBoxes(moof, "traf") {
+		tfhds := childBoxes(traf.Data, "tfhd")
+		if len(tfhds) == 0 || len(tfhds[0].Data) < 8 {
+			continue
+		}
+		tfhd := tfhds[0].Data
+		track := fragmentTrack{ID: binary.BigEndian.Uint32(tfhd[4:]), Sized: true}
+
+		// The default sample duration and size follow the optional base
+		// data offset and sample description index.
+		var defaultDuration, defaultSize uint32
+		hasDuration, hasDefault := false, false
+		flags := uint32(tfhd[1])<<16 | uint32(tfhd[2])<<8 | uint32(tfhd[3])
+		offset := 8
+		for _, field := range []struct {
+			flag uint32
+			size int
+		}{{0x01, 8}, {0x02, 4}} {
+			if flags&field.flag != 0 {
+				offset += field.size
+			}
+		}
+		if flags&0x08 != 0 {
+			if len(tfhd) >= offset+4 {
+				defaultDuration, hasDuration = binary.BigEndian.Uint32(tfhd[offset:]), true
+			}
+			offset += 4
+		}
+		if flags&0x10 != 0 && len(tfhd) >= offset+4 {
+			defaultSize, hasDefault = binary.BigEndian.Uint32(tfhd[offset:]), true
+		}
+
+		for _, trun := range childBoxes(traf.Data, "trun") {
+			size, ok := trunSampleBytes(trun.Data, defaultSize, hasDefault)
+			track.SampleBytes += size
+			track.Sized = track.Sized && ok
+
+			ticks, untimed := trunSampleTicks(trun.Data, defaultDuration, hasDuration)
+			track.Ticks += ticks
+			track.Untimed += untimed
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+// trunSampleBytes returns the total size of the samples of a trun payload,
+// falling back to defaultSize for samples without one. It's false when a
+// sample can't be sized or the box is truncated.
+func trunSampleBytes(data []byte, defaultSize uint32, hasDefault bool) (int64, bool) {
+	if len(data) < 8 {
+		return 0, false
+	}
+
+	flags := uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+	count := int64(binary.BigEndian.Uint32(data[4:]))
+	offset := 8
+	if flags&0x01 != 0 {
+		offset += 4
+	}
+	if flags&0x04 != 0 {
+		offset += 4
+	}
+
+	if flags&0x200 == 0 {
+		return count * int64(defaultSize), hasDefault
+	}
+
+	entry := 0
+	for _, flag := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&flag != 0 {
+			entry += 4
+		}
+	}
+	sizeAt := 0
+	if flags&0x100 != 0 {
+		sizeAt = 4
+	}
+	if int64(len(data)-offset) < count*int64(entry) {
+		return 0, false
+	}
+
+	var total int64
+	for i := int64(0); i < count; i++ {
+		total += int64(binary.BigEndian.Uint32(data[offset+int(i)*entry+sizeAt:]))
+	}
+	return total, true
+}
+
+// trunSampleTicks returns the total duration of the samples of a trun
+// payload, falling back to defaultDuration for samples without one, along
+// with the amount of samples left without a duration to fall back to.
+func trunSampleTicks(data []byte, defaultDuration uint32, hasDefault bool) (uint64, int64) {
+	if len(data) < 8 {
+		return 0, 0
+	}
+
+	flags := uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+	count := int64(binary.BigEndian.Uint32(data[4:]))
+	offset := 8
+	if flags&0x01 != 0 {
+		offset += 4
+	}
+	if flags&0x04 != 0 {
+		offset += 4
+	}
+
+	if flags&0x100 == 0 {
+		if !hasDefault {
+			return 0, count
+		}
+		return uint64(count) * uint64(defaultDuration), 0
+	}
+
+	entry := 0
+	for _, flag := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&flag != 0 {
+			entry += 4
+		}
+	}
+	if int64(len(data)-offset) < count*int64(entry) {
+		return 0, count
+	}
+
+	var total uint64
+	for i := int64(0); i < count; i++ {
+		total += uint64(binary.BigEndian.Uint32(data[offset+int(i)*entry:]))
+	}
+	return total, 0
+}
@@ -0,0 +1,192 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payload formats of the --notify-webhook requests.
+const (
+	NotifyFormatJSON  = "json"
+	NotifyFormatSlack = "slack"
+)
+
+// notifyMaxFailures bounds the failures detailed on a single notification,
+// the rest are only counted.
+const notifyMaxFailures = 20
+
+// notifyTimeout bounds a single --notify-webhook request.
+const notifyTimeout = 10 * time.Second
+
+// Notification is the JSON body of a --notify-webhook request, sent with the
+// failed segments and live playlist errors found since the previous one.
+type Notification struct {
+	Manifest string                `json:"manifest"`
+	RunID    string                `json:"run_id"`
+	Failures []NotificationFailure `json:"failures"`
+	Omitted  int                   `json:"omitted,omitempty"`
+}
+
+// NotificationFailure describes a failed segment of a Notification, or a
+// LiveError of its rendition when Segment is empty.
+type NotificationFailure struct {
+	Variant   string     `json:"variant"`
+	Rendition string     `json:"rendition"`
+	Segment   string     `json:"segment,omitempty"`
+	Class     ErrorClass `json:"class"`
+	Error     string     `json:"error"`
+}
+
+// notifier batches the failed segments and live playlist errors of a run,
+// posting them to the webhook at most once every interval so followed live
+// playlists don't send one request per segment. It's safe for use by multiple goroutines.
+type notifier struct {
+	v        *Verifier
+	manifest string
+
+	mu      sync.Mutex
+	pending []NotificationFailure
+	omitted int
+	timer   *time.Timer
+	sending sync.WaitGroup
+}
+
+func (v *Verifier) newNotifier(manifest string) *notifier {
+	return &notifier{v: v, manifest: manifest}
+}
+
+// add queues a failed segment of media.
+func (n *notifier) add(media *MediaResult, segment *SegmentResult) {
+	if n == nil || segment.OK() {
+		return
+	}
+	n.queue(NotificationFailure{
+		Variant:   media.Variant,
+		Rendition: media.URI,
+		Segment:   segment.URI,
+		Class:     segment.Class,
+		Error:     segment.Error,
+	})
+}
+
+// addLive queues a LiveError of the live playlist of media.
+func (n *notifier) addLive(media *MediaResult, liveErr *LiveError) {
+	if n == nil {
+		return
+	}
+	n.queue(NotificationFailure{
+		Variant:   media.Variant,
+		Rendition: media.URI,
+		Class:     ClassLive,
+		Error:     liveErr.Kind + ": " + liveErr.Error,
+	})
+}
+
+// queue queues failure, scheduling a notification after the interval
+// unless one is already.
+func (n *notifier) queue(failure NotificationFailure) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.pending) < notifyMaxFailures {
+		n.pending = append(n.pending, failure)
+	} else {
+		n.omitted++
+	}
+
+	if n.timer == nil {
+		n.sending.Add(1)
+		n.timer = time.AfterFunc(n.v.opts.NotifyInterval, func() {
+			defer n.sending.Done()
+			n.flush()
+		})
+	}
+}
+
+// close sends the failures still queued, waiting for notifications in
+// flight.
+func (n *notifier) close() {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	if n.timer != nil && n.timer.Stop() {
+		n.sending.Done()
+	}
+	n.mu.Unlock()
+
+	n.flush()
+	n.sending.Wait()
+}
+
+// flush sends the queued failures, if any.
+func (n *notifier) flush() {
+	n.mu.Lock()
+	notification := Notification{Manifest: n.manifest, RunID: n.v.opts.RunID, Failures: n.pending, Omitted: n.omitted}
+	n.pending, n.omitted, n.timer = nil, 0, nil
+	n.mu.Unlock()
+
+	if len(notification.Failures) == 0 {
+		return
+	}
+	if err := n.send(notification); err != nil {
+		n.v.warnf("Unable to send --notify-webhook of %d failures: %s", len(notification.Failures)+notification.Omitted, err.Error())
+	}
+}
+
+// send posts notification to the webhook in the format of NotifyFormat.
+func (n *notifier) send(notification Notification) error {
+	var payload interface{} = notification
+	if n.v.opts.NotifyFormat == NotifyFormatSlack {
+		payload = map[string]string{"text": notification.slackText()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.v.opts.NotifyWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook answered %s", res.Status)
+	}
+	return nil
+}
+
+// slackText formats n as the text of a Slack incoming webhook message.
+func (n Notification) slackText() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "hlseverify found %d failures on %s (run %s):", len(n.Failures)+n.Omitted, n.Manifest, n.RunID)
+	for _, failure := range n.Failures {
+		uri := failure.Segment
+		if uri == "" {
+			uri = failure.Rendition
+		}
+		fmt.Fprintf(&b, "\n• %s %s: %s, %s", failure.Variant, uri, failure.Class, failure.Error)
+	}
+	if n.Omitted > 0 {
+		fmt.Fprintf(&b, "\n…and %d more", n.Omitted)
+	}
+	return b.String()
+}
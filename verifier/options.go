@@ -0,0 +1,263 @@
+package verifier
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Options configures a Verifier. Every field mirrors a command-line flag of
+// hlseverify, documented on its --help.
+type Options struct {
+	// ManifestType is "master" or "media", the type of the manifest sent
+	// to Verify.
+	ManifestType string
+
+	// Client sends every request. When nil, a client is built from the TLS
+	// and connection options below, which are ignored otherwise.
+	Client *http.Client
+
+	// Fetchers send the requests of the uri schemes they're keyed by, in
+	// lower case, over the built-in ones reading file uris from disk and s3
+	// and gs uris from their bucket.
+	Fetchers map[string]Fetcher
+
+	// Metrics, when set, aggregates the segments verified for a
+	// Prometheus /metrics endpoint, and can be shared by many Verifiers.
+	Metrics *Metrics
+
+	// Logger receives what the run logs, with every request and segment
+	// result at debug level. When nil, text is logged to stdout, debug
+	// records included only when Verbose.
+	Logger *slog.Logger
+
+	// Output stores saved segments. When nil, they're written under
+	// OutputDir by an FSWriter.
+	Output OutputWriter
+
+	// OutputDir is the root every rendition folder is created under by the
+	// default Output. Only the files hlseverify writes are ever removed
+	// from it.
+	OutputDir string
+
+	// FolderNames is FolderNamesIndex or FolderNamesRendition, naming the
+	// folder of every rendition of a master manifest.
+	FolderNames string
+
+	// Token is sent as a Bearer Authorization header on every request.
+	// TokenCommand is run through the shell for a fresh one, printed on its
+	// stdout, when Token is empty and whenever a request is answered with a
+	// 401 or 403, which is then sent again.
+	Token        string
+	TokenCommand string
+
+	// Headers are "Key: Value" pairs set on every request, along with
+	// UserAgent when not empty. Cookies are "name=value" pairs joined into
+	// the Cookie header.
+	Headers   []string
+	Cookies   []string
+	UserAgent string
+
+	// RunID identifies the run on saved results and output folders. A new
+	// one is generated when empty.
+	RunID string
+
+	SaveSegments    bool
+	Concat          bool
+	OutputDirPerRun bool
+	ResultsPath     string
+	Verbose         bool
+	Trace           bool
+
+	RequireHTTPS  bool
+	NormalizeURIs bool
+	EscapeURIs    bool
+
+	DeepCheck      bool
+	NoPaddingCheck bool
+
+	// FFprobe decodes every decrypted segment with the ffprobe binary on
+	// FFprobePath, failing the ones it logs errors on.
+	FFprobe        bool
+	FFprobePath    string
+	DumpTails      bool
+	PrefetchKeys   bool
+	GunzipSegments bool
+
+	AudioOnly      bool
+	Iframes        bool
+	Follow         bool
+	FollowDuration time.Duration
+
+	// StallTargetDurations is how many target durations a followed
+	// playlist can go without new segments before it's failed as stalled,
+	// 0 to never fail it. Under PollTimeout it's only warned about.
+	StallTargetDurations int
+
+	// PollTimeout is how long a followed playlist can go without new
+	// segments before following it ends as a stream stalled, 0 to keep
+	// following it.
+	PollTimeout    time.Duration
+	CompareMethods bool
+	Concurrency    int
+
+	// RenditionConcurrency bounds the segments of a single rendition
+	// verified at once, within the Concurrency of the whole run.
+	RenditionConcurrency int
+
+	SkipSegmentCounts bool
+
+	// SimulatePlayback verifies the segments of every rendition one at a
+	// time at the pace of a player, PlaybackSpeed times faster.
+	SimulatePlayback bool
+	PlaybackSpeed    float64
+
+	// CheckMediaDurations measures the media of every decrypted segment
+	// from its timestamps, failing it when it drifts from its EXTINF by more
+	// than MediaDurationTolerance or exceeds the EXT-X-TARGETDURATION.
+	CheckMediaDurations    bool
+	MediaDurationTolerance time.Duration
+
+	// CheckAlignment compares the media playlists of every video rendition
+	// of a master manifest, failing the ones whose segments don't line up
+	// with the first within AlignmentTolerance.
+	CheckAlignment     bool
+	AlignmentTolerance time.Duration
+
+	// CheckMarkers decodes the SCTE-35 payloads of the EXT-X-DATERANGE
+	// tags of every media playlist, validating their pairing and durations.
+	CheckMarkers bool
+
+	// CheckProgramDateTime requires the EXT-X-PROGRAM-DATE-TIME tags of
+	// every media playlist to be present and to follow its segment
+	// durations, with the live edge within MaxClockSkew of the wall clock.
+	CheckProgramDateTime bool
+	MaxClockSkew         time.Duration
+
+	// CachePath is the JSON index of the segments verified by previous
+	// runs, which are skipped while the origin answers they're unchanged
+	// to a conditional request, "" to verify every segment. DefaultCachePath
+	// is where the CLI keeps it. NoCache verifies every segment anyway.
+	CachePath string
+	NoCache   bool
+
+	// VerifyChecksums is the OutputDir of a previous SaveSegments run,
+	// whose checksum manifest of every rendition the segments must match.
+	VerifyChecksums string
+
+	// Sample is every=N or percent=P to only verify a sample of the
+	// segments of every rendition, with SampleSeed repeating a percent one.
+	Sample     string
+	SampleSeed int64
+
+	// VariantBandwidth, MinBandwidth, MaxBandwidth, Resolution and
+	// AudioGroup filter the variants of a master manifest, when set.
+	VariantBandwidth int64
+	MinBandwidth     int64
+	MaxBandwidth     int64
+	Resolution       string
+	AudioGroup       string
+
+	SegmentOrigin string
+	CompareOrigin string
+
+	// NoRecheck stops segments whose padding, container or bytes fail
+	// verification from being fetched a second time, from CompareHost when
+	// set, to tell persistent failures from transient or edge-specific ones.
+	NoRecheck   bool
+	CompareHost string
+
+	AssertSegmentCount int
+
+	// DominantByteRatio, when set, fails segments that decrypt with a valid
+	// padding but are at least that ratio a single repeated byte, as wrong
+	// keys can decrypt to. Off by default, as silence or black frames can
+	// be valid low-entropy segments.
+	DominantByteRatio float64
+
+	MaxDuration       time.Duration
+	ExpectedDuration  time.Duration
+	DurationTolerance time.Duration
+	MaxTotalBytes     int64
+	RequestTimeout    time.Duration
+	Retries           int
+	RetryBackoff      time.Duration
+
+	// ConnectTimeout bounds dialing a connection, and IdleConnsPerHost the
+	// connections kept open to every host between requests, Concurrency
+	// when 0.
+	ConnectTimeout   time.Duration
+	IdleConnsPerHost int
+
+	// Proxy is an http, https or socks5 URL every request is sent through.
+	// When empty, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored.
+	Proxy string
+
+	DisableKeepAlive   bool
+	ParallelVariants   bool
+	RequireInitSegment bool
+	ValidateBandwidth  bool
+
+	TLSMinVersion   string
+	TLSCipherSuites []string
+	CACert          string
+	Insecure        bool
+
+	// ClientCert and ClientKey are the PEM certificate and private key
+	// presented to origins requiring mutual TLS.
+	ClientCert string
+	ClientKey  string
+
+	RequiredSessionData []string
+
+	KeyMethod string
+	KeyBody   string
+
+	// KeyHeaders are "Key: Value" pairs set on key requests only, over
+	// Headers, for the license or token headers of a key server.
+	KeyHeaders []string
+
+	// KeyHex and KeyFiles supply keys instead of fetching them, as
+	// [MATCH=]VALUE pairs matching a key uri, media playlist uri or
+	// rendition folder, or every key without MATCH.
+	KeyHex   []string
+	KeyFiles []string
+
+	ManifestQuery []string
+	SegmentQuery  []string
+	KeyQuery      []string
+
+	// NotifyWebhook is posted the failed segments of a run in NotifyFormat,
+	// batched so at most one request is sent every NotifyInterval.
+	NotifyWebhook  string
+	NotifyFormat   string
+	NotifyInterval time.Duration
+}
+
+// DefaultOptions returns the Options hlseverify runs with when no flags are
+// sent.
+func DefaultOptions() Options {
+	return Options{
+		ManifestType:           "master",
+		OutputDir:              "hlseverify-out",
+		FolderNames:            FolderNamesIndex,
+		Concurrency:            16,
+		RenditionConcurrency:   8,
+		Retries:                3,
+		RetryBackoff:           250 * time.Millisecond,
+		RequestTimeout:         2 * time.Minute,
+		ConnectTimeout:         10 * time.Second,
+		AssertSegmentCount:     -1,
+		DurationTolerance:      time.Second,
+		MediaDurationTolerance: 250 * time.Millisecond,
+		AlignmentTolerance:     500 * time.Millisecond,
+		MaxClockSkew:           30 * time.Second,
+		StallTargetDurations:   3,
+		ParallelVariants:       true,
+		KeyMethod:              http.MethodGet,
+		FFprobePath:            "ffprobe",
+		PlaybackSpeed:          1,
+		NotifyFormat:           NotifyFormatJSON,
+		NotifyInterval:         10 * time.Second,
+	}
+}
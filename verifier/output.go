@@ -0,0 +1,193 @@
+package verifier
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Status is the verdict of a segment handed to an OutputWriter.
+type Status int
+
+// Statuses a segment or init segment can be written with.
+const (
+	SegmentValid Status = iota
+	SegmentInvalid
+	InitValid
+	InitInvalid
+)
+
+// OutputWriter stores the segments that are saved while verifying, either
+// because they failed verification or because --save was sent.
+type OutputWriter interface {
+	// Write stores the decrypted data of the segment at index of variant.
+	Write(variant string, index int, status Status, data []byte) error
+}
+
+// OutputResetter is implemented by an OutputWriter that can discard the
+// previous output of a variant before it's verified again.
+type OutputResetter interface {
+	Reset(variant string) error
+}
+
+// OutputStreamer is implemented by an OutputWriter that can store a segment
+// as it's decrypted, so segments too large to hold in memory are written as
+// they're downloaded. Segments are written whole to an OutputWriter that
+// isn't one.
+type OutputStreamer interface {
+	// Create starts writing the segment at index of variant, stored with
+	// the status it's committed with.
+	Create(variant string, index int) (SegmentFile, error)
+}
+
+// OutputFileWriter is implemented by an OutputWriter that can also store the
+// other files of a variant, like the checksum manifest written under --save.
+// They aren't written to an OutputWriter that isn't one.
+type OutputFileWriter interface {
+	// WriteFile stores data as the file name of variant.
+	WriteFile(variant, name string, data []byte) error
+}
+
+// SegmentFile is a segment being written by an OutputStreamer.
+type SegmentFile interface {
+	io.Writer
+
+	// Commit stores what was written as the segment, with status.
+	Commit(status Status) error
+
+	// Discard drops what was written without storing it.
+	Discard() error
+}
+
+// filePrefixes maps each Status to the prefix of the files FSWriter writes.
+var filePrefixes = map[Status]string{
+	SegmentValid:   "segment",
+	SegmentInvalid: "error_segment",
+	InitValid:      "init",
+	InitInvalid:    "error_init",
+}
+
+// FSWriter is the default OutputWriter, writing every variant to its own
+// folder under Root, or the current directory if Root is empty.
+type FSWriter struct {
+	Root string
+}
+
+func (w FSWriter) Write(variant string, index int, status Status, data []byte) error {
+	return w.WriteFile(variant, filepath.Base(w.path(variant, index, status)), data)
+}
+
+// WriteFile writes data to the file name in the folder of variant.
+func (w FSWriter) WriteFile(variant, name string, data []byte) error {
+	folder := filepath.Join(w.Root, variant)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(filepath.Join(folder, name), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Create writes the segment at index of variant to a temporary file of its
+// folder, renamed to the file of its status once committed.
+func (w FSWriter) Create(variant string, index int) (SegmentFile, error) {
+	folder := filepath.Join(w.Root, variant)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	out, err := os.CreateTemp(folder, ".write-*")
+	if err != nil {
+		return nil, err
+	}
+	if err = out.Chmod(0o644); err != nil {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+		return nil, err
+	}
+	return &fsSegmentFile{File: out, writer: w, variant: variant, index: index}, nil
+}
+
+// fsSegmentFile is a SegmentFile of an FSWriter.
+type fsSegmentFile struct {
+	*os.File
+	writer  FSWriter
+	variant string
+	index   int
+}
+
+func (f *fsSegmentFile) Commit(status Status) error {
+	err := f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), f.writer.path(f.variant, f.index, status))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+func (f *fsSegmentFile) Discard() error {
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// path returns the file the segment at index of variant is written to with
+// status.
+func (w FSWriter) path(variant string, index int, status Status) string {
+	return filepath.Join(w.Root, variant, fmt.Sprintf("%s%d.m4f", filePrefixes[status], index))
+}
+
+// WriteFileAtomic writes path through a temporary file in its folder that's
+// only renamed to it once write succeeds, so a run stopped midway never
+// leaves a half-written file behind.
+func WriteFileAtomic(path string, write func(io.Writer) error) error {
+	out, err := os.CreateTemp(filepath.Dir(path), ".write-*")
+	if err != nil {
+		return err
+	}
+
+	// Temporary files are only readable by their owner, unlike the files
+	// os.Create would write.
+	err = out.Chmod(0o644)
+	if err == nil {
+		err = write(out)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(out.Name())
+	}
+	return err
+}
+
+// Reset removes the files previously written for variant, and its folder
+// once empty. Anything else in the folder is left untouched, so pointing
+// Root at a populated directory never loses unrelated files.
+func (w FSWriter) Reset(variant string) error {
+	folder := filepath.Join(w.Root, variant)
+	for _, prefix := range filePrefixes {
+		files, err := filepath.Glob(filepath.Join(folder, prefix+"[0-9]*.m4f"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err = os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	// Removing a folder fails if it isn't empty, which keeps foreign files.
+	_ = os.Remove(folder)
+	return nil
+}
@@ -0,0 +1,122 @@
+package verifier
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestVerifyWritesUnderOutputRoot(t *testing.T) {
+	tests := []struct {
+		name        string
+		folderNames string
+		perRun      bool
+	}{
+		{name: "index folders", folderNames: FolderNamesIndex},
+		{name: "rendition folders", folderNames: FolderNamesRendition},
+		{name: "per run folders", folderNames: FolderNamesIndex, perRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.add("/master.m3u8", []byte("#EXTM3U\n"+
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="../aac",NAME="../../escape",DEFAULT=YES,AUTOSELECT=YES,URI="audio/index.m3u8"`+"\n"+
+				"#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=640x360,AUDIO=\"../aac\"\nvideo/index.m3u8\n"))
+			stream.addMedia("/video/index.m3u8", 2)
+			stream.addMedia("/audio/index.m3u8", 2)
+			// Decrypts to a last byte of 0, so an error segment is written too.
+			stream.add("/video/seg1.ts", encryptBlocks(testKey, sequenceIV(1), make([]byte, 64)))
+
+			// The working directory holds files named like the output of a
+			// run, which must be left alone.
+			cwd := t.TempDir()
+			root := filepath.Join(cwd, "out")
+			foreign := []string{
+				filepath.Join(cwd, "video_0", "segment0.m4f"),
+				filepath.Join(cwd, "audio_0_0", "keep.txt"),
+				filepath.Join(cwd, "segment0.m4f"),
+				filepath.Join(root, "video_0", "notes.txt"),
+			}
+			for _, path := range foreign {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("keep"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// A segment left by an earlier run is the only file removed.
+			stale := filepath.Join(root, "video_0", "segment9.m4f")
+			if err := os.WriteFile(stale, []byte("stale"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			chdir(t, cwd)
+
+			v := newTestVerifier(t, func(opts *Options) {
+				opts.ManifestType = "master"
+				opts.OutputDir = root
+				opts.FolderNames = tt.folderNames
+				opts.OutputDirPerRun = tt.perRun
+				opts.SaveSegments = true
+				opts.NoRecheck = true
+			})
+			for run := 0; run < 2; run++ {
+				if _, err := v.Verify(context.Background(), stream.uri("/master.m3u8")); err == nil {
+					t.Fatal("Verify() error = nil, want the padding failure")
+				}
+			}
+
+			var written []string
+			err := filepath.WalkDir(cwd, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				if slices.Contains(foreign, path) {
+					body, err := os.ReadFile(path)
+					if err != nil || string(body) != "keep" {
+						t.Errorf("%s was changed", path)
+					}
+					return err
+				}
+				written = append(written, path)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range foreign {
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("%s was removed: %v", path, err)
+				}
+			}
+			if _, err := os.Stat(stale); tt.folderNames == FolderNamesIndex && !tt.perRun && err == nil {
+				t.Errorf("%s of an earlier run wasn't removed", stale)
+			}
+			if len(written) == 0 {
+				t.Fatal("Verify() wrote no segments")
+			}
+			for _, path := range written {
+				if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+					t.Errorf("%s was written outside of %s", path, root)
+				}
+			}
+		})
+	}
+}
+
+// chdir changes the working directory to dir until t ends.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+}
@@ -0,0 +1,91 @@
+package verifier
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// pdtTolerance is how far an EXT-X-PROGRAM-DATE-TIME can be from the one
+// before it plus the EXTINF of the segments in between.
+const pdtTolerance = 500 * time.Millisecond
+
+// checkProgramDateTime errors under --check-pdt unless the first segment of
+// mp with a media sequence number of at least fromSeq, and every one after
+// an EXT-X-DISCONTINUITY, has an EXT-X-PROGRAM-DATE-TIME, and every one of
+// them follows the one before by the EXTINF in between. The live edge of a
+// playlist without EXT-X-ENDLIST must also be within --max-clock-skew of
+// the wall clock, reported once per rendition.
+func (v *Verifier) checkProgramDateTime(media *MediaResult, mp *m3u8.MediaPlaylist, fromSeq uint64) error {
+	var errs []error
+	var previous time.Time
+	var elapsed, last time.Duration
+	var edge time.Time
+	first := true
+
+	for i := 0; i < int(mp.Count()); i++ {
+		segment := mp.Segments[i]
+		if segment == nil {
+			continue
+		}
+		duration := time.Duration(segment.Duration * float64(time.Second))
+		if segment.SeqId < fromSeq {
+			// Earlier segments are only followed up to fromSeq, so jumps
+			// between them and the new ones are still found.
+			if !segment.ProgramDateTime.IsZero() {
+				previous, elapsed = segment.ProgramDateTime, 0
+			}
+			if segment.Discontinuity {
+				previous = time.Time{}
+			}
+			elapsed += duration
+			continue
+		}
+
+		pdt := segment.ProgramDateTime
+		switch {
+		case pdt.IsZero() && (first && previous.IsZero() || segment.Discontinuity):
+			errs = append(errs, fmt.Errorf("segment at media sequence %d has no EXT-X-PROGRAM-DATE-TIME", segment.SeqId))
+		case pdt.IsZero():
+		case segment.Discontinuity || previous.IsZero():
+		case !pdt.After(previous):
+			errs = append(errs, fmt.Errorf("EXT-X-PROGRAM-DATE-TIME %s at media sequence %d doesn't increase from %s", pdt.Format(time.RFC3339Nano), segment.SeqId, previous.Format(time.RFC3339Nano)))
+		case absDuration(pdt.Sub(previous)-elapsed) > pdtTolerance:
+			errs = append(errs, fmt.Errorf(
+				"EXT-X-PROGRAM-DATE-TIME at media sequence %d jumps %s after the one before, whose segments last %s",
+				segment.SeqId,
+				pdt.Sub(previous),
+				elapsed,
+			))
+		}
+		first = false
+
+		if !pdt.IsZero() {
+			previous, elapsed = pdt, 0
+		} else if segment.Discontinuity {
+			previous = time.Time{}
+		}
+		elapsed += duration
+		if !previous.IsZero() {
+			edge, last = previous, elapsed
+		}
+	}
+
+	if !mp.Closed && !edge.IsZero() && !media.clockSkewed {
+		if skew := time.Since(edge.Add(last)); absDuration(skew) > v.opts.MaxClockSkew {
+			media.clockSkewed = true
+			errs = append(errs, fmt.Errorf("live edge at %s is %s away from the wall clock", edge.Add(last).Format(time.RFC3339Nano), skew.Round(time.Millisecond)))
+		} else {
+			v.debugf("Live edge of %s is %s behind the wall clock", media.URI, skew.Round(time.Millisecond))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		v.errorf("EXT-X-PROGRAM-DATE-TIME invalid on: %s", media.URI)
+		return newError(fmt.Sprintf("invalid EXT-X-PROGRAM-DATE-TIME: %s", strings.ReplaceAll(err.Error(), "\n", "; ")))
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// Plan is what a run would download, as found by --dry-run from the
+// playlists alone. Segments without a byte range are sized through HEAD
+// requests, the ones whose size is still unknown are counted as Unsized.
+type Plan struct {
+	URI              string              `json:"uri"`
+	Renditions       []*PlannedRendition `json:"renditions"`
+	Segments         int                 `json:"segments"`
+	Bytes            int64               `json:"bytes"`
+	Unsized          int                 `json:"unsized,omitempty"`
+	KeyURIs          []string            `json:"key_uris,omitempty"`
+	EstimatedRuntime time.Duration       `json:"estimated_runtime"`
+}
+
+// PlannedRendition is a rendition of a Plan, with the media duration and
+// bytes of its segments and init segments.
+type PlannedRendition struct {
+	Rendition
+	Duration time.Duration `json:"duration"`
+	Bytes    int64         `json:"bytes"`
+	Unsized  int           `json:"unsized,omitempty"`
+	KeyURIs  []string      `json:"key_uris,omitempty"`
+}
+
+// planTimings measures the requests of a Plan, which the runtime of the
+// run is estimated from.
+type planTimings struct {
+	mu       sync.Mutex
+	requests int
+	elapsed  time.Duration
+	bytes    int64
+	fetching time.Duration
+}
+
+func (t *planTimings) addRequest(elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests++
+	t.elapsed += elapsed
+}
+
+func (t *planTimings) addDownload(bytes int, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bytes += int64(bytes)
+	t.fetching += elapsed
+	t.requests++
+	t.elapsed += elapsed
+}
+
+// Plan fetches and parses the playlists of the manifest on uri, returning
+// the renditions, segments, bytes and keys Verify would download, without
+// downloading any media.
+func (v *Verifier) Plan(ctx context.Context, uri string) (*Plan, error) {
+	v.reset()
+
+	var renditions []*Rendition
+	switch v.opts.ManifestType {
+	case "master":
+		var err error
+		if renditions, err = v.listRenditions(ctx, uri); err != nil {
+			return nil, err
+		}
+	case "media":
+		renditions = []*Rendition{{Type: "media", URI: uri}}
+	}
+
+	plan := &Plan{URI: uri}
+	timings := &planTimings{}
+	seenKeys := make(map[string]bool)
+	for _, rendition := range renditions {
+		// Closed captions are carried in the video and have no playlist.
+		if rendition.URI == "" || (rendition.Type == "iframe" && !v.opts.Iframes) {
+			continue
+		}
+		planned := &PlannedRendition{Rendition: *rendition}
+		v.planRendition(ctx, planned, timings)
+		plan.Renditions = append(plan.Renditions, planned)
+
+		if planned.SegmentCount != nil {
+			plan.Segments += *planned.SegmentCount
+		}
+		plan.Bytes += planned.Bytes
+		plan.Unsized += planned.Unsized
+		for _, keyURI := range planned.KeyURIs {
+			if !seenKeys[keyURI] {
+				seenKeys[keyURI] = true
+				plan.KeyURIs = append(plan.KeyURIs, keyURI)
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return plan, err
+	}
+
+	plan.EstimatedRuntime = v.estimateRuntime(plan, timings)
+	return plan, nil
+}
+
+// planRendition fills planned from its media playlist, storing any error
+// on it.
+func (v *Verifier) planRendition(ctx context.Context, planned *PlannedRendition, timings *planTimings) {
+	start := time.Now()
+	raw, base, mp, err := v.loadMedia(ctx, planned.URI)
+	if err != nil {
+		planned.Error = err.Error()
+		return
+	}
+	timings.addDownload(len(raw), time.Since(start))
+
+	keys := segmentKeys(mp)
+	planned.Encryption, planned.KeyURIs = keySummary(mp, keys)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	size := func(uri string, limit int64) {
+		if limit > 0 {
+			mu.Lock()
+			planned.Bytes += limit
+			mu.Unlock()
+			return
+		}
+		started := v.pool.Go(ctx, &wg, func() {
+			length, elapsed, err := v.contentLength(ctx, uri)
+			timings.addRequest(elapsed)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || length < 0 {
+				planned.Unsized++
+				return
+			}
+			planned.Bytes += length
+		})
+		if !started {
+			mu.Lock()
+			planned.Unsized++
+			mu.Unlock()
+		}
+	}
+
+	count := 0
+	seenMaps := make(map[m3u8.Map]bool)
+	for _, segment := range mp.Segments {
+		if segment == nil {
+			continue
+		}
+		count++
+		planned.Duration += time.Duration(segment.Duration * float64(time.Second))
+
+		if segment.Map != nil && !seenMaps[*segment.Map] {
+			seenMaps[*segment.Map] = true
+			if initURI, err := v.resolveSegmentURI(base, segment.Map.URI); err == nil {
+				size(initURI, segment.Map.Limit)
+			}
+		}
+		size(segment.URI, segment.Limit)
+	}
+	wg.Wait()
+	planned.SegmentCount = &count
+}
+
+// contentLength returns the Content-Length of a HEAD request for uri, or -1
+// when the origin doesn't send one, along with how long it took.
+func (v *Verifier) contentLength(ctx context.Context, uri string) (int64, time.Duration, error) {
+	uri, err := withQuery(uri, v.opts.SegmentQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	req, err := v.newRequest(ctx, http.MethodHead, uri, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := time.Now()
+	res, err := v.do(req)
+	if err != nil {
+		return 0, time.Since(start), err
+	}
+	_ = res.Body.Close()
+	elapsed := time.Since(start)
+	if err = v.checkStatus(uri, res); err != nil {
+		return 0, elapsed, err
+	}
+	return res.ContentLength, elapsed, nil
+}
+
+// estimateRuntime estimates how long verifying plan takes, with a request
+// per segment and key spread across --concurrency at the mean latency of
+// the requests of the plan, plus its bytes at the throughput its playlists
+// were downloaded at. Playlists are small, so it's a rough, pessimistic
+// estimate.
+func (v *Verifier) estimateRuntime(plan *Plan, timings *planTimings) time.Duration {
+	if timings.requests == 0 {
+		return 0
+	}
+	latency := timings.elapsed / time.Duration(timings.requests)
+	requests := plan.Segments + len(plan.KeyURIs)
+	estimate := latency * time.Duration((requests+v.opts.Concurrency-1)/v.opts.Concurrency)
+
+	if timings.fetching > 0 && timings.bytes > 0 {
+		throughput := float64(timings.bytes) / timings.fetching.Seconds()
+		estimate += time.Duration(float64(plan.Bytes) / throughput * float64(time.Second) / float64(v.opts.Concurrency))
+	}
+	return estimate
+}
+
+// Print prints the renditions of p, followed by its totals.
+func (p *Plan) Print() {
+	fmt.Printf("\nPlan for %s:\n", p.URI)
+	for _, r := range p.Renditions {
+		var declared []string
+		if r.Bandwidth > 0 {
+			declared = append(declared, fmt.Sprintf("%d bps", r.Bandwidth))
+		}
+		for _, value := range []string{r.Resolution, r.Codecs, r.Language} {
+			if value != "" {
+				declared = append(declared, value)
+			}
+		}
+		name := r.Type
+		if len(declared) > 0 {
+			name += " (" + strings.Join(declared, ", ") + ")"
+		}
+
+		if r.Error != "" {
+			fmt.Printf("  %s %s: %s\n", name, r.URI, r.Error)
+			continue
+		}
+		fmt.Printf("  %s %s: %d segments, %s of media, %d bytes%s, %s", name, r.URI, *r.SegmentCount, r.Duration, r.Bytes, unsized(r.Unsized), r.Encryption)
+		if len(r.KeyURIs) > 0 {
+			fmt.Printf(" with %d keys", len(r.KeyURIs))
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("  total: %d renditions, %d segments, %d bytes%s, %d keys required\n", len(p.Renditions), p.Segments, p.Bytes, unsized(p.Unsized), len(p.KeyURIs))
+	for _, keyURI := range p.KeyURIs {
+		fmt.Printf("    key: %s\n", keyURI)
+	}
+	fmt.Printf("  estimated runtime: %s\n", p.EstimatedRuntime.Round(time.Millisecond))
+}
+
+// unsized describes the amount of segments of unknown size on a Plan.
+func unsized(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d segments of unknown size)", n)
+}
+
+// WriteJSON writes p to w as indented JSON.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
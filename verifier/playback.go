@@ -0,0 +1,61 @@
+package verifier
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// playSegments verifies the queued segments of media one at a time as a
+// player would request them, every segment once the ones before it would
+// have played at PlaybackSpeed, or right away when their downloads took
+// longer than that. Renditions are still verified at once, each taking a
+// single slot of the pool shared by the whole run.
+func (v *Verifier) playSegments(ctx context.Context, media *MediaResult, queue []queuedSegment, verify func(queuedSegment)) {
+	v.infof("Simulating playback of %s at %gx speed", media.URI, v.opts.PlaybackSpeed)
+
+	due := time.Now()
+	for n, queued := range queue {
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		if !v.pool.acquire(ctx) {
+			for range queue[n:] {
+				media.addSkipped()
+			}
+			return
+		}
+
+		verify(queued)
+		v.pool.release()
+		due = due.Add(playbackDuration(queued.segment, v.opts.PlaybackSpeed))
+	}
+}
+
+// checkRebuffer flags result as a rebuffer risk when segment took longer to
+// download than to play at PlaybackSpeed.
+func (v *Verifier) checkRebuffer(segment *m3u8.MediaSegment, result *SegmentResult) {
+	playback := playbackDuration(segment, v.opts.PlaybackSpeed)
+	if result.FetchDuration <= playback || playback == 0 {
+		return
+	}
+
+	result.RebufferRisk = true
+	v.warnf(
+		"%s took %s to download but plays for %s, risking a rebuffer",
+		result.URI,
+		roundFetch(result.FetchDuration),
+		roundFetch(playback),
+	)
+}
+
+// playbackDuration returns how long segment plays for at speed.
+func playbackDuration(segment *m3u8.MediaSegment, speed float64) time.Duration {
+	return time.Duration(segment.Duration / speed * float64(time.Second))
+}
@@ -0,0 +1,53 @@
+package verifier
+
+import (
+	"context"
+	"sync"
+)
+
+// workerPool bounds the amount of segments verified at once across the
+// whole run, so large masters don't open thousands of connections.
+type workerPool struct {
+	slots chan struct{}
+}
+
+func newWorkerPool(size int) *workerPool {
+	return &workerPool{slots: make(chan struct{}, size)}
+}
+
+// acquire blocks until a slot of p is free, returning false without taking
+// one if ctx is done first.
+func (p *workerPool) acquire(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a slot taken by acquire.
+func (p *workerPool) release() {
+	<-p.slots
+}
+
+// Go runs task on a new goroutine tracked by wg once a slot is free,
+// blocking until then. Tasks submitted in order are started in order. It
+// returns false without running task if ctx is done first.
+func (p *workerPool) Go(ctx context.Context, wg *sync.WaitGroup, task func()) bool {
+	if !p.acquire(ctx) {
+		return false
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer p.release()
+		task()
+	}()
+	return true
+}
@@ -0,0 +1,53 @@
+package verifier
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerifyBoundsConcurrency(t *testing.T) {
+	tests := []struct {
+		concurrency          int
+		renditionConcurrency int
+		want                 int
+	}{
+		{concurrency: 1, renditionConcurrency: 8, want: 1},
+		{concurrency: 3, renditionConcurrency: 8, want: 3},
+		{concurrency: 8, renditionConcurrency: 2, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d/%d", tt.concurrency, tt.renditionConcurrency), func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.delay = 5 * time.Millisecond
+			stream.add("/master.m3u8", []byte("#EXTM3U\n"+
+				"#EXT-X-STREAM-INF:BANDWIDTH=1000000\nlow/index.m3u8\n"+
+				"#EXT-X-STREAM-INF:BANDWIDTH=2000000\nhigh/index.m3u8\n"))
+			stream.addMedia("/low/index.m3u8", 12)
+			stream.addMedia("/high/index.m3u8", 12)
+
+			transport := newCountingTransport()
+			v := newTestVerifier(t, func(opts *Options) {
+				opts.ManifestType = "master"
+				opts.Client = &http.Client{Transport: transport}
+				opts.Concurrency = tt.concurrency
+				opts.RenditionConcurrency = tt.renditionConcurrency
+			})
+			report, err := v.Verify(context.Background(), stream.uri("/master.m3u8"))
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if report.Totals.Verified != 24 {
+				t.Errorf("Verify() verified %d segments, want 24", report.Totals.Verified)
+			}
+			if transport.maxInFlight > tt.want {
+				t.Errorf("%d segments were in flight at once, want at most %d", transport.maxInFlight, tt.want)
+			}
+			if tt.want > 1 && transport.maxInFlight < 2 {
+				t.Errorf("segments were fetched one at a time, want up to %d at once", tt.want)
+			}
+		})
+	}
+}
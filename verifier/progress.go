@@ -0,0 +1,179 @@
+package verifier
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is a snapshot of the segments of a running verification, across
+// every rendition, with the Progress of each rendition on Renditions.
+type Progress struct {
+	Queued   int
+	Verified int
+	Failed   int
+	Skipped  int
+	Bytes    int64
+	Elapsed  time.Duration
+
+	Renditions []RenditionProgress
+}
+
+// RenditionProgress is the Progress of the rendition saved to the Variant
+// folder, without Renditions of its own.
+type RenditionProgress struct {
+	Variant string
+	URI     string
+	Progress
+}
+
+// Done returns the amount of queued segments that are already finished.
+func (p Progress) Done() int {
+	return p.Verified + p.Failed + p.Skipped
+}
+
+// Throughput returns the bytes downloaded per second so far.
+func (p Progress) Throughput() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+// ETA estimates how long the segments still queued take at the pace of the
+// finished ones, or returns 0 when none finished yet or none are left.
+func (p Progress) ETA() time.Duration {
+	done := p.Done()
+	if done == 0 || done >= p.Queued {
+		return 0
+	}
+	return p.Elapsed * time.Duration(p.Queued-done) / time.Duration(done)
+}
+
+// counters are the segment counts of a Progress.
+type counters struct {
+	queued   atomic.Int64
+	verified atomic.Int64
+	failed   atomic.Int64
+	skipped  atomic.Int64
+	bytes    atomic.Int64
+}
+
+func (c *counters) addSegment(segment *SegmentResult) {
+	if segment.OK() {
+		c.verified.Add(1)
+	} else {
+		c.failed.Add(1)
+	}
+	c.bytes.Add(int64(segment.Length))
+}
+
+func (c *counters) progress(elapsed time.Duration) Progress {
+	return Progress{
+		Queued:   int(c.queued.Load()),
+		Verified: int(c.verified.Load()),
+		Failed:   int(c.failed.Load()),
+		Skipped:  int(c.skipped.Load()),
+		Bytes:    c.bytes.Load(),
+		Elapsed:  elapsed,
+	}
+}
+
+// progressCounter tracks the Progress of the runs of a Verifier. It's safe
+// for use by multiple goroutines, so it can be read while a run advances.
+type progressCounter struct {
+	start atomic.Int64
+	counters
+
+	mu         sync.Mutex
+	renditions []*renditionCounter
+}
+
+// reset zeroes every counter, starting the clock of a new run.
+func (c *progressCounter) reset() {
+	c.queued.Store(0)
+	c.verified.Store(0)
+	c.failed.Store(0)
+	c.skipped.Store(0)
+	c.bytes.Store(0)
+	c.start.Store(time.Now().UnixNano())
+
+	c.mu.Lock()
+	c.renditions = nil
+	c.mu.Unlock()
+}
+
+// rendition returns the counter of the rendition on uri, saved to folder,
+// which adds its segments to the totals of c too.
+func (c *progressCounter) rendition(folder, uri string) *renditionCounter {
+	r := &renditionCounter{total: c, variant: folder, uri: uri}
+	c.mu.Lock()
+	c.renditions = append(c.renditions, r)
+	c.mu.Unlock()
+	return r
+}
+
+func (c *progressCounter) snapshot() Progress {
+	var elapsed time.Duration
+	if start := c.start.Load(); start != 0 {
+		elapsed = time.Since(time.Unix(0, start))
+	}
+	p := c.progress(elapsed)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.renditions {
+		p.Renditions = append(p.Renditions, r.snapshot())
+	}
+	return p
+}
+
+// renditionCounter tracks the Progress of a single rendition, from the
+// first segment queued to the last one finished.
+type renditionCounter struct {
+	total   *progressCounter
+	variant string
+	uri     string
+
+	start atomic.Int64
+	last  atomic.Int64
+	counters
+}
+
+func (r *renditionCounter) queue(n int) {
+	r.start.CompareAndSwap(0, time.Now().UnixNano())
+	r.queued.Add(int64(n))
+	r.total.queued.Add(int64(n))
+}
+
+func (r *renditionCounter) addSegment(segment *SegmentResult) {
+	r.counters.addSegment(segment)
+	r.total.addSegment(segment)
+	r.last.Store(time.Now().UnixNano())
+}
+
+func (r *renditionCounter) addSkipped() {
+	r.skipped.Add(1)
+	r.total.skipped.Add(1)
+	r.last.Store(time.Now().UnixNano())
+}
+
+func (r *renditionCounter) snapshot() RenditionProgress {
+	p := r.progress(0)
+	if start := r.start.Load(); start != 0 {
+		// Finished renditions keep the time they took, live ones the time
+		// they've been running for.
+		end := time.Now().UnixNano()
+		if p.Done() >= p.Queued {
+			end = r.last.Load()
+		}
+		p.Elapsed = time.Duration(end - start)
+	}
+	return RenditionProgress{Variant: r.variant, URI: r.uri, Progress: p}
+}
+
+// Progress returns how far along the current, or last, run of v is. Unlike
+// the rest of v, it can be called while Verify runs.
+func (v *Verifier) Progress() Progress {
+	return v.progress.snapshot()
+}
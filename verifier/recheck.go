@@ -0,0 +1,116 @@
+package verifier
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// recheckFolder is the folder under the one of its rendition the second
+// copies of failed segments are saved to.
+const recheckFolder = "recheck"
+
+// Verdicts of a Recheck.
+const (
+	// RecheckPersistent is a segment that failed again on its second
+	// fetch.
+	RecheckPersistent = "persistent"
+
+	// RecheckTransient is a segment that passed on its second fetch from
+	// the same origin, like a truncated object a CDN stopped serving.
+	RecheckTransient = "transient"
+
+	// RecheckEdgeSpecific is a segment that passed on its second fetch
+	// from CompareHost, broken on the origin of the first one only.
+	RecheckEdgeSpecific = "edge-specific"
+
+	// RecheckInconclusive is a segment whose second fetch failed for a
+	// reason unrelated to its bytes, like a network error.
+	RecheckInconclusive = "inconclusive"
+)
+
+// Recheck is the second fetch of a segment that failed verification, with
+// its Verdict and whether both copies had the same bytes.
+type Recheck struct {
+	URI       string `json:"uri"`
+	Verdict   string `json:"verdict"`
+	SameBytes bool   `json:"same_bytes"`
+	Error     string `json:"error,omitempty"`
+}
+
+// rechecked reports whether segments failing with class are fetched a
+// second time: the classes of broken bytes, which a CDN serving a truncated
+// or corrupted object would cause.
+func rechecked(class ErrorClass) bool {
+	switch class {
+	case ClassPadding, ClassContainer, ClassDominant, ClassAlignment, ClassDecode:
+		return true
+	}
+	return false
+}
+
+// recheckSegment fetches the segment of the failed result a second time,
+// from CompareHost when set, and verifies it again under recheckFolder,
+// recording a Recheck on result. It returns err annotated with the verdict.
+func (v *Verifier) recheckSegment(ctx context.Context, media *MediaResult, queued queuedSegment, result *SegmentResult, err error) error {
+	folder := filepath.Join(media.Variant, recheckFolder)
+	v.shareInitTracks(media.Variant, folder)
+
+	segment := *queued.segment
+	if v.opts.CompareHost != "" {
+		uri, uriErr := withOrigin(segment.URI, v.opts.CompareHost)
+		if uriErr != nil {
+			result.Recheck = &Recheck{URI: segment.URI, Verdict: RecheckInconclusive, Error: uriErr.Error()}
+			return fmt.Errorf("%w, %s on recheck", err, RecheckInconclusive)
+		}
+		segment.URI = uri
+	}
+
+	second, secondErr := v.DecodeSegment(ctx, &segment, queued.key, folder, queued.index)
+	if secondErr != nil && ctx.Err() != nil {
+		return err
+	}
+
+	recheck := &Recheck{
+		URI:       segment.URI,
+		SameBytes: result.SHA256 != "" && result.SHA256 == second.SHA256,
+	}
+	switch {
+	case secondErr == nil && v.opts.CompareHost != "":
+		recheck.Verdict = RecheckEdgeSpecific
+	case secondErr == nil:
+		recheck.Verdict = RecheckTransient
+	case rechecked(classOf(secondErr)):
+		recheck.Verdict = RecheckPersistent
+		recheck.Error = secondErr.Error()
+	default:
+		recheck.Verdict = RecheckInconclusive
+		recheck.Error = secondErr.Error()
+	}
+	result.Recheck = recheck
+
+	bytes := "different bytes"
+	if recheck.SameBytes {
+		bytes = "the same bytes"
+	}
+	v.warnf("Recheck of failed segment %s from %s: %s, with %s", result.URI, segment.URI, recheck.Verdict, bytes)
+	return fmt.Errorf("%w, %s on recheck", err, recheck.Verdict)
+}
+
+// formatRechecks describes the amount of rechecked failures of every
+// verdict, in alphabetical order.
+func formatRechecks(rechecks map[string]int) string {
+	verdicts := make([]string, 0, len(rechecks))
+	for verdict := range rechecks {
+		verdicts = append(verdicts, verdict)
+	}
+	sort.Strings(verdicts)
+
+	counts := make([]string, 0, len(verdicts))
+	for _, verdict := range verdicts {
+		counts = append(counts, fmt.Sprintf("%d %s", rechecks[verdict], verdict))
+	}
+	return strings.Join(counts, ", ")
+}
@@ -0,0 +1,213 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// Rendition is an entry of the --list-renditions inventory.
+type Rendition struct {
+	Type         string `json:"type"`
+	URI          string `json:"uri"`
+	Bandwidth    uint32 `json:"bandwidth,omitempty"`
+	Resolution   string `json:"resolution,omitempty"`
+	Codecs       string `json:"codecs,omitempty"`
+	Language     string `json:"language,omitempty"`
+	GroupID      string `json:"group_id,omitempty"`
+	Encryption   string `json:"encryption,omitempty"`
+	SegmentCount *int   `json:"segment_count,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// ListRenditions prints a JSON inventory of every rendition of the master
+// manifest on uri. Unless --skip-segment-counts is set, each media playlist
+// is fetched for its encryption method and segment count.
+func (v *Verifier) ListRenditions(ctx context.Context, uri string) error {
+	v.reset()
+
+	renditions, err := v.listRenditions(ctx, uri)
+	if err != nil {
+		return err
+	}
+
+	if !v.opts.SkipSegmentCounts {
+		for _, rendition := range renditions {
+			// Closed captions are carried in the video and have no playlist.
+			if rendition.URI == "" {
+				continue
+			}
+			v.inspectRendition(ctx, rendition)
+		}
+	}
+
+	out, err := json.MarshalIndent(renditions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
+// listRenditions returns every rendition of the master manifest on uri
+// passing the variant filters, without fetching their playlists.
+func (v *Verifier) listRenditions(ctx context.Context, uri string) ([]*Rendition, error) {
+	p, pType, base, err := v.getPlaylist(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	mp, ok := p.(*m3u8.MasterPlaylist)
+	if pType != m3u8.MASTER || !ok {
+		return nil, newError("manifest must be of master type")
+	}
+
+	if v.hasVariantFilters() {
+		v.regroupAlternatives(mp)
+	}
+
+	var renditions []*Rendition
+	seen := make(map[string]bool)
+	for _, variant := range mp.Variants {
+		if !v.variantSelected(variant) {
+			continue
+		}
+		rendition := &Rendition{
+			Type:       "video",
+			URI:        v.resolveURI(base, variant.URI),
+			Bandwidth:  variant.Bandwidth,
+			Resolution: variant.Resolution,
+			Codecs:     variant.Codecs,
+		}
+		if variant.Iframe {
+			rendition.Type = "iframe"
+		}
+		renditions = append(renditions, rendition)
+
+		for _, alt := range variant.Alternatives {
+			key := alt.Type + "|" + alt.GroupId + "|" + alt.Name + "|" + alt.URI
+			if seen[key] || !v.alternativeSelected(alt) {
+				continue
+			}
+			seen[key] = true
+
+			renditions = append(renditions, &Rendition{
+				Type:     strings.ToLower(alt.Type),
+				URI:      v.resolveURI(base, alt.URI),
+				Language: alt.Language,
+				GroupID:  alt.GroupId,
+			})
+		}
+	}
+	return renditions, nil
+}
+
+// hasVariantFilters reports whether any of the variant filters is set.
+func (v *Verifier) hasVariantFilters() bool {
+	o := v.opts
+	return o.VariantBandwidth > 0 || o.MinBandwidth > 0 || o.MaxBandwidth > 0 || o.Resolution != "" || o.AudioGroup != ""
+}
+
+// validateVariantFilters checks the bandwidth range and resolution the
+// variants of a master manifest are filtered by.
+func validateVariantFilters(opts Options) error {
+	if opts.MaxBandwidth > 0 && opts.MinBandwidth > opts.MaxBandwidth {
+		return newError(fmt.Sprintf("--min-bandwidth %d is above --max-bandwidth %d", opts.MinBandwidth, opts.MaxBandwidth))
+	}
+	if opts.Resolution == "" {
+		return nil
+	}
+
+	width, height, ok := strings.Cut(strings.ToLower(opts.Resolution), "x")
+	if _, err := strconv.Atoi(width); err != nil || !ok {
+		return newError("--resolution must be WIDTHxHEIGHT, such as 1920x1080, got: " + opts.Resolution)
+	}
+	if _, err := strconv.Atoi(height); err != nil {
+		return newError("--resolution must be WIDTHxHEIGHT, such as 1920x1080, got: " + opts.Resolution)
+	}
+	return nil
+}
+
+// variantSelected reports whether variant passes the --variant-bandwidth,
+// --min-bandwidth, --max-bandwidth, --resolution and --audio-group filters.
+func (v *Verifier) variantSelected(variant *m3u8.Variant) bool {
+	o := v.opts
+	switch {
+	case o.VariantBandwidth > 0 && int64(variant.Bandwidth) != o.VariantBandwidth:
+		return false
+	case o.MinBandwidth > 0 && int64(variant.Bandwidth) < o.MinBandwidth:
+		return false
+	case o.MaxBandwidth > 0 && int64(variant.Bandwidth) > o.MaxBandwidth:
+		return false
+	case o.Resolution != "" && !strings.EqualFold(variant.Resolution, o.Resolution):
+		return false
+	case o.AudioGroup != "" && !variant.Iframe && variant.Audio != o.AudioGroup:
+		return false
+	}
+	return true
+}
+
+// alternativeSelected reports whether alt passes the --audio-group filter,
+// which only applies to audio renditions.
+func (v *Verifier) alternativeSelected(alt *m3u8.Alternative) bool {
+	return v.opts.AudioGroup == "" || alt.Type != "AUDIO" || alt.GroupId == v.opts.AudioGroup
+}
+
+// regroupAlternatives moves every alternative rendition of mp to the first
+// variant passing the filters that references its group. The m3u8 package
+// attaches them all to the variant following their EXT-X-MEDIA tags, which
+// the filters could otherwise skip along with them.
+func (v *Verifier) regroupAlternatives(mp *m3u8.MasterPlaylist) {
+	var alternatives []*m3u8.Alternative
+	for _, variant := range mp.Variants {
+		alternatives = append(alternatives, variant.Alternatives...)
+		variant.Alternatives = nil
+	}
+
+	for _, alt := range alternatives {
+		for _, variant := range mp.Variants {
+			if variant.Iframe || !v.variantSelected(variant) {
+				continue
+			}
+			group := map[string]string{
+				"AUDIO":           variant.Audio,
+				"VIDEO":           variant.Video,
+				"SUBTITLES":       variant.Subtitles,
+				"CLOSED-CAPTIONS": variant.Captions,
+			}[alt.Type]
+			if group != "" && group == alt.GroupId {
+				variant.Alternatives = append(variant.Alternatives, alt)
+				break
+			}
+		}
+	}
+}
+
+// inspectRendition fills the encryption method and segment count of a
+// rendition from its media playlist, storing any error on the rendition.
+func (v *Verifier) inspectRendition(ctx context.Context, rendition *Rendition) {
+	p, pType, err := v.GetPlaylist(ctx, rendition.URI)
+	if err != nil {
+		rendition.Error = err.Error()
+		return
+	}
+
+	mp, ok := p.(*m3u8.MediaPlaylist)
+	if pType != m3u8.MEDIA || !ok {
+		rendition.Error = newError("manifest must be of media type").Error()
+		return
+	}
+
+	rendition.Encryption = "NONE"
+	if mp.Key != nil && mp.Key.Method != "" {
+		rendition.Encryption = normalizeMethod(mp.Key.Method)
+	}
+
+	count := int(mp.Count())
+	rendition.SegmentCount = &count
+}
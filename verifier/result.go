@@ -0,0 +1,671 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// SegmentResult holds every diagnostic gathered while verifying a segment.
+// An empty Class means the segment was verified successfully.
+type SegmentResult struct {
+	Variant         string        `json:"variant"`
+	Index           int           `json:"index"`
+	MediaSequence   uint64        `json:"media_sequence"`
+	URI             string        `json:"uri"`
+	Offset          int64         `json:"offset,omitempty"`
+	Limit           int64         `json:"limit,omitempty"`
+	KeyURI          string        `json:"key_uri,omitempty"`
+	IV              string        `json:"iv,omitempty"`
+	Method          string        `json:"method,omitempty"`
+	HTTPStatus      int           `json:"http_status,omitempty"`
+	ContentType     string        `json:"content_type,omitempty"`
+	Length          int           `json:"length"`
+	DecryptedLength int           `json:"decrypted_length"`
+	PadValue        int           `json:"pad_value"`
+	Passed          bool          `json:"passed"`
+	Class           ErrorClass    `json:"class,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	FetchDuration   time.Duration `json:"fetch_duration"`
+	FirstByte       time.Duration `json:"first_byte,omitempty"`
+	Bitrate         int64         `json:"bitrate,omitempty"`
+	Retries         int           `json:"retries"`
+
+	// SHA256 is the checksum of the segment as served, summed when it's
+	// saved, compared under --verify-checksums or rechecked.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Tail is the hex of the last decrypted bytes of the segment, ending
+	// with the padding length PadValue claims, recorded on padding
+	// failures and on every segment under --dump-tails.
+	Tail string `json:"tail,omitempty"`
+
+	// Recheck is the second fetch of the segment after it failed, unless
+	// --no-recheck.
+	Recheck *Recheck `json:"recheck,omitempty"`
+
+	// Cached is set when the segment was skipped as unchanged since a
+	// previous run verified it, restoring the results of that run.
+	Cached bool `json:"cached,omitempty"`
+
+	// RebufferRisk is set under --simulate-playback when the segment took
+	// longer to download than to play.
+	RebufferRisk bool `json:"rebuffer_risk,omitempty"`
+
+	// MediaDuration is how long the media of the segment lasts according to
+	// its timestamps, measured under --check-media-durations.
+	MediaDuration time.Duration `json:"media_duration,omitempty"`
+
+	// Probe is what ffprobe decoded from the segment under --ffprobe.
+	Probe *ProbeResult `json:"probe,omitempty"`
+
+	// etag and lastModified are the validators the segment was served
+	// with, stored on the segment cache.
+	etag, lastModified string
+
+	// content is the codecs and resolution read from the decrypted TS
+	// segment under --deep-check.
+	content *mediaContent
+
+	// initMap is the EXT-X-MAP of the segment, whose body --ffprobe
+	// prepends to it.
+	initMap *m3u8.Map
+}
+
+// fail records err as the failure of the segment.
+func (r *SegmentResult) fail(err error) {
+	r.Class = classOf(err)
+	r.Error = err.Error()
+	r.Passed = false
+}
+
+// OK reports whether the segment was verified successfully.
+func (r *SegmentResult) OK() bool {
+	return r.Class == ""
+}
+
+func (r *SegmentResult) String() string {
+	status := "ok"
+	if !r.OK() {
+		status = string(r.Class)
+	}
+	return fmt.Sprintf(
+		"%s #%d (seq %d) %s: %s, http %d, %d bytes, %d decrypted, pad %d, fetched in %s with %d retries",
+		r.Variant,
+		r.Index,
+		r.MediaSequence,
+		r.URI,
+		status,
+		r.HTTPStatus,
+		r.Length,
+		r.DecryptedLength,
+		r.PadValue,
+		r.FetchDuration.Round(time.Millisecond),
+		r.Retries,
+	)
+}
+
+// fetchInfo describes the response a resource was downloaded from, with
+// FirstByte as the time its headers took to arrive.
+type fetchInfo struct {
+	Status       int
+	ContentType  string
+	ETag         string
+	LastModified string
+	FirstByte    time.Duration
+	Duration     time.Duration
+	Retries      int
+}
+
+// setFetchInfo records how the segment of r was served.
+func (r *SegmentResult) setFetchInfo(info fetchInfo) {
+	r.HTTPStatus = info.Status
+	r.ContentType = info.ContentType
+	r.FetchDuration = info.Duration
+	r.FirstByte = info.FirstByte
+	r.Retries = info.Retries
+	r.etag, r.lastModified = info.ETag, info.LastModified
+}
+
+// bitrate returns the bits per second n bytes downloaded in d amount to.
+func bitrate(n int, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) * 8 / d.Seconds())
+}
+
+type retriesKey struct{}
+
+// withRetryCounter returns a context whose retries are counted on n by the
+// transport.
+func withRetryCounter(ctx context.Context, n *int32) context.Context {
+	return context.WithValue(ctx, retriesKey{}, n)
+}
+
+// countRetry increments the retry counter of ctx, if it has one.
+func countRetry(ctx context.Context) {
+	if n, ok := ctx.Value(retriesKey{}).(*int32); ok {
+		atomic.AddInt32(n, 1)
+	}
+}
+
+// MediaResult aggregates the verification of a media manifest.
+type MediaResult struct {
+	URI                string           `json:"uri"`
+	Type               string           `json:"type"`
+	Variant            string           `json:"variant"`
+	Bandwidth          uint32           `json:"bandwidth,omitempty"`
+	Resolution         string           `json:"resolution,omitempty"`
+	Codecs             string           `json:"codecs,omitempty"`
+	Segments           []*SegmentResult `json:"segments"`
+	Dropped            int              `json:"dropped,omitempty"`
+	Verified           int              `json:"verified"`
+	Failed             int              `json:"failed"`
+	Skipped            int              `json:"skipped,omitempty"`
+	Cached             int              `json:"cached,omitempty"`
+	Unsampled          int              `json:"unsampled,omitempty"`
+	Failures           int              `json:"failures"`
+	Bytes              int64            `json:"bytes"`
+	Duration           time.Duration    `json:"duration"`
+	Encryption         string           `json:"encryption,omitempty"`
+	KeyURIs            []string         `json:"key_uris,omitempty"`
+	TimeToFirstSegment time.Duration    `json:"time_to_first_segment,omitempty"`
+	Elapsed            time.Duration    `json:"elapsed"`
+	Throughput         *Throughput      `json:"throughput,omitempty"`
+	RebufferRisks      int              `json:"rebuffer_risks,omitempty"`
+	Discontinuities    int              `json:"discontinuities,omitempty"`
+	Gaps               int              `json:"gaps,omitempty"`
+	Markers            []*Marker        `json:"markers,omitempty"`
+	Parts              []*PartResult    `json:"parts,omitempty"`
+	PartsFailed        int              `json:"parts_failed,omitempty"`
+	LiveErrors         []*LiveError     `json:"live_errors,omitempty"`
+	Stall              *Stall           `json:"stall,omitempty"`
+	Rechecks           map[string]int   `json:"rechecks,omitempty"`
+	TargetDuration     float64          `json:"target_duration,omitempty"`
+	Error              string           `json:"error,omitempty"`
+
+	mu sync.Mutex
+
+	// progress, when set, is updated with every segment recorded.
+	progress *renditionCounter
+
+	// sampleFrom is the media sequence number --sample every=N counts
+	// from, the first one of the rendition.
+	sampleFrom uint64
+
+	// timeline is the segment layout of the media playlist as first loaded,
+	// compared across renditions under --check-alignment.
+	timeline *timeline
+
+	// clockSkewed is set once --check-pdt found the live edge away from
+	// the wall clock, so following reloads don't report it again.
+	clockSkewed bool
+
+	// content is the codecs and resolution of the first segment recorded
+	// with them, compared with the declarations of the variant.
+	content *mediaContent
+
+	// keepSegments, when set, bounds the passing results kept on Segments
+	// to the most recent ones, dropping the oldest to Dropped.
+	keepSegments int
+	kept         int
+
+	// checksums are the checksum manifest lines of the segments summed so
+	// far, by index, kept apart from Segments so dropping results doesn't
+	// drop them from the manifest written under --save.
+	checksums map[int]string
+
+	// partsQueued are the partial segments of a Low-Latency HLS playlist
+	// queued so far, by media sequence number and part, so every reload
+	// only verifies the new ones.
+	partsQueued map[[2]uint64]bool
+}
+
+// declare records the BANDWIDTH, RESOLUTION and CODECS of the variant of r on
+// the master manifest.
+func (r *MediaResult) declare(variant *m3u8.Variant) {
+	r.Bandwidth = variant.Bandwidth
+	r.Resolution = variant.Resolution
+	r.Codecs = variant.Codecs
+}
+
+// mediaContent returns the codecs and resolution found on the segments of
+// r, or nil when none were read.
+func (r *MediaResult) mediaContent() *mediaContent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.content
+}
+
+// slowestSegment returns the segment of r that took the longest to fetch,
+// or nil when none was fetched.
+func (r *MediaResult) slowestSegment() *SegmentResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var slowest *SegmentResult
+	for _, segment := range r.Segments {
+		if segment.FetchDuration > 0 && (slowest == nil || segment.FetchDuration > slowest.FetchDuration) {
+			slowest = segment
+		}
+	}
+	return slowest
+}
+
+// followedSegments is how many of the passing segment results of a followed
+// rendition are kept, so following a live stream for days doesn't hold
+// every result in memory. Failed ones are always kept.
+const followedSegments = 1000
+
+// addSegment records the result of a segment on the totals of r.
+func (r *MediaResult) addSegment(segment *SegmentResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Segments = append(r.Segments, segment)
+	if segment.SHA256 != "" {
+		if r.checksums == nil {
+			r.checksums = make(map[int]string)
+		}
+		r.checksums[segment.Index] = segment.SHA256 + "  " + checksumName(segment) + "\n"
+	}
+	if segment.OK() {
+		r.kept++
+	}
+	if r.keepSegments > 0 && r.kept >= 2*r.keepSegments {
+		r.dropSegments()
+	}
+	r.Bytes += int64(segment.Length)
+	if r.progress != nil {
+		r.progress.addSegment(segment)
+	}
+	if segment.OK() {
+		r.Verified++
+	} else {
+		r.Failed++
+	}
+	if segment.RebufferRisk {
+		r.RebufferRisks++
+	}
+	if segment.Cached {
+		r.Cached++
+	}
+	if segment.Recheck != nil {
+		if r.Rechecks == nil {
+			r.Rechecks = make(map[string]int)
+		}
+		r.Rechecks[segment.Recheck.Verdict]++
+	}
+	if r.content == nil {
+		r.content = segment.content
+	}
+}
+
+// dropSegments drops the oldest passing results of r, but for the last
+// keepSegments of them, counting them as Dropped.
+func (r *MediaResult) dropSegments() {
+	drop := r.kept - r.keepSegments
+	kept := r.Segments[:0]
+	for _, segment := range r.Segments {
+		if drop > 0 && segment.OK() {
+			drop--
+			r.Dropped++
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	clear(r.Segments[len(kept):])
+	r.Segments = kept
+	r.kept = r.keepSegments
+}
+
+// queuePart returns the index partial segment p is saved under, and false
+// when it was already queued by a previous load of the playlist.
+func (r *MediaResult) queuePart(p partialSegment) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := [2]uint64{p.MediaSequence, uint64(p.Part)}
+	if r.partsQueued[id] {
+		return 0, false
+	}
+	if r.partsQueued == nil {
+		r.partsQueued = make(map[[2]uint64]bool)
+	}
+	r.partsQueued[id] = true
+	return len(r.partsQueued) - 1, true
+}
+
+// addPart records the result of a partial segment.
+func (r *MediaResult) addPart(part *PartResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Parts = append(r.Parts, part)
+	if !part.OK() {
+		r.PartsFailed++
+	}
+}
+
+// addLiveError records a problem of the live playlist of r found between
+// reloads.
+func (r *MediaResult) addLiveError(liveErr *LiveError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.LiveErrors = append(r.LiveErrors, liveErr)
+}
+
+// setStall records where the followed live playlist of r stalled.
+func (r *MediaResult) setStall(stall *Stall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Stall = stall
+}
+
+// addDiscontinuity records a segment following an EXT-X-DISCONTINUITY.
+func (r *MediaResult) addDiscontinuity() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Discontinuities++
+}
+
+// addGap records a segment marked with EXT-X-GAP, skipped as intentionally
+// absent.
+func (r *MediaResult) addGap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Gaps++
+}
+
+// addSkipped records a segment that wasn't verified.
+func (r *MediaResult) addSkipped() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped++
+	if r.progress != nil {
+		r.progress.addSkipped()
+	}
+}
+
+// addUnsampled records n segments left out by --sample.
+func (r *MediaResult) addUnsampled(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Unsampled += n
+}
+
+// sortSegments orders the segment and part results by their index.
+func (r *MediaResult) sortSegments() {
+	sort.Slice(r.Segments, func(i, j int) bool {
+		return r.Segments[i].Index < r.Segments[j].Index
+	})
+	sort.Slice(r.Parts, func(i, j int) bool {
+		return r.Parts[i].Index < r.Parts[j].Index
+	})
+}
+
+// CheckResult is the outcome of a check spanning more than one manifest,
+// like the audio declarations of a master manifest.
+type CheckResult struct {
+	Name  string `json:"name"`
+	URI   string `json:"uri"`
+	Error string `json:"error,omitempty"`
+}
+
+// Report aggregates the verification of a master manifest. When a
+// media manifest is verified on its own, it's the only entry of Variants.
+// Passed is only set when the run finished without any failure.
+type Report struct {
+	URI          string         `json:"uri"`
+	Passed       bool           `json:"passed"`
+	Sampling     string         `json:"sampling,omitempty"`
+	Totals       Totals         `json:"totals"`
+	Variants     []*MediaResult `json:"variants"`
+	Alternatives []*MediaResult `json:"alternatives,omitempty"`
+	CrossChecks  []*CheckResult `json:"cross_checks,omitempty"`
+	Keys         []*KeyResult   `json:"keys,omitempty"`
+	Bytes        int64          `json:"bytes"`
+
+	// output is the FSWriter failed segments were saved with, linked to by
+	// the HTML report, or nil when written elsewhere.
+	output *FSWriter
+
+	mu sync.Mutex
+}
+
+// Totals sums up a Report. Failures counts every failure of the run,
+// including the ones found on manifests rather than on segments, and Keys
+// the distinct keys requested, each only once however many segments and
+// renditions share it. Bytes only counts segments, while the Bytes of the
+// Report include manifests and keys too.
+type Totals struct {
+	Renditions int           `json:"renditions"`
+	Segments   int           `json:"segments"`
+	Verified   int           `json:"verified"`
+	Failed     int           `json:"failed"`
+	Skipped    int           `json:"skipped"`
+	Cached     int           `json:"cached,omitempty"`
+	Unsampled  int           `json:"unsampled,omitempty"`
+	Failures   int           `json:"failures"`
+	Keys       int           `json:"keys"`
+	Bytes      int64         `json:"bytes"`
+	Elapsed    time.Duration `json:"elapsed"`
+
+	// Unverified is how many of the Failures are playlists that couldn't
+	// be fetched, parsed or reloaded, so their segments weren't verified.
+	Unverified int `json:"unverified,omitempty"`
+}
+
+// sumTotals fills the Totals of r, with failures as the failures found on
+// the run, keys as the distinct keys requested and elapsed as the
+// wall-clock duration of the run.
+func (r *Report) sumTotals(failures *MultiError, keys int, elapsed time.Duration) {
+	totals := Totals{
+		Failures:   failures.Len(),
+		Keys:       keys,
+		Elapsed:    elapsed,
+		Unverified: failures.ByClass()[ClassPlaylist],
+	}
+	for _, media := range r.Renditions() {
+		media.sumThroughput()
+		totals.Renditions++
+		totals.Segments += media.Verified + media.Failed + media.Skipped
+		totals.Verified += media.Verified
+		totals.Failed += media.Failed
+		totals.Skipped += media.Skipped
+		totals.Cached += media.Cached
+		totals.Unsampled += media.Unsampled
+		totals.Bytes += media.Bytes
+	}
+	r.Totals = totals
+}
+
+// countFailures sets the Failures of every rendition of r to the amount
+// recorded for its folder on failures, including the ones found on its
+// manifest rather than on its segments.
+func (r *Report) countFailures(failures *MultiError) {
+	counts := failures.ByVariant()
+	for _, media := range r.Renditions() {
+		media.Failures = counts[media.Variant]
+	}
+}
+
+// WriteJSON writes r to w as an indented JSON document.
+func (r *Report) WriteJSON(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func (r *Report) addVariant(media *MediaResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Variants = append(r.Variants, media)
+}
+
+func (r *Report) addAlternative(media *MediaResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Alternatives = append(r.Alternatives, media)
+}
+
+func (r *Report) addCrossCheck(check *CheckResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.CrossChecks = append(r.CrossChecks, check)
+}
+
+// Renditions returns the results of every verified rendition, variants
+// first, each group sorted by folder.
+func (r *Report) Renditions() []*MediaResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sortMedia := func(media []*MediaResult) {
+		sort.Slice(media, func(i, j int) bool { return media[i].Variant < media[j].Variant })
+	}
+	sortMedia(r.Variants)
+	sortMedia(r.Alternatives)
+
+	return append(append([]*MediaResult{}, r.Variants...), r.Alternatives...)
+}
+
+// PrintBrief prints a single line per verified rendition, for --format
+// brief.
+func (r *Report) PrintBrief() {
+	fmt.Println()
+	for _, media := range r.Renditions() {
+		status := "PASS"
+		if media.Failed > 0 || media.Error != "" {
+			status = "FAIL"
+		}
+		fmt.Printf(
+			"%s %s segments=%d passed=%d failed=%d bytes=%d\n",
+			status,
+			media.Variant,
+			media.Verified+media.Failed+media.Skipped,
+			media.Verified,
+			media.Failed,
+			media.Bytes,
+		)
+	}
+}
+
+// PrintSummary prints the segment totals, bytes, duration and time to first
+// segment of every verified rendition, followed by the Totals of r.
+func (r *Report) PrintSummary() {
+	renditions := r.Renditions()
+	if len(renditions) == 0 {
+		return
+	}
+
+	fmt.Printf("\nSummary (%d bytes downloaded, %d keys requested):\n", r.Bytes, r.Totals.Keys)
+	for _, media := range renditions {
+		fmt.Printf(
+			"  %s %s: %d verified, %d failed, %d skipped, %s of segments, %d bytes in %s, first segment in %s\n",
+			media.Variant,
+			media.URI,
+			media.Verified,
+			media.Failed,
+			media.Skipped,
+			media.Duration,
+			media.Bytes,
+			media.Elapsed.Round(time.Millisecond),
+			media.TimeToFirstSegment.Round(time.Millisecond),
+		)
+		if slowest := media.slowestSegment(); slowest != nil {
+			fmt.Printf("    slowest segment fetched in %s: %s\n", roundFetch(slowest.FetchDuration), slowest.URI)
+		}
+		if media.Cached > 0 {
+			fmt.Printf("    %d verified segments unchanged since a previous run, not downloaded again\n", media.Cached)
+		}
+		if media.Dropped > 0 {
+			fmt.Printf("    %d passing segment results dropped while following, still counted above\n", media.Dropped)
+		}
+		if len(media.Parts) > 0 {
+			fmt.Printf("    %d partial segments verified, %d failed\n", len(media.Parts)-media.PartsFailed, media.PartsFailed)
+		}
+		for _, liveErr := range media.LiveErrors {
+			fmt.Printf("    live playlist %s at media sequence %d: %s\n", liveErr.Kind, liveErr.MediaSequence, liveErr.Error)
+		}
+		if stall := media.Stall; stall != nil {
+			fmt.Printf("    stream stalled at media sequence %d, no new segments since %s\n", stall.MediaSequence, stall.LastSeen.Format(time.RFC3339))
+		}
+		if len(media.Rechecks) > 0 {
+			fmt.Printf("    rechecked failures: %s\n", formatRechecks(media.Rechecks))
+		}
+		if media.Discontinuities > 0 || media.Gaps > 0 {
+			fmt.Printf("    %d discontinuities, %d EXT-X-GAP segments skipped\n", media.Discontinuities, media.Gaps)
+		}
+		if media.RebufferRisks > 0 {
+			fmt.Printf("    %d segments took longer to download than to play, risking a rebuffer\n", media.RebufferRisks)
+		}
+		if t := media.Throughput; t != nil {
+			fmt.Printf(
+				"    p50/p95/p99 of %d segments: first byte %s, download %s, bitrate %s\n",
+				t.Segments,
+				t.FirstByte,
+				t.Download,
+				t.Bitrate,
+			)
+		}
+		if media.Error != "" {
+			fmt.Printf("    %s\n", media.Error)
+		}
+	}
+
+	totals := r.Totals
+	fmt.Printf(
+		"  total: %d renditions, %d segments, %d verified, %d failed, %d skipped, %d bytes in %s\n",
+		totals.Renditions,
+		totals.Segments,
+		totals.Verified,
+		totals.Failed,
+		totals.Skipped,
+		totals.Bytes,
+		totals.Elapsed.Round(time.Millisecond),
+	)
+	if totals.Cached > 0 {
+		fmt.Printf("  %d segments unchanged since a previous run, skipped through the segment cache, --no-cache to download them\n", totals.Cached)
+	}
+	if r.Sampling != "" {
+		fmt.Printf("  sampled with --sample %s, %d segments not sampled\n", r.Sampling, totals.Unsampled)
+	}
+	for _, key := range r.Keys {
+		fmt.Printf("  key %s\n", key)
+	}
+}
+
+// byteCounter accumulates the bytes downloaded during a run, so it can be
+// stopped once --max-total-bytes is reached. It's safe for use by multiple
+// goroutines.
+type byteCounter struct {
+	limit int64
+	total int64
+}
+
+// Add records n more downloaded bytes.
+func (c *byteCounter) Add(n int) {
+	atomic.AddInt64(&c.total, int64(n))
+}
+
+// Total returns the bytes downloaded so far.
+func (c *byteCounter) Total() int64 {
+	return atomic.LoadInt64(&c.total)
+}
+
+// Exceeded reports whether the downloaded bytes reached the limit, if any.
+func (c *byteCounter) Exceeded() bool {
+	return c.limit > 0 && c.Total() >= c.limit
+}
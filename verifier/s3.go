@@ -0,0 +1,425 @@
+package verifier
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of the empty body of every S3 request.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// metadataTimeout bounds the requests to the metadata endpoints of cloud
+// instances, which hang off them.
+const metadataTimeout = 2 * time.Second
+
+// awsCredentials are the credentials S3 requests are signed with, valid
+// until Expires when it's set.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// s3Fetcher reads s3://bucket/key uris from their bucket, signing every
+// request with Signature Version 4. Credentials are looked up the way the
+// AWS CLI does: from the AWS_ACCESS_KEY_ID environment, the shared
+// credentials file, the ECS container role or the EC2 instance role.
+// AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL points it to an S3-compatible
+// store, addressed by path.
+type s3Fetcher struct {
+	client   *http.Client
+	region   string
+	endpoint string
+
+	mu      sync.Mutex
+	creds   *awsCredentials
+	regions map[string]string
+}
+
+func newS3Fetcher(client *http.Client) *s3Fetcher {
+	region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Fetcher{
+		client:   client,
+		region:   region,
+		endpoint: strings.TrimSuffix(firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"), "/"),
+		regions:  make(map[string]string),
+	}
+}
+
+func (f *s3Fetcher) Do(req *http.Request) (*http.Response, error) {
+	bucket, region := req.URL.Host, f.bucketRegion(req.URL.Host)
+	res, err := f.do(req, region)
+	if err != nil {
+		return nil, err
+	}
+
+	// A bucket of another region answers with the one it's on, which the
+	// request is signed for again.
+	actual := res.Header.Get("X-Amz-Bucket-Region")
+	if actual == "" || actual == region || (res.StatusCode != http.StatusMovedPermanently && res.StatusCode != http.StatusBadRequest) {
+		return res, nil
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	f.mu.Lock()
+	f.regions[bucket] = actual
+	f.mu.Unlock()
+	return f.do(req, actual)
+}
+
+func (f *s3Fetcher) bucketRegion(bucket string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if region, ok := f.regions[bucket]; ok {
+		return region
+	}
+	return f.region
+}
+
+func (f *s3Fetcher) do(req *http.Request, region string) (*http.Response, error) {
+	creds, err := f.credentials(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := f.objectURL(req.URL, region)
+	if err != nil {
+		return nil, err
+	}
+	out := objectRequest(req, target, "")
+	signS3(out, creds, region, time.Now().UTC())
+	return doObject(f.client, req, out)
+}
+
+// objectURL returns the https url of the object of the s3 uri u, on the
+// virtual-hosted endpoint of its bucket on region, or under the bucket path
+// of the custom endpoint.
+func (f *s3Fetcher) objectURL(u *url.URL, region string) (*url.URL, error) {
+	if u.Host == "" {
+		return nil, newError("s3 uri without a bucket: " + u.String())
+	}
+	key := escapeObjectPath(u.Path)
+	if f.endpoint != "" {
+		return url.Parse(f.endpoint + "/" + u.Host + key + rawQuery(u))
+	}
+	return url.Parse("https://" + u.Host + ".s3." + region + ".amazonaws.com" + key + rawQuery(u))
+}
+
+func rawQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+	return "?" + awsCanonicalQuery(u.Query())
+}
+
+// signS3 sets the Signature Version 4 Authorization of req, an S3 request
+// without a body sent at now, signing its host, range and x-amz headers.
+func signS3(req *http.Request, creds *awsCredentials, region string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	signed := map[string]string{"host": req.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			signed[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.Query()),
+		headers.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := now.Format("20060102") + "/" + region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape escapes s the way Signature Version 4 expects, keeping only
+// unreserved characters.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// escapeObjectPath escapes every segment of the path of an object on a
+// bucket, as S3 signs and GCS expects it.
+func escapeObjectPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	escaped := strings.Join(segments, "/")
+	if !strings.HasPrefix(escaped, "/") {
+		escaped = "/" + escaped
+	}
+	return escaped
+}
+
+// awsCanonicalQuery returns query escaped and sorted by name and value.
+func awsCanonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// credentials returns the credentials requests are signed with, looking them
+// up again once they expire.
+func (f *s3Fetcher) credentials(ctx context.Context) (*awsCredentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.creds != nil && (f.creds.Expires.IsZero() || time.Until(f.creds.Expires) > time.Minute) {
+		return f.creds, nil
+	}
+	creds, err := lookupAWSCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f.creds = creds
+	return creds, nil
+}
+
+func lookupAWSCredentials(ctx context.Context) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if creds, err := sharedAWSCredentials(); creds != nil || err != nil {
+		return creds, err
+	}
+
+	metadata := &http.Client{Timeout: metadataTimeout}
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		return fetchAWSRoleCredentials(ctx, metadata, "http://169.254.170.2"+relative, nil)
+	}
+	if full := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); full != "" {
+		header := http.Header{}
+		if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+			header.Set("Authorization", token)
+		}
+		return fetchAWSRoleCredentials(ctx, metadata, full, header)
+	}
+	creds, err := instanceRoleCredentials(ctx, metadata)
+	if err != nil {
+		return nil, newError("no AWS credentials for s3 uris, set AWS_ACCESS_KEY_ID, a shared credentials file or an instance role: " + err.Error())
+	}
+	return creds, nil
+}
+
+// sharedAWSCredentials reads the AWS_PROFILE, or default, profile of the
+// shared credentials file, returning nil when there's none.
+func sharedAWSCredentials() (*awsCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil
+	}
+	defer func() { _ = file.Close() }()
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	creds := &awsCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" {
+		return nil, nil
+	}
+	return creds, nil
+}
+
+// instanceRoleCredentials fetches the credentials of the role of the EC2
+// instance through IMDSv2.
+func instanceRoleCredentials(ctx context.Context, client *http.Client) (*awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	token, err := readMetadata(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("X-Aws-Ec2-Metadata-Token", token)
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, imds+"/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	role, err := readMetadata(client, req)
+	if err != nil {
+		return nil, err
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	return fetchAWSRoleCredentials(ctx, client, imds+"/meta-data/iam/security-credentials/"+role, header)
+}
+
+// fetchAWSRoleCredentials fetches the temporary credentials of a role from
+// the metadata endpoint on uri.
+func fetchAWSRoleCredentials(ctx context.Context, client *http.Client, uri string, header http.Header) (*awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+	body, err := readMetadata(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var role struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err = json.Unmarshal([]byte(body), &role); err != nil || role.AccessKeyID == "" {
+		return nil, newError("invalid AWS role credentials from " + uri)
+	}
+	return &awsCredentials{
+		AccessKeyID:     role.AccessKeyID,
+		SecretAccessKey: role.SecretAccessKey,
+		SessionToken:    role.Token,
+		Expires:         role.Expiration,
+	}, nil
+}
+
+// readMetadata returns the body of a metadata endpoint answering req.
+func readMetadata(client *http.Client, req *http.Request) (string, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s on %s", res.Status, req.URL)
+	}
+	return string(body), nil
+}
+
+// firstEnv returns the first of the environment variables names that's set.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package verifier
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sampler picks the segments of every rendition verified under --sample,
+// either every Nth one from the first segment of the rendition, or a
+// percentage of them picked by hashing their uri with a seed. Picks don't
+// depend on the order segments are verified in, so a seed repeats a run.
+type sampler struct {
+	every   uint64
+	percent float64
+	seed    int64
+}
+
+// parseSample parses --sample as every=N or percent=P, returning nil when
+// it's empty. A seed of 0 picks a new one from the clock.
+func parseSample(sample string, seed int64) (*sampler, error) {
+	if sample == "" {
+		return nil, nil
+	}
+
+	strategy, value, _ := strings.Cut(sample, "=")
+	switch strategy {
+	case "every":
+		every, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || every == 0 {
+			return nil, newError("--sample every=N requires N to be at least 1, got: " + sample)
+		}
+		return &sampler{every: every}, nil
+	case "percent":
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, newError("--sample percent=P requires P above 0 and up to 100, got: " + sample)
+		}
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		return &sampler{percent: percent, seed: seed}, nil
+	}
+	return nil, newError("--sample must be every=N or percent=P, got: " + sample)
+}
+
+// String describes the strategy of s, along with the seed that repeats it.
+func (s *sampler) String() string {
+	if s == nil {
+		return ""
+	}
+	if s.every > 0 {
+		return fmt.Sprintf("every=%d", s.every)
+	}
+	return fmt.Sprintf("percent=%g seed=%d", s.percent, s.seed)
+}
+
+// sampled reports whether the segment on uri with media sequence number
+// seq is verified, on a rendition starting at sequence number first.
+func (s *sampler) sampled(first, seq uint64, uri string) bool {
+	switch {
+	case s == nil:
+		return true
+	case s.every > 0:
+		return seq < first || (seq-first)%s.every == 0
+	}
+
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.BigEndian, s.seed)
+	_, _ = h.Write([]byte(uri))
+	return float64(h.Sum64()%10000)/100 < s.percent
+}
+
+// sample returns the segments of queue picked by --sample, counting the
+// rest as unsampled on media.
+func (v *Verifier) sample(media *MediaResult, queue []queuedSegment) []queuedSegment {
+	if v.sampler == nil {
+		return queue
+	}
+
+	var sampled []queuedSegment
+	for _, queued := range queue {
+		if v.sampler.sampled(media.sampleFrom, queued.segment.SeqId, queued.segment.URI) {
+			sampled = append(sampled, queued)
+		}
+	}
+	media.addUnsampled(len(queue) - len(sampled))
+	return sampled
+}
@@ -0,0 +1,238 @@
+package verifier
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SCTE-35 splice command types.
+const (
+	spliceNull     = 0x00
+	spliceSchedule = 0x04
+	spliceInsert   = 0x05
+	timeSignal     = 0x06
+	spliceBandwith = 0x07
+	splicePrivate  = 0xFF
+)
+
+// spliceCommandNames names the SCTE-35 splice command types.
+var spliceCommandNames = map[byte]string{
+	spliceNull:     "splice_null",
+	spliceSchedule: "splice_schedule",
+	spliceInsert:   "splice_insert",
+	timeSignal:     "time_signal",
+	spliceBandwith: "bandwidth_reservation",
+	splicePrivate:  "private_command",
+}
+
+// errSCTE35 is returned when an SCTE-35 payload can't be decoded.
+var errSCTE35 = errors.New("invalid SCTE-35 payload")
+
+// spliceInfo is what's verified of an SCTE-35 splice_info_section: its
+// command, and the event and break duration of a splice_insert or of the
+// first segmentation descriptor of a time_signal.
+type spliceInfo struct {
+	Command     string
+	EventID     uint32
+	Cancel      bool
+	Duration    time.Duration
+	HasDuration bool
+}
+
+// decodeSCTE35 decodes the splice_info_section of an SCTE35-OUT, SCTE35-IN
+// or SCTE35-CMD attribute, a hexadecimal sequence as required by the spec or
+// base64 as some packagers write, checking its CRC.
+func decodeSCTE35(value string) (*spliceInfo, error) {
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+	var data []byte
+	var err error
+	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+		data, err = hex.DecodeString(value[2:])
+	} else {
+		data, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: neither 0x prefixed hex nor base64", errSCTE35)
+	}
+
+	if len(data) < 17 || data[0] != 0xFC {
+		return nil, fmt.Errorf("%w: no splice_info_section", errSCTE35)
+	}
+	total := 3 + int(binary.BigEndian.Uint16(data[1:])&0x0FFF)
+	if total < 17 || total > len(data) {
+		return nil, fmt.Errorf("%w: section_length %d exceeds the %d bytes sent", errSCTE35, total-3, len(data)-3)
+	}
+	if crc := mpegCRC32(data[:total-4]); crc != binary.BigEndian.Uint32(data[total-4:]) {
+		return nil, fmt.Errorf("%w: CRC_32 mismatch", errSCTE35)
+	}
+	if data[4]&0x80 != 0 {
+		return &spliceInfo{Command: "encrypted"}, nil
+	}
+
+	commandLength := int(binary.BigEndian.Uint16(data[11:]) & 0x0FFF)
+	commandType := data[13]
+	info := &spliceInfo{Command: spliceCommandNames[commandType]}
+	if info.Command == "" {
+		info.Command = fmt.Sprintf("0x%02x", commandType)
+	}
+
+	// A splice_command_length of 0xFFF is a legacy placeholder for an
+	// unknown length, which only splice_insert can be parsed past.
+	command := data[14 : total-4]
+	if commandLength != 0xFFF {
+		if commandLength > len(command) {
+			return nil, fmt.Errorf("%w: splice_command_length %d exceeds the section", errSCTE35, commandLength)
+		}
+		command = command[:commandLength]
+	}
+
+	switch commandType {
+	case spliceInsert:
+		if err = info.readSpliceInsert(command); err != nil {
+			return nil, err
+		}
+	case timeSignal:
+		if commandLength == 0xFFF {
+			return info, nil
+		}
+		descriptors := data[14+commandLength : total-4]
+		if len(descriptors) < 2 {
+			return nil, fmt.Errorf("%w: truncated descriptor_loop_length", errSCTE35)
+		}
+		loop := int(binary.BigEndian.Uint16(descriptors))
+		if loop > len(descriptors)-2 {
+			return nil, fmt.Errorf("%w: descriptor_loop_length %d exceeds the section", errSCTE35, loop)
+		}
+		if err = info.readSegmentation(descriptors[2 : 2+loop]); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// readSpliceInsert reads the event and break duration of a splice_insert.
+func (s *spliceInfo) readSpliceInsert(c []byte) error {
+	truncated := fmt.Errorf("%w: truncated splice_insert", errSCTE35)
+	if len(c) < 5 {
+		return truncated
+	}
+	s.EventID = binary.BigEndian.Uint32(c)
+	if s.Cancel = c[4]&0x80 != 0; s.Cancel {
+		return nil
+	}
+	if len(c) < 6 {
+		return truncated
+	}
+
+	flags := c[5]
+	program, hasDuration, immediate := flags&0x40 != 0, flags&0x20 != 0, flags&0x10 != 0
+	i := 6
+	spliceTime := func() bool {
+		if i >= len(c) {
+			return false
+		}
+		if c[i]&0x80 != 0 {
+			i += 5
+		} else {
+			i++
+		}
+		return i <= len(c)
+	}
+
+	switch {
+	case program && !immediate:
+		if !spliceTime() {
+			return truncated
+		}
+	case !program:
+		if i >= len(c) {
+			return truncated
+		}
+		components := int(c[i])
+		i++
+		for n := 0; n < components; n++ {
+			i++
+			if !immediate && !spliceTime() {
+				return truncated
+			}
+		}
+	}
+
+	if hasDuration {
+		if i+5 > len(c) {
+			return truncated
+		}
+		s.Duration, s.HasDuration = ticksDuration(uint64(c[i]&0x01)<<32|uint64(binary.BigEndian.Uint32(c[i+1:]))), true
+	}
+	return nil
+}
+
+// readSegmentation reads the event and duration of the first segmentation
+// descriptor of the descriptor loop of a time_signal.
+func (s *spliceInfo) readSegmentation(loop []byte) error {
+	truncated := fmt.Errorf("%w: truncated segmentation_descriptor", errSCTE35)
+	for len(loop) >= 2 {
+		tag, length := loop[0], int(loop[1])
+		if 2+length > len(loop) {
+			return truncated
+		}
+		d := loop[2 : 2+length]
+		loop = loop[2+length:]
+		if tag != 0x02 || len(d) < 4 || string(d[:4]) != "CUEI" {
+			continue
+		}
+
+		if len(d) < 9 {
+			return truncated
+		}
+		s.EventID = binary.BigEndian.Uint32(d[4:])
+		if s.Cancel = d[8]&0x80 != 0; s.Cancel {
+			return nil
+		}
+		if len(d) < 10 {
+			return truncated
+		}
+		flags := d[9]
+		i := 10
+		if flags&0x80 == 0 {
+			if i >= len(d) {
+				return truncated
+			}
+			i += 1 + 6*int(d[i])
+		}
+		if flags&0x40 != 0 {
+			if i+5 > len(d) {
+				return truncated
+			}
+			s.Duration, s.HasDuration = ticksDuration(uint64(d[i])<<32|uint64(binary.BigEndian.Uint32(d[i+1:]))), true
+		}
+		return nil
+	}
+	return nil
+}
+
+// ticksDuration converts 90kHz clock ticks to a duration.
+func ticksDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / tsClockRate
+}
+
+// mpegCRC32 returns the CRC-32/MPEG-2 of data, as used by MPEG-TS sections.
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,391 @@
+package verifier
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+)
+
+// streamChunkSize is the amount of ciphertext an AES-128 segment is
+// decrypted in as it's downloaded, so a worker only holds a chunk of it
+// rather than the whole segment.
+const streamChunkSize = 64 << 10
+
+// streamsSegment reports whether the segment of result is decrypted as it's
+// downloaded: an AES-128 one, unless it may be gzip-encoded and has to be
+// decompressed whole first.
+func (v *Verifier) streamsSegment(result *SegmentResult) bool {
+	return result.Method == methodAES128 && result.KeyURI != "" && !v.opts.GunzipSegments
+}
+
+// buffersDecrypted reports whether the checks of the segment on uri need its
+// whole decrypted body, held in memory rather than streamed: subtitles,
+// and --deep-check, --ffprobe, --concat and --check-media-durations, which
+// parse the segment, along with --save to an OutputWriter that isn't an
+// OutputStreamer.
+func (v *Verifier) buffersDecrypted(uri string) bool {
+	if _, ok := v.output.(OutputStreamer); v.opts.SaveSegments && !ok {
+		return true
+	}
+	return v.opts.DeepCheck || v.opts.FFprobe || v.opts.Concat || v.opts.CheckMediaDurations || isWebVTT(uri, nil)
+}
+
+// decodeStreamedSegment is decodeSegment for the AES-128 segment of result,
+// decrypting it in streamChunkSize chunks as it's downloaded. Only the
+// padding of its last block and the byte counts needed to find a dominant
+// byte are checked on the way, and it's written to disk directly under
+// --save, so the memory it takes is bounded however large it is. Without
+// --save, failed segments are downloaded again to be saved. Segments whose
+// checks need it whole are still buffered, and verified by verifyDecrypted.
+func (v *Verifier) decodeStreamedSegment(ctx context.Context, result *SegmentResult, cached *cacheEntry) error {
+	uri := result.URI
+
+	mode, err := v.GetCBCDecrypter(ctx, result.KeyURI, result.IV, result.MediaSequence)
+	if err != nil {
+		return err
+	}
+
+	plain := v.newPlainSegment(result)
+	defer plain.discard()
+	decrypter := newCBCStream(mode, plain)
+
+	var sum hash.Hash
+	if v.sumsSegments() || v.opts.CompareOrigin != "" {
+		sum = sha256.New()
+	}
+	gzipped := false
+	var length int64
+	info, err := v.fetchStream(ctx, uri, result.Offset, result.Limit, cached, func(r io.Reader) error {
+		if sum != nil {
+			r = io.TeeReader(r, sum)
+		}
+		br := bufio.NewReader(r)
+		var copyErr error
+		if head, _ := br.Peek(len(gzipMagic)); isGzip(head) {
+			gzipped = true
+			length, copyErr = io.Copy(io.Discard, br)
+		} else {
+			length, copyErr = io.Copy(decrypter, br)
+		}
+		return copyErr
+	})
+	result.setFetchInfo(info)
+	if err != nil {
+		return err
+	}
+	if cached != nil && info.Status == http.StatusNotModified {
+		cached.restore(result)
+		v.infof("Segment unchanged since verified on %s, skipped: %s", cached.VerifiedAt.Format(time.RFC3339), uri)
+		return nil
+	}
+	result.Length = int(length)
+	result.Bitrate = bitrate(result.Length, info.Duration)
+
+	var mismatch error
+	if sum != nil {
+		var served [sha256.Size]byte
+		sum.Sum(served[:0])
+		if v.sumsSegments() {
+			mismatch = v.checksumSum(result, served)
+		}
+		if v.opts.CompareOrigin != "" {
+			mismatch = errors.Join(mismatch, v.compareOrigin(ctx, result, served))
+		}
+	}
+
+	if gzipped {
+		v.errorf("Segment is gzip-encoded, not raw media on segment: %s", uri)
+		return errors.Join(errGzipEncoded, mismatch)
+	}
+
+	last, err := decrypter.close()
+	if errors.Is(err, errBlockAlignment) {
+		return errors.Join(v.alignmentFailure(ctx, result, plain), mismatch)
+	}
+	if err != nil {
+		return err
+	}
+	if plain.buffered {
+		return errors.Join(v.verifyDecrypted(ctx, result, plain.body.Bytes()), mismatch)
+	}
+	return errors.Join(v.verifyStreamed(ctx, result, plain, last), mismatch)
+}
+
+// verifyStreamed is verifyDecrypted for a streamed segment, whose padding is
+// on last, its last block.
+func (v *Verifier) verifyStreamed(ctx context.Context, result *SegmentResult, plain *plainSegment, last []byte) error {
+	uri := result.URI
+
+	result.DecryptedLength = int(plain.length)
+	result.PadValue = int(last[len(last)-1])
+
+	if v.opts.DumpTails {
+		v.printTail(result, plain.tail)
+	}
+
+	if v.opts.NoPaddingCheck {
+		v.infof("Segment decrypted, padding not checked: %s", uri)
+		if v.opts.SaveSegments {
+			return plain.commit(ctx, SegmentValid)
+		}
+		return nil
+	}
+
+	if !hasValidPadding(last) {
+		v.errorf("Segment padding incorrect on segment: %s", uri)
+		recordTail(result, plain.tail)
+		if err := plain.commit(ctx, SegmentInvalid); err != nil {
+			return err
+		}
+		return errPadding
+	}
+
+	// A valid padding can still be a coincidence when a wrong key decrypts
+	// the segment into a long run of a single byte.
+	padding := int(last[len(last)-1])
+	result.DecryptedLength -= padding
+	if v.opts.DominantByteRatio > 0 {
+		if value, ratio := plain.dominantByte(byte(padding), padding); ratio >= v.opts.DominantByteRatio {
+			v.errorf("Segment dominated by byte 0x%02x (%.1f%%) on segment: %s", value, ratio*100, uri)
+			if err := plain.commit(ctx, SegmentInvalid); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: 0x%02x makes up %.1f%% of the segment", errDominantByte, value, ratio*100)
+		}
+	}
+
+	if v.opts.SaveSegments {
+		return plain.commit(ctx, SegmentValid)
+	}
+	return nil
+}
+
+// alignmentFailure saves the segment of result whose length isn't a
+// multiple of the block size, as far as its whole blocks decrypted followed
+// by the trailing bytes as served, and returns errBlockAlignment.
+func (v *Verifier) alignmentFailure(ctx context.Context, result *SegmentResult, plain *plainSegment) error {
+	v.errorf("Segment length %d isn't a multiple of the block size on segment: %s", result.Length, result.URI)
+	if plain.buffered {
+		if err := v.output.Write(result.Variant, result.Index, SegmentInvalid, plain.body.Bytes()); err != nil {
+			return err
+		}
+	} else if err := plain.commit(ctx, SegmentInvalid); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %d bytes", errBlockAlignment, result.Length)
+}
+
+// cbcStream decrypts the AES-128 CBC ciphertext written to it into plain, a
+// chunk at a time, holding back the last block it was written until close
+// as it carries the padding.
+type cbcStream struct {
+	mode   cipher.BlockMode
+	plain  io.Writer
+	buf    []byte
+	n      int
+	length int64
+}
+
+func newCBCStream(mode cipher.BlockMode, plain io.Writer) *cbcStream {
+	return &cbcStream{mode: mode, plain: plain, buf: make([]byte, streamChunkSize)}
+}
+
+func (s *cbcStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[s.n:], p)
+		p = p[n:]
+		if err := s.fill(n); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// ReadFrom reads r straight into the chunk being decrypted, saving io.Copy
+// a buffer of its own.
+func (s *cbcStream) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		n, err := r.Read(s.buf[s.n:])
+		total += int64(n)
+		if fillErr := s.fill(n); fillErr != nil {
+			return total, fillErr
+		}
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// fill records n more bytes on the chunk, decrypting and writing it but for
+// its last block once full.
+func (s *cbcStream) fill(n int) error {
+	s.n += n
+	s.length += int64(n)
+	if s.n < len(s.buf) {
+		return nil
+	}
+
+	ready := s.n - aes.BlockSize
+	s.mode.CryptBlocks(s.buf[:ready], s.buf[:ready])
+	if _, err := s.plain.Write(s.buf[:ready]); err != nil {
+		return err
+	}
+	s.n = copy(s.buf, s.buf[ready:s.n])
+	return nil
+}
+
+// close decrypts and writes what's left of the ciphertext, returning its
+// last block. It errors with errBlockAlignment when the ciphertext is empty
+// or isn't made of whole blocks, writing the bytes past the last whole one
+// as they were.
+func (s *cbcStream) close() ([]byte, error) {
+	whole := s.n - s.n%aes.BlockSize
+	s.mode.CryptBlocks(s.buf[:whole], s.buf[:whole])
+	if _, err := s.plain.Write(s.buf[:s.n]); err != nil {
+		return nil, err
+	}
+	if s.length == 0 || whole != s.n {
+		return nil, errBlockAlignment
+	}
+	return s.buf[whole-aes.BlockSize : whole], nil
+}
+
+// plainSegment receives a segment as it's decrypted. Unless buffered, it
+// only keeps the counts of every byte and its tail, writing the rest to the
+// SegmentFile it's saved with under --save, rather than the whole segment.
+type plainSegment struct {
+	v      *Verifier
+	result *SegmentResult
+
+	// buffered is set when the segment is kept whole on body, decided
+	// by buffersDecrypted or once its first bytes read as WebVTT.
+	buffered bool
+	started  bool
+	body     bytes.Buffer
+
+	spool  SegmentFile
+	counts [256]int64
+	length int64
+	tail   []byte
+}
+
+func (v *Verifier) newPlainSegment(result *SegmentResult) *plainSegment {
+	return &plainSegment{
+		v:        v,
+		result:   result,
+		buffered: v.buffersDecrypted(result.URI),
+	}
+}
+
+func (p *plainSegment) Write(b []byte) (int, error) {
+	if !p.started {
+		p.started = true
+		p.buffered = p.buffered || isWebVTT("", b)
+		if streamer, ok := p.v.output.(OutputStreamer); ok && !p.buffered && p.v.opts.SaveSegments {
+			var err error
+			if p.spool, err = streamer.Create(p.result.Variant, p.result.Index); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if p.buffered {
+		return p.body.Write(b)
+	}
+
+	for _, c := range b {
+		p.counts[c]++
+	}
+	p.length += int64(len(b))
+	if len(b) >= tailSize {
+		p.tail = append(p.tail[:0], b[len(b)-tailSize:]...)
+	} else {
+		p.tail = append(p.tail, b...)
+		if len(p.tail) > tailSize {
+			p.tail = p.tail[len(p.tail)-tailSize:]
+		}
+	}
+	if p.spool == nil {
+		return len(b), nil
+	}
+	return p.spool.Write(b)
+}
+
+// dominantByte is the dominantByte of the segment without its padding, its
+// last n bytes of value pad.
+func (p *plainSegment) dominantByte(pad byte, n int) (byte, float64) {
+	counts := p.counts
+	counts[pad] -= int64(n)
+	length := p.length - int64(n)
+	if length <= 0 {
+		return 0, 0
+	}
+
+	var value byte
+	for b, count := range counts {
+		if count > counts[value] {
+			value = byte(b)
+		}
+	}
+	return value, float64(counts[value]) / float64(length)
+}
+
+// commit saves the segment with status. An empty one is written as such,
+// and one that wasn't kept, without --save, is downloaded again.
+func (p *plainSegment) commit(ctx context.Context, status Status) error {
+	switch {
+	case p.spool != nil:
+		spool := p.spool
+		p.spool = nil
+		return spool.Commit(status)
+	case p.length == 0:
+		return p.v.output.Write(p.result.Variant, p.result.Index, status, nil)
+	}
+	return p.v.saveRefetched(ctx, p.result, status)
+}
+
+// discard drops the segment unless it was committed.
+func (p *plainSegment) discard() {
+	if p.spool != nil {
+		_ = p.spool.Discard()
+		p.spool = nil
+	}
+}
+
+// saveRefetched downloads the streamed segment of result again to save it
+// with status, decrypted as far as its whole blocks followed by any
+// trailing bytes as served. The segment already failed, so a download that
+// fails as well is only printed, as is a copy that isn't the one verified.
+func (v *Verifier) saveRefetched(ctx context.Context, result *SegmentResult, status Status) error {
+	body, err := v.GetByteRange(ctx, result.URI, result.Offset, result.Limit)
+	if err != nil {
+		v.warnf("Unable to download failed segment %s again to save it: %s", result.URI, err.Error())
+		return nil
+	}
+	if sum := sha256.Sum256(body); result.SHA256 != "" && hex.EncodeToString(sum[:]) != result.SHA256 {
+		v.warnf("Failed segment %s changed since it was verified, saving the copy downloaded again", result.URI)
+	}
+
+	mode, err := v.GetCBCDecrypter(ctx, result.KeyURI, result.IV, result.MediaSequence)
+	if err != nil {
+		return err
+	}
+	whole := len(body) - len(body)%aes.BlockSize
+	mode.CryptBlocks(body[:whole], body[:whole])
+	return v.output.Write(result.Variant, result.Index, status, body)
+}
@@ -0,0 +1,140 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCBCStream(t *testing.T) {
+	writers := []struct {
+		name  string
+		write func(s *cbcStream, ciphertext []byte) error
+	}{
+		{"one write", func(s *cbcStream, ciphertext []byte) error {
+			_, err := s.Write(ciphertext)
+			return err
+		}},
+		{"odd writes", func(s *cbcStream, ciphertext []byte) error {
+			for len(ciphertext) > 0 {
+				n := min(len(ciphertext), 1000)
+				if _, err := s.Write(ciphertext[:n]); err != nil {
+					return err
+				}
+				ciphertext = ciphertext[n:]
+			}
+			return nil
+		}},
+		{"read from", func(s *cbcStream, ciphertext []byte) error {
+			_, err := io.Copy(s, bytes.NewReader(ciphertext))
+			return err
+		}},
+		{"read from short reads", func(s *cbcStream, ciphertext []byte) error {
+			_, err := s.ReadFrom(iotest.HalfReader(bytes.NewReader(ciphertext)))
+			return err
+		}},
+	}
+	sizes := []struct {
+		length  int
+		aligned bool
+	}{
+		{0, false},
+		{15, false},
+		{aes.BlockSize, true},
+		{17, false},
+		{2 * aes.BlockSize, true},
+		{streamChunkSize - aes.BlockSize, true},
+		{streamChunkSize, true},
+		{streamChunkSize + 1, false},
+		{streamChunkSize + aes.BlockSize, true},
+		{3*streamChunkSize + 7*aes.BlockSize, true},
+		{3*streamChunkSize + 7, false},
+	}
+	block, err := aes.NewCipher(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := sequenceIV(3)
+
+	for _, size := range sizes {
+		for _, writer := range writers {
+			t.Run(fmt.Sprintf("%d bytes %s", size.length, writer.name), func(t *testing.T) {
+				ciphertext := testPlain(size.length, size.length)
+				whole := size.length - size.length%aes.BlockSize
+				want := make([]byte, size.length)
+				cipher.NewCBCDecrypter(block, iv).CryptBlocks(want[:whole], ciphertext[:whole])
+				copy(want[whole:], ciphertext[whole:])
+
+				var plain bytes.Buffer
+				s := newCBCStream(cipher.NewCBCDecrypter(block, iv), &plain)
+				if err := writer.write(s, bytes.Clone(ciphertext)); err != nil {
+					t.Fatal(err)
+				}
+				last, err := s.close()
+
+				if !size.aligned {
+					if !errors.Is(err, errBlockAlignment) {
+						t.Errorf("close() error = %v, want errBlockAlignment", err)
+					}
+				} else if err != nil {
+					t.Fatalf("close() error = %v", err)
+				} else if !bytes.Equal(last, want[whole-aes.BlockSize:]) {
+					t.Errorf("close() last block = %x, want %x", last, want[whole-aes.BlockSize:])
+				}
+				if !bytes.Equal(plain.Bytes(), want) {
+					t.Errorf("decrypted %d bytes, want %d matching a whole CBC decryption", plain.Len(), len(want))
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyStreamsLargeSegments(t *testing.T) {
+	tests := []struct {
+		name string
+		save bool
+	}{
+		{name: "verified", save: false},
+		{name: "saved", save: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.addMedia("/media/index.m3u8", 2)
+			large := testPlain(5, 3*streamChunkSize+100)
+			stream.add("/media/seg1.ts", encryptSegment(testKey, sequenceIV(1), large))
+
+			v := newTestVerifier(t, func(opts *Options) { opts.SaveSegments = tt.save })
+			report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			segment := report.Variants[0].Segments[1]
+			if segment.DecryptedLength != len(large) {
+				t.Errorf("segment 1 decrypted to %d bytes, want %d", segment.DecryptedLength, len(large))
+			}
+			if !tt.save {
+				return
+			}
+
+			saved, err := os.ReadFile(filepath.Join(v.opts.OutputDir, segment.Variant, "segment1.m4f"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Segments are saved as decrypted, padding included.
+			padding := aes.BlockSize - len(large)%aes.BlockSize
+			want := append(bytes.Clone(large), bytes.Repeat([]byte{byte(padding)}, padding)...)
+			if !bytes.Equal(saved, want) {
+				t.Errorf("saved %d bytes of segment 1, want the %d decrypted ones", len(saved), len(want))
+			}
+		})
+	}
+}
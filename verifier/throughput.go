@@ -0,0 +1,106 @@
+package verifier
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Throughput aggregates the segments of a rendition fetched successfully,
+// to catch CDN performance regressions along with broken segments.
+type Throughput struct {
+	Segments  int                 `json:"segments"`
+	FirstByte DurationPercentiles `json:"first_byte"`
+	Download  DurationPercentiles `json:"download"`
+	Bitrate   BitratePercentiles  `json:"bitrate"`
+}
+
+// DurationPercentiles are the 50th, 95th and 99th percentiles of a
+// duration.
+type DurationPercentiles struct {
+	P50 time.Duration `json:"p50"`
+	P95 time.Duration `json:"p95"`
+	P99 time.Duration `json:"p99"`
+}
+
+func (p DurationPercentiles) String() string {
+	return fmt.Sprintf(
+		"%s/%s/%s",
+		roundFetch(p.P50),
+		roundFetch(p.P95),
+		roundFetch(p.P99),
+	)
+}
+
+// roundFetch rounds the duration of a fetch for printing, keeping a tenth
+// of a millisecond so fetches from nearby origins don't all print as 0s.
+func roundFetch(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
+
+// BitratePercentiles are the 50th, 95th and 99th percentiles of a bitrate, in
+// bits per second, ranked from the fastest so that P95 and P99 are the slow
+// tail of the segments as with DurationPercentiles.
+type BitratePercentiles struct {
+	P50 int64 `json:"p50"`
+	P95 int64 `json:"p95"`
+	P99 int64 `json:"p99"`
+}
+
+func (p BitratePercentiles) String() string {
+	return fmt.Sprintf("%.2f/%.2f/%.2f Mbps", float64(p.P50)/1e6, float64(p.P95)/1e6, float64(p.P99)/1e6)
+}
+
+// sumThroughput sets the Throughput of r from its segments with a body,
+// leaving it nil when there are none.
+func (r *MediaResult) sumThroughput() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var firstBytes, downloads []time.Duration
+	var bitrates []int64
+	for _, segment := range r.Segments {
+		if segment.Length == 0 || segment.FetchDuration <= 0 || segment.Cached {
+			continue
+		}
+		firstBytes = append(firstBytes, segment.FirstByte)
+		downloads = append(downloads, segment.FetchDuration)
+		bitrates = append(bitrates, segment.Bitrate)
+	}
+	if len(downloads) == 0 {
+		r.Throughput = nil
+		return
+	}
+
+	sort.Slice(firstBytes, func(i, k int) bool { return firstBytes[i] < firstBytes[k] })
+	sort.Slice(downloads, func(i, k int) bool { return downloads[i] < downloads[k] })
+	sort.Slice(bitrates, func(i, k int) bool { return bitrates[i] > bitrates[k] })
+	r.Throughput = &Throughput{
+		Segments: len(downloads),
+		FirstByte: DurationPercentiles{
+			P50: firstBytes[percentileIndex(len(firstBytes), 50)],
+			P95: firstBytes[percentileIndex(len(firstBytes), 95)],
+			P99: firstBytes[percentileIndex(len(firstBytes), 99)],
+		},
+		Download: DurationPercentiles{
+			P50: downloads[percentileIndex(len(downloads), 50)],
+			P95: downloads[percentileIndex(len(downloads), 95)],
+			P99: downloads[percentileIndex(len(downloads), 99)],
+		},
+		Bitrate: BitratePercentiles{
+			P50: bitrates[percentileIndex(len(bitrates), 50)],
+			P95: bitrates[percentileIndex(len(bitrates), 95)],
+			P99: bitrates[percentileIndex(len(bitrates), 99)],
+		},
+	}
+}
+
+// percentileIndex returns the index of the p-th percentile of n sorted
+// values, by the nearest-rank method.
+func percentileIndex(n, p int) int {
+	rank := (p*n + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return rank - 1
+}
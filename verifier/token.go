@@ -0,0 +1,116 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// tokenSource holds the Bearer token requests are authorized with, running
+// the TokenCommand of a Verifier for a fresh one when there's none yet or
+// the origin rejected it.
+type tokenSource struct {
+	command string
+
+	mu    sync.Mutex
+	token string
+}
+
+func newTokenSource(opts Options) *tokenSource {
+	return &tokenSource{command: opts.TokenCommand, token: opts.Token}
+}
+
+// get returns the current token, running the command for a first one when
+// it has none.
+func (s *tokenSource) get(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" || s.command == "" {
+		return s.token, nil
+	}
+	token, err := s.run(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	return token, nil
+}
+
+// refresh replaces rejected, the token a request was denied with, with a
+// fresh one from the command and returns it, reporting whether the command
+// ran. When another request already refreshed rejected, the token it got is
+// returned without running the command again.
+func (s *tokenSource) refresh(ctx context.Context, rejected string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != rejected {
+		return s.token, false, nil
+	}
+	token, err := s.run(ctx)
+	if err != nil {
+		return "", true, err
+	}
+	s.token = token
+	return token, true, nil
+}
+
+// run runs the command through the shell, returning the token it printed
+// on stdout without surrounding whitespace. It's called with mu held.
+func (s *tokenSource) run(ctx context.Context) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		detail := strings.TrimSpace(stderr.String())
+		if detail == "" {
+			detail = err.Error()
+		}
+		return "", newError(fmt.Sprintf("--token-command failed: %s", detail))
+	}
+
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return "", newError("--token-command printed no token")
+	}
+	return token, nil
+}
+
+// setToken authorizes req with the current token of v, if any.
+func (v *Verifier) setToken(req *http.Request) error {
+	token, err := v.token.get(req.Context())
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// reauthorize refreshes the token res denied req with through the
+// TokenCommand of v, setting the fresh one on req so it can be sent again.
+// It reports false when there's no command, res isn't a 401 or 403, or the
+// command failed.
+func (v *Verifier) reauthorize(req *http.Request, res *http.Response) bool {
+	if v.token.command == "" || res == nil ||
+		(res.StatusCode != http.StatusUnauthorized && res.StatusCode != http.StatusForbidden) {
+		return false
+	}
+	rejected := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	token, ran, err := v.token.refresh(req.Context(), rejected)
+	if err != nil {
+		v.errorf("Unable to refresh the token after %s on %s: %s", res.Status, req.URL, err.Error())
+		return false
+	}
+	if ran {
+		v.infof("Refreshed the token after %s on: %s", res.Status, req.URL)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return true
+}
@@ -0,0 +1,78 @@
+package verifier
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTokenAuthorizesRequests(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{name: "no token", want: ""},
+		{name: "token", token: "secret", want: "Bearer secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.add("/master.m3u8", []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000\nmedia/index.m3u8\n"))
+			stream.addMedia("/media/index.m3u8", 2)
+
+			v := newTestVerifier(t, func(opts *Options) {
+				opts.ManifestType = "master"
+				opts.Token = tt.token
+			})
+			if _, err := v.Verify(context.Background(), stream.uri("/master.m3u8")); err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+
+			for _, path := range []string{"/master.m3u8", "/media/index.m3u8", "/media/key.bin", "/media/seg0.ts", "/media/seg1.ts"} {
+				requests := stream.requestsTo(path)
+				if len(requests) == 0 {
+					t.Fatalf("%s wasn't requested", path)
+				}
+				for _, r := range requests {
+					if got := r.Header.Get("Authorization"); got != tt.want {
+						t.Errorf("request to %s sent Authorization %q, want %q", path, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHeadersSentOnEveryRequest(t *testing.T) {
+	stream := newTestStream(t)
+	stream.add("/master.m3u8", []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000\nmedia/index.m3u8\n"))
+	stream.addMedia("/media/index.m3u8", 2)
+
+	v := newTestVerifier(t, func(opts *Options) {
+		opts.ManifestType = "master"
+		opts.Headers = []string{"X-Origin-Auth: abc123", "Referer: https://player.example.com/"}
+		opts.UserAgent = "hlseverify-test/1.0"
+	})
+	if _, err := v.Verify(context.Background(), stream.uri("/master.m3u8")); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	want := map[string]string{
+		"X-Origin-Auth": "abc123",
+		"Referer":       "https://player.example.com/",
+		"User-Agent":    "hlseverify-test/1.0",
+	}
+	for _, path := range []string{"/master.m3u8", "/media/index.m3u8", "/media/key.bin", "/media/seg0.ts", "/media/seg1.ts"} {
+		requests := stream.requestsTo(path)
+		if len(requests) == 0 {
+			t.Fatalf("%s wasn't requested", path)
+		}
+		for _, r := range requests {
+			for name, value := range want {
+				if got := r.Header.Get(name); got != value {
+					t.Errorf("request to %s sent %s %q, want %q", path, name, got, value)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package verifier
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsVersions maps the accepted --tls-min-version values to their tls
+// package constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTransport builds the http.RoundTripper used by the Verifier,
+// applying the TLS and connection options of v.
+func (v *Verifier) newTransport() (http.RoundTripper, error) {
+	tlsConfig, err := v.newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DisableKeepAlives = v.opts.DisableKeepAlive
+	if v.opts.Proxy != "" {
+		proxy, err := parseProxy(v.opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+		v.debugf("Sending every request through proxy: %s", proxy.Redacted())
+	}
+	if v.opts.ConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: v.opts.ConnectTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = v.opts.ConnectTimeout
+	}
+
+	// Byte-range segments share their resource and host, so concurrent
+	// ranges keep their connections instead of reopening them.
+	transport.MaxIdleConnsPerHost = v.opts.Concurrency
+	if v.opts.IdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = v.opts.IdleConnsPerHost
+	}
+	if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+
+	if v.opts.DisableKeepAlive {
+		v.infof("Keep-alive disabled, every request will use a new connection")
+	}
+
+	var rt http.RoundTripper = &reuseRetrier{next: transport, transport: transport, log: v.log}
+	if v.log.Enabled(context.Background(), slog.LevelDebug) {
+		rt = &tlsReporter{next: rt, log: v.log}
+	}
+	if v.opts.Trace {
+		rt = &tracer{next: rt, log: v.log}
+	}
+
+	return rt, nil
+}
+
+// parseProxy parses a --proxy URL, which requires a host and one of the
+// schemes supported by http.Transport.
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, newError("--proxy must be a URL like http://host:port, got: " + proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, newError("--proxy scheme must be http, https or socks5, got: " + u.Scheme)
+}
+
+func (v *Verifier) newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if v.opts.Insecure {
+		if v.opts.CACert != "" {
+			return nil, newError("--insecure skips certificate verification, it can't be combined with --ca-cert")
+		}
+		v.warnf("--insecure set, TLS certificates of every origin won't be verified")
+		config.InsecureSkipVerify = true
+	}
+
+	if v.opts.CACert != "" {
+		pool, err := v.loadCertPool(v.opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if v.opts.ClientCert != "" || v.opts.ClientKey != "" {
+		if v.opts.ClientCert == "" || v.opts.ClientKey == "" {
+			return nil, newError("--client-cert and --client-key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(v.opts.ClientCert, v.opts.ClientKey)
+		if err != nil {
+			return nil, newError("unable to load client certificate " + v.opts.ClientCert + ": " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			v.debugf("Presenting client certificate: %s", leaf.Subject.String())
+		}
+	}
+
+	if v.opts.TLSMinVersion != "" {
+		version, ok := tlsVersions[v.opts.TLSMinVersion]
+		if !ok {
+			return nil, newError("tls version \"" + v.opts.TLSMinVersion + "\" isn't supported")
+		}
+		config.MinVersion = version
+	}
+
+	if len(v.opts.TLSCipherSuites) == 0 {
+		return config, nil
+	}
+
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+
+	for _, name := range v.opts.TLSCipherSuites {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, newError("cipher suite \"" + name + "\" isn't supported")
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	return config, nil
+}
+
+// loadCertPool returns the system root CAs along with the PEM certificates
+// on path, erroring if none can be loaded from it.
+func (v *Verifier) loadCertPool(path string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	added := 0
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, newError("unable to parse certificate on " + path + ": " + err.Error())
+		}
+
+		pool.AddCert(cert)
+		added++
+		v.debugf("Added CA from %s: %s", path, cert.Subject.String())
+	}
+
+	if added == 0 {
+		return nil, newError("no certificates found on " + path)
+	}
+
+	return pool, nil
+}
+
+// tlsReporter prints the TLS version and cipher suite negotiated with each
+// host the first time a response is received from it.
+type tlsReporter struct {
+	next  http.RoundTripper
+	log   *slog.Logger
+	hosts sync.Map
+}
+
+func (t *tlsReporter) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || res.TLS == nil {
+		return res, err
+	}
+
+	if _, seen := t.hosts.LoadOrStore(req.URL.Host, struct{}{}); !seen {
+		logf(t.log, slog.LevelDebug,
+			"Negotiated %s (%s) with host: %s",
+			tls.VersionName(res.TLS.Version),
+			tls.CipherSuiteName(res.TLS.CipherSuite),
+			req.URL.Host,
+		)
+	}
+
+	return res, nil
+}
+
+// tracer records the DNS, connect, TLS handshake, first byte and total
+// times of every request, printing them once the response body is closed.
+type tracer struct {
+	next http.RoundTripper
+	log  *slog.Logger
+}
+
+// requestTimings holds the instants measured for a single traced request.
+// Trace hooks may run on other goroutines, so they're guarded by mu.
+type requestTimings struct {
+	mu                    sync.Mutex
+	start                 time.Time
+	dnsStart, dns         time.Time
+	connectStart, connect time.Time
+	tlsStart, tls         time.Time
+	firstByte             time.Time
+}
+
+func (t *tracer) RoundTrip(req *http.Request) (*http.Response, error) {
+	timings := &requestTimings{start: time.Now()}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { timings.mark(&timings.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { timings.mark(&timings.dns) },
+		ConnectStart:         func(string, string) { timings.mark(&timings.connectStart) },
+		ConnectDone:          func(string, string, error) { timings.mark(&timings.connect) },
+		TLSHandshakeStart:    func() { timings.mark(&timings.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { timings.mark(&timings.tls) },
+		GotFirstResponseByte: func() { timings.mark(&timings.firstByte) },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		logf(t.log, slog.LevelInfo, "Trace %s %s: failed after %s: %s", req.Method, req.URL, time.Since(timings.start), err.Error())
+		return nil, err
+	}
+
+	res.Body = &tracedBody{
+		ReadCloser: res.Body,
+		done: func() {
+			timings.mu.Lock()
+			defer timings.mu.Unlock()
+
+			logf(t.log, slog.LevelInfo,
+				"Trace %s %s: dns=%s connect=%s tls=%s first-byte=%s total=%s",
+				req.Method,
+				req.URL,
+				since(timings.dnsStart, timings.dns),
+				since(timings.connectStart, timings.connect),
+				since(timings.tlsStart, timings.tls),
+				since(timings.start, timings.firstByte),
+				time.Since(timings.start),
+			)
+		},
+	}
+
+	return res, nil
+}
+
+func (t *requestTimings) mark(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	*at = time.Now()
+}
+
+// since returns the duration between start and end, or zero if either
+// didn't happen, like the DNS lookup of a reused connection.
+func since(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// tracedBody calls done the first time the response body is closed.
+type tracedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// reuseRetrier retries idempotent requests once on a new connection when
+// they fail on a reused one, as origins without keep-alive support tend to
+// reset idle connections.
+type reuseRetrier struct {
+	next      http.RoundTripper
+	transport *http.Transport
+	log       *slog.Logger
+}
+
+func (r *reuseRetrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}
+
+	res, err := r.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil || !reused || req.Body != nil || req.Method != http.MethodGet {
+		return res, err
+	}
+
+	logf(r.log, slog.LevelInfo, "Retrying %s on a new connection after a reused connection failed: %s", req.URL, err.Error())
+	r.transport.CloseIdleConnections()
+	countRetry(req.Context())
+
+	return r.next.RoundTrip(req)
+}
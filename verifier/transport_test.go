@@ -0,0 +1,62 @@
+package verifier
+
+import (
+	"context"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifySelfSignedOrigin(t *testing.T) {
+	stream := newTLSTestStream(t)
+	stream.addMedia("/media/index.m3u8", 2)
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: stream.Certificate().Raw})
+	if err := os.WriteFile(caCert, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		insecure bool
+		caCert   string
+		wantErr  bool
+	}{
+		{name: "verified", wantErr: true},
+		{name: "insecure", insecure: true},
+		{name: "ca cert", caCert: caCert},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVerifier(t, func(opts *Options) {
+				opts.Insecure = tt.insecure
+				opts.CACert = tt.caCert
+			})
+			report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Verify() error = nil, want the certificate to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if report.Totals.Verified != 2 {
+				t.Errorf("Verify() verified %d segments, want 2", report.Totals.Verified)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInsecureWithCACert(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Insecure = true
+	opts.CACert = filepath.Join(t.TempDir(), "ca.pem")
+	if _, err := New(opts); err == nil || !strings.Contains(err.Error(), "can't be combined") {
+		t.Errorf("New() error = %v, want --insecure and --ca-cert to be rejected together", err)
+	}
+}
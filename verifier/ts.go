@@ -0,0 +1,249 @@
+package verifier
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	tsNullPID    = 0x1FFF
+)
+
+// MPEG-TS stream types carrying audio.
+var tsAudioStreamTypes = map[byte]bool{
+	0x03: true, // MPEG-1 audio
+	0x04: true, // MPEG-2 audio
+	0x0F: true, // AAC ADTS
+	0x81: true, // AC-3
+	0x87: true, // E-AC-3
+	0xCF: true, // SAMPLE-AES AAC ADTS
+	0xC1: true, // SAMPLE-AES AC-3
+	0xC2: true, // SAMPLE-AES E-AC-3
+}
+
+// MPEG-TS stream types of the elementary streams SAMPLE-AES encrypts.
+var tsSampleAESStreamTypes = map[byte]bool{
+	0xDB: true, // H.264
+	0xCF: true, // AAC ADTS
+	0xC1: true, // AC-3
+	0xC2: true, // E-AC-3
+}
+
+// isTransportStream reports whether data looks like an MPEG-TS segment.
+func isTransportStream(data []byte) bool {
+	if len(data) < tsPacketSize || data[0] != tsSyncByte {
+		return false
+	}
+	return len(data) < 2*tsPacketSize || data[tsPacketSize] == tsSyncByte
+}
+
+// tsPacket is a single transport stream packet split into its header fields
+// and payload. HasPayload is set even when the adaptation field leaves the
+// payload empty, as it's what advances the continuity counter.
+type tsPacket struct {
+	PID           uint16
+	Start         bool
+	Continuity    byte
+	HasPayload    bool
+	Discontinuity bool
+	Payload       []byte
+}
+
+// tsPackets splits data into transport stream packets, stopping at the first
+// packet without a sync byte.
+func tsPackets(data []byte) []tsPacket {
+	var packets []tsPacket
+	for offset := 0; offset+tsPacketSize <= len(data); offset += tsPacketSize {
+		packet := data[offset : offset+tsPacketSize]
+		if packet[0] != tsSyncByte {
+			break
+		}
+
+		adaptation := packet[3] >> 4 & 0x03
+		p := tsPacket{
+			PID:        uint16(packet[1]&0x1F)<<8 | uint16(packet[2]),
+			Start:      packet[1]&0x40 != 0,
+			Continuity: packet[3] & 0x0F,
+			HasPayload: adaptation&0x01 != 0,
+		}
+
+		payload := packet[4:]
+		if adaptation&0x02 != 0 {
+			if len(payload) == 0 || int(payload[0])+1 > len(payload) {
+				packets = append(packets, p)
+				continue
+			}
+			p.Discontinuity = payload[0] > 0 && payload[1]&0x80 != 0
+			payload = payload[int(payload[0])+1:]
+		}
+		if adaptation&0x01 != 0 {
+			p.Payload = payload
+		}
+
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+// checkContinuity returns the first packet whose continuity counter doesn't
+// follow the previous packet of its PID, if any. A packet with a payload
+// must increment it, once repeated packets are allowed, and one without must
+// keep it. Null packets and those flagging a discontinuity are exempt.
+func checkContinuity(packets []tsPacket) (int, bool) {
+	type counter struct {
+		last     byte
+		repeated bool
+	}
+	counters := make(map[uint16]*counter)
+
+	for i, p := range packets {
+		c, seen := counters[p.PID]
+		if p.PID == tsNullPID {
+			continue
+		}
+		if !seen || p.Discontinuity {
+			counters[p.PID] = &counter{last: p.Continuity}
+			continue
+		}
+
+		switch {
+		case !p.HasPayload && p.Continuity == c.last:
+		case p.HasPayload && p.Continuity == (c.last+1)&0x0F:
+			c.repeated = false
+		case p.HasPayload && p.Continuity == c.last && !c.repeated:
+			c.repeated = true
+		default:
+			return i, false
+		}
+		c.last = p.Continuity
+	}
+	return 0, true
+}
+
+// psiSection returns the section carried by a PSI packet payload, skipping
+// its pointer field.
+func psiSection(payload []byte) []byte {
+	if len(payload) == 0 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+	return payload[int(payload[0])+1:]
+}
+
+// pmtPID returns the PID of the first program map table listed on a PAT
+// section.
+func pmtPID(section []byte) (uint16, bool) {
+	if len(section) < 8 {
+		return 0, false
+	}
+
+	end := 3 + int(uint16(section[1]&0x0F)<<8|uint16(section[2])) - 4
+	for i := 8; i+4 <= end && i+4 <= len(section); i += 4 {
+		program := uint16(section[i])<<8 | uint16(section[i+1])
+		if program != 0 {
+			return uint16(section[i+2]&0x1F)<<8 | uint16(section[i+3]), true
+		}
+	}
+	return 0, false
+}
+
+// pmtStreams returns the stream type of every elementary stream PID listed
+// on a PMT section.
+func pmtStreams(section []byte) map[uint16]byte {
+	streams := make(map[uint16]byte)
+	if len(section) < 12 {
+		return streams
+	}
+
+	end := 3 + int(uint16(section[1]&0x0F)<<8|uint16(section[2])) - 4
+	i := 12 + int(uint16(section[10]&0x0F)<<8|uint16(section[11]))
+	for i+5 <= end && i+5 <= len(section) {
+		pid := uint16(section[i+1]&0x1F)<<8 | uint16(section[i+2])
+		streams[pid] = section[i]
+		i += 5 + int(uint16(section[i+3]&0x0F)<<8|uint16(section[i+4]))
+	}
+	return streams
+}
+
+// segmentStreams returns the stream type of every elementary stream PID
+// declared on the first PMT of packets, or nil when there's none.
+func segmentStreams(packets []tsPacket) map[uint16]byte {
+	var pmt uint16
+	var hasPMT bool
+	for _, p := range packets {
+		switch {
+		case p.PID == 0 && p.Start && !hasPMT:
+			pmt, hasPMT = pmtPID(psiSection(p.Payload))
+		case hasPMT && p.PID == pmt && p.Start:
+			return pmtStreams(psiSection(p.Payload))
+		}
+	}
+	return nil
+}
+
+// firstAudioPayload returns the elementary stream data of the first PES
+// packet of the first audio stream declared on the segment's PMT.
+func firstAudioPayload(data []byte) ([]byte, error) {
+	return firstStreamPayload(data, "audio", func(streamType byte) bool {
+		return tsAudioStreamTypes[streamType]
+	})
+}
+
+// firstStreamPayload returns the elementary stream data of the first PES
+// packet of the first stream declared on the segment's PMT whose type
+// matches, kind naming the streams matched on errors.
+func firstStreamPayload(data []byte, kind string, matches func(streamType byte) bool) ([]byte, error) {
+	packets := tsPackets(data)
+
+	var pmt uint16
+	var hasPMT bool
+	var streams map[uint16]byte
+	var streamPID uint16
+	var payload []byte
+
+	for _, p := range packets {
+		switch {
+		case p.PID == 0 && p.Start && !hasPMT:
+			pmt, hasPMT = pmtPID(psiSection(p.Payload))
+		case hasPMT && p.PID == pmt && p.Start && streams == nil:
+			streams = pmtStreams(psiSection(p.Payload))
+			for pid, streamType := range streams {
+				if matches(streamType) && (streamPID == 0 || pid < streamPID) {
+					streamPID = pid
+				}
+			}
+			if streamPID == 0 {
+				return nil, newError("no " + kind + " stream declared on segment")
+			}
+		case streamPID != 0 && p.PID == streamPID:
+			if p.Start && payload != nil {
+				return payload, nil
+			}
+			if p.Start {
+				es, ok := pesPayload(p.Payload)
+				if !ok {
+					return nil, newError("invalid " + kind + " PES header on segment")
+				}
+				payload = append([]byte{}, es...)
+				continue
+			}
+			if payload != nil {
+				payload = append(payload, p.Payload...)
+			}
+		}
+	}
+
+	if payload == nil {
+		return nil, newError("no " + kind + " PES found on segment")
+	}
+	return payload, nil
+}
+
+// pesPayload strips the PES header off the first packet of a PES.
+func pesPayload(data []byte) ([]byte, bool) {
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil, false
+	}
+
+	start := 9 + int(data[8])
+	if start > len(data) {
+		return nil, false
+	}
+	return data[start:], true
+}
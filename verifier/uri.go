@@ -0,0 +1,228 @@
+package verifier
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// resolveURI returns the uri that should be fetched for a uri referenced
+// inside the playlist on base, resolving it against base when relative.
+func (v *Verifier) resolveURI(base, uri string) string {
+	// Inline data: uris have no path to normalize, and an empty uri, like
+	// the one of a METHOD=NONE key, must not resolve to base itself.
+	if uri == "" || strings.HasPrefix(strings.ToLower(uri), "data:") {
+		return uri
+	}
+
+	uri = resolveReference(base, v.checkURIEscaping(uri))
+	if !v.opts.NormalizeURIs {
+		return uri
+	}
+
+	normalized := cleanURIPath(uri)
+	if normalized != uri {
+		v.infof("Normalized uri: %s -> %s", uri, normalized)
+	}
+	return normalized
+}
+
+// localPath returns the filesystem path of a uri without a scheme or with a
+// file scheme, so hand-edited manifests can be verified against the remote
+// keys and segments they reference, and captured streams from disk.
+func localPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "":
+		return uri, true
+	case "file":
+		return u.Path, true
+	}
+	return "", false
+}
+
+// resolveReference resolves uri against base per RFC 3986, leaving absolute
+// and unparsable uris untouched.
+func resolveReference(base, uri string) string {
+	ref, err := url.Parse(uri)
+	if err != nil || ref.IsAbs() {
+		return uri
+	}
+
+	// Local manifests are resolved against their absolute path, as a
+	// relative base would lose its leading directories.
+	if file, ok := fileURI(base); ok {
+		base = file
+	}
+
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return uri
+	}
+	return baseURL.ResolveReference(ref).String()
+}
+
+// resolveSegmentURI returns the uri that should be fetched for a segment uri
+// of the playlist on base, pointing it to SegmentOrigin when one is set.
+func (v *Verifier) resolveSegmentURI(base, uri string) (string, error) {
+	uri = v.resolveURI(base, uri)
+	if v.opts.SegmentOrigin == "" {
+		return uri, nil
+	}
+	return withOrigin(uri, v.opts.SegmentOrigin)
+}
+
+// withOrigin replaces the host of uri with origin, which can be a bare host
+// or a scheme://host pair to also replace the scheme.
+func withOrigin(uri, origin string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.Contains(origin, "://") {
+		u.Host = origin
+		return u.String(), nil
+	}
+
+	o, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+
+	u.Scheme = o.Scheme
+	u.Host = o.Host
+	return u.String(), nil
+}
+
+// cleanURIPath removes dot segments and duplicate slashes from the path of
+// uri, keeping its scheme, host and query untouched. Unparsable uris are
+// returned as is.
+func cleanURIPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	escaped := u.EscapedPath()
+	if escaped == "" {
+		return uri
+	}
+
+	cleaned := path.Clean(escaped)
+	if strings.HasSuffix(escaped, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned == escaped {
+		return uri
+	}
+
+	unescaped, err := url.PathUnescape(cleaned)
+	if err != nil {
+		return uri
+	}
+
+	u.Path = unescaped
+	u.RawPath = cleaned
+	return u.String()
+}
+
+// withQuery appends params, sent as key=value pairs, to the query of uri,
+// keeping its existing query untouched so signed parameters stay valid.
+func withQuery(uri string, params []string) (string, error) {
+	if len(params) == 0 {
+		return uri, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	pairs := make([]string, 0, len(params))
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		pairs = append(pairs, url.QueryEscape(key)+"="+url.QueryEscape(value))
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += strings.Join(pairs, "&")
+	return u.String(), nil
+}
+
+// validateQueryParams errors if a query parameter sent through flag isn't a
+// key=value pair.
+func validateQueryParams(flag string, params []string) error {
+	for _, param := range params {
+		if key, _, ok := strings.Cut(param, "="); !ok || key == "" {
+			return newError(fmt.Sprintf("--%s must be a key=value pair, got: %s", flag, param))
+		}
+	}
+	return nil
+}
+
+// checkURIEscaping warns when uri has characters that must be
+// percent-encoded, like spaces, as its request will likely fail. If
+// EscapeURIs is set they're percent-encoded instead.
+func (v *Verifier) checkURIEscaping(uri string) string {
+	if !hasUnescapedChars(uri) {
+		return uri
+	}
+
+	if v.opts.EscapeURIs {
+		escaped := escapeURI(uri)
+		v.infof("Escaped uri: %s -> %s", uri, escaped)
+		return escaped
+	}
+
+	v.warnf("Unescaped characters on uri, its request will likely fail: %q", uri)
+	return uri
+}
+
+// hasUnescapedChars reports whether uri has a character that isn't allowed
+// unencoded by RFC 3986, or a "%" not followed by two hex digits.
+func hasUnescapedChars(uri string) bool {
+	for i := 0; i < len(uri); i++ {
+		if !isURIChar(uri, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeURI percent-encodes every character of uri that isn't allowed
+// unencoded, keeping existing escapes.
+func escapeURI(uri string) string {
+	var b strings.Builder
+	for i := 0; i < len(uri); i++ {
+		if isURIChar(uri, i) {
+			b.WriteByte(uri[i])
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", uri[i])
+	}
+	return b.String()
+}
+
+// isURIChar reports whether the byte at i of uri can appear unencoded.
+func isURIChar(uri string, i int) bool {
+	c := uri[i]
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	case c == '%':
+		return i+2 < len(uri) && isHex(uri[i+1]) && isHex(uri[i+2])
+	}
+	return strings.IndexByte("-._~:/?#[]@!$&'()*+,;=", c) >= 0
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
@@ -0,0 +1,37 @@
+package verifier
+
+import "testing"
+
+func TestResolveURI(t *testing.T) {
+	const master = "https://cdn.example.com/vod/title/master.m3u8"
+	tests := []struct {
+		name      string
+		base      string
+		uri       string
+		normalize bool
+		want      string
+	}{
+		{name: "relative", base: master, uri: "720p/index.m3u8", want: "https://cdn.example.com/vod/title/720p/index.m3u8"},
+		{name: "sibling", base: "https://cdn.example.com/vod/title/720p/index.m3u8", uri: "seg0.ts", want: "https://cdn.example.com/vod/title/720p/seg0.ts"},
+		{name: "parent", base: master, uri: "../audio/en.m3u8", want: "https://cdn.example.com/vod/audio/en.m3u8"},
+		{name: "absolute path", base: master, uri: "/keys/key.bin", want: "https://cdn.example.com/keys/key.bin"},
+		{name: "absolute", base: master, uri: "https://keys.example.com/key?id=1", want: "https://keys.example.com/key?id=1"},
+		{name: "scheme relative", base: master, uri: "//edge.example.com/seg0.ts", want: "https://edge.example.com/seg0.ts"},
+		{name: "query preserved", base: master, uri: "seg0.ts?token=a%2Fb&exp=1", want: "https://cdn.example.com/vod/title/seg0.ts?token=a%2Fb&exp=1"},
+		{name: "base query dropped", base: master + "?sig=abc", uri: "seg0.ts", want: "https://cdn.example.com/vod/title/seg0.ts"},
+		{name: "query only", base: master + "?sig=abc", uri: "?sig=def", want: master + "?sig=def"},
+		{name: "empty", base: master, uri: "", want: ""},
+		{name: "data uri", base: master, uri: "data:text/plain;base64,MDEyMzQ1Njc4OWFiY2RlZg==", want: "data:text/plain;base64,MDEyMzQ1Njc4OWFiY2RlZg=="},
+		{name: "local manifest", base: "/srv/streams/index.m3u8", uri: "seg0.ts", want: "file:///srv/streams/seg0.ts"},
+		{name: "duplicate slashes kept", base: master, uri: "720p//seg0.ts", want: "https://cdn.example.com/vod/title/720p//seg0.ts"},
+		{name: "duplicate slashes normalized", base: master, uri: "720p//seg0.ts?x=1", normalize: true, want: "https://cdn.example.com/vod/title/720p/seg0.ts?x=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVerifier(t, func(opts *Options) { opts.NormalizeURIs = tt.normalize })
+			if got := v.resolveURI(tt.base, tt.uri); got != tt.want {
+				t.Errorf("resolveURI(%q, %q) = %q, want %q", tt.base, tt.uri, got, tt.want)
+			}
+		})
+	}
+}
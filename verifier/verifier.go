@@ -0,0 +1,1899 @@
+// Package verifier downloads, decrypts and verifies the segments of HLS
+// manifests, as done by the hlseverify command. Run verifies a single
+// manifest, while a Verifier built by New can verify many:
+//
+//	report, err := verifier.Run(ctx, "https://example.com/master.m3u8", verifier.DefaultOptions())
+//
+// Failed verifications are returned as a *MultiError, along with the Report
+// of everything verified.
+package verifier
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// Verifier downloads, decrypts and verifies the segments of HLS manifests.
+// It runs one verification at a time, separate Verifiers can run
+// concurrently with different Options.
+type Verifier struct {
+	opts   Options
+	client *http.Client
+	output OutputWriter
+	log    *slog.Logger
+
+	// fetchers send the requests of the uri schemes client doesn't, by
+	// scheme.
+	fetchers map[string]Fetcher
+
+	// keyRequestBody is the body keys are requested with, loaded from
+	// KeyBody by loadKeyRequest.
+	keyRequestBody []byte
+
+	// headers are set on every request, parsed from Headers and UserAgent,
+	// and keyHeaders on top of them on key requests.
+	headers    http.Header
+	keyHeaders http.Header
+
+	// token authorizes every request, from Token or TokenCommand.
+	token *tokenSource
+
+	// keyOverrides are the keys supplied through KeyHex and KeyFiles.
+	keyOverrides *keyOverrides
+
+	// sampler picks the segments verified under Sample, nil verifies all.
+	sampler *sampler
+
+	failures   *MultiError
+	keys       *keyCache
+	downloaded *byteCounter
+	results    *resultsDB
+	cache      *segmentCache
+	pool       *workerPool
+	progress   *progressCounter
+	notifier   *notifier
+
+	// concats are the --concat files of the renditions being verified, by
+	// folder.
+	concatMu sync.Mutex
+	concats  map[string]*concatFile
+
+	// initTracks are the tracks declared by the init segments of the
+	// renditions being verified under --deep-check or
+	// --check-media-durations, by folder, and initBodies the decrypted init
+	// segments themselves under --ffprobe.
+	initTracksMu sync.Mutex
+	initTracks   map[string]map[uint32]initTrack
+	initBodies   map[string]map[m3u8.Map][]byte
+
+	// checksums are the --verify-checksums manifests of the renditions
+	// being verified, by folder.
+	checksumsMu sync.Mutex
+	checksums   map[string]*checksumManifest
+}
+
+// New returns a Verifier configured by opts, or an error if they're invalid.
+func New(opts Options) (*Verifier, error) {
+	v := &Verifier{
+		opts:     opts,
+		client:   opts.Client,
+		output:   opts.Output,
+		log:      optionsLogger(opts),
+		progress: &progressCounter{},
+	}
+
+	if v.opts.NoPaddingCheck && !v.opts.DeepCheck {
+		return nil, newError("--no-padding-check requires --deep-check")
+	}
+
+	if v.opts.Concurrency < 1 {
+		return nil, newError("--concurrency must be at least 1")
+	}
+
+	if v.opts.RenditionConcurrency < 1 {
+		return nil, newError("--rendition-concurrency must be at least 1")
+	}
+
+	if v.opts.RequestTimeout < 0 || v.opts.ConnectTimeout < 0 {
+		return nil, newError("--request-timeout and --connect-timeout can't be negative")
+	}
+
+	if v.opts.IdleConnsPerHost < 0 {
+		return nil, newError("--idle-conn-per-host can't be negative")
+	}
+
+	if v.opts.SimulatePlayback && v.opts.PlaybackSpeed <= 0 {
+		return nil, newError("--playback-speed must be above 0")
+	}
+
+	if v.opts.MediaDurationTolerance < 0 {
+		return nil, newError("--media-duration-tolerance can't be negative")
+	}
+
+	if v.opts.AlignmentTolerance < 0 {
+		return nil, newError("--alignment-tolerance can't be negative")
+	}
+
+	if v.opts.MaxClockSkew < 0 {
+		return nil, newError("--max-clock-skew can't be negative")
+	}
+
+	if v.opts.StallTargetDurations < 0 {
+		return nil, newError("--stall-target-durations can't be negative")
+	}
+
+	if v.opts.VerifyChecksums != "" {
+		if info, err := os.Stat(v.opts.VerifyChecksums); err != nil || !info.IsDir() {
+			return nil, newError("--verify-checksums must be the --out folder of a previous --save run, got: " + v.opts.VerifyChecksums)
+		}
+	}
+
+	if v.opts.NotifyWebhook != "" {
+		if u, err := url.Parse(v.opts.NotifyWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, newError("--notify-webhook must be an http or https URL, got: " + v.opts.NotifyWebhook)
+		}
+		if v.opts.NotifyFormat != NotifyFormatJSON && v.opts.NotifyFormat != NotifyFormatSlack {
+			return nil, newError("--notify-format must be \"json\" or \"slack\", got: " + v.opts.NotifyFormat)
+		}
+		if v.opts.NotifyInterval <= 0 {
+			return nil, newError("--notify-interval must be above 0")
+		}
+	}
+
+	if err := validateVariantFilters(v.opts); err != nil {
+		return nil, err
+	}
+
+	if v.opts.FolderNames != FolderNamesIndex && v.opts.FolderNames != FolderNamesRendition {
+		return nil, newError("--folder-names must be index or rendition, got: " + v.opts.FolderNames)
+	}
+
+	if v.opts.ManifestType != "master" && v.opts.ManifestType != "media" {
+		return nil, newError("type \"" + v.opts.ManifestType + "\" isn't supported")
+	}
+
+	if err := v.loadKeyRequest(); err != nil {
+		return nil, err
+	}
+
+	if v.opts.FFprobe {
+		if _, err := exec.LookPath(v.opts.FFprobePath); err != nil {
+			return nil, newError("--ffprobe requires ffprobe on the PATH or --ffprobe-path: " + err.Error())
+		}
+	}
+
+	for name, params := range map[string][]string{
+		"manifest-query": v.opts.ManifestQuery,
+		"segment-query":  v.opts.SegmentQuery,
+		"key-query":      v.opts.KeyQuery,
+	} {
+		if err := validateQueryParams(name, params); err != nil {
+			return nil, err
+		}
+	}
+
+	headers, err := parseHeaders(v.opts.Headers, v.opts.Cookies, v.opts.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	v.headers = headers
+	if v.keyHeaders, err = parseHeaderPairs("key-header", v.opts.KeyHeaders); err != nil {
+		return nil, err
+	}
+	v.token = newTokenSource(v.opts)
+
+	if v.keyOverrides, err = parseKeyOverrides(v.opts.KeyHex, v.opts.KeyFiles); err != nil {
+		return nil, err
+	}
+
+	if v.sampler, err = parseSample(v.opts.Sample, v.opts.SampleSeed); err != nil {
+		return nil, err
+	}
+
+	if v.opts.RunID == "" {
+		v.opts.RunID = NewRunID()
+	}
+
+	if v.output == nil {
+		v.output = FSWriter{Root: opts.OutputDir}
+	}
+
+	if v.client == nil {
+		transport, err := v.newTransport()
+		if err != nil {
+			return nil, err
+		}
+
+		// Cookies set by manifest or key responses are sent on the
+		// following requests, for CDNs signing streams through cookies.
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		v.client = &http.Client{Transport: transport, Jar: jar, Timeout: v.opts.RequestTimeout}
+	}
+	v.fetchers = v.newFetchers()
+	return v, nil
+}
+
+// Run verifies the manifest on uri with a new Verifier configured by opts,
+// returning the Report of the run. Failures are returned as a *MultiError,
+// other errors stop the run or come from invalid opts.
+func Run(ctx context.Context, uri string, opts Options) (*Report, error) {
+	v, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return v.Verify(ctx, uri)
+}
+
+// RunID returns the identifier of the runs of v.
+func (v *Verifier) RunID() string {
+	return v.opts.RunID
+}
+
+// NewRunID returns a sortable run identifier made of the current UTC time
+// and a random suffix, so runs started on the same second don't collide.
+func NewRunID() string {
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%x", time.Now().UTC().Format("20060102T150405Z"), suffix)
+}
+
+// outputFolder returns the folder a rendition's segments are written to,
+// nesting it under the run ID when OutputDirPerRun is set.
+func (v *Verifier) outputFolder(name string) string {
+	if !v.opts.OutputDirPerRun {
+		return name
+	}
+	return filepath.Join(v.opts.RunID, name)
+}
+
+// Naming schemes of rendition folders, sent through --folder-names.
+const (
+	// FolderNamesIndex names folders after the position of their rendition
+	// on the master manifest, such as video_0 or audio_0_1.
+	FolderNamesIndex = "index"
+
+	// FolderNamesRendition names folders after the attributes of their
+	// rendition, such as 1080p_6000k or audio_aac_en.
+	FolderNamesRendition = "rendition"
+)
+
+// variantFolderName describes variant by its resolution height and
+// bandwidth in kbps, such as 1080p_6000k.
+func variantFolderName(variant *m3u8.Variant) string {
+	name := fmt.Sprintf("%dk", variant.Bandwidth/1000)
+	if _, height, ok := strings.Cut(variant.Resolution, "x"); ok && height != "" {
+		name = height + "p_" + name
+	}
+	return name
+}
+
+// sanitizeFolderName replaces every character of a folder name taken from
+// manifest attributes that isn't a letter, digit, dot, dash or underscore,
+// so it can't point outside the output root.
+func sanitizeFolderName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.Trim(name, ".") == "" {
+		return "rendition"
+	}
+	return name
+}
+
+// reset discards the state of the previous run of v.
+func (v *Verifier) reset() {
+	v.failures = &MultiError{log: v.log}
+	v.keys = newKeyCache()
+	v.downloaded = &byteCounter{limit: v.opts.MaxTotalBytes}
+	v.pool = newWorkerPool(v.opts.Concurrency)
+	v.progress.reset()
+	v.concats = make(map[string]*concatFile)
+	v.initTracks = make(map[string]map[uint32]initTrack)
+	v.initBodies = make(map[string]map[m3u8.Map][]byte)
+	v.checksums = make(map[string]*checksumManifest)
+}
+
+// Verify verifies the manifest on uri according to ManifestType, returning
+// the report of every rendition along with the failures found on them. The
+// report is returned even on failure, with the renditions verified so far.
+//
+// Failures found while verifying are returned as a *MultiError, any other
+// error means the manifest couldn't be verified at all.
+func (v *Verifier) Verify(ctx context.Context, uri string) (*Report, error) {
+	v.reset()
+	start := time.Now()
+
+	if v.opts.ResultsPath != "" {
+		var err error
+		if v.results, err = openResultsDB(v.opts.ResultsPath, v.opts.RunID); err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = v.results.Close()
+			v.results = nil
+		}()
+	}
+
+	if v.useCache() {
+		var err error
+		if v.cache, err = openSegmentCache(v.opts.CachePath, v.cacheChecks()); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := v.cache.save(); err != nil {
+				v.warnf("Segment cache not saved on %s: %s", v.opts.CachePath, err.Error())
+			}
+			v.cache = nil
+		}()
+	}
+
+	if v.sampler != nil {
+		v.infof("Verifying a sample of segments, --sample %s", v.sampler)
+	}
+
+	if v.opts.NotifyWebhook != "" {
+		v.notifier = v.newNotifier(uri)
+		defer func() {
+			v.notifier.close()
+			v.notifier = nil
+		}()
+	}
+
+	var result *Report
+	var err error
+	switch v.opts.ManifestType {
+	case "master":
+		result, err = v.GetMaster(ctx, uri)
+	case "media":
+		var media *MediaResult
+		media, err = v.GetMedia(ctx, uri, v.outputFolder("media"))
+		media.Type = "media"
+		result = &Report{URI: uri, Variants: []*MediaResult{media}}
+	}
+	result.Bytes = v.downloaded.Total()
+	result.Sampling = v.sampler.String()
+	result.Keys = v.keys.results()
+	if output, ok := v.output.(FSWriter); ok {
+		result.output = &output
+	}
+	result.sumTotals(v.failures, v.keys.Len(), time.Since(start))
+	result.countFailures(v.failures)
+	if err == nil {
+		err = v.failures.ErrorOrNil()
+	}
+	result.Passed = err == nil
+	return result, err
+}
+
+// GetMaster verifies every rendition of the master manifest on uri.
+func (v *Verifier) GetMaster(ctx context.Context, uri string) (*Report, error) {
+	result := &Report{URI: uri}
+
+	raw, base, err := v.fetchPlaylist(ctx, uri)
+	if err != nil {
+		return result, err
+	}
+
+	p, pType, err := decodePlaylist(uri, raw)
+	if err != nil {
+		return result, err
+	}
+
+	if pType != m3u8.MASTER {
+		return result, newError("manifest must be of master type")
+	}
+
+	mp, ok := p.(*m3u8.MasterPlaylist)
+	if !ok {
+		return result, newError("unable to parse master manifest")
+	}
+
+	if err = v.checkSessionData(raw); err != nil {
+		return result, err
+	}
+
+	if err = checkMediaGroups(mp); err != nil {
+		v.failures.Add(ClassCompliance, "master", uri, err)
+	}
+
+	if v.opts.ValidateBandwidth {
+		if err = v.checkBandwidthOrdering(uri, mp); err != nil {
+			v.failures.Add(ClassCompliance, "master", uri, err)
+		}
+	}
+
+	if v.hasVariantFilters() {
+		v.regroupAlternatives(mp)
+	}
+
+	// Renditions rejected by --require-https are recorded as failures of the
+	// master and skipped, the rest are still verified.
+	rejected := make(map[string]bool)
+	reject := func(childURI string) {
+		if err := v.checkSchemeDowngrade(base, childURI); err != nil {
+			v.failures.Add(ClassCompliance, "master", childURI, err)
+			rejected[childURI] = true
+		}
+	}
+	for _, variant := range mp.Variants {
+		if variant.Iframe && !v.opts.Iframes {
+			continue
+		}
+		variant.URI = v.resolveURI(base, variant.URI)
+		reject(variant.URI)
+		for _, alt := range variant.Alternatives {
+			alt.URI = v.resolveURI(base, alt.URI)
+			reject(alt.URI)
+		}
+	}
+
+	// folders are the output folders of every rendition, named by
+	// --folder-names without repeating one.
+	folders := make(map[string]bool)
+	folderFor := func(index, rendition string) string {
+		name := index
+		if v.opts.FolderNames == FolderNamesRendition {
+			name = sanitizeFolderName(rendition)
+			for n := 2; folders[name]; n++ {
+				name = fmt.Sprintf("%s_%d", sanitizeFolderName(rendition), n)
+			}
+		}
+		folders[name] = true
+		return v.outputFolder(name)
+	}
+
+	// Audio renditions are shared by every variant in their group, so their
+	// declarations are inspected, and under --audio-only-verify they're
+	// verified, only once.
+	seen := make(map[string]bool)
+
+	// run verifies the rendition on uri on its own goroutine, or right away
+	// when --parallel-variants is false. A panic while verifying it is
+	// recorded as a failure of folder, so the other renditions still finish.
+	var wg sync.WaitGroup
+	run := func(folder, uri string, verify func()) {
+		if rejected[uri] {
+			return
+		}
+		if v.downloaded.Exceeded() {
+			v.infof("Skipping %s, --max-total-bytes reached", uri)
+			return
+		}
+		if err := ctx.Err(); err != nil {
+			v.infof("Skipping %s, run stopped: %s", uri, err.Error())
+			v.failures.Add(ClassStopped, folder, uri, err)
+			return
+		}
+		isolated := func() {
+			defer v.failures.Recover(folder, uri)
+			verify()
+		}
+		if !v.opts.ParallelVariants {
+			isolated()
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			isolated()
+		}()
+	}
+
+	if v.hasVariantFilters() {
+		selected := 0
+		for _, variant := range mp.Variants {
+			if v.variantSelected(variant) && (!variant.Iframe || v.opts.Iframes) {
+				selected++
+			}
+		}
+		v.infof("Verifying %d of %d variants matching the variant filters of: %s", selected, len(mp.Variants), uri)
+	}
+
+	for i, variant := range mp.Variants {
+		i, variant := i, variant
+		if !v.variantSelected(variant) {
+			continue
+		}
+
+		// I-frame playlists are byte ranges of the segments of their video
+		// variant, verified as any other media playlist under --iframes.
+		if variant.Iframe {
+			if !v.opts.Iframes || v.opts.AudioOnly {
+				continue
+			}
+			folder := folderFor(fmt.Sprintf("iframe_%d", i), "iframe_"+variantFolderName(variant))
+			run(folder, variant.URI, func() {
+				media, err := v.GetMedia(ctx, variant.URI, folder)
+				media.Type = "iframe"
+				media.declare(variant)
+				result.addVariant(media)
+				if err != nil {
+					v.failures.Add(stoppedOr(ctx, ClassPlaylist), folder, variant.URI, err)
+					return
+				}
+				if v.opts.DeepCheck {
+					v.recordCodecDeclaration(result, variant, media)
+				}
+			})
+			continue
+		}
+
+		if !v.opts.AudioOnly {
+			folder := folderFor(fmt.Sprintf("video_%d", i), variantFolderName(variant))
+			run(folder, variant.URI, func() {
+				media, err := v.GetMedia(ctx, variant.URI, folder)
+				media.Type = "video"
+				media.declare(variant)
+				result.addVariant(media)
+				if err != nil {
+					v.failures.Add(stoppedOr(ctx, ClassPlaylist), folder, variant.URI, err)
+					return
+				}
+				if v.opts.DeepCheck {
+					v.recordCodecDeclaration(result, variant, media)
+				}
+			})
+		}
+
+		if variant.Alternatives == nil {
+			continue
+		}
+
+		for j, alt := range variant.Alternatives {
+			if !v.alternativeSelected(alt) {
+				continue
+			}
+			// Closed captions are carried in the video, as are renditions
+			// without a URI, so there's no playlist to verify.
+			if alt.Type == "CLOSED-CAPTIONS" && alt.URI != "" && !seen[alt.URI] {
+				v.errorf("CLOSED-CAPTIONS rendition %q has a URI: %s", alt.Name, alt.URI)
+				v.failures.Add(ClassCompliance, "master", alt.URI, newError(fmt.Sprintf("CLOSED-CAPTIONS rendition %q of group %q must not have a URI", alt.Name, alt.GroupId)))
+			}
+			if alt.Type == "CLOSED-CAPTIONS" || alt.URI == "" {
+				seen[alt.URI] = true
+				continue
+			}
+			first := !seen[alt.URI]
+			seen[alt.URI] = true
+
+			if v.opts.AudioOnly && (alt.Type != "AUDIO" || !first) {
+				continue
+			}
+			inspect := v.opts.DeepCheck && alt.Type == "AUDIO" && first
+
+			j, alt := j, alt
+			folder := folderFor(fmt.Sprintf("audio_%d_%d", i, j), strings.ToLower(alt.Type)+"_"+alt.GroupId+"_"+alt.Name)
+			run(folder, alt.URI, func() {
+				media, err := v.GetMedia(ctx, alt.URI, folder)
+				media.Type = strings.ToLower(alt.Type)
+				result.addAlternative(media)
+				if err != nil {
+					v.failures.Add(stoppedOr(ctx, ClassPlaylist), folder, alt.URI, err)
+					return
+				}
+				if !inspect {
+					return
+				}
+
+				check := &CheckResult{Name: "audio-declaration", URI: alt.URI}
+				if err := v.VerifyAudioDeclaration(ctx, alt, variant.Codecs); err != nil {
+					check.Error = err.Error()
+					v.failures.Add(stoppedOr(ctx, ClassDeclaration), folder, alt.URI, err)
+				}
+				result.addCrossCheck(check)
+			})
+		}
+
+	}
+	wg.Wait()
+
+	if v.opts.CheckAlignment {
+		v.checkAlignment(result)
+	}
+	return result, nil
+}
+
+// GetMedia verifies every segment of the media manifest on uri, saving the
+// ones that fail, or all of them under --save, to folder.
+func (v *Verifier) GetMedia(ctx context.Context, uri string, folder string) (*MediaResult, error) {
+	media := &MediaResult{URI: uri, Variant: folder, progress: v.progress.rendition(folder, uri)}
+	if v.opts.Follow {
+		media.keepSegments = followedSegments
+	}
+
+	var concat *concatFile
+	if v.opts.Concat {
+		var err error
+		if concat, err = v.openConcat(folder); err != nil {
+			media.Error = err.Error()
+			return media, err
+		}
+	}
+
+	if v.opts.VerifyChecksums != "" {
+		if err := v.openChecksums(folder); err != nil {
+			v.errorf("No --verify-checksums manifest for: %s", uri)
+			v.failures.Add(ClassChecksum, folder, uri, err)
+		}
+		defer func() {
+			v.checksumsMu.Lock()
+			delete(v.checksums, folder)
+			v.checksumsMu.Unlock()
+		}()
+	}
+
+	start := time.Now()
+	err := v.getMedia(ctx, media)
+	media.Elapsed = time.Since(start)
+	if concat != nil {
+		if concatErr := v.finishConcat(uri, folder, concat); concatErr != nil {
+			v.errorf("Unable to write --concat file of %s: %s", uri, concatErr.Error())
+			v.failures.Add(ClassMedia, folder, uri, fmt.Errorf("--concat: %w", concatErr))
+		}
+	}
+	if err != nil {
+		media.Error = err.Error()
+	}
+	media.sortSegments()
+	if v.opts.SaveSegments {
+		if sumErr := v.writeChecksums(media); sumErr != nil {
+			v.errorf("Unable to write checksums of %s: %s", uri, sumErr.Error())
+			v.failures.Add(ClassMedia, folder, uri, fmt.Errorf("%s: %w", checksumFile, sumErr))
+		}
+	}
+	return media, err
+}
+
+func (v *Verifier) getMedia(ctx context.Context, media *MediaResult) error {
+	uri, folder := media.URI, media.Variant
+	start := time.Now()
+
+	raw, base, mp, err := v.loadMedia(ctx, uri)
+	if err != nil {
+		return err
+	}
+	v.keyOverrides.mapRendition(media, mp)
+	if v.opts.CheckAlignment {
+		media.timeline = newTimeline(mp)
+	}
+
+	if v.opts.SegmentOrigin != "" {
+		v.infof("Fetching segments for %s from: %s", uri, v.opts.SegmentOrigin)
+	}
+
+	if !v.opts.Follow || mp.Closed {
+		v.checkEndList(uri, mp)
+	}
+
+	if err = v.checkTotalDuration(uri, mp); err != nil {
+		v.failures.Add(ClassCompliance, folder, uri, err)
+	}
+
+	if err = v.checkSegmentCount(uri, mp); err != nil {
+		v.failures.Add(ClassCompliance, folder, uri, err)
+	}
+
+	if err = v.checkInitSegment(uri, mp); err != nil {
+		v.failures.Add(ClassCompliance, folder, uri, err)
+	}
+
+	if err = v.checkTargetDuration(uri, raw, mp); err != nil {
+		v.failures.Add(ClassCompliance, folder, uri, err)
+	}
+	if target, ok := declaredTargetDuration(raw); ok {
+		media.TargetDuration = target
+	}
+
+	if v.opts.CheckMarkers {
+		if err = v.checkMarkers(media, raw, mp); err != nil {
+			v.failures.Add(ClassCompliance, folder, uri, err)
+		}
+	}
+
+	if v.opts.CheckProgramDateTime {
+		if err = v.checkProgramDateTime(media, mp, 0); err != nil {
+			v.failures.Add(ClassCompliance, folder, uri, err)
+		}
+	}
+
+	if v.opts.PrefetchKeys {
+		v.PrefetchKeys(ctx, uri, mp)
+	}
+
+	keys := segmentKeys(mp)
+	media.Encryption, media.KeyURIs = keySummary(mp, keys)
+	rotations, periods := keyRotations(mp, keys)
+	if rotations > 0 {
+		v.infof("Key rotation on %s: %d key changes across %d keys, each segment is decrypted with the one in effect", uri, rotations, len(media.KeyURIs))
+	}
+	if periods > 0 {
+		v.infof("Key changes at discontinuities on %s: %d, segments after each are decrypted with their own key and IV", uri, periods)
+	}
+
+	// Clear previous output of this rendition, its partial segments and
+	// rechecked copies first so its folder is left empty.
+	if resetter, ok := v.output.(OutputResetter); ok {
+		for _, sub := range []string{partsFolder, recheckFolder} {
+			if err = resetter.Reset(filepath.Join(folder, sub)); err != nil {
+				return err
+			}
+		}
+		if err = resetter.Reset(folder); err != nil {
+			return err
+		}
+	}
+
+	v.infof("Starting decryption for: %s", uri)
+
+	v.VerifyInitSegments(ctx, base, raw, mp, keys, folder)
+
+	var verified time.Duration
+	media.sampleFrom = mp.SeqNo
+	queue := v.sample(media, v.skipGaps(media, v.queueSegments(mp, keys, gapSegments(raw), 0, &verified)))
+	v.verifySegments(ctx, media, queue, start)
+	ll, _ := v.followLowLatency(ctx, media, raw, base, mp, true)
+
+	if v.opts.Follow && !mp.Closed {
+		v.followMedia(ctx, media, mp, ll, &verified, start)
+	}
+	media.Duration = verified
+
+	if err = v.checkMissingChecksums(media, mp); err != nil {
+		v.failures.Add(ClassChecksum, folder, uri, err)
+	}
+
+	if v.opts.MaxDuration > 0 {
+		v.infof("Verified %s of segments for: %s", verified, uri)
+	}
+	switch {
+	case media.Skipped == 0:
+	case ctx.Err() != nil:
+		v.infof("Skipped %d segments of %s, run stopped: %s", media.Skipped, uri, ctx.Err().Error())
+		v.failures.Add(ClassStopped, folder, uri, fmt.Errorf("%d segments not verified: %w", media.Skipped, ctx.Err()))
+	default:
+		v.infof("Skipped %d segments of %s, --max-total-bytes reached", media.Skipped, uri)
+	}
+	return nil
+}
+
+// loadMedia fetches and decodes the media manifest on uri, resolving the
+// uris and byte ranges of its keys and segments against the base it
+// returns, where the manifest was served from.
+func (v *Verifier) loadMedia(ctx context.Context, uri string) ([]byte, string, *m3u8.MediaPlaylist, error) {
+	raw, base, err := v.fetchPlaylist(ctx, uri)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	p, pType, err := decodePlaylist(uri, raw)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	if pType != m3u8.MEDIA {
+		return nil, "", nil, newError("manifest must be of media type")
+	}
+
+	mp, ok := p.(*m3u8.MediaPlaylist)
+	if !ok {
+		return nil, "", nil, newError("unable to parse media manifest")
+	}
+
+	v.normalizeKeyMethods(uri, mp)
+
+	if mp.Key != nil && mp.Key.URI != "" {
+		mp.Key.URI = v.resolveURI(base, mp.Key.URI)
+		if err = v.checkSchemeDowngrade(base, mp.Key.URI); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	for _, segment := range mp.Segments {
+		if segment == nil {
+			continue
+		}
+		if segment.URI, err = v.resolveSegmentURI(base, segment.URI); err != nil {
+			return nil, "", nil, err
+		}
+		if err = v.checkSchemeDowngrade(base, segment.URI); err != nil {
+			return nil, "", nil, err
+		}
+		if segment.Key == nil || segment.Key.URI == "" {
+			continue
+		}
+		segment.Key.URI = v.resolveURI(base, segment.Key.URI)
+		if err = v.checkSchemeDowngrade(base, segment.Key.URI); err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	resolveByteRanges(mp)
+
+	return raw, base, mp, nil
+}
+
+// queuedSegment is a segment waiting to be verified, along with the key in
+// effect for it and the index it's saved and reported under.
+type queuedSegment struct {
+	segment *m3u8.MediaSegment
+	key     *m3u8.Key
+	index   int
+	gap     bool
+}
+
+// queueSegments returns the segments of mp with a media sequence number of
+// at least fromSeq, adding their duration to verified until --max-duration
+// is reached. Segments are indexed by their media sequence number, so saved
+// files and results map back to the manifest across gaps and reloads. The
+// ones at a position of gaps are flagged, without adding their duration.
+func (v *Verifier) queueSegments(mp *m3u8.MediaPlaylist, keys []*m3u8.Key, gaps map[int]bool, fromSeq uint64, verified *time.Duration) []queuedSegment {
+	var queue []queuedSegment
+	for i := 0; i < int(mp.Count()); i++ {
+		segment := mp.Segments[i]
+		if segment == nil || segment.SeqId < fromSeq {
+			continue
+		}
+		if v.opts.MaxDuration > 0 && *verified >= v.opts.MaxDuration {
+			break
+		}
+		if !gaps[i] {
+			*verified += time.Duration(segment.Duration * float64(time.Second))
+		}
+		queue = append(queue, queuedSegment{segment: segment, key: keys[i], index: int(segment.SeqId), gap: gaps[i]})
+	}
+	return queue
+}
+
+// verifySegments verifies every queued segment of media on the worker pool,
+// waiting for all of them. The time to first segment is measured from start
+// unless it was already recorded.
+func (v *Verifier) verifySegments(ctx context.Context, media *MediaResult, queue []queuedSegment, start time.Time) {
+	if len(queue) == 0 {
+		return
+	}
+	uri, folder := media.URI, media.Variant
+	measureFirst := media.TimeToFirstSegment == 0
+	media.progress.queue(len(queue))
+
+	verify := func(queued queuedSegment) {
+		segmentURI := queued.segment.URI
+		defer v.failures.Recover(folder, segmentURI)
+
+		if v.downloaded.Exceeded() {
+			media.addSkipped()
+			return
+		}
+
+		result, err := v.DecodeSegment(ctx, queued.segment, queued.key, folder, queued.index)
+		if err != nil && ctx.Err() != nil {
+			// Cancelled mid-fetch, the segment wasn't actually verified.
+			media.addSkipped()
+			return
+		}
+		if v.opts.SimulatePlayback {
+			v.checkRebuffer(queued.segment, result)
+		}
+		if err == nil && result.MediaDuration > 0 {
+			if err = v.checkMediaDuration(media, queued.segment, result); err != nil {
+				result.fail(err)
+			}
+		}
+		if err != nil && !v.opts.NoRecheck && rechecked(classOf(err)) {
+			err = v.recheckSegment(ctx, media, queued, result, err)
+			result.fail(err)
+		}
+		media.addSegment(result)
+		v.opts.Metrics.addSegment(media, result)
+		v.notifier.add(media, result)
+		if v.results != nil {
+			if err := v.results.Insert(result); err != nil {
+				v.warnf("Unable to write result of %s to --db: %s", segmentURI, err.Error())
+			}
+		}
+		v.debugf("Segment result: %s", result)
+		if measureFirst && queued.index == queue[0].index {
+			elapsed := time.Since(start)
+			v.infof("Time to first segment for %s: %s", uri, elapsed.Round(time.Millisecond))
+			media.TimeToFirstSegment = elapsed
+		}
+		if err == nil {
+			return
+		}
+		v.failures.Add(classOf(err), folder, segmentURI, err)
+
+		switch classOf(err) {
+		case ClassPadding, ClassContainer, ClassDominant:
+			if v.opts.CompareMethods {
+				v.CompareDecryptMethods(ctx, queued.segment, queued.key)
+			}
+		}
+	}
+
+	if v.opts.SimulatePlayback {
+		v.playSegments(ctx, media, queue, verify)
+		return
+	}
+
+	// Segments are submitted in playlist order, so early failures are
+	// found first. Each rendition takes at most RenditionConcurrency slots
+	// of the pool shared by the whole run, so one rendition can't starve
+	// the others.
+	var wg sync.WaitGroup
+	rendition := newWorkerPool(v.opts.RenditionConcurrency)
+	for n, queued := range queue {
+		queued := queued
+		started := rendition.acquire(ctx) &&
+			v.pool.Go(ctx, &wg, func() {
+				defer rendition.release()
+				verify(queued)
+			})
+		if !started {
+			for range queue[n:] {
+				media.addSkipped()
+			}
+			break
+		}
+	}
+	wg.Wait()
+}
+
+// followMedia reloads the live or EVENT media playlist mp of media every
+// target duration, or half of it when nothing changed, verifying only the
+// segments after the last media sequence number seen. A Low-Latency HLS
+// playlist, declared by ll, is reloaded every part target instead, or at
+// once when it supports blocking reloads, which wait on the server for
+// the next part or segment, and its new parts are verified too. It returns
+// once EXT-X-ENDLIST appears, ctx is done, --max-duration or --duration is
+// reached or a reload fails. Every reload is checked by a liveWatchdog.
+func (v *Verifier) followMedia(ctx context.Context, media *MediaResult, mp *m3u8.MediaPlaylist, ll *lowLatency, verified *time.Duration, start time.Time) {
+	uri, folder := media.URI, media.Variant
+	nextSeq := mp.SeqNo + uint64(mp.Count())
+	v.infof("Following live playlist %s from media sequence %d", uri, nextSeq)
+
+	wait := reloadWait(mp, ll, true)
+	grown := time.Now()
+	watchdog := v.newLiveWatchdog(mp)
+	for !mp.Closed {
+		if v.opts.MaxDuration > 0 && *verified >= v.opts.MaxDuration {
+			return
+		}
+		if v.opts.FollowDuration > 0 {
+			remaining := time.Until(start.Add(v.opts.FollowDuration))
+			if remaining <= 0 {
+				v.infof("Stopped following %s, --duration of %s reached", uri, v.opts.FollowDuration)
+				return
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+		}
+		if v.opts.PollTimeout > 0 {
+			if remaining := time.Until(grown.Add(v.opts.PollTimeout)); wait > remaining {
+				wait = max(remaining, 0)
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		reloadURI := uri
+		if ll != nil && ll.CanBlockReload {
+			msn, part := ll.nextReload(nextSeq)
+			reloadURI = blockingReloadURI(uri, msn, part)
+		}
+		raw, base, reloaded, err := v.loadMedia(ctx, reloadURI)
+		if err != nil {
+			if ctx.Err() == nil {
+				v.errorf("Unable to reload live playlist %s: %s", uri, err.Error())
+				v.failures.Add(ClassPlaylist, folder, uri, fmt.Errorf("reload failed: %w", err))
+			}
+			return
+		}
+		mp = reloaded
+		v.keyOverrides.mapRendition(media, mp)
+
+		var parts int
+		ll, parts = v.followLowLatency(ctx, media, raw, base, mp, false)
+		end := mp.SeqNo + uint64(mp.Count())
+		v.watchLive(media, watchdog, mp, end > nextSeq)
+		if end <= nextSeq {
+			if v.opts.PollTimeout > 0 && time.Since(grown) >= v.opts.PollTimeout {
+				v.stallMedia(media, lastSequence(mp), grown)
+				return
+			}
+			v.opts.Metrics.setReloadLag(media, time.Since(grown))
+			wait = reloadWait(mp, ll, parts > 0)
+			continue
+		}
+		wait = reloadWait(mp, ll, true)
+		grown = time.Now()
+		v.opts.Metrics.setReloadLag(media, 0)
+
+		if mp.SeqNo > nextSeq {
+			v.warnf("%d segments of %s left the live window before they were verified", mp.SeqNo-nextSeq, uri)
+		}
+		if v.opts.CheckProgramDateTime {
+			if err = v.checkProgramDateTime(media, mp, nextSeq); err != nil {
+				v.failures.Add(ClassCompliance, folder, uri, err)
+			}
+		}
+		queue := v.sample(media, v.skipGaps(media, v.queueSegments(mp, segmentKeys(mp), gapSegments(raw), nextSeq, verified)))
+		v.infof("Reloaded %s, verifying %d new segments", uri, len(queue))
+		nextSeq = end
+
+		v.verifySegments(ctx, media, queue, start)
+	}
+	v.infof("EXT-X-ENDLIST appeared on: %s", uri)
+}
+
+// lastSequence returns the media sequence number of the last segment of mp,
+// or of its first one when it has none.
+func lastSequence(mp *m3u8.MediaPlaylist) uint64 {
+	if mp.Count() == 0 {
+		return mp.SeqNo
+	}
+	return mp.SeqNo + uint64(mp.Count()) - 1
+}
+
+// reloadInterval returns the target duration of mp, or a second if it
+// declares none, so a broken playlist isn't reloaded in a busy loop.
+func reloadInterval(mp *m3u8.MediaPlaylist) time.Duration {
+	if mp.TargetDuration <= 0 {
+		return time.Second
+	}
+	return time.Duration(mp.TargetDuration * float64(time.Second))
+}
+
+func (v *Verifier) GetPlaylist(ctx context.Context, uri string) (m3u8.Playlist, m3u8.ListType, error) {
+	p, pType, _, err := v.getPlaylist(ctx, uri)
+	return p, pType, err
+}
+
+// getPlaylist fetches and decodes the playlist on uri, along with the base
+// the uris inside it resolve against.
+func (v *Verifier) getPlaylist(ctx context.Context, uri string) (m3u8.Playlist, m3u8.ListType, string, error) {
+	raw, base, err := v.fetchPlaylist(ctx, uri)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	p, pType, err := decodePlaylist(uri, raw)
+	return p, pType, base, err
+}
+
+// GetPlaylistRaw fetches the playlist on uri without decoding it, for checks
+// on tags the m3u8 package doesn't expose.
+func (v *Verifier) GetPlaylistRaw(ctx context.Context, uri string) ([]byte, error) {
+	raw, _, err := v.fetchPlaylist(ctx, uri)
+	return raw, err
+}
+
+// fetchPlaylist fetches the playlist on uri, returning the url it was
+// finally served from as the base its relative uris resolve against, which
+// differs from uri once the origin redirects to a CDN.
+func (v *Verifier) fetchPlaylist(ctx context.Context, uri string) ([]byte, string, error) {
+	if uri == "-" {
+		raw, err := io.ReadAll(os.Stdin)
+		return raw, uri, err
+	}
+	if path, ok := localPath(uri); ok {
+		raw, err := os.ReadFile(path)
+		return raw, uri, err
+	}
+
+	requested, err := withQuery(uri, v.opts.ManifestQuery)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := v.newRequest(ctx, http.MethodGet, requested, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, err := v.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if err := v.checkStatus(requested, res); err != nil {
+		return nil, "", err
+	}
+
+	base := uri
+	if res.Request != nil && res.Request.URL.String() != requested {
+		base = res.Request.URL.String()
+		v.debugf("Playlist %s redirected to %s, resolving its uris against it", uri, base)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	v.downloaded.Add(len(body))
+	if err != nil {
+		return nil, "", err
+	}
+	body, err = v.decodeContent(requested, res.Header.Get("Content-Encoding"), body)
+	return body, base, err
+}
+
+// resolveByteRanges sets the offset of every EXT-X-BYTERANGE segment
+// without one, which starts right after the previous sub-range of the same
+// resource. The m3u8 package leaves those offsets at 0, so a range
+// explicitly starting at 0 right after another one of its resource can't be
+// told apart, and is treated as implicit too.
+func resolveByteRanges(mp *m3u8.MediaPlaylist) {
+	var previous *m3u8.MediaSegment
+	for _, segment := range mp.Segments {
+		if segment == nil {
+			continue
+		}
+		if segment.Limit > 0 && segment.Offset == 0 && previous != nil &&
+			previous.Limit > 0 && previous.URI == segment.URI {
+			segment.Offset = previous.Offset + previous.Limit
+		}
+		previous = segment
+	}
+}
+
+// newRequest builds a request for uri carrying the headers, cookies and
+// Token of v, if any, so signed streams authorize every manifest, key and
+// segment request. Local paths are requested as file uris, read from disk by
+// fetcherFor.
+func (v *Verifier) newRequest(ctx context.Context, method, uri string, body io.Reader) (*http.Request, error) {
+	if file, ok := fileURI(uri); ok {
+		uri = file
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+
+	setHeaders(req, v.headers)
+	if err = v.setToken(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// setHeaders sets headers on req, replacing the values it had for them.
+func setHeaders(req *http.Request, headers http.Header) {
+	for key, values := range headers {
+		if key == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[key] = append([]string(nil), values...)
+	}
+}
+
+// previewLines is the amount of lines of an unparsable playlist included on
+// its error, to show what was actually served.
+const previewLines = 20
+
+func decodePlaylist(uri string, raw []byte) (m3u8.Playlist, m3u8.ListType, error) {
+	p, pType, err := m3u8.DecodeFrom(bytes.NewReader(raw), false)
+	if err == nil {
+		return p, pType, nil
+	}
+
+	lines := strings.SplitN(string(raw), "\n", previewLines+1)
+	if len(lines) > previewLines {
+		lines[previewLines] = "..."
+	}
+
+	return nil, 0, newError(fmt.Sprintf(
+		"unable to parse playlist %s: %s. First lines served:\n    | %s",
+		uri,
+		err.Error(),
+		strings.Join(lines, "\n    | "),
+	))
+}
+
+// DecodeSegment downloads, decrypts and verifies a segment of a rendition,
+// saved under segmentNo, its media sequence number, returning the
+// diagnostics gathered along the way.
+func (v *Verifier) DecodeSegment(ctx context.Context, segment *m3u8.MediaSegment, key *m3u8.Key, folder string, segmentNo int) (*SegmentResult, error) {
+	result := &SegmentResult{
+		Variant:       folder,
+		Index:         segmentNo,
+		MediaSequence: segment.SeqId,
+		URI:           segment.URI,
+		Offset:        segment.Offset,
+		Limit:         segment.Limit,
+	}
+	if key != nil {
+		result.KeyURI = key.URI
+		result.IV = key.IV
+		result.Method = key.Method
+	}
+	result.initMap = segment.Map
+
+	err := v.decodeSegment(ctx, result)
+	if err != nil {
+		result.fail(err)
+	} else if v.cache != nil && !result.Cached {
+		if keySum, ok := v.keySum(ctx, result); ok {
+			v.cache.store(result, keySum)
+		}
+	}
+	result.Passed = result.OK()
+	return result, err
+}
+
+func (v *Verifier) decodeSegment(ctx context.Context, result *SegmentResult) error {
+	uri, folder, segmentNo := result.URI, result.Variant, result.Index
+
+	var cached *cacheEntry
+	if v.cache != nil {
+		if keySum, ok := v.keySum(ctx, result); ok {
+			cached = v.cache.lookup(result, keySum)
+		}
+	}
+
+	if v.streamsSegment(result) {
+		return v.decodeStreamedSegment(ctx, result, cached)
+	}
+
+	body, info, err := v.fetchIfModified(ctx, uri, result.Offset, result.Limit, cached)
+	result.setFetchInfo(info)
+	if err != nil {
+		return err
+	}
+	if cached != nil && info.Status == http.StatusNotModified {
+		cached.restore(result)
+		v.infof("Segment unchanged since verified on %s, skipped: %s", cached.VerifiedAt.Format(time.RFC3339), uri)
+		return nil
+	}
+	result.Length = len(body)
+	result.Bitrate = bitrate(len(body), info.Duration)
+
+	mismatch := v.checksumSegment(result, body)
+	if v.opts.CompareOrigin != "" {
+		mismatch = errors.Join(mismatch, v.CompareOrigin(ctx, result, body))
+	}
+
+	if isGzip(body) {
+		if !v.opts.GunzipSegments {
+			v.errorf("Segment is gzip-encoded, not raw media on segment: %s", uri)
+			return errors.Join(errGzipEncoded, mismatch)
+		}
+		if body, err = gunzip(body); err != nil {
+			return errors.Join(err, mismatch)
+		}
+		v.infof("Segment gzip-encoded, decompressed before decryption: %s", uri)
+	}
+
+	// Segments no EXT-X-KEY applies to aren't encrypted, same as under
+	// METHOD=NONE.
+	if result.Method == "" || result.Method == methodNone {
+		if isWebVTT(uri, body) {
+			return errors.Join(v.verifyWebVTTSegment(uri, folder, segmentNo, body), mismatch)
+		}
+		v.measureMediaDuration(result, body)
+		v.readContent(result, body)
+		if err = v.probeSegment(ctx, result, body); err != nil {
+			return errors.Join(err, mismatch)
+		}
+		return errors.Join(v.verifyClearSegment(uri, folder, segmentNo, body), mismatch)
+	}
+	if err = checkKeyMethod(result.Method); err != nil {
+		v.errorf("%s on segment: %s", err.Error(), uri)
+		return errors.Join(err, mismatch)
+	}
+	if result.KeyURI == "" {
+		return errors.Join(newError("EXT-X-KEY of segment has no URI"), mismatch)
+	}
+	if isSampleEncryption(result.Method) {
+		return errors.Join(v.verifySampleEncryptedSegment(ctx, result, body), mismatch)
+	}
+
+	if len(body) == 0 || len(body)%aes.BlockSize != 0 {
+		v.errorf("Segment length %d isn't a multiple of the block size on segment: %s", len(body), uri)
+		if err = v.output.Write(folder, segmentNo, SegmentInvalid, body); err != nil {
+			return err
+		}
+		return errors.Join(fmt.Errorf("%w: %d bytes", errBlockAlignment, len(body)), mismatch)
+	}
+
+	mode, err := v.GetCBCDecrypter(ctx, result.KeyURI, result.IV, result.MediaSequence)
+	if err != nil {
+		return errors.Join(err, mismatch)
+	}
+
+	mode.CryptBlocks(body, body)
+	return errors.Join(v.verifyDecrypted(ctx, result, body), mismatch)
+}
+
+// verifyDecrypted verifies body, the whole decrypted segment of result with
+// its padding, saving it when it fails or under --save.
+func (v *Verifier) verifyDecrypted(ctx context.Context, result *SegmentResult, body []byte) error {
+	uri, folder, segmentNo := result.URI, result.Variant, result.Index
+
+	result.DecryptedLength = len(body)
+	if len(body) > 0 {
+		result.PadValue = int(body[len(body)-1])
+	}
+
+	if v.opts.DumpTails {
+		v.printTail(result, body)
+	}
+
+	// Subtitles are text, so only their padding and cues are verified.
+	if isWebVTT(uri, body) {
+		if !v.opts.NoPaddingCheck && !hasValidPadding(body) {
+			return v.paddingFailure(result, body)
+		}
+		text := stripPadding(body)
+		result.DecryptedLength = len(text)
+		return v.verifyWebVTTSegment(uri, folder, segmentNo, text)
+	}
+
+	if v.opts.DeepCheck {
+		if err := v.validateSegmentContainer(folder, stripPadding(body)); err != nil {
+			v.errorf("Segment container invalid on segment: %s", uri)
+			if writeErr := v.output.Write(folder, segmentNo, SegmentInvalid, body); writeErr != nil {
+				return writeErr
+			}
+			return err
+		}
+	}
+
+	if v.opts.NoPaddingCheck {
+		v.infof("Segment decrypted, padding not checked: %s", uri)
+		v.measureMediaDuration(result, stripPadding(body))
+		v.readContent(result, stripPadding(body))
+		if err := v.probeSegment(ctx, result, stripPadding(body)); err != nil {
+			return err
+		}
+		if err := v.concat(folder).add(segmentNo, false, body); err != nil {
+			return err
+		}
+		if v.opts.SaveSegments {
+			if err := v.output.Write(folder, segmentNo, SegmentValid, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !hasValidPadding(body) {
+		return v.paddingFailure(result, body)
+	}
+
+	// A valid padding can still be a coincidence when a wrong key decrypts
+	// the segment into a long run of a single byte.
+	unpadded := body[:len(body)-int(body[len(body)-1])]
+	result.DecryptedLength = len(unpadded)
+	if v.opts.DominantByteRatio > 0 {
+		if value, ratio := dominantByte(unpadded); ratio >= v.opts.DominantByteRatio {
+			v.errorf("Segment dominated by byte 0x%02x (%.1f%%) on segment: %s", value, ratio*100, uri)
+			if err := v.output.Write(folder, segmentNo, SegmentInvalid, body); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: 0x%02x makes up %.1f%% of the segment", errDominantByte, value, ratio*100)
+		}
+	}
+
+	v.measureMediaDuration(result, unpadded)
+	v.readContent(result, unpadded)
+	if err := v.probeSegment(ctx, result, unpadded); err != nil {
+		return err
+	}
+	if err := v.concat(folder).add(segmentNo, false, unpadded); err != nil {
+		return err
+	}
+	if v.opts.SaveSegments {
+		if err := v.output.Write(folder, segmentNo, SegmentValid, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyClearSegment checks a segment without EXT-X-KEY or under one with
+// METHOD=NONE, which is only required to be present, skipping its
+// decryption. Under --deep-check its container is validated instead of its
+// padding.
+func (v *Verifier) verifyClearSegment(uri, folder string, segmentNo int, body []byte) error {
+	if len(body) == 0 {
+		return newError("segment is empty")
+	}
+	v.infof("Segment not encrypted, decryption skipped: %s", uri)
+
+	if v.opts.DeepCheck {
+		if err := v.validateSegmentContainer(folder, body); err != nil {
+			v.errorf("Segment container invalid on segment: %s", uri)
+			if writeErr := v.output.Write(folder, segmentNo, SegmentInvalid, body); writeErr != nil {
+				return writeErr
+			}
+			return err
+		}
+	}
+
+	if err := v.concat(folder).add(segmentNo, false, body); err != nil {
+		return err
+	}
+	if v.opts.SaveSegments {
+		return v.output.Write(folder, segmentNo, SegmentValid, body)
+	}
+	return nil
+}
+
+// verifySampleEncryptedSegment checks a SAMPLE-AES or SAMPLE-AES-CTR
+// segment, whose samples are encrypted inside a clear container, without
+// decrypting it. Its key is fetched when it can be, and its container is
+// always validated, which whole segment encryption under a sample method
+// fails. The PMT of a TS segment must declare sample encrypted streams.
+func (v *Verifier) verifySampleEncryptedSegment(ctx context.Context, result *SegmentResult, body []byte) error {
+	uri, folder, segmentNo := result.URI, result.Variant, result.Index
+	if len(body) == 0 {
+		return newError("segment is empty")
+	}
+
+	if isKeyFetchable(result.KeyURI) {
+		if _, err := v.GetKey(ctx, result.KeyURI); err != nil {
+			return err
+		}
+	}
+
+	err := v.validateSegmentContainer(folder, body)
+	if err == nil && isTransportStream(body) {
+		encrypted := false
+		for _, streamType := range segmentStreams(tsPackets(body)) {
+			encrypted = encrypted || tsSampleAESStreamTypes[streamType]
+		}
+		if !encrypted {
+			err = fmt.Errorf("%w: PMT declares no sample encrypted streams under %s", errContainer, result.Method)
+		}
+	}
+	if err != nil {
+		v.errorf("%s segment container invalid on segment: %s", result.Method, uri)
+		if writeErr := v.output.Write(folder, segmentNo, SegmentInvalid, body); writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+
+	v.infof("Segment %s, container verified without decrypting samples: %s", result.Method, uri)
+	v.measureMediaDuration(result, body)
+	v.readContent(result, body)
+	if err = v.concat(folder).add(segmentNo, false, body); err != nil {
+		return err
+	}
+	if v.opts.SaveSegments {
+		return v.output.Write(folder, segmentNo, SegmentValid, body)
+	}
+	return nil
+}
+
+// CompareOrigin fetches the segment of result from the CompareOrigin host
+// and returns errOriginMismatch if it differs from the still encrypted body.
+// Both copies share the key and IV, so equal ciphertexts decrypt to equal
+// segments.
+func (v *Verifier) CompareOrigin(ctx context.Context, result *SegmentResult, body []byte) error {
+	return v.compareOrigin(ctx, result, sha256.Sum256(body))
+}
+
+// compareOrigin is CompareOrigin with sum, the SHA256 of the still encrypted
+// body. The copy of the CompareOrigin host is hashed as it's downloaded.
+func (v *Verifier) compareOrigin(ctx context.Context, result *SegmentResult, sum [sha256.Size]byte) error {
+	uri := result.URI
+	altURI, err := withOrigin(uri, v.opts.CompareOrigin)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	_, err = v.fetchStream(ctx, altURI, result.Offset, result.Limit, nil, func(r io.Reader) error {
+		_, copyErr := io.Copy(hash, r)
+		return copyErr
+	})
+	if err != nil {
+		return err
+	}
+
+	var altSum [sha256.Size]byte
+	hash.Sum(altSum[:0])
+	if sum == altSum {
+		return nil
+	}
+
+	v.errorf("Segment differs between origins on segment: %s", uri)
+	return fmt.Errorf("%w: sha256 %x on %s, %x on %s", errOriginMismatch, sum, uri, altSum, altURI)
+}
+
+// hasValidPadding reports whether a decrypted body ends with a valid PKCS7
+// padding: a last byte between 1 and the block size, no longer than body,
+// repeated on every padding byte.
+func hasValidPadding(body []byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+
+	padding := int(body[len(body)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(body) {
+		return false
+	}
+
+	for _, b := range body[len(body)-padding:] {
+		if int(b) != padding {
+			return false
+		}
+	}
+	return true
+}
+
+// stripPadding returns body without its PKCS7 padding, or unchanged when it
+// has none, for checks on the media it decrypted into.
+func stripPadding(body []byte) []byte {
+	if !hasValidPadding(body) {
+		return body
+	}
+	return body[:len(body)-int(body[len(body)-1])]
+}
+
+// dominantByte returns the most repeated byte of body along with the ratio
+// of body it makes up.
+func dominantByte(body []byte) (byte, float64) {
+	if len(body) == 0 {
+		return 0, 0
+	}
+
+	var counts [256]int
+	for _, b := range body {
+		counts[b]++
+	}
+
+	var value byte
+	for b, count := range counts {
+		if count > counts[value] {
+			value = byte(b)
+		}
+	}
+
+	return value, float64(counts[value]) / float64(len(body))
+}
+
+// tailSize is the amount of trailing decrypted bytes recorded by
+// --dump-tails and on padding failures.
+const tailSize = 32
+
+// recordTail records the last tailSize bytes of body, a decrypted segment
+// or its end, as hex on the segment of result.
+func recordTail(result *SegmentResult, body []byte) {
+	if len(body) > tailSize {
+		body = body[len(body)-tailSize:]
+	}
+	result.Tail = hex.EncodeToString(body)
+}
+
+// printTail records the tail of a segment ending with body and prints it,
+// along with the padding length its last byte claims.
+func (v *Verifier) printTail(result *SegmentResult, body []byte) {
+	recordTail(result, body)
+	if len(body) == 0 {
+		v.infof("Tail of segment %s: empty", result.URI)
+		return
+	}
+	v.infof("Tail of segment %s (claimed padding %d): %s", result.URI, result.PadValue, result.Tail)
+}
+
+// paddingFailure records the tail of body, writes the error segment and
+// returns errPadding, so the failure is recorded once the segment is saved.
+func (v *Verifier) paddingFailure(result *SegmentResult, body []byte) error {
+	v.errorf("Segment padding incorrect on segment: %s", result.URI)
+	recordTail(result, body)
+
+	if err := v.output.Write(result.Variant, result.Index, SegmentInvalid, body); err != nil {
+		return err
+	}
+	return errPadding
+}
+
+// GetSegment downloads the still encrypted segment on uri.
+func (v *Verifier) GetSegment(ctx context.Context, uri string) ([]byte, error) {
+	return v.GetByteRange(ctx, uri, 0, 0)
+}
+
+// GetByteRange downloads limit bytes starting at offset from the resource on
+// uri. A limit of 0 downloads the whole resource.
+func (v *Verifier) GetByteRange(ctx context.Context, uri string, offset, limit int64) ([]byte, error) {
+	body, _, err := v.fetch(ctx, uri, offset, limit)
+	return body, err
+}
+
+// fetch downloads a byte range like GetByteRange, also describing the
+// response it was served with.
+func (v *Verifier) fetch(ctx context.Context, uri string, offset, limit int64) ([]byte, fetchInfo, error) {
+	return v.fetchIfModified(ctx, uri, offset, limit, nil)
+}
+
+// fetchIfModified is fetch, requesting uri only if it changed since it was
+// served as cached when not nil. An unchanged one is returned without a
+// body and a 304 Status.
+func (v *Verifier) fetchIfModified(ctx context.Context, uri string, offset, limit int64, cached *cacheEntry) ([]byte, fetchInfo, error) {
+	var body []byte
+	info, err := v.fetchStream(ctx, uri, offset, limit, cached, func(r io.Reader) error {
+		var readErr error
+		body, readErr = io.ReadAll(r)
+		return readErr
+	})
+	if err != nil {
+		return nil, info, err
+	}
+	return body, info, nil
+}
+
+// fetchStream is fetchIfModified handing the body to read as it's
+// downloaded, rather than returning it whole. read isn't called when the
+// resource is unchanged or served with an error status, and the range
+// served is checked once it returns.
+func (v *Verifier) fetchStream(ctx context.Context, uri string, offset, limit int64, cached *cacheEntry, read func(r io.Reader) error) (info fetchInfo, err error) {
+	// info is a named result so the deferred timing below is returned.
+	var retries int32
+
+	uri, err = withQuery(uri, v.opts.SegmentQuery)
+	if err != nil {
+		return info, err
+	}
+
+	req, err := v.newRequest(withRetryCounter(ctx, &retries), http.MethodGet, uri, nil)
+	if err != nil {
+		return info, err
+	}
+
+	if limit > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+limit-1))
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		} else {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	start := time.Now()
+	defer func() {
+		info.Duration = time.Since(start)
+		info.Retries = int(atomic.LoadInt32(&retries))
+	}()
+
+	res, err := v.do(req)
+	if err != nil {
+		return info, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	info.FirstByte = time.Since(start)
+	info.Status = res.StatusCode
+	info.ContentType = res.Header.Get("Content-Type")
+	info.ETag = res.Header.Get("ETag")
+	info.LastModified = res.Header.Get("Last-Modified")
+
+	body := &countingReader{r: res.Body, counter: v.downloaded}
+	if cached != nil && res.StatusCode == http.StatusNotModified {
+		return info, nil
+	}
+	if err := v.checkStatus(uri, res); err != nil {
+		_, _ = io.Copy(io.Discard, body)
+		return info, err
+	}
+	if limit == 0 || (res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent) {
+		return info, read(body)
+	}
+	if res.StatusCode == http.StatusPartialContent {
+		if err := read(body); err != nil {
+			return info, err
+		}
+		return info, checkContentRange(uri, res.Header.Get("Content-Range"), offset, limit, body.n)
+	}
+
+	// The origin ignored the Range header and serves the whole resource,
+	// sliced as it's read.
+	if _, err := io.CopyN(io.Discard, body, offset); err != nil && !errors.Is(err, io.EOF) {
+		return info, err
+	}
+	if err := read(io.LimitReader(body, limit)); err != nil {
+		return info, err
+	}
+	if body.n < offset+limit {
+		return info, newError(fmt.Sprintf("range %d@%d requested but only %d bytes served on %s", limit, offset, body.n, uri))
+	}
+	v.warnf("Range ignored by origin, sliced from the whole resource: %s", uri)
+	return info, nil
+}
+
+// countingReader counts the bytes read from r, adding them to counter as
+// they're downloaded when not nil.
+type countingReader struct {
+	r       io.Reader
+	n       int64
+	counter *byteCounter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.counter != nil {
+		c.counter.Add(n)
+	}
+	return n, err
+}
+
+// checkContentRange checks that a partial content response of n bytes to
+// uri serves the limit bytes requested at offset, as a range starting
+// elsewhere or cut short would be verified as the wrong segment.
+func checkContentRange(uri, contentRange string, offset, limit, n int64) error {
+	if n != limit {
+		return newError(fmt.Sprintf("range %d@%d requested but %d bytes served on %s", limit, offset, n, uri))
+	}
+	if contentRange == "" {
+		return nil
+	}
+
+	var first, last int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &first, &last); err != nil {
+		return newError(fmt.Sprintf("unable to parse Content-Range %q on %s", contentRange, uri))
+	}
+	if first != offset || last != offset+limit-1 {
+		return newError(fmt.Sprintf("range %d@%d requested but Content-Range %q served on %s", limit, offset, contentRange, uri))
+	}
+	return nil
+}
+
+// gzipMagic is the header every gzip stream starts with, including the
+// deflate compression method byte so ciphertext rarely matches by chance.
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+// isGzip reports whether body is a gzip stream rather than encrypted media.
+func isGzip(body []byte) bool {
+	return bytes.HasPrefix(body, gzipMagic)
+}
+
+// gunzip decompresses a gzip-encoded body.
+func gunzip(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = zr.Close() }()
+
+	return io.ReadAll(zr)
+}
+
+// GetDecryptedSegment downloads limit bytes starting at offset from the
+// segment on uri, or all of it when limit is 0, and decrypts them in place
+// with mode.
+func (v *Verifier) GetDecryptedSegment(ctx context.Context, uri string, offset, limit int64, mode cipher.BlockMode) ([]byte, error) {
+	body, err := v.GetByteRange(ctx, uri, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) == 0 || len(body)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: %d bytes", errBlockAlignment, len(body))
+	}
+
+	mode.CryptBlocks(body, body)
+	return body, nil
+}
+
+// checkSchemeDowngrade warns when a playlist fetched over https references a
+// child uri served over plain http. If RequireHTTPS is set the downgrade is
+// returned as an error instead.
+func (v *Verifier) checkSchemeDowngrade(parentURI, childURI string) error {
+	parent, err := url.Parse(parentURI)
+	if err != nil {
+		return err
+	}
+
+	child, err := url.Parse(childURI)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(parent.Scheme, "https") || !strings.EqualFold(child.Scheme, "http") {
+		return nil
+	}
+
+	if v.opts.RequireHTTPS {
+		return newError("https to http scheme downgrade on: " + childURI)
+	}
+
+	v.warnf("HTTPS to HTTP scheme downgrade on: %s", childURI)
+	return nil
+}
+
+func newError(msg string) error {
+	return errors.New("error: " + msg)
+}
+
+// GetCBCDecrypter returns a new decrypter for the segment with media
+// sequence number seqID, using the key on keyURI and the IV in ivHEX, or the
+// sequence number as IV when ivHEX is empty. CBC decrypters are stateful, so
+// each segment needs its own.
+func (v *Verifier) GetCBCDecrypter(ctx context.Context, keyURI string, ivHEX string, seqID uint64) (cipher.BlockMode, error) {
+	key, err := v.GetKey(ctx, keyURI)
+	if err != nil {
+		return nil, err
+	}
+
+	iv, err := segmentIV(ivHEX, seqID)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewCBCDecrypter(block, iv), nil
+}
+
+// segmentIV returns the IV declared in ivHEX, or the one derived from seqID
+// when the EXT-X-KEY has no IV attribute. The IV is a 128-bit hexadecimal
+// integer, so its 0x prefix is optional, quotes and whitespace are ignored,
+// and shorter values are zero-padded on the left.
+func segmentIV(ivHEX string, seqID uint64) ([]byte, error) {
+	digits := strings.Trim(strings.TrimSpace(ivHEX), "\"")
+	if digits == "" {
+		return sequenceIV(seqID), nil
+	}
+	digits = strings.TrimPrefix(strings.TrimPrefix(digits, "0x"), "0X")
+
+	if len(digits) > 2*aes.BlockSize {
+		return nil, newError(fmt.Sprintf("IV %s has %d hex digits, more than the %d of a 128-bit IV", ivHEX, len(digits), 2*aes.BlockSize))
+	}
+	digits = strings.Repeat("0", 2*aes.BlockSize-len(digits)) + digits
+
+	iv, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, newError(fmt.Sprintf("IV %s isn't hexadecimal: %s", ivHEX, err.Error()))
+	}
+	return iv, nil
+}
+
+// sequenceIV returns the media sequence number seqID as a 16 byte big-endian
+// IV, used by segments whose EXT-X-KEY has no IV attribute.
+func sequenceIV(seqID uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[aes.BlockSize-8:], seqID)
+	return iv
+}
@@ -0,0 +1,399 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestVerifyResolvesRelativeURIs(t *testing.T) {
+	stream := newTestStream(t)
+	stream.add("/streams/master.m3u8", []byte("#EXTM3U\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000\nlow/index.m3u8\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000\n../high/index.m3u8\n"))
+	stream.addMedia("/streams/low/index.m3u8", 2)
+	stream.addMedia("/high/index.m3u8", 2)
+
+	v := newTestVerifier(t, func(opts *Options) { opts.ManifestType = "master" })
+	report, err := v.Verify(context.Background(), stream.uri("/streams/master.m3u8"))
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if report.Totals.Verified != 4 {
+		t.Errorf("Verify() verified %d segments, want 4", report.Totals.Verified)
+	}
+
+	for _, path := range []string{
+		"/streams/low/index.m3u8",
+		"/streams/low/key.bin",
+		"/streams/low/seg0.ts",
+		"/streams/low/seg1.ts",
+		"/high/index.m3u8",
+		"/high/key.bin",
+		"/high/seg0.ts",
+		"/high/seg1.ts",
+	} {
+		if len(stream.requestsTo(path)) == 0 {
+			t.Errorf("%s wasn't requested", path)
+		}
+	}
+}
+
+func TestVerifyRotatingKeys(t *testing.T) {
+	stream := newTestStream(t)
+	rotated := []byte("fedcba9876543210")
+	explicitIV := []byte("ivivivivivivivix")
+	stream.add("/media/key1.bin", testKey)
+	stream.add("/media/key2.bin", rotated)
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:5\n")
+	for i, seq := range []uint64{5, 6, 7, 8} {
+		key, iv := testKey, sequenceIV(seq)
+		switch i {
+		case 0:
+			playlist.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"key1.bin\"\n")
+		case 2:
+			key, iv = rotated, explicitIV
+			fmt.Fprintf(&playlist, "#EXT-X-KEY:METHOD=AES-128,URI=\"key2.bin\",IV=0x%x\n", explicitIV)
+		case 3:
+			key, iv = rotated, explicitIV
+		}
+		stream.add(fmt.Sprintf("/media/seg%d.ts", seq), encryptSegment(key, iv, testPlain(i, 1000+i)))
+		fmt.Fprintf(&playlist, "#EXTINF:4.0,\nseg%d.ts\n", seq)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	stream.add("/media/index.m3u8", []byte(playlist.String()))
+
+	v := newTestVerifier(t, nil)
+	report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if report.Totals.Verified != 4 {
+		t.Errorf("Verify() verified %d segments, want 4", report.Totals.Verified)
+	}
+	for _, path := range []string{"/media/key1.bin", "/media/key2.bin"} {
+		if len(stream.requestsTo(path)) != 1 {
+			t.Errorf("%s was requested %d times, want 1", path, len(stream.requestsTo(path)))
+		}
+	}
+}
+
+func TestSegmentIV(t *testing.T) {
+	tests := []struct {
+		name    string
+		ivHEX   string
+		seqID   uint64
+		want    string
+		wantErr bool
+	}{
+		{name: "sequence number", seqID: 258, want: "00000000000000000000000000000102"},
+		{name: "prefixed", ivHEX: "0x000102030405060708090a0b0c0d0e0f", want: "000102030405060708090a0b0c0d0e0f"},
+		{name: "upper case prefix", ivHEX: "0X000102030405060708090A0B0C0D0E0F", want: "000102030405060708090a0b0c0d0e0f"},
+		{name: "unprefixed", ivHEX: "000102030405060708090a0b0c0d0e0f", want: "000102030405060708090a0b0c0d0e0f"},
+		{name: "quoted", ivHEX: `"0x1f"`, seqID: 7, want: "0000000000000000000000000000001f"},
+		{name: "short", ivHEX: "0x1", want: "00000000000000000000000000000001"},
+		{name: "odd length", ivHEX: "0x123", want: "00000000000000000000000000000123"},
+		{name: "too long", ivHEX: "0x000102030405060708090a0b0c0d0e0f10", wantErr: true},
+		{name: "not hexadecimal", ivHEX: "0xzz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iv, err := segmentIV(tt.ivHEX, tt.seqID)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("segmentIV(%q) = %x, want an error", tt.ivHEX, iv)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("segmentIV(%q) error = %v", tt.ivHEX, err)
+			}
+			if got := hex.EncodeToString(iv); got != tt.want {
+				t.Errorf("segmentIV(%q, %d) = %s, want %s", tt.ivHEX, tt.seqID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSequenceIV(t *testing.T) {
+	tests := []struct {
+		seqID uint64
+		want  string
+	}{
+		{0, "00000000000000000000000000000000"},
+		{1, "00000000000000000000000000000001"},
+		{1 << 32, "00000000000000000000000100000000"},
+		{math.MaxUint64, "0000000000000000ffffffffffffffff"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(sequenceIV(tt.seqID)); got != tt.want {
+			t.Errorf("sequenceIV(%d) = %s, want %s", tt.seqID, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyUnalignedSegment(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		gunzip bool
+	}{
+		{name: "100 bytes streamed", length: 100},
+		{name: "100 bytes buffered", length: 100, gunzip: true},
+		{name: "under a block streamed", length: 15},
+		{name: "under a block buffered", length: 15, gunzip: true},
+		{name: "empty streamed", length: 0},
+		{name: "empty buffered", length: 0, gunzip: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.addMedia("/media/index.m3u8", 3)
+			stream.add("/media/seg1.ts", testPlain(1, tt.length))
+
+			v := newTestVerifier(t, func(opts *Options) {
+				opts.GunzipSegments = tt.gunzip
+				opts.NoRecheck = true
+			})
+			report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+			if err == nil {
+				t.Fatal("Verify() error = nil, want the alignment failure")
+			}
+			if report.Totals.Verified != 2 || report.Totals.Failed != 1 {
+				t.Errorf("Verify() verified %d and failed %d segments, want 2 and 1", report.Totals.Verified, report.Totals.Failed)
+			}
+			if segment := report.Variants[0].Segments[1]; segment.Class != ClassAlignment {
+				t.Errorf("segment 1 failed as %q, want %q", segment.Class, ClassAlignment)
+			}
+
+			saved, err := filepath.Glob(filepath.Join(v.opts.OutputDir, "*", "error_segment1.*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(saved) != 1 {
+				t.Fatalf("saved error segments %v, want error_segment1", saved)
+			}
+			if body, err := os.ReadFile(saved[0]); err != nil || len(body) != tt.length {
+				t.Errorf("saved %d bytes of segment 1 (%v), want the %d served", len(body), err, tt.length)
+			}
+		})
+	}
+}
+
+func TestVerifyDominantByte(t *testing.T) {
+	tests := []struct {
+		name   string
+		ratio  float64
+		gunzip bool
+		failed bool
+	}{
+		{name: "off by default streamed"},
+		{name: "off by default buffered", gunzip: true},
+		{name: "ratio streamed", ratio: 0.9, failed: true},
+		{name: "ratio buffered", ratio: 0.9, gunzip: true, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTestStream(t)
+			stream.addMedia("/media/index.m3u8", 2)
+			// Silence can decrypt to a segment of a single byte.
+			stream.add("/media/seg1.ts", encryptSegment(testKey, sequenceIV(1), make([]byte, 1000)))
+
+			v := newTestVerifier(t, func(opts *Options) {
+				if tt.ratio > 0 {
+					opts.DominantByteRatio = tt.ratio
+				}
+				opts.GunzipSegments = tt.gunzip
+				opts.NoRecheck = true
+			})
+			report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+			if !tt.failed {
+				if err != nil {
+					t.Fatalf("Verify() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Verify() error = nil, want the dominant byte failure")
+			}
+			if segment := report.Variants[0].Segments[1]; segment.Class != ClassDominant {
+				t.Errorf("segment 1 failed as %q, want %q", segment.Class, ClassDominant)
+			}
+		})
+	}
+}
+
+func TestHasValidPadding(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"single byte of padding", []byte{1}, true},
+		{"single byte too long", []byte{2}, false},
+		{"single zero byte", []byte{0}, false},
+		{"last byte zero", append(bytes.Repeat([]byte{7}, 15), 0), false},
+		{"last byte past the body", []byte{9, 9, 9, 9}, false},
+		{"last byte past the block size", bytes.Repeat([]byte{17}, 32), false},
+		{"one byte", append(bytes.Repeat([]byte{7}, 15), 1), true},
+		{"full block", bytes.Repeat([]byte{16}, 32), true},
+		{"whole body", bytes.Repeat([]byte{4}, 4), true},
+		{"mismatched padding byte", append(bytes.Repeat([]byte{7}, 12), 4, 3, 4, 4), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasValidPadding(tt.body); got != tt.want {
+				t.Errorf("hasValidPadding(%x) = %t, want %t", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyByteRanges(t *testing.T) {
+	stream := newTestStream(t)
+	stream.add("/media/key.bin", testKey)
+
+	var resource []byte
+	var playlist strings.Builder
+	var ranges []string
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n")
+	playlist.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n")
+	for i := 0; i < 3; i++ {
+		segment := encryptSegment(testKey, sequenceIV(uint64(i)), testPlain(i, 1000+i))
+		// The first range is explicit, the next ones follow on from it.
+		if i == 0 {
+			fmt.Fprintf(&playlist, "#EXTINF:4.0,\n#EXT-X-BYTERANGE:%d@0\nall.ts\n", len(segment))
+		} else {
+			fmt.Fprintf(&playlist, "#EXTINF:4.0,\n#EXT-X-BYTERANGE:%d\nall.ts\n", len(segment))
+		}
+		ranges = append(ranges, fmt.Sprintf("bytes=%d-%d", len(resource), len(resource)+len(segment)-1))
+		resource = append(resource, segment...)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	stream.add("/media/index.m3u8", []byte(playlist.String()))
+	stream.add("/media/all.ts", resource)
+
+	v := newTestVerifier(t, nil)
+	report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if report.Totals.Verified != 3 {
+		t.Errorf("Verify() verified %d segments, want 3", report.Totals.Verified)
+	}
+
+	var sent []string
+	for _, r := range stream.requestsTo("/media/all.ts") {
+		sent = append(sent, r.Header.Get("Range"))
+	}
+	slices.Sort(sent)
+	if !slices.Equal(sent, ranges) {
+		t.Errorf("sent Range headers %q, want %q", sent, ranges)
+	}
+}
+
+func TestQueueSegmentsIndexesBySequence(t *testing.T) {
+	tests := []struct {
+		name    string
+		seqNo   uint64
+		removed []int
+		fromSeq uint64
+		want    []int
+	}{
+		{name: "dense", seqNo: 0, want: []int{0, 1, 2, 3}},
+		{name: "media sequence", seqNo: 10, want: []int{10, 11, 12, 13}},
+		{name: "sparse", seqNo: 10, removed: []int{1, 2}, want: []int{10, 13}},
+		{name: "sparse start", seqNo: 5, removed: []int{0}, want: []int{6, 7, 8}},
+		{name: "reloaded", seqNo: 10, removed: []int{2}, fromSeq: 12, want: []int{13}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mp, err := m3u8.NewMediaPlaylist(0, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mp.SeqNo = tt.seqNo
+			for i := 0; i < 4; i++ {
+				if err := mp.AppendSegment(&m3u8.MediaSegment{URI: fmt.Sprintf("seg%d.ts", i), SeqId: tt.seqNo + uint64(i), Duration: 4}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, i := range tt.removed {
+				mp.Segments[i] = nil
+			}
+
+			var verified time.Duration
+			queue := newTestVerifier(t, nil).queueSegments(mp, segmentKeys(mp), nil, tt.fromSeq, &verified)
+			var got []int
+			for _, queued := range queue {
+				got = append(got, queued.index)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("queueSegments() indexes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyNamesFilesBySequence(t *testing.T) {
+	stream := newTestStream(t)
+	stream.add("/media/key.bin", testKey)
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:40\n")
+	playlist.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n")
+	for seq := uint64(40); seq < 43; seq++ {
+		body := encryptSegment(testKey, sequenceIV(seq), testPlain(int(seq), 1000))
+		if seq == 41 {
+			// Decrypts to a last byte of 0, an invalid padding.
+			body = encryptBlocks(testKey, sequenceIV(seq), make([]byte, 64))
+		}
+		stream.add(fmt.Sprintf("/media/seg%d.ts", seq), body)
+		fmt.Fprintf(&playlist, "#EXTINF:4.0,\nseg%d.ts\n", seq)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	stream.add("/media/index.m3u8", []byte(playlist.String()))
+
+	v := newTestVerifier(t, func(opts *Options) {
+		opts.SaveSegments = true
+		opts.NoRecheck = true
+	})
+	report, err := v.Verify(context.Background(), stream.uri("/media/index.m3u8"))
+	if err == nil {
+		t.Fatal("Verify() error = nil, want the padding failure")
+	}
+
+	saved, err := filepath.Glob(filepath.Join(v.opts.OutputDir, "*", "*.m4f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, path := range saved {
+		names = append(names, filepath.Base(path))
+	}
+	slices.Sort(names)
+	if want := []string{"error_segment41.m4f", "segment40.m4f", "segment42.m4f"}; !slices.Equal(names, want) {
+		t.Errorf("saved %v, want %v", names, want)
+	}
+	segments := report.Variants[0].Segments
+	if len(segments) != 3 {
+		t.Fatalf("Verify() reported %d segments, want 3", len(segments))
+	}
+	for _, segment := range segments {
+		if segment.Index != int(segment.MediaSequence) || segment.Passed != (segment.Index != 41) {
+			t.Errorf("segment %d of media sequence %d passed = %t", segment.Index, segment.MediaSequence, segment.Passed)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package verifier
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// Kinds of a LiveError.
+const (
+	LiveStalled              = "stalled"
+	LiveSequenceRegression   = "sequence-regression"
+	LiveEarlyRemoval         = "early-removal"
+	LiveTargetDurationChange = "target-duration-change"
+	LiveSegmentChanged       = "segment-changed"
+)
+
+// minLiveWindow is the amount of target durations a live playlist must
+// still last after removing a segment, per RFC 8216 section 6.2.2.
+const minLiveWindow = 3
+
+// LiveError is a problem of a followed live playlist found between two of
+// its reloads, at the media sequence number the reload started with.
+type LiveError struct {
+	Kind          string    `json:"kind"`
+	MediaSequence uint64    `json:"media_sequence"`
+	Error         string    `json:"error"`
+	At            time.Time `json:"at"`
+}
+
+// Stall is where a followed live playlist stopped being followed after
+// going --poll-timeout without new segments: the last media sequence number
+// it had and when its last new segment appeared.
+type Stall struct {
+	MediaSequence uint64    `json:"media_sequence"`
+	LastSeen      time.Time `json:"last_seen"`
+}
+
+// liveWatchdog tracks a followed live media playlist between reloads, to
+// flag it when it stops advancing or changes in ways players can't follow.
+type liveWatchdog struct {
+	// stallTargetDurations is how many target durations the playlist can
+	// go without new segments, or 0 to never report it.
+	stallTargetDurations int
+
+	targetDuration float64
+	seqNo          uint64
+	uris           map[uint64]string
+	grown          time.Time
+	stalled        bool
+}
+
+func (v *Verifier) newLiveWatchdog(mp *m3u8.MediaPlaylist) *liveWatchdog {
+	w := &liveWatchdog{stallTargetDurations: v.opts.StallTargetDurations, grown: time.Now()}
+	w.update(mp)
+	return w
+}
+
+// update records mp as the last load of the playlist.
+func (w *liveWatchdog) update(mp *m3u8.MediaPlaylist) {
+	w.targetDuration = mp.TargetDuration
+	w.seqNo = mp.SeqNo
+	w.uris = make(map[uint64]string, mp.Count())
+	for i, segment := range mp.Segments {
+		if segment != nil {
+			w.uris[mp.SeqNo+uint64(i)] = segment.URI
+		}
+	}
+}
+
+// check compares mp, the playlist just reloaded, with the previous load,
+// returning what players following it would trip on. grown is whether it
+// has new segments.
+func (w *liveWatchdog) check(mp *m3u8.MediaPlaylist, grown bool) []*LiveError {
+	now := time.Now()
+	var errs []*LiveError
+	add := func(kind, format string, args ...interface{}) {
+		errs = append(errs, &LiveError{Kind: kind, MediaSequence: mp.SeqNo, Error: fmt.Sprintf(format, args...), At: now})
+	}
+
+	if mp.TargetDuration != w.targetDuration {
+		add(LiveTargetDurationChange, "EXT-X-TARGETDURATION changed from %g to %g", w.targetDuration, mp.TargetDuration)
+	}
+
+	switch {
+	case mp.SeqNo < w.seqNo:
+		add(LiveSequenceRegression, "EXT-X-MEDIA-SEQUENCE went back from %d to %d", w.seqNo, mp.SeqNo)
+	case mp.SeqNo > w.seqNo && mp.MediaType == m3u8.EVENT:
+		add(LiveEarlyRemoval, "%d segments removed from an EVENT playlist", mp.SeqNo-w.seqNo)
+	case mp.SeqNo > w.seqNo:
+		if window, least := playlistDuration(mp), float64(minLiveWindow)*mp.TargetDuration; window < least {
+			add(LiveEarlyRemoval, "segments removed with %gs left on the playlist, less than %d target durations (%gs)", window, minLiveWindow, least)
+		}
+	}
+
+	var changed []string
+	for i, segment := range mp.Segments {
+		if segment == nil {
+			continue
+		}
+		seq := mp.SeqNo + uint64(i)
+		if previous, ok := w.uris[seq]; ok && previous != segment.URI {
+			changed = append(changed, fmt.Sprintf("%d from %s to %s", seq, previous, segment.URI))
+		}
+	}
+	if len(changed) > 0 {
+		add(LiveSegmentChanged, "segments changed uri under the same media sequence number: %s", strings.Join(changed, ", "))
+	}
+
+	stallAfter := time.Duration(w.stallTargetDurations) * reloadInterval(mp)
+	switch {
+	case grown:
+		w.grown, w.stalled = now, false
+	case !w.stalled && stallAfter > 0 && now.Sub(w.grown) >= stallAfter:
+		w.stalled = true
+		add(LiveStalled, "no new segments for %s, over %d target durations", now.Sub(w.grown).Round(time.Second), w.stallTargetDurations)
+	}
+
+	w.update(mp)
+	return errs
+}
+
+// playlistDuration returns the sum of the EXTINF durations of mp, in
+// seconds.
+func playlistDuration(mp *m3u8.MediaPlaylist) float64 {
+	total := 0.0
+	for _, segment := range mp.Segments {
+		if segment != nil {
+			total += segment.Duration
+		}
+	}
+	return total
+}
+
+// stallMedia records the stall of the followed playlist of media, whose last
+// media sequence number is seq and last new segment appeared at lastSeen,
+// as a ClassStalled failure.
+func (v *Verifier) stallMedia(media *MediaResult, seq uint64, lastSeen time.Time) {
+	media.setStall(&Stall{MediaSequence: seq, LastSeen: lastSeen})
+	err := fmt.Errorf(
+		"%w at media sequence %d, no new segments since %s (%s)",
+		errStreamStalled,
+		seq,
+		lastSeen.Format(time.RFC3339),
+		time.Since(lastSeen).Round(time.Second),
+	)
+	v.errorf("Stopped following %s: %s", media.URI, err.Error())
+	v.failures.Add(ClassStalled, media.Variant, media.URI, err)
+}
+
+// watchLive checks mp, the reload of the live playlist of media, with w,
+// recording what it finds as ClassLive failures on media and notifying
+// them. Under --poll-timeout stalls are only warned about, as following the
+// playlist ends with a ClassStalled failure once the timeout is reached.
+func (v *Verifier) watchLive(media *MediaResult, w *liveWatchdog, mp *m3u8.MediaPlaylist, grown bool) {
+	for _, liveErr := range w.check(mp, grown) {
+		if liveErr.Kind == LiveStalled && v.opts.PollTimeout > 0 {
+			v.warnf("Live playlist %s on %s: %s, stopping at --poll-timeout of %s", liveErr.Kind, media.URI, liveErr.Error, v.opts.PollTimeout)
+			continue
+		}
+		v.errorf("Live playlist %s on %s: %s", liveErr.Kind, media.URI, liveErr.Error)
+		media.addLiveError(liveErr)
+		v.failures.Add(ClassLive, media.Variant, media.URI, fmt.Errorf("%s: %s", liveErr.Kind, liveErr.Error))
+		v.notifier.addLive(media, liveErr)
+	}
+}
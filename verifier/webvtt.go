@@ -0,0 +1,217 @@
+package verifier
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errWebVTT is returned by DecodeSegment when a subtitle segment isn't a
+// valid WebVTT file for HLS.
+var errWebVTT = errors.New("invalid WebVTT segment")
+
+const timestampMapHeader = "X-TIMESTAMP-MAP="
+
+// utf8BOM may start a WebVTT file before its WEBVTT signature.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// isWebVTT reports whether the segment on uri with body is a WebVTT
+// subtitle segment, by its signature or by the extension of its uri, so
+// one missing its signature is still verified as subtitles.
+func isWebVTT(uri string, body []byte) bool {
+	if bytes.HasPrefix(bytes.TrimPrefix(body, utf8BOM), []byte("WEBVTT")) {
+		return true
+	}
+	if u, err := url.Parse(uri); err == nil {
+		uri = u.Path
+	}
+	ext := strings.ToLower(path.Ext(uri))
+	return ext == ".vtt" || ext == ".webvtt"
+}
+
+// checkWebVTT validates the WebVTT segment body, returning its amount of
+// cues. It must start with the WEBVTT signature and have an X-TIMESTAMP-MAP
+// header mapping its cues to the media timestamps, as HLS requires, and
+// every cue must end after it starts, starting no earlier than the one
+// before.
+func checkWebVTT(body []byte) (int, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(body, utf8BOM)))
+	if !scanner.Scan() {
+		return 0, fmt.Errorf("%w: empty", errWebVTT)
+	}
+	if signature := strings.TrimRight(scanner.Text(), "\r"); signature != "WEBVTT" &&
+		!strings.HasPrefix(signature, "WEBVTT ") && !strings.HasPrefix(signature, "WEBVTT\t") {
+		return 0, fmt.Errorf("%w: no WEBVTT signature", errWebVTT)
+	}
+
+	// The header runs up to the first blank line, blocks are separated by
+	// blank lines after it.
+	var block []string
+	var blocks [][]string
+	header := true
+	mapped := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if header {
+			if line == "" {
+				header = false
+				continue
+			}
+			if strings.HasPrefix(line, timestampMapHeader) {
+				if err := checkTimestampMap(strings.TrimPrefix(line, timestampMapHeader)); err != nil {
+					return 0, err
+				}
+				mapped = true
+			}
+			continue
+		}
+		if line == "" {
+			if len(block) > 0 {
+				blocks = append(blocks, block)
+			}
+			block = nil
+			continue
+		}
+		block = append(block, line)
+	}
+	if len(block) > 0 {
+		blocks = append(blocks, block)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("%w: %s", errWebVTT, err.Error())
+	}
+	if !mapped {
+		return 0, fmt.Errorf("%w: no X-TIMESTAMP-MAP header", errWebVTT)
+	}
+
+	cues := 0
+	var previous time.Duration
+	for _, block := range blocks {
+		first := strings.Fields(block[0])
+		if len(first) > 0 && (first[0] == "NOTE" || first[0] == "STYLE" || first[0] == "REGION") {
+			continue
+		}
+
+		// A cue may have an identifier line before its timings.
+		timing := block[0]
+		if !strings.Contains(timing, "-->") && len(block) > 1 {
+			timing = block[1]
+		}
+		start, end, err := parseCueTiming(timing)
+		if err != nil {
+			return cues, fmt.Errorf("%w: cue %d: %s", errWebVTT, cues+1, err.Error())
+		}
+		if end <= start {
+			return cues, fmt.Errorf("%w: cue %d ends at %s, before it starts at %s", errWebVTT, cues+1, end, start)
+		}
+		if start < previous {
+			return cues, fmt.Errorf("%w: cue %d starts at %s, before the one before it at %s", errWebVTT, cues+1, start, previous)
+		}
+		previous = start
+		cues++
+	}
+	return cues, nil
+}
+
+// checkTimestampMap validates the value of an X-TIMESTAMP-MAP header, an
+// MPEGTS timestamp and the LOCAL cue time it maps to, in any order.
+func checkTimestampMap(value string) error {
+	var mpegts, local bool
+	for _, pair := range strings.Split(value, ",") {
+		name, field, _ := strings.Cut(strings.TrimSpace(pair), ":")
+		switch name {
+		case "MPEGTS":
+			if _, err := strconv.ParseUint(field, 10, 64); err != nil {
+				return fmt.Errorf("%w: X-TIMESTAMP-MAP has an invalid MPEGTS %q", errWebVTT, field)
+			}
+			mpegts = true
+		case "LOCAL":
+			if _, err := parseWebVTTTimestamp(field); err != nil {
+				return fmt.Errorf("%w: X-TIMESTAMP-MAP has an invalid LOCAL %q", errWebVTT, field)
+			}
+			local = true
+		}
+	}
+	if !mpegts || !local {
+		return fmt.Errorf("%w: X-TIMESTAMP-MAP needs both MPEGTS and LOCAL, got %q", errWebVTT, value)
+	}
+	return nil
+}
+
+// parseCueTiming parses the "start --> end settings" timing line of a cue.
+func parseCueTiming(line string) (time.Duration, time.Duration, error) {
+	before, after, ok := strings.Cut(line, "-->")
+	if !ok {
+		return 0, 0, fmt.Errorf("no timings, got %q", line)
+	}
+	fields := strings.Fields(after)
+	if len(fields) == 0 {
+		return 0, 0, fmt.Errorf("no end time, got %q", line)
+	}
+	start, err := parseWebVTTTimestamp(strings.TrimSpace(before))
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseWebVTTTimestamp(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// parseWebVTTTimestamp parses a [hh:]mm:ss.ttt WebVTT timestamp.
+func parseWebVTTTimestamp(s string) (time.Duration, error) {
+	invalid := fmt.Errorf("invalid timestamp %q", s)
+	clock, millis, ok := strings.Cut(s, ".")
+	if !ok || len(millis) != 3 {
+		return 0, invalid
+	}
+	parts := strings.Split(clock, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"00"}, parts...)
+	}
+	if len(parts) != 3 || len(parts[0]) < 2 || len(parts[1]) != 2 || len(parts[2]) != 2 {
+		return 0, invalid
+	}
+
+	var values [4]int
+	for i, part := range append(parts, millis) {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, invalid
+		}
+		values[i] = n
+	}
+	if values[1] > 59 || values[2] > 59 {
+		return 0, invalid
+	}
+	return time.Duration(values[0])*time.Hour +
+		time.Duration(values[1])*time.Minute +
+		time.Duration(values[2])*time.Second +
+		time.Duration(values[3])*time.Millisecond, nil
+}
+
+// verifyWebVTTSegment checks the clear or decrypted WebVTT subtitle segment
+// body, which none of the checks of binary media apply to.
+func (v *Verifier) verifyWebVTTSegment(uri, folder string, segmentNo int, body []byte) error {
+	cues, err := checkWebVTT(body)
+	if err != nil {
+		v.errorf("WebVTT invalid on segment: %s", uri)
+		if writeErr := v.output.Write(folder, segmentNo, SegmentInvalid, body); writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+
+	v.infof("Segment WebVTT verified, %d cues: %s", cues, uri)
+	if v.opts.SaveSegments {
+		return v.output.Write(folder, segmentNo, SegmentValid, body)
+	}
+	return nil
+}